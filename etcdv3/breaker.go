@@ -0,0 +1,148 @@
+package etcdv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/intel/multus-cni/disk"
+	"github.com/intel/multus-cni/logging"
+)
+
+const breakerFile = "etcd_breaker"
+
+var (
+	DefaultBreakerFailures = 5
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// now is replaced by tests to travel in time
+var now = time.Now
+
+// Breaker is a circuit breaker around the etcd path. The plugin only lives for
+// a single CNI call, so the state is kept in a file of dir shared by all calls.
+//
+// It opens after failures consecutive failures, short-circuiting the calls for
+// cooldown. Then it half-opens, letting one call through to test the recovery,
+// while the others are still short-circuited for another cooldown. A success
+// closes it, a failure opens it again.
+type Breaker struct {
+	dir      string
+	failures int
+	cooldown time.Duration
+}
+
+type breakerState struct {
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"openedAt"`
+}
+
+// BreakerOpenError is returned while the breaker short-circuits the calls
+type BreakerOpenError struct {
+	Failures int
+	RetryIn  time.Duration
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("etcd circuit breaker is open after %d consecutive failures, retry in %v", e.Failures, e.RetryIn)
+}
+
+// NewBreaker returns a breaker keeping its state in dir, a zero failures or
+// cooldown takes the default
+func NewBreaker(dir string, failures int, cooldown time.Duration) *Breaker {
+	if failures <= 0 {
+		failures = DefaultBreakerFailures
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	return &Breaker{dir, failures, cooldown}
+}
+
+// update runs f on the state under the lock of dir, saving it if f says so
+func (b *Breaker) update(f func(st *breakerState) bool) error {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	lk, err := disk.NewFileLock(b.dir)
+	if err != nil {
+		return err
+	}
+	defer lk.Close()
+	lk.Lock()
+	defer lk.Unlock()
+
+	fname := filepath.Join(b.dir, breakerFile)
+	st := breakerState{}
+	if data, err := ioutil.ReadFile(fname); err == nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			logging.Errorf("reset corrupted breaker state %v, %v", fname, err)
+			st = breakerState{}
+		}
+	}
+	if !f(&st) {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, data, 0644)
+}
+
+// Allow returns a BreakerOpenError if the call shall not go to etcd
+func (b *Breaker) Allow() error {
+	var openErr error
+	err := b.update(func(st *breakerState) bool {
+		if st.Failures < b.failures {
+			return false
+		}
+		if elapsed := now().Sub(st.OpenedAt); elapsed < b.cooldown {
+			openErr = &BreakerOpenError{st.Failures, b.cooldown - elapsed}
+			return false
+		}
+		// half-open, this call tests the recovery while the others wait
+		logging.Verbosef("etcd circuit breaker half-opens after %v", b.cooldown)
+		st.OpenedAt = now()
+		return true
+	})
+	if err != nil {
+		logging.Errorf("update breaker state in %v failed, %v", b.dir, err)
+	}
+	return openErr
+}
+
+// Success closes the breaker
+func (b *Breaker) Success() {
+	err := b.update(func(st *breakerState) bool {
+		if st.Failures == 0 {
+			return false
+		}
+		if st.Failures >= b.failures {
+			logging.Verbosef("etcd circuit breaker closes")
+		}
+		*st = breakerState{}
+		return true
+	})
+	if err != nil {
+		logging.Errorf("update breaker state in %v failed, %v", b.dir, err)
+	}
+}
+
+// Failure counts a failed call, opening the breaker at the threshold
+func (b *Breaker) Failure() {
+	err := b.update(func(st *breakerState) bool {
+		st.Failures++
+		if st.Failures >= b.failures {
+			logging.Errorf("etcd circuit breaker opens after %d consecutive failures", st.Failures)
+			st.OpenedAt = now()
+		}
+		return true
+	})
+	if err != nil {
+		logging.Errorf("update breaker state in %v failed, %v", b.dir, err)
+	}
+}
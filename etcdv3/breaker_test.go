@@ -0,0 +1,70 @@
+package etcdv3
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Breaker", func() {
+	var dir = "/tmp/testbreaker"
+	var cur time.Time
+
+	BeforeEach(func() {
+		os.RemoveAll(dir)
+		cur = time.Now()
+		now = func() time.Time { return cur }
+	})
+	AfterEach(func() {
+		now = time.Now
+		os.RemoveAll(dir)
+	})
+
+	It("open after consecutive failures, half-open after cooldown and close on recovery", func() {
+		b := NewBreaker(dir, 3, 10*time.Second)
+		for i := 0; i < 2; i++ {
+			Expect(b.Allow()).To(Succeed())
+			b.Failure()
+		}
+		// a success in between resets the count
+		b.Success()
+		for i := 0; i < 3; i++ {
+			Expect(b.Allow()).To(Succeed())
+			b.Failure()
+		}
+
+		// open, short-circuit the calls in cooldown
+		err := b.Allow()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*BreakerOpenError).Failures).To(Equal(3))
+		cur = cur.Add(9 * time.Second)
+		err = b.Allow()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*BreakerOpenError).RetryIn).To(Equal(time.Second))
+
+		// half-open, one call tests the recovery while the others wait
+		cur = cur.Add(time.Second)
+		Expect(b.Allow()).To(Succeed())
+		Expect(b.Allow()).To(HaveOccurred())
+		b.Failure()
+		Expect(b.Allow()).To(HaveOccurred())
+
+		// recovered
+		cur = cur.Add(10 * time.Second)
+		Expect(b.Allow()).To(Succeed())
+		b.Success()
+		Expect(b.Allow()).To(Succeed())
+		Expect(b.Allow()).To(Succeed())
+	})
+
+	It("share the state between the calls", func() {
+		for i := 0; i < DefaultBreakerFailures; i++ {
+			NewBreaker(dir, 0, 0).Failure()
+		}
+		Expect(NewBreaker(dir, 0, 0).Allow()).To(HaveOccurred())
+		cur = cur.Add(DefaultBreakerCooldown)
+		Expect(NewBreaker(dir, 0, 0).Allow()).To(Succeed())
+	})
+})
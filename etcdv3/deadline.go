@@ -0,0 +1,26 @@
+package etcdv3
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrDeadline is returned by the lock waits and the retries past the deadline
+// of their context
+var ErrDeadline = errors.New("allocation timed out under contention")
+
+// Wait waits for d unless ctx is done first, for the backoffs between the
+// tries of an allocation. It returns ErrDeadline if the deadline of ctx comes
+// first, the error of ctx if ctx is otherwise done.
+func Wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrDeadline
+		}
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package etcdv3
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// the ways etcd.conf gives the endpoints of etcd
+const (
+	DiscoveryStatic = "static" // the endpoints listed
+	DiscoveryK8s    = "k8s"    // the endpoints of a service of kubernetes
+)
+
+// defaultDiscoveryNamespace is the namespace of the service of etcd, if not
+// configured
+const defaultDiscoveryNamespace = "default"
+
+// clientPortName is the name of the port of the service preferred for the
+// clients, the first port is used if none is named so
+const clientPortName = "client"
+
+// k8sClient returns the client to the kubernetes the plugin runs in, its
+// requests bounded by timeout as the ones to etcd, tests replace it with a
+// fake one
+var k8sClient = func(timeout time.Duration) (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = timeout
+	return kubernetes.NewForConfig(config)
+}
+
+// discoverEndpoints returns the endpoints of the ready addresses of the
+// service of cfg, read from the kubernetes api on each New so that etcd is
+// found however it is deployed. The endpoints api is read, which the client
+// library in use knows, the endpoint slices mirror it.
+func discoverEndpoints(cfg *etcdCfg) ([]string, error) {
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = defaultDiscoveryNamespace
+	}
+	client, err := k8sClient(cfgTimeout(cfg.RequestTimeout, defaultRequestTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("create kubernetes client failed, %v", err)
+	}
+	eps, err := client.CoreV1().Endpoints(namespace).Get(cfg.Service, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get endpoints of service %v/%v failed, %v", namespace, cfg.Service, err)
+	}
+	scheme := "http"
+	if cfg.Auth.Client.SecureTransport {
+		scheme = "https"
+	}
+	endpoints := []string{}
+	for _, subset := range eps.Subsets {
+		if len(subset.Ports) == 0 {
+			continue
+		}
+		port := subset.Ports[0].Port
+		for _, p := range subset.Ports {
+			if p.Name == clientPortName {
+				port = p.Port
+				break
+			}
+		}
+		for _, addr := range subset.Addresses {
+			endpoints = append(endpoints, scheme+"://"+net.JoinHostPort(addr.IP, strconv.Itoa(int(port))))
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("service %v/%v has no ready endpoints", namespace, cfg.Service)
+	}
+	logging.Debugf("discovered etcd endpoints %v of service %v/%v", endpoints, namespace, cfg.Service)
+	return endpoints, nil
+}
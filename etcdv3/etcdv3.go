@@ -3,11 +3,12 @@ package etcdv3
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"path/filepath"
@@ -16,24 +17,65 @@ import (
 	"github.com/coreos/etcd/clientv3/concurrency"
 	"github.com/coreos/etcd/pkg/transport"
 	"github.com/intel/multus-cni/logging"
+	"google.golang.org/grpc"
 )
 
 var (
-	RequestTimeout = 5 * time.Second
+	// RequestTimeout bounds each request to etcd, the first New sets it to
+	// the requestTimeout of etcd.conf
+	RequestTimeout = defaultRequestTimeout
+
+	// requestTimeoutOnce keeps the clients made at once, e.g. by the ranges
+	// of an ADD applied in parallel, from writing RequestTimeout as they read it
+	requestTimeoutOnce sync.Once
 )
 
+// DialOptions are added to the dial of the clients made by New, e.g. for the
+// benchmarks to count the round trips with interceptors
+var DialOptions []grpc.DialOption
+
+// ErrKeyExists is returned by TransPutKey when the key to put only if absent
+// was already put, e.g. by another node
+var ErrKeyExists = errors.New("key exists")
+
+// ErrUnavailable is wrapped by the errors of New once no endpoint of etcd can
+// be reached, which passes once etcd is back unlike a wrong configuration
+var ErrUnavailable = errors.New("etcd is unavailable")
+
+// ErrInvalidId is wrapped by the errors of New once the id of the node is
+// empty, which would own the leases of every node, or holds a slash, which
+// breaks the keys it is written in
+var ErrInvalidId = errors.New("invalid node id")
+
 var (
-	dialTimeout        = 5 * time.Second
-	defaultEtcdCfgDir  = "/etc/cni/net.d/multus.d/etcd"
-	defaultEtcdRootDir = "multus"
-	defaultEtcdCfgName = "etcd.conf"
+	defaultDialTimeout    = 5 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+	defaultEtcdCfgDir     = "/etc/cni/net.d/multus.d/etcd"
+	defaultEtcdRootDir    = "multus"
+	defaultEtcdCfgName    = "etcd.conf"
 )
 
 // etcdCfg is the struct of stored etcd information
 type etcdCfg struct {
-	Name      string   `json:"name"`
-	Endpoints []string `json:"endpoints"`
-	Auth      authCfg  `json:"auth"`
+	Name           string   `json:"name"`
+	Endpoints      []string `json:"endpoints"`
+	Fallback       []string `json:"fallbackEndpoints,omitempty"` // tried once no endpoint answers, see New
+	Discovery      string   `json:"discovery,omitempty"`         // static or k8s, see discoverEndpoints
+	Service        string   `json:"service,omitempty"`           // k8s: the service of etcd
+	Namespace      string   `json:"namespace,omitempty"`         // k8s: the namespace of the service, default if absent
+	Auth           authCfg  `json:"auth"`
+	NodeLeaseTTL   int64    `json:"nodeLeaseTTL,omitempty"` // seconds, see NodeLease
+	Retry          RetryCfg `json:"retry,omitempty"`
+	DialTimeout    int64    `json:"dialTimeout,omitempty"`    // milliseconds, 5s if absent
+	RequestTimeout int64    `json:"requestTimeout,omitempty"` // milliseconds of each request, 5s if absent
+}
+
+// cfgTimeout returns ms milliseconds, def unless ms is positive
+func cfgTimeout(ms int64, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
 }
 
 type authCfg struct {
@@ -54,9 +96,11 @@ type authPeer struct {
 }
 
 type EtcdMultus struct {
-	Cli        *clientv3.Client
-	RootKeyDir string
-	Id         string
+	Cli          *clientv3.Client
+	RootKeyDir   string
+	Id           string
+	NodeLeaseTTL int64
+	Retries      RetryCfg
 }
 
 func getInitParams() (etcdCfgDir string, rootKeyDir string, id string) {
@@ -67,14 +111,18 @@ func getInitParams() (etcdCfgDir string, rootKeyDir string, id string) {
 	}
 	etcdCfgDir = strings.Trim(etcdCfgDir, " \r\n\t")
 
-	rootKeyDir = os.Getenv("ETCD_ROOT_DIR")
+	// the root of the network config comes first, see SetRootKeyDir
+	rootKeyDir = RootKeyDir()
+	if rootKeyDir == "" {
+		rootKeyDir = os.Getenv("ETCD_ROOT_DIR")
+	}
 	if rootKeyDir == "" {
 		logging.Verbosef("using default etcd root key dir: %s ", defaultEtcdCfgDir)
 		rootKeyDir = defaultEtcdRootDir
 	}
 	rootKeyDir = strings.Trim(rootKeyDir, " \r\n\t")
 
-	id = os.Getenv("HOSTNAME")
+	id = strings.Trim(os.Getenv("HOSTNAME"), " \r\n\t")
 	if id == "" {
 		logging.Verbosef("using id from file %s", filepath.Join(etcdCfgDir, "id"))
 		data, err := ioutil.ReadFile(filepath.Join(etcdCfgDir, "id"))
@@ -88,6 +136,19 @@ func getInitParams() (etcdCfgDir string, rootKeyDir string, id string) {
 	return etcdCfgDir, rootKeyDir, id
 }
 
+// checkId fails on the ids the leases can not be owned by
+func checkId(id, etcdCfgDir string) error {
+	if id == "" {
+		logging.Errorf("no node id, HOSTNAME and %v are both empty", filepath.Join(etcdCfgDir, "id"))
+		return fmt.Errorf("%w, HOSTNAME and %v are both empty", ErrInvalidId, filepath.Join(etcdCfgDir, "id"))
+	}
+	if strings.Contains(id, "/") {
+		logging.Errorf("node id %q holds a slash", id)
+		return fmt.Errorf("%w %q, it shall not hold a slash", ErrInvalidId, id)
+	}
+	return nil
+}
+
 func getEtcdCfg(cfg string) (*etcdCfg, error) {
 	data, err := ioutil.ReadFile(cfg)
 	if err != nil {
@@ -99,57 +160,161 @@ func getEtcdCfg(cfg string) (*etcdCfg, error) {
 		return nil, logging.Errorf("etcd config is not right, %v", err)
 	}
 
-	if len(etcdCfg.Endpoints) == 0 {
-		return nil, logging.Errorf("no etcd endpoints")
+	switch etcdCfg.Discovery {
+	case "", DiscoveryStatic:
+		if len(etcdCfg.Endpoints) == 0 {
+			return nil, logging.Errorf("no etcd endpoints")
+		}
+	case DiscoveryK8s:
+		if etcdCfg.Service == "" {
+			return nil, logging.Errorf("no service of etcd to discover the endpoints of")
+		}
+		// the endpoints listed, if any, are kept for the api to fail
+		endpoints, err := discoverEndpoints(&etcdCfg)
+		if err != nil {
+			if len(etcdCfg.Endpoints) == 0 {
+				return nil, logging.Errorf("discover etcd endpoints failed, %v", err)
+			}
+			logging.Errorf("discover etcd endpoints failed, use %v, %v", etcdCfg.Endpoints, err)
+		} else {
+			etcdCfg.Endpoints = endpoints
+		}
+	default:
+		return nil, logging.Errorf("invalid discovery %v, it shall be %v or %v", etcdCfg.Discovery, DiscoveryStatic, DiscoveryK8s)
+	}
+
+	// a congested cluster is better served by the defaults than by no timeout
+	if etcdCfg.DialTimeout < 0 {
+		logging.Errorf("invalid dialTimeout %d, use %v", etcdCfg.DialTimeout, defaultDialTimeout)
+		etcdCfg.DialTimeout = 0
+	}
+	if etcdCfg.RequestTimeout < 0 {
+		logging.Errorf("invalid requestTimeout %d, use %v", etcdCfg.RequestTimeout, defaultRequestTimeout)
+		etcdCfg.RequestTimeout = 0
 	}
 
 	return &etcdCfg, nil
 }
 
-//New create a new etcd client, and provide a unify id  for node
-func New() (*EtcdMultus, error) {
-	etcdCfgDir, rootKeyDir, id := getInitParams()
-	logging.Debugf("using parameters: etcdCfgDir:%v, rootKeyDir:%v, id:%v", etcdCfgDir, rootKeyDir, id)
-
-	etcdCfg, err := getEtcdCfg(filepath.Join(etcdCfgDir, defaultEtcdCfgName))
-	if err != nil {
-		return nil, err
+// clientConfig returns the config of the client to the etcd of cfg
+func clientConfig(cfg *etcdCfg) (clientv3.Config, error) {
+	c := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfgTimeout(cfg.DialTimeout, defaultDialTimeout),
+		DialOptions: DialOptions,
 	}
-
-	var cli *clientv3.Client
-
-	if etcdCfg.Auth.Client.SecureTransport {
+	if cfg.Auth.Client.SecureTransport {
 		logging.Debugf("using secure transport")
 		tlsInfo := transport.TLSInfo{
-			CertFile:      etcdCfg.Auth.Client.SecretDirectory + "/etcd-client.crt",
-			KeyFile:       etcdCfg.Auth.Client.SecretDirectory + "/etcd-client.key",
-			TrustedCAFile: etcdCfg.Auth.Client.SecretDirectory + "/etcd-client-ca.crt",
+			CertFile:      cfg.Auth.Client.SecretDirectory + "/etcd-client.crt",
+			KeyFile:       cfg.Auth.Client.SecretDirectory + "/etcd-client.key",
+			TrustedCAFile: cfg.Auth.Client.SecretDirectory + "/etcd-client-ca.crt",
 		}
 		tlsConfig, err := tlsInfo.ClientConfig()
 		if err != nil {
-			return nil, logging.Errorf("create tls config failed, %v", err)
+			return c, logging.Errorf("create tls config failed, %v", err)
 		}
-		cli, err = clientv3.New(clientv3.Config{
-			Endpoints:   etcdCfg.Endpoints,
-			DialTimeout: dialTimeout,
-			TLS:         tlsConfig,
-		})
+		c.TLS = tlsConfig
+	} else {
+		logging.Debugf("using plain transport, %v", cfg.Endpoints)
+	}
+	if cfg.Auth.Client.EnableAuthentication {
+		user, err := readSecret(cfg.Auth.Client.SecretDirectory, "etcd-user")
 		if err != nil {
-			return nil, logging.Errorf("create etcd client failed, %v", err)
+			return c, err
 		}
-	} else {
-		logging.Debugf("using plain transport, %v", etcdCfg.Endpoints)
-		cli, err = clientv3.New(clientv3.Config{
-			Endpoints:   etcdCfg.Endpoints,
-			DialTimeout: dialTimeout,
-		})
+		password, err := readSecret(cfg.Auth.Client.SecretDirectory, "etcd-password")
 		if err != nil {
-			log.Println(err)
-			return nil, logging.Errorf("create etcd client failed, %v", err)
+			return c, err
 		}
+		logging.Debugf("authenticating as %v", user)
+		c.Username, c.Password = user, password
+	}
+	return c, nil
+}
+
+// readSecret returns the trimmed content of the file name in dir, failing if
+// it is absent or empty
+func readSecret(dir, name string) (string, error) {
+	fname := filepath.Join(dir, name)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", logging.Errorf("authentication is enabled but %v can not be read, %v", fname, err)
+	}
+	secret := strings.Trim(string(data), " \r\n\t")
+	if secret == "" {
+		return "", logging.Errorf("authentication is enabled but %v is empty", fname)
+	}
+	return secret, nil
+}
+
+//New create a new etcd client, and provide a unify id  for node
+func New() (*EtcdMultus, error) {
+	etcdCfgDir, rootKeyDir, id := getInitParams()
+	logging.Debugf("using parameters: etcdCfgDir:%v, rootKeyDir:%v, id:%v", etcdCfgDir, rootKeyDir, id)
+	if err := checkId(id, etcdCfgDir); err != nil {
+		return nil, err
+	}
+
+	etcdCfg, err := getEtcdCfg(filepath.Join(etcdCfgDir, defaultEtcdCfgName))
+	if err != nil {
+		return nil, err
 	}
-	return &EtcdMultus{cli, rootKeyDir, id}, nil
+
+	config, err := clientConfig(etcdCfg)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := newClient(config, etcdCfg.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	requestTimeoutOnce.Do(func() {
+		RequestTimeout = cfgTimeout(etcdCfg.RequestTimeout, defaultRequestTimeout)
+	})
+	return &EtcdMultus{cli, rootKeyDir, id, etcdCfg.NodeLeaseTTL, etcdCfg.Retry}, nil
 }
+
+// newClient returns a client to the endpoints of config. With fallback
+// endpoints, e.g. of a second cluster for the first to be upgraded, the
+// endpoints are probed first and the fallback ones are used once none of
+// them answers, failing if none of the fallback ones does either.
+func newClient(config clientv3.Config, fallback []string) (*clientv3.Client, error) {
+	cli, err := clientv3.New(config)
+	if err != nil {
+		logging.Errorf("create etcd client failed, %v", err)
+		return nil, fmt.Errorf("%w, create etcd client failed, %v", ErrUnavailable, err)
+	}
+	if len(fallback) == 0 {
+		return cli, nil
+	}
+	if EndpointsHealthy(cli) {
+		logging.Debugf("using the etcd endpoints %v", config.Endpoints)
+		return cli, nil
+	}
+	cli.Close()
+	primary := config.Endpoints
+	logging.Errorf("etcd endpoints %v are all unreachable, fall back to %v", primary, fallback)
+	config.Endpoints = fallback
+	if cli, err = clientv3.New(config); err != nil {
+		logging.Errorf("create etcd client of the fallback endpoints failed, %v", err)
+		return nil, fmt.Errorf("%w, create etcd client of the fallback endpoints failed, %v", ErrUnavailable, err)
+	}
+	if !EndpointsHealthy(cli) {
+		cli.Close()
+		logging.Errorf("etcd endpoints %v and the fallback %v are all unreachable", primary, fallback)
+		return nil, fmt.Errorf("%w, endpoints %v and the fallback %v are all unreachable", ErrUnavailable, primary, fallback)
+	}
+	logging.Verbosef("using the fallback etcd endpoints %v", fallback)
+	return cli, nil
+}
+
+// NodeId returns the id this node owns its leases with
+func NodeId() string {
+	_, _, id := getInitParams()
+	return id
+}
+
 func (e *EtcdMultus) Close() {
 	e.Cli.Close()
 }
@@ -157,44 +322,174 @@ func (e *EtcdMultus) Close() {
 func KeyToMutex(key string) string {
 	return DirToMutex(filepath.Dir(key))
 }
+
+// DirToMutex returns the mutex of dir, <root>/mutex/<rest of dir>, keeping a
+// leading / of the root
 func DirToMutex(dir string) string {
-	ss := strings.Split(strings.TrimRight(dir, "/"), "/")
+	lead := ""
+	if strings.HasPrefix(dir, "/") {
+		lead = "/"
+	}
+	ss := strings.Split(strings.Trim(dir, "/"), "/")
 	mutex := filepath.Join(ss[0], "mutex")
 	for _, s := range ss[1:] {
 		mutex = filepath.Join(mutex, s)
 	}
-	return mutex
+	return lead + mutex
+}
+
+// ShardToMutex returns the mutex of a shard of dir, the shards of a dir lock
+// independently of each other and of the dir itself
+func ShardToMutex(dir string, shard int) string {
+	return fmt.Sprintf("%s-shard-%d", DirToMutex(dir), shard)
+}
+
+// BucketToMutex returns the mutex of a bucket of dir, named apart from the
+// shards so that a claim in buckets and a claim in a region of the same index
+// do not pass for the same lock
+func BucketToMutex(dir string, bucket int) string {
+	return fmt.Sprintf("%s-bucket-%d", DirToMutex(dir), bucket)
 }
 
 type DirMutex struct {
-	s *concurrency.Session
-	m *concurrency.Mutex
+	s  *concurrency.Session
+	ms []*concurrency.Mutex
 }
 
-func LockDir(cli *clientv3.Client, dir string) (*DirMutex, error) {
-	s, err := concurrency.NewSession(cli)
-	if err != nil {
-		return nil, logging.Errorf("create etcd session failed, %v", err)
+func LockDir(ctx context.Context, cli *clientv3.Client, dir string) (*DirMutex, error) {
+	return lockMutexes(ctx, cli, []string{DirToMutex(dir)})
+}
+
+// LockDirShard locks a shard of dir, which is the whole dir when it has less
+// than 2 shards
+func LockDirShard(ctx context.Context, cli *clientv3.Client, dir string, shard, shards int) (*DirMutex, error) {
+	if shards < 2 {
+		return LockDir(ctx, cli, dir)
+	}
+	return lockMutexes(ctx, cli, []string{ShardToMutex(dir, shard)})
+}
+
+// LockDirShards locks all the shards of dir in order, then all its buckets,
+// for the operations on the whole dir, which exclude the claims in buckets and
+// those of the nodes still claiming in the regions of the shards alike
+func LockDirShards(ctx context.Context, cli *clientv3.Client, dir string, shards int) (*DirMutex, error) {
+	if shards < 2 {
+		return LockDir(ctx, cli, dir)
+	}
+	mutexes := []string{}
+	for i := 0; i < shards; i++ {
+		mutexes = append(mutexes, ShardToMutex(dir, i))
+	}
+	for i := 0; i < shards; i++ {
+		mutexes = append(mutexes, BucketToMutex(dir, i))
 	}
+	return lockMutexes(ctx, cli, mutexes)
+}
 
+// LockDirBucketList locks the buckets of dir listed, which shall be in order,
+// for the operations on the part of the dir they cover
+func LockDirBucketList(ctx context.Context, cli *clientv3.Client, dir string, list []int, buckets int) (*DirMutex, error) {
+	if buckets < 2 {
+		return LockDir(ctx, cli, dir)
+	}
+	mutexes := []string{}
+	for _, i := range list {
+		mutexes = append(mutexes, BucketToMutex(dir, i))
+	}
+	return lockMutexes(ctx, cli, mutexes)
+}
+
+// DirShardContended tells if the mutex LockDirShard locks is held or waited for
+func DirShardContended(ctx context.Context, cli *clientv3.Client, dir string, shard, shards int) (bool, error) {
 	mutex := DirToMutex(dir)
-	m := concurrency.NewMutex(s, mutex)
+	if shards >= 2 {
+		mutex = ShardToMutex(dir, shard)
+	}
+	return mutexContended(ctx, cli, mutex)
+}
+
+// DirBucketContended tells if the mutex of a bucket LockDirBucketList locks is
+// held or waited for
+func DirBucketContended(ctx context.Context, cli *clientv3.Client, dir string, bucket, buckets int) (bool, error) {
+	mutex := DirToMutex(dir)
+	if buckets >= 2 {
+		mutex = BucketToMutex(dir, bucket)
+	}
+	return mutexContended(ctx, cli, mutex)
+}
 
-	if err := m.Lock(context.TODO()); err != nil {
-		s.Close()
-		return nil, logging.Errorf("get etcd locd failed, %v", err)
+func mutexContended(ctx context.Context, cli *clientv3.Client, mutex string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	resp, err := cli.Get(ctx, mutex+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return false, err
 	}
-	return &DirMutex{s: s, m: m}, nil
+	return resp.Count > 0, nil
 }
 
+// lockMutexes locks the mutexes in order in a single session, giving up once
+// ctx is done
+func lockMutexes(ctx context.Context, cli *clientv3.Client, mutexes []string) (*DirMutex, error) {
+	// the session ends with ctx, the mutexes are unlocked by Close before
+	s, err := concurrency.NewSession(cli, concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, logging.Errorf("create etcd session failed, %v", err)
+	}
+
+	dm := &DirMutex{s: s}
+	for _, mutex := range mutexes {
+		m := concurrency.NewMutex(s, mutex)
+		if err := m.Lock(ctx); err != nil {
+			dm.Close()
+			if ctx.Err() == context.DeadlineExceeded {
+				logging.Errorf("wait for etcd lock %v past the deadline", mutex)
+				return nil, ErrDeadline
+			}
+			logging.Errorf("get etcd lock %v failed, %v", mutex, err)
+			return nil, fmt.Errorf("get etcd lock %v failed, %w", mutex, err)
+		}
+		dm.ms = append(dm.ms, m)
+	}
+	return dm, nil
+}
+
+// Close unlocks the mutexes and ends the session, the unlocks are not bound to
+// the context of the lock, which may be done by then
 func (dm *DirMutex) Close() {
-	if err := dm.m.Unlock(context.TODO()); err != nil {
-		logging.Debugf("unlock etcd mutex failed, %v", err)
+	for i := len(dm.ms) - 1; i >= 0; i-- {
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		if err := dm.ms[i].Unlock(ctx); err != nil {
+			logging.Debugf("unlock etcd mutex failed, %v", err)
+		}
+		cancel()
 	}
 	dm.s.Close()
 }
 
-func TransPutKey(c *clientv3.Client, key string, value string, noExist bool) error {
+// PutKeyIfAbsent puts key in a single transaction unless it exists, in which
+// case ErrKeyExists is returned. The opts go to the put, e.g. a lease.
+func PutKeyIfAbsent(ctx context.Context, cli *clientv3.Client, key string, value string, opts ...clientv3.OpOption) error {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, opts...)).
+		Commit()
+	cancel()
+	if err != nil {
+		return logging.Errorf("write key %v to %v failed, %v", key, value, err)
+	}
+	if !resp.Succeeded {
+		logging.Verbosef("key %v exists", key)
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// TransPutKey puts key, only if absent if noExist, under the locks of all the
+// shards of dir, so that it serializes with the claims locking a shard of dir.
+// The calls to etcd are bounded by ctx and each by RequestTimeout.
+func TransPutKey(ctx context.Context, c *clientv3.Client, dir string, shards int, key string, value string, noExist bool, opts ...clientv3.OpOption) error {
 	logging.Debugf("going to write %v:%v, check=%v", key, value, noExist)
 	cli := c
 	if cli == nil {
@@ -207,34 +502,30 @@ func TransPutKey(c *clientv3.Client, key string, value string, noExist bool) err
 		defer cli.Close()
 	}
 
-	dirMutex, err := LockDir(cli, filepath.Base(key))
+	dirMutex, err := LockDirShards(ctx, cli, dir, shards)
 	if err != nil {
 		return err
 	}
 	defer dirMutex.Close()
 
 	if noExist {
-		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
-		resp, err := cli.Get(ctx, key)
-		cancel()
-		if err != nil {
-			return logging.Errorf("failed to check key %v, %v", key, err)
-		}
-		if len(resp.Kvs) != 0 {
-			logging.Verbosef("key %v exists", key)
-			return fmt.Errorf("key %v exists", key)
-		}
+		return PutKeyIfAbsent(ctx, cli, key, value, opts...)
 	}
 
-	_, err = cli.Put(context.TODO(), key, value)
+	putCtx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	_, err = cli.Put(putCtx, key, value, opts...)
+	cancel()
 	if err != nil {
-		return logging.Errorf("write key %v to %v failed", key, value)
+		logging.Errorf("write key %v to %v failed, %v", key, value, err)
+		return fmt.Errorf("write key %v to %v failed, %w", key, value, err)
 	}
 
 	return nil
 }
 
-func TransDelKey(c *clientv3.Client, key string) error {
+// TransDelKey deletes key under the locks of all the shards of dir, bounded by
+// ctx as TransPutKey
+func TransDelKey(ctx context.Context, c *clientv3.Client, dir string, shards int, key string) error {
 	logging.Debugf("going to del %v", key)
 	cli := c
 	if cli == nil {
@@ -247,19 +538,58 @@ func TransDelKey(c *clientv3.Client, key string) error {
 		defer cli.Close()
 	}
 
-	dirMutex, err := LockDir(cli, filepath.Base(key))
+	dirMutex, err := LockDirShards(ctx, cli, dir, shards)
+	if err != nil {
+		return err
+	}
 	defer dirMutex.Close()
 
-	_, err = cli.Delete(context.TODO(), key)
+	delCtx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	_, err = cli.Delete(delCtx, key)
+	cancel()
 	if err != nil {
-		return logging.Errorf("delete key %v failed", key)
+		logging.Errorf("delete key %v failed, %v", key, err)
+		return fmt.Errorf("delete key %v failed, %w", key, err)
 	}
 
 	return nil
 }
 
-func TransDelKeys(c *clientv3.Client, keys []string) {
+// TransDelKeys deletes the keys each under the lock of its own dir, for the
+// keys of the owners gone, which no claim contends for. It goes on past a key
+// failing to delete and returns the first error
+func TransDelKeys(ctx context.Context, c *clientv3.Client, keys []string) error {
+	var first error
 	for _, k := range keys {
-		TransDelKey(c, k)
+		if err := TransDelKey(ctx, c, filepath.Dir(k), 1, k); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// TransDelPrefix deletes all the keys under dir by a single delete, under the
+// mutexes of the shards of dir taken once, e.g. to tear down the keys of a
+// network. It returns the number of keys deleted. TransDelKey is left for the
+// callers locking each key.
+func TransDelPrefix(ctx context.Context, cli *clientv3.Client, dir string, shards int) (int64, error) {
+	dir = strings.TrimRight(dir, "/")
+	if dir == "" {
+		return 0, fmt.Errorf("dir to delete the keys under is empty")
+	}
+	logging.Debugf("going to del the keys under %v", dir)
+	dirMutex, err := LockDirShards(ctx, cli, dir, shards)
+	if err != nil {
+		return 0, err
+	}
+	defer dirMutex.Close()
+
+	delCtx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	resp, err := cli.Delete(delCtx, dir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		logging.Errorf("delete keys under %v failed, %v", dir, err)
+		return 0, fmt.Errorf("delete keys under %v failed, %w", dir, err)
 	}
+	return resp.Deleted, nil
 }
@@ -4,12 +4,22 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"errors"
+	"fmt"
 	"os"
 	"io/ioutil"
 	"strings"
 	"context"
 	"path/filepath"
+	"sync"
+	"time"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/intel/multus-cni/logging"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 var _ = Describe("Etcdv3", func() {
@@ -60,6 +70,17 @@ var _ = Describe("Etcdv3", func() {
 				Expect(id).To(Equal("hostname"))
 			})
 		})
+		Context("using the root key dir of the network config", func() {
+			It("should take it over the env until removed", func() {
+				os.Setenv("ETCD_ROOT_DIR", "etcd_root_dir")
+				SetRootKeyDir("tenant-a")
+				_, rootKeyDir, _ := getInitParams()
+				Expect(rootKeyDir).To(Equal("tenant-a"))
+				SetRootKeyDir("")
+				_, rootKeyDir, _ = getInitParams()
+				Expect(rootKeyDir).To(Equal("etcd_root_dir"))
+			})
+		})
 		Context("using default value", func() {
 			It("cfg dir and root dir should use default parameters", func() {
 				os.Setenv("ETCD_CFG_DIR", "")
@@ -78,6 +99,45 @@ var _ = Describe("Etcdv3", func() {
 				os.Remove(idFile)
 			})
 		})
+		Context("validating the id", func() {
+			It("should trim the id file and a blank HOSTNAME", func() {
+				dir, err := ioutil.TempDir("", "etcdid")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+				os.Setenv("ETCD_CFG_DIR", dir)
+				os.Setenv("HOSTNAME", " \t")
+				Expect(ioutil.WriteFile(filepath.Join(dir, "id"), []byte("node201 \r\n\t\n"), 0666)).To(Succeed())
+				_, _, id := getInitParams()
+				Expect(id).To(Equal("node201"))
+				Expect(checkId(id, dir)).To(Succeed())
+			})
+			It("should fail New without an id", func() {
+				dir, err := ioutil.TempDir("", "etcdid")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+				Expect(ioutil.WriteFile(filepath.Join(dir, defaultEtcdCfgName), etcdCfg, 0666)).To(Succeed())
+				os.Setenv("ETCD_CFG_DIR", dir)
+				os.Setenv("HOSTNAME", "")
+				em, err := New()
+				Expect(em).To(BeNil())
+				Expect(errors.Is(err, ErrInvalidId)).To(BeTrue())
+				// an id file of whitespace only is no id either
+				Expect(ioutil.WriteFile(filepath.Join(dir, "id"), []byte(" \n"), 0666)).To(Succeed())
+				_, err = New()
+				Expect(errors.Is(err, ErrInvalidId)).To(BeTrue())
+			})
+			It("should fail New on an id holding a slash", func() {
+				dir, err := ioutil.TempDir("", "etcdid")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+				Expect(ioutil.WriteFile(filepath.Join(dir, defaultEtcdCfgName), etcdCfg, 0666)).To(Succeed())
+				os.Setenv("ETCD_CFG_DIR", dir)
+				os.Setenv("HOSTNAME", "rack1/node201")
+				_, err = New()
+				Expect(errors.Is(err, ErrInvalidId)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("rack1/node201"))
+			})
+		})
 	})
 
 	Describe("Get etcd configuration", func() {
@@ -106,6 +166,156 @@ var _ = Describe("Etcdv3", func() {
 		})
 	})
 
+	Describe("Timeouts of etcd configuration", func() {
+		BeforeEach(func() {
+			requestTimeoutOnce = sync.Once{}
+		})
+		AfterEach(func() {
+			RequestTimeout = defaultRequestTimeout
+		})
+
+		It("should take the timeouts configured", func() {
+			cfgData := strings.Replace(string(etcdCfg), `"endpoints"`, `"dialTimeout": 1500, "requestTimeout": 12000, "endpoints"`, 1)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(cfgData), 0666)
+			defer os.Remove("/tmp/etcd.conf")
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			config, err := clientConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.DialTimeout).To(Equal(1500 * time.Millisecond))
+
+			os.Setenv("ETCD_CFG_DIR", "/tmp")
+			em, err := New()
+			Expect(err).NotTo(HaveOccurred())
+			em.Close()
+			Expect(RequestTimeout).To(Equal(12 * time.Second))
+		})
+
+		It("should fall back to the defaults on the timeouts absent or invalid", func() {
+			cfgData := strings.Replace(string(etcdCfg), `"endpoints"`, `"dialTimeout": -1, "endpoints"`, 1)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(cfgData), 0666)
+			defer os.Remove("/tmp/etcd.conf")
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			config, err := clientConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.DialTimeout).To(Equal(defaultDialTimeout))
+			Expect(cfgTimeout(cfg.RequestTimeout, defaultRequestTimeout)).To(Equal(defaultRequestTimeout))
+
+			cfgData = strings.Replace(string(etcdCfg), `"endpoints"`, `"requestTimeout": "5s", "endpoints"`, 1)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(cfgData), 0666)
+			_, err = getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Discovery of etcd configuration", func() {
+		var k8sCfg = strings.Replace(string(etcdCfg), `"endpoints": ["192.168.56.201:12379"],`,
+			`"discovery": "k8s", "service": "etcd", "namespace": "kube-system",`, 1)
+		var etcdEndpoints = &v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "kube-system"},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+				Ports:     []v1.EndpointPort{{Name: "peer", Port: 2380}, {Name: "client", Port: 2379}},
+			}},
+		}
+		var inCluster func(timeout time.Duration) (kubernetes.Interface, error)
+		BeforeEach(func() {
+			inCluster = k8sClient
+		})
+		AfterEach(func() {
+			k8sClient = inCluster
+			os.Remove("/tmp/etcd.conf")
+		})
+
+		It("should build the client against the endpoints of the service", func() {
+			var timeout time.Duration
+			k8sClient = func(t time.Duration) (kubernetes.Interface, error) {
+				timeout = t
+				return fake.NewSimpleClientset(etcdEndpoints), nil
+			}
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(k8sCfg), 0666)
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			// the api is read within the timeout of the requests to etcd
+			Expect(timeout).To(Equal(defaultRequestTimeout))
+			config, err := clientConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Endpoints).To(Equal([]string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"}))
+		})
+
+		It("should fail without endpoints to fall back to and keep the listed ones", func() {
+			k8sClient = func(time.Duration) (kubernetes.Interface, error) {
+				return fake.NewSimpleClientset(), nil
+			}
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(k8sCfg), 0666)
+			_, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).To(MatchError(HavePrefix("discover etcd endpoints failed")))
+
+			listed := strings.Replace(k8sCfg, `"discovery"`, `"endpoints": ["192.168.56.201:12379"], "discovery"`, 1)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(listed), 0666)
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Endpoints).To(Equal([]string{"192.168.56.201:12379"}))
+		})
+
+		It("should refuse an unknown discovery or no service", func() {
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(strings.Replace(k8sCfg, `"k8s"`, `"dns"`, 1)), 0666)
+			_, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).To(MatchError("invalid discovery dns, it shall be static or k8s"))
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(strings.Replace(k8sCfg, `"service": "etcd",`, "", 1)), 0666)
+			_, err = getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).To(MatchError("no service of etcd to discover the endpoints of"))
+		})
+	})
+
+	Describe("Authentication of etcd configuration", func() {
+		var secretDir = "/tmp/etcdsecret"
+		var authCfg = strings.Replace(strings.Replace(string(etcdCfg), `"enableAuthentication": false`, `"enableAuthentication": true`, 1),
+			"/etc/cni/net.d/multus.d/etcd/pki", secretDir, 1)
+		BeforeEach(func() {
+			os.MkdirAll(secretDir, 0755)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(authCfg), 0666)
+		})
+		AfterEach(func() {
+			os.RemoveAll(secretDir)
+			os.Remove("/tmp/etcd.conf")
+		})
+
+		It("should pass the credentials of the secret directory", func() {
+			ioutil.WriteFile(filepath.Join(secretDir, "etcd-user"), []byte("multus\n"), 0600)
+			ioutil.WriteFile(filepath.Join(secretDir, "etcd-password"), []byte("secret\n"), 0600)
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			config, err := clientConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Username).To(Equal("multus"))
+			Expect(config.Password).To(Equal("secret"))
+			Expect(config.TLS).To(BeNil())
+		})
+
+		It("should fail on the credentials missing", func() {
+			ioutil.WriteFile(filepath.Join(secretDir, "etcd-user"), []byte("multus"), 0600)
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = clientConfig(cfg)
+			Expect(err).To(MatchError(HavePrefix("authentication is enabled but /tmp/etcdsecret/etcd-password can not be read")))
+
+			ioutil.WriteFile(filepath.Join(secretDir, "etcd-password"), []byte(" \n"), 0600)
+			_, err = clientConfig(cfg)
+			Expect(err).To(MatchError("authentication is enabled but /tmp/etcdsecret/etcd-password is empty"))
+		})
+
+		It("should not read credentials unless enabled", func() {
+			ioutil.WriteFile("/tmp/etcd.conf", etcdCfg, 0666)
+			cfg, err := getEtcdCfg("/tmp/etcd.conf")
+			Expect(err).NotTo(HaveOccurred())
+			config, err := clientConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Username).To(Equal(""))
+		})
+	})
+
 	Describe("New etcd client without ca", func() {
 		Context("create etcd client with correct cfg", func() {
 			It("should create etcd client successfully ", func() {
@@ -151,6 +361,10 @@ var _ = Describe("Etcdv3", func() {
 			    mutex := KeyToMutex("multus/type/network/key")
 				Expect(mutex).To(Equal("multus/mutex/type/network"))
 			})
+			It("should root the mutex of a dir with a leading / under the root", func() {
+				Expect(DirToMutex("/multus/lease/network")).To(Equal("/multus/mutex/lease/network"))
+				Expect(DirToMutex("multus/lease/network/")).To(Equal("multus/mutex/lease/network"))
+			})
 		})
 	})
 
@@ -167,7 +381,7 @@ var _ = Describe("Etcdv3", func() {
 				defer cli.Close()
 				keyDir := filepath.Join(rKeyDir, "testtype","testnet")
 				testKey := filepath.Join(keyDir, "transtest")
-				TransDelKey(cli, testKey)	
+				TransDelKey(context.TODO(), cli, keyDir, 1, testKey)	
 			})
 
 			AfterEach(func(){
@@ -180,7 +394,7 @@ var _ = Describe("Etcdv3", func() {
 				defer cli.Close()
 				keyDir := filepath.Join(rKeyDir, "testtype","testnet")
 				testKey := filepath.Join(keyDir, "transtest")
-				err = TransPutKey(nil, testKey, testKey, false)
+				err = TransPutKey(context.TODO(), nil, keyDir, 1, testKey, testKey, false)
 				Expect(err==nil).To(Equal(true))
 				ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
 				resp, err := cli.Get(ctx, testKey)	
@@ -192,9 +406,10 @@ var _ = Describe("Etcdv3", func() {
 				Expect(len(resp.Kvs)).To(Equal(1))		
 				Expect(string(resp.Kvs[0].Key)).To(Equal(testKey))	
 				Expect(string(resp.Kvs[0].Value)).To(Equal(testKey))
-				err = TransPutKey(nil, testKey, testKey, true)
+				err = TransPutKey(context.TODO(), nil, keyDir, 1, testKey, testKey, true)
 				Expect(err!=nil).To(Equal(true))
 				Expect(strings.Contains(err.Error(),"exist")).To(Equal(true))
+				Expect(err==ErrKeyExists).To(Equal(true))
 			})
 			It("add and del a key with an valid input cli", func() {	
 				etcdMultus, err := New()
@@ -202,7 +417,7 @@ var _ = Describe("Etcdv3", func() {
 				defer cli.Close()
 				keyDir := filepath.Join(rKeyDir, "testtype","testnet")
 				testKey := filepath.Join(keyDir, "transtest")
-				err = TransPutKey(cli, testKey, testKey, false)
+				err = TransPutKey(context.TODO(), cli, keyDir, 1, testKey, testKey, false)
 				Expect(err==nil).To(Equal(true))
 				Expect(cli!=nil).To(Equal(true))
 				ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
@@ -216,12 +431,308 @@ var _ = Describe("Etcdv3", func() {
 				Expect(string(resp.Kvs[0].Key)).To(Equal(testKey))	
 				Expect(string(resp.Kvs[0].Value)).To(Equal(testKey))
 			})
+			It("let exactly one of the concurrent claims of a key win", func() {
+				const claims = 8
+				var wg sync.WaitGroup
+				errs := make([]error, claims)
+				var testKey string
+				for i := 0; i < claims; i++ {
+					// each claim is a node of its own
+					etcdMultus, err := New()
+					Expect(err).To(BeNil())
+					defer etcdMultus.Close()
+					testKey = filepath.Join(etcdMultus.RootKeyDir, "testtype", "testnet", "transtest")
+					wg.Add(1)
+					go func(i int, em *EtcdMultus) {
+						defer wg.Done()
+						errs[i] = PutKeyIfAbsent(context.TODO(), em.Cli, testKey, fmt.Sprintf("node%d", i))
+					}(i, etcdMultus)
+				}
+				wg.Wait()
+				won := -1
+				for i, err := range errs {
+					if err == nil {
+						Expect(won).To(Equal(-1))
+						won = i
+						continue
+					}
+					Expect(err).To(Equal(ErrKeyExists))
+				}
+				Expect(won).NotTo(Equal(-1))
+				etcdMultus, err := New()
+				Expect(err).To(BeNil())
+				defer etcdMultus.Close()
+				resp, err := etcdMultus.Cli.Get(context.TODO(), testKey)
+				Expect(err).To(BeNil())
+				Expect(string(resp.Kvs[0].Value)).To(Equal(fmt.Sprintf("node%d", won)))
+			})
+			It("abort a put waiting for the lock once its context is canceled", func() {
+				etcdMultus, err := New()
+				Expect(err).To(BeNil())
+				defer etcdMultus.Close()
+				keyDir := filepath.Join(etcdMultus.RootKeyDir, "testtype", "testnet")
+				testKey := filepath.Join(keyDir, "transtest")
+				holder, err := LockDir(context.TODO(), etcdMultus.Cli, keyDir)
+				Expect(err).To(BeNil())
+				defer holder.Close()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				start := time.Now()
+				err = TransPutKey(ctx, etcdMultus.Cli, keyDir, 1, testKey, testKey, false)
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(time.Since(start)).To(BeNumerically("<", RequestTimeout))
+
+				// a context canceled already fails the put before any wait
+				err = TransPutKey(ctx, etcdMultus.Cli, keyDir, 1, testKey, testKey, false)
+				Expect(err).NotTo(BeNil())
+				resp, err := etcdMultus.Cli.Get(context.TODO(), testKey)
+				Expect(err).To(BeNil())
+				Expect(resp.Kvs).To(BeEmpty())
+			})
+			It("serialize the puts of sibling keys with the claims of a shard of their dir", func() {
+				etcdMultus, err := New()
+				Expect(err).To(BeNil())
+				defer etcdMultus.Close()
+				keyDir := filepath.Join(etcdMultus.RootKeyDir, "testtype", "testnet")
+				defer etcdMultus.Cli.Delete(context.TODO(), keyDir+"/", clientv3.WithPrefix())
+				// a claim holds shard 1 of the dir
+				holder, err := LockDirShard(context.TODO(), etcdMultus.Cli, keyDir, 1, 4)
+				Expect(err).To(BeNil())
+
+				keys := []string{filepath.Join(keyDir, "0167772160-4"), filepath.Join(keyDir, "0167772176-4")}
+				errs := make([]error, len(keys))
+				var wg sync.WaitGroup
+				for i, key := range keys {
+					wg.Add(1)
+					go func(i int, key string) {
+						defer wg.Done()
+						errs[i] = TransPutKey(context.TODO(), etcdMultus.Cli, keyDir, 4, key, key, true)
+					}(i, key)
+				}
+				// the puts contend on the mutex of shard 0, the one holding it
+				// waits for the shard of the claim
+				Eventually(func() int64 {
+					resp, err := etcdMultus.Cli.Get(context.TODO(), ShardToMutex(keyDir, 0)+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+					Expect(err).To(BeNil())
+					return resp.Count
+				}, RequestTimeout).Should(Equal(int64(2)))
+				resp, err := etcdMultus.Cli.Get(context.TODO(), keyDir+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+				Expect(err).To(BeNil())
+				Expect(resp.Count).To(Equal(int64(0)))
+
+				holder.Close()
+				wg.Wait()
+				Expect(errs).To(Equal([]error{nil, nil}))
+				resp, err = etcdMultus.Cli.Get(context.TODO(), keyDir+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+				Expect(err).To(BeNil())
+				Expect(resp.Count).To(Equal(int64(2)))
+			})
+			It("serialize the puts of keys with the claims of a bucket of their dir", func() {
+				etcdMultus, err := New()
+				Expect(err).To(BeNil())
+				defer etcdMultus.Close()
+				keyDir := filepath.Join(etcdMultus.RootKeyDir, "testtype", "testnet")
+				defer etcdMultus.Cli.Delete(context.TODO(), keyDir+"/", clientv3.WithPrefix())
+				// the buckets are not the shards of the same index
+				Expect(BucketToMutex(keyDir, 1)).NotTo(Equal(ShardToMutex(keyDir, 1)))
+
+				// a claim holds bucket 1 of the dir, not the shards
+				holder, err := LockDirBucketList(context.TODO(), etcdMultus.Cli, keyDir, []int{1}, 4)
+				Expect(err).To(BeNil())
+				contended, err := DirBucketContended(context.TODO(), etcdMultus.Cli, keyDir, 1, 4)
+				Expect(err).To(BeNil())
+				Expect(contended).To(BeTrue())
+				contended, err = DirShardContended(context.TODO(), etcdMultus.Cli, keyDir, 1, 4)
+				Expect(err).To(BeNil())
+				Expect(contended).To(BeFalse())
+
+				key := filepath.Join(keyDir, "0167772160-4")
+				done := make(chan error)
+				go func() {
+					done <- TransPutKey(context.TODO(), etcdMultus.Cli, keyDir, 4, key, key, true)
+				}()
+				Consistently(done, 200*time.Millisecond).ShouldNot(Receive())
+				holder.Close()
+				Eventually(done, RequestTimeout).Should(Receive(BeNil()))
+				resp, err := etcdMultus.Cli.Get(context.TODO(), key)
+				Expect(err).To(BeNil())
+				Expect(resp.Kvs).To(HaveLen(1))
+			})
 		})
 		Context("batch del keys from etcd batchly", func() {
 			It("should del all keys correctly ", func() {
 			    
 			})
+			It("should del all keys under a prefix by one delete under one lock", func() {
+				ioutil.WriteFile("/tmp/etcd.conf", etcdCfg, 0666)
+				defer os.Remove("/tmp/etcd.conf")
+				os.Setenv("ETCD_CFG_DIR", "/tmp")
+				em, err := New()
+				Expect(err).To(BeNil())
+				defer em.Close()
+				dir := filepath.Join(em.RootKeyDir, "testtype", "prefixnet")
+				other := filepath.Join(em.RootKeyDir, "testtype", "prefixnet2", "key")
+				defer em.Cli.Delete(context.TODO(), filepath.Join(em.RootKeyDir, "testtype")+"/", clientv3.WithPrefix())
+				for i := 0; i < 5; i++ {
+					_, err = em.Cli.Put(context.TODO(), filepath.Join(dir, fmt.Sprintf("key%d", i)), "v")
+					Expect(err).To(BeNil())
+				}
+				// a network sharing the prefix of the name is left
+				_, err = em.Cli.Put(context.TODO(), other, "v")
+				Expect(err).To(BeNil())
+
+				// the delete waits for the holder of the dir
+				holder, err := LockDirShards(context.TODO(), em.Cli, dir, 2)
+				Expect(err).To(BeNil())
+				resp, err := em.Cli.Get(context.TODO(), dir+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+				Expect(err).To(BeNil())
+				rev := resp.Header.Revision
+				done := make(chan int64)
+				go func() {
+					defer GinkgoRecover()
+					deleted, err := TransDelPrefix(context.TODO(), em.Cli, dir+"/", 2)
+					Expect(err).To(BeNil())
+					done <- deleted
+				}()
+				Consistently(done, 200*time.Millisecond).ShouldNot(Receive())
+				holder.Close()
+				var deleted int64
+				Eventually(done, RequestTimeout).Should(Receive(&deleted))
+				Expect(deleted).To(Equal(int64(5)))
+
+				resp, err = em.Cli.Get(context.TODO(), dir+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+				Expect(err).To(BeNil())
+				Expect(resp.Count).To(BeZero())
+				resp, err = em.Cli.Get(context.TODO(), other)
+				Expect(err).To(BeNil())
+				Expect(resp.Kvs).To(HaveLen(1))
+
+				// the keys go at one revision, and each shard mutex is taken once
+				events := func(prefix string, n int) []*clientv3.Event {
+					ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+					defer cancel()
+					evs := []*clientv3.Event{}
+					for wresp := range em.Cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+						evs = append(evs, wresp.Events...)
+						if len(evs) >= n {
+							break
+						}
+					}
+					return evs
+				}
+				revs := map[int64]bool{}
+				for _, ev := range events(dir+"/", 5) {
+					Expect(ev.Type).To(Equal(mvccpb.DELETE))
+					revs[ev.Kv.ModRevision] = true
+				}
+				Expect(revs).To(HaveLen(1))
+				for shard := 0; shard < 2; shard++ {
+					puts := 0
+					for _, ev := range events(ShardToMutex(dir, shard)+"/", 2) {
+						if ev.Type == mvccpb.PUT {
+							puts++
+						}
+					}
+					Expect(puts).To(Equal(1))
+				}
+			})
 		})
 		
 	})
+
+	Describe("Fallback endpoints", func() {
+		var dir string
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "fallback")
+			Expect(err).To(BeNil())
+			os.Setenv("ETCD_CFG_DIR", dir)
+			os.Setenv("ETCD_ROOT_DIR", "test")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should fall back once the endpoints are unreachable", func() {
+			ioutil.WriteFile(filepath.Join(dir, defaultEtcdCfgName), []byte(`{"name": "multus-etcdcni", "endpoints": ["127.0.0.1:1"], "fallbackEndpoints": ["192.168.56.201:12379"]}`), 0666)
+			timeout := HealthTimeout
+			HealthTimeout = 500 * time.Millisecond
+			defer func() { HealthTimeout = timeout }()
+
+			em, err := New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			Expect(em.Cli.Endpoints()).To(Equal([]string{"192.168.56.201:12379"}))
+			ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+			_, err = em.Cli.Put(ctx, "test/fallback", "fallback")
+			cancel()
+			Expect(err).To(BeNil())
+			em.Cli.Delete(context.TODO(), "test/fallback")
+		})
+
+		It("should keep the endpoints answering", func() {
+			ioutil.WriteFile(filepath.Join(dir, defaultEtcdCfgName), []byte(`{"name": "multus-etcdcni", "endpoints": ["192.168.56.201:12379"], "fallbackEndpoints": ["127.0.0.1:1"]}`), 0666)
+			em, err := New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			Expect(em.Cli.Endpoints()).To(Equal([]string{"192.168.56.201:12379"}))
+		})
+
+		It("should fail once the fallback endpoints are unreachable too", func() {
+			ioutil.WriteFile(filepath.Join(dir, defaultEtcdCfgName), []byte(`{"name": "multus-etcdcni", "endpoints": ["127.0.0.1:1"], "fallbackEndpoints": ["127.0.0.1:2"]}`), 0666)
+			timeout := HealthTimeout
+			HealthTimeout = 500 * time.Millisecond
+			defer func() { HealthTimeout = timeout }()
+
+			_, err := New()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("unreachable"))
+			Expect(errors.Is(err, ErrUnavailable)).To(BeTrue())
+		})
+	})
+
+	Describe("Keeper of the daemon client", func() {
+		It("should rebuild the client once all endpoints are unhealthy", func() {
+			dir, err := ioutil.TempDir("", "keeper")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			os.Setenv("ETCD_CFG_DIR", dir)
+			os.Setenv("ETCD_ROOT_DIR", "test")
+			cfgFile := filepath.Join(dir, defaultEtcdCfgName)
+			ioutil.WriteFile(cfgFile, []byte(`{"name": "multus-etcdcni", "endpoints": ["127.0.0.1:1"]}`), 0666)
+
+			timeout := HealthTimeout
+			HealthTimeout = 500 * time.Millisecond
+			defer func() { HealthTimeout = timeout }()
+			k := &Keeper{}
+			defer k.Close()
+			em, err := k.Client()
+			Expect(err).To(BeNil())
+
+			// all the endpoints are down, the rebuilt client is still unhealthy
+			rebuilt, err := k.Check()
+			Expect(err).To(BeNil())
+			Expect(rebuilt).To(BeTrue())
+
+			// etcd recovers at another endpoint
+			ioutil.WriteFile(cfgFile, etcdCfg, 0666)
+			rebuilt, err = k.Check()
+			Expect(err).To(BeNil())
+			Expect(rebuilt).To(BeTrue())
+			recovered, err := k.Client()
+			Expect(err).To(BeNil())
+			Expect(recovered).NotTo(BeIdenticalTo(em))
+			ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+			_, err = recovered.Cli.Put(ctx, "test/keeper", "keeper")
+			cancel()
+			Expect(err).To(BeNil())
+			recovered.Cli.Delete(context.TODO(), "test/keeper")
+
+			rebuilt, err = k.Check()
+			Expect(err).To(BeNil())
+			Expect(rebuilt).To(BeFalse())
+			Expect(k.Rebuilds()).To(Equal(2))
+		})
+	})
 })
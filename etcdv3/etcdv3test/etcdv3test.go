@@ -0,0 +1,119 @@
+// Package etcdv3test runs an embedded etcd for the tests and benchmarks of the
+// etcd paths, counting the round trips of the clients made by etcdv3.New
+package etcdv3test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/intel/multus-cni/etcdv3"
+	"google.golang.org/grpc"
+)
+
+const startTimeout = 30 * time.Second
+
+// Server is an embedded etcd the clients made by etcdv3.New connect to while
+// it runs. Every unary call and every stream opened by these clients counts as
+// a round trip, the messages of a stream after it is opened are not counted.
+type Server struct {
+	etcd       *embed.Etcd
+	dir        string
+	cfgDir     string
+	roundTrips int64
+}
+
+// Start starts an embedded etcd in a temp dir and points etcdv3.New to it
+func Start() (*Server, error) {
+	dir, err := ioutil.TempDir("", "etcdv3test")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{dir: dir, cfgDir: os.Getenv("ETCD_CFG_DIR")}
+
+	clientURL, err := freeURL()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	peerURL, err := freeURL()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = filepath.Join(dir, "data")
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	s.etcd, err = embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	select {
+	case <-s.etcd.Server.ReadyNotify():
+	case <-time.After(startTimeout):
+		s.Stop()
+		return nil, fmt.Errorf("embedded etcd is not ready in %v", startTimeout)
+	}
+
+	etcdCfg := fmt.Sprintf(`{"name": "etcdv3test", "endpoints": ["%s"]}`, clientURL.Host)
+	if err := ioutil.WriteFile(filepath.Join(dir, "etcd.conf"), []byte(etcdCfg), 0644); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	os.Setenv("ETCD_CFG_DIR", dir)
+	etcdv3.DialOptions = []grpc.DialOption{
+		grpc.WithUnaryInterceptor(s.countUnary),
+		grpc.WithStreamInterceptor(s.countStream),
+	}
+	return s, nil
+}
+
+// Stop stops the embedded etcd and removes its data
+func (s *Server) Stop() {
+	etcdv3.DialOptions = nil
+	os.Setenv("ETCD_CFG_DIR", s.cfgDir)
+	s.etcd.Close()
+	os.RemoveAll(s.dir)
+}
+
+// RoundTrips returns the round trips made since the last reset
+func (s *Server) RoundTrips() int64 {
+	return atomic.LoadInt64(&s.roundTrips)
+}
+
+// ResetRoundTrips resets the count of round trips
+func (s *Server) ResetRoundTrips() {
+	atomic.StoreInt64(&s.roundTrips, 0)
+}
+
+func (s *Server) countUnary(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	atomic.AddInt64(&s.roundTrips, 1)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (s *Server) countStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	atomic.AddInt64(&s.roundTrips, 1)
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+func freeURL() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return url.Parse("http://" + l.Addr().String())
+}
@@ -0,0 +1,106 @@
+package etcdv3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/logging"
+)
+
+// HealthTimeout bounds the status request checking the health of an endpoint
+var HealthTimeout = 2 * time.Second
+
+// EndpointsHealthy tells if any endpoint of cli answers a status request
+func EndpointsHealthy(cli *clientv3.Client) bool {
+	for _, ep := range cli.Endpoints() {
+		ctx, cancel := context.WithTimeout(context.Background(), HealthTimeout)
+		_, err := cli.Status(ctx, ep)
+		cancel()
+		if err == nil {
+			return true
+		}
+		logging.Debugf("etcd endpoint %v is unhealthy, %v", ep, err)
+	}
+	return false
+}
+
+// Keeper keeps the etcd client of a long-lived daemon, which may otherwise end
+// up pinned to failed endpoints. Once all the endpoints it knows are unhealthy,
+// the client is rebuilt by New, re-reading the endpoints and the TLS config.
+type Keeper struct {
+	mu       sync.Mutex
+	em       *EtcdMultus
+	rebuilds int
+}
+
+// Client returns the client kept, made by New on the first call
+func (k *Keeper) Client() (*EtcdMultus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.em == nil {
+		em, err := New()
+		if err != nil {
+			return nil, err
+		}
+		k.em = em
+	}
+	return k.em, nil
+}
+
+// Check rebuilds the client kept if all its endpoints are unhealthy, telling
+// if it did. The old client is closed, ending its watches, for the users to
+// go on with the new one from Client.
+func (k *Keeper) Check() (bool, error) {
+	k.mu.Lock()
+	em := k.em
+	k.mu.Unlock()
+	if em == nil || EndpointsHealthy(em.Cli) {
+		return false, nil
+	}
+
+	logging.Errorf("etcd endpoints %v are all unhealthy, rebuild the client", em.Cli.Endpoints())
+	rebuilt, err := New()
+	if err != nil {
+		return false, logging.Errorf("rebuild etcd client failed, %v", err)
+	}
+	k.mu.Lock()
+	old := k.em
+	k.em = rebuilt
+	k.rebuilds++
+	k.mu.Unlock()
+	old.Close()
+	return true, nil
+}
+
+// Rebuilds returns how many times the client was rebuilt
+func (k *Keeper) Rebuilds() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rebuilds
+}
+
+// Run checks the client every interval until ctx is done
+func (k *Keeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.Check()
+		}
+	}
+}
+
+// Close closes the client kept
+func (k *Keeper) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.em != nil {
+		k.em.Close()
+		k.em = nil
+	}
+}
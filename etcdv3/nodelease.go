@@ -0,0 +1,110 @@
+package etcdv3
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/logging"
+)
+
+// nodeLeaseDir keeps the id of the etcd lease of each node
+const nodeLeaseDir = "nodelease"
+
+// maxNodeLeaseTry bounds the grants racing the other calls of the node
+const maxNodeLeaseTry = 3
+
+// NodeLeaseKey returns the key keeping the etcd lease of node, it is attached
+// to the lease itself, so it only exists while the lease is alive
+func NodeLeaseKey(rootKeyDir, node string) string {
+	return filepath.Join(rootKeyDir, nodeLeaseDir, node)
+}
+
+// NodeLease returns the etcd lease the range keys of this node attach to,
+// granting it if the node has none alive. All the keys of a node share it, so
+// the etcd lease objects stay one per node however many ranges it leases. It
+// is clientv3.NoLease, with which the keys never expire, unless nodeLeaseTTL
+// is configured.
+func (e *EtcdMultus) NodeLease() (clientv3.LeaseID, error) {
+	if e.NodeLeaseTTL <= 0 {
+		return clientv3.NoLease, nil
+	}
+	key := NodeLeaseKey(e.RootKeyDir, e.Id)
+	for i := 0; i < maxNodeLeaseTry; i++ {
+		if lease, err := nodeLease(e.Cli, key); err != nil || lease != clientv3.NoLease {
+			return lease, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		grant, err := e.Cli.Grant(ctx, e.NodeLeaseTTL)
+		cancel()
+		if err != nil {
+			return clientv3.NoLease, logging.Errorf("grant lease of node %v failed, %v", e.Id, err)
+		}
+		err = PutKeyIfAbsent(context.Background(), e.Cli, key, strconv.FormatInt(int64(grant.ID), 16), clientv3.WithLease(grant.ID))
+		if err == nil {
+			logging.Verbosef("granted lease %x of node %v, ttl %ds", grant.ID, e.Id, e.NodeLeaseTTL)
+			return grant.ID, nil
+		}
+		// another call of the node granted one in the meantime
+		ctx, cancel = context.WithTimeout(context.Background(), RequestTimeout)
+		e.Cli.Revoke(ctx, grant.ID)
+		cancel()
+		if err != ErrKeyExists {
+			return clientv3.NoLease, err
+		}
+	}
+	return clientv3.NoLease, logging.Errorf("get lease of node %v failed after %d tries", e.Id, maxNodeLeaseTry)
+}
+
+// nodeLease returns the lease kept by key, NoLease if there is none alive
+func nodeLease(cli *clientv3.Client, key string) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	resp, err := cli.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return clientv3.NoLease, logging.Errorf("get %v failed, %v", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return clientv3.NoLease, nil
+	}
+	return clientv3.LeaseID(resp.Kvs[0].Lease), nil
+}
+
+// KeepNodeLease renews the lease of this node once, the daemon calls it well
+// within nodeLeaseTTL. Once the renewals stop, e.g. on a dead node, the lease
+// expires and all the keys attached to it vanish together.
+func (e *EtcdMultus) KeepNodeLease() error {
+	if e.NodeLeaseTTL <= 0 {
+		return nil
+	}
+	lease, err := nodeLease(e.Cli, NodeLeaseKey(e.RootKeyDir, e.Id))
+	if err != nil || lease == clientv3.NoLease {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	_, err = e.Cli.KeepAliveOnce(ctx, lease)
+	cancel()
+	if err != nil {
+		return logging.Errorf("keep lease %x of node %v alive failed, %v", lease, e.Id, err)
+	}
+	return nil
+}
+
+// RevokeNodeLease revokes the lease of node, deleting all the keys attached
+// to it at once. It tells if node had a lease alive.
+func RevokeNodeLease(cli *clientv3.Client, rootKeyDir, node string) (bool, error) {
+	lease, err := nodeLease(cli, NodeLeaseKey(rootKeyDir, node))
+	if err != nil || lease == clientv3.NoLease {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	_, err = cli.Revoke(ctx, lease)
+	cancel()
+	if err != nil {
+		return false, logging.Errorf("revoke lease %x of node %v failed, %v", lease, node, err)
+	}
+	logging.Verbosef("revoked lease %x of node %v", lease, node)
+	return true, nil
+}
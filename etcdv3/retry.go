@@ -0,0 +1,136 @@
+package etcdv3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+)
+
+// retryableErrors are the errors of etcd retried by default, an election or an
+// overload of the cluster which passes in a while
+var retryableErrors = []string{
+	"etcdserver: leader changed",
+	"etcdserver: no leader",
+	"etcdserver: request timed out",
+	"etcdserver: too many requests",
+}
+
+// RetryCfg tunes the retries of the etcd operations, the zero values take the
+// defaults
+type RetryCfg struct {
+	Attempts  int      `json:"attempts,omitempty"`  // tries of an operation, 1 for no retry
+	Backoff   int      `json:"backoff,omitempty"`   // milliseconds before the first retry, doubled on each
+	Retryable []string `json:"retryable,omitempty"` // substrings of the errors retried besides the default ones
+}
+
+// Classifier tells if an error of an operation is worth retrying
+type Classifier func(err error) bool
+
+var (
+	classifiersMu sync.Mutex
+	classifiers   = map[string]Classifier{}
+)
+
+// SetClassifier overrides the classification of the errors of op, e.g. for an
+// etcd version failing with errors of its own. A nil c restores the default.
+func SetClassifier(op string, c Classifier) {
+	classifiersMu.Lock()
+	defer classifiersMu.Unlock()
+	if c == nil {
+		delete(classifiers, op)
+		return
+	}
+	classifiers[op] = c
+}
+
+func classifier(op string) Classifier {
+	classifiersMu.Lock()
+	defer classifiersMu.Unlock()
+	return classifiers[op]
+}
+
+// DefaultRetryable tells if err is of an etcd unavailable, overloaded or
+// electing a leader, or a timeout
+func DefaultRetryable(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return containsAny(err.Error(), retryableErrors)
+}
+
+// Unavailable tells if err is of etcd not reachable, found by New, by a
+// request or by the circuit breaker short-circuiting the calls
+func Unavailable(err error) bool {
+	var open *BreakerOpenError
+	if errors.Is(err, ErrUnavailable) || errors.As(err, &open) {
+		return true
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &se) && se.GRPCStatus().Code() == codes.Unavailable
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if sub != "" && strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry runs f, the operation op, until it succeeds or fails with an error not
+// retryable, for the attempts of the config at most. The errors are classified
+// by the classifier of op if set, or else by DefaultRetryable and the
+// retryable errors of the config.
+func (e *EtcdMultus) Retry(op string, f func() error) error {
+	return e.RetryContext(context.Background(), op, f)
+}
+
+// RetryContext is Retry giving up once ctx is done, with the last error
+func (e *EtcdMultus) RetryContext(ctx context.Context, op string, f func() error) error {
+	attempts, backoff := e.Retries.Attempts, time.Duration(e.Retries.Backoff)*time.Millisecond
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	retryable := classifier(op)
+	if retryable == nil {
+		retryable = func(err error) bool {
+			return DefaultRetryable(err) || containsAny(err.Error(), e.Retries.Retryable)
+		}
+	}
+	var err error
+	for i := 1; ; i++ {
+		if err = f(); err == nil || i >= attempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if d, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(d) {
+			logging.Errorf("%v failed at attempt %d, no retry past the deadline, %v", op, i, err)
+			return ErrDeadline
+		}
+		logging.Verbosef("%v failed at attempt %d, retry in %v, %v", op, i, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,101 @@
+package etcdv3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Retry", func() {
+	var errFatal = errors.New("etcdserver: permission denied")
+	var e *EtcdMultus
+	var calls int
+	var failing = func(err error) func() error {
+		return func() error {
+			calls++
+			return err
+		}
+	}
+
+	BeforeEach(func() {
+		e = &EtcdMultus{Retries: RetryCfg{Attempts: 3, Backoff: 1}}
+		calls = 0
+	})
+	AfterEach(func() {
+		SetClassifier("test", nil)
+	})
+
+	It("retry the default retryable errors only", func() {
+		Expect(e.Retry("test", failing(context.DeadlineExceeded))).To(Equal(context.DeadlineExceeded))
+		Expect(calls).To(Equal(3))
+
+		calls = 0
+		Expect(e.Retry("test", failing(errors.New("etcdserver: leader changed")))).To(HaveOccurred())
+		Expect(calls).To(Equal(3))
+
+		calls = 0
+		Expect(e.Retry("test", failing(errFatal))).To(Equal(errFatal))
+		Expect(calls).To(Equal(1))
+
+		calls = 0
+		Expect(e.Retry("test", failing(nil))).To(Succeed())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("stop retrying once the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(e.RetryContext(ctx, "test", failing(context.DeadlineExceeded))).To(Equal(context.DeadlineExceeded))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("retry a fatal error classified retryable by the config or a classifier", func() {
+		e.Retries.Retryable = []string{"permission denied"}
+		Expect(e.Retry("test", failing(errFatal))).To(Equal(errFatal))
+		Expect(calls).To(Equal(3))
+
+		e.Retries.Retryable = nil
+		SetClassifier("test", func(err error) bool { return err == errFatal })
+		calls = 0
+		Expect(e.Retry("test", failing(errFatal))).To(Equal(errFatal))
+		Expect(calls).To(Equal(3))
+
+		// the classifier overrides the default of its operation only
+		calls = 0
+		Expect(e.Retry("test", failing(context.DeadlineExceeded))).To(HaveOccurred())
+		Expect(calls).To(Equal(1))
+		calls = 0
+		Expect(e.Retry("other", failing(errFatal))).To(HaveOccurred())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("tell the errors of etcd unavailable from the others", func() {
+		Expect(Unavailable(fmt.Errorf("%w, endpoints are all unreachable", ErrUnavailable))).To(BeTrue())
+		Expect(Unavailable(&BreakerOpenError{Failures: 5})).To(BeTrue())
+		Expect(Unavailable(status.Error(codes.Unavailable, "transport is closing"))).To(BeTrue())
+
+		Expect(Unavailable(ErrDeadline)).To(BeFalse())
+		Expect(Unavailable(errFatal)).To(BeFalse())
+		Expect(Unavailable(status.Error(codes.PermissionDenied, "permission denied"))).To(BeFalse())
+	})
+
+	It("cut a wait short once the context is done or the deadline comes", func() {
+		Expect(Wait(context.Background(), time.Millisecond)).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		start := time.Now()
+		Expect(Wait(ctx, time.Minute)).To(Equal(context.Canceled))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Expect(Wait(ctx, time.Minute)).To(Equal(ErrDeadline))
+	})
+})
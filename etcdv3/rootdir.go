@@ -0,0 +1,27 @@
+package etcdv3
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	rootKeyDirMu   sync.Mutex
+	confRootKeyDir string
+)
+
+// SetRootKeyDir roots the keys of the clients New makes under dir instead of
+// ETCD_ROOT_DIR, for a network config keeping its keys apart from the other
+// IPAM domains sharing the etcd. An empty dir removes the override.
+func SetRootKeyDir(dir string) {
+	rootKeyDirMu.Lock()
+	defer rootKeyDirMu.Unlock()
+	confRootKeyDir = strings.Trim(dir, " \r\n\t")
+}
+
+// RootKeyDir returns the root key dir set by SetRootKeyDir, "" if none
+func RootKeyDir() string {
+	rootKeyDirMu.Lock()
+	defer rootKeyDirMu.Unlock()
+	return confRootKeyDir
+}
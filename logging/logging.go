@@ -16,8 +16,10 @@ package logging
 
 import (
 	"fmt"
+	"hash/fnv"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -40,6 +42,11 @@ var loggingStderr bool
 var loggingFp *os.File
 var loggingLevel Level
 
+var (
+	requestIDMu sync.Mutex
+	requestID   string
+)
+
 const defaultTimestampFormat = time.RFC3339
 
 func (l Level) String() string {
@@ -57,25 +64,53 @@ func (l Level) String() string {
 }
 
 func printf(level Level, format string, a ...interface{}) {
-	header := "%s [%s] "
+	header := "%s [%s] %s"
 	t := time.Now()
 	if level > loggingLevel {
 		return
 	}
+	prefix := requestPrefix()
 
 	if loggingStderr {
-		fmt.Fprintf(os.Stderr, header, t.Format(defaultTimestampFormat), level)
+		fmt.Fprintf(os.Stderr, header, t.Format(defaultTimestampFormat), level, prefix)
 		fmt.Fprintf(os.Stderr, format, a...)
 		fmt.Fprintf(os.Stderr, "\n")
 	}
 
 	if loggingFp != nil {
-		fmt.Fprintf(loggingFp, header, t.Format(defaultTimestampFormat), level)
+		fmt.Fprintf(loggingFp, header, t.Format(defaultTimestampFormat), level, prefix)
 		fmt.Fprintf(loggingFp, format, a...)
 		fmt.Fprintf(loggingFp, "\n")
 	}
 }
 
+// RequestID returns the id of the invocations of a plugin for the interface
+// ifName of containerID, the same for its ADD, CHECK and DEL
+func RequestID(containerID, ifName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(containerID + "/" + ifName))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// SetRequestID prefixes the lines logged by the process with id, so that the
+// lines of an invocation can be told apart in a busy log. An empty id removes
+// the prefix.
+func SetRequestID(id string) {
+	requestIDMu.Lock()
+	defer requestIDMu.Unlock()
+	requestID = id
+}
+
+// requestPrefix returns the prefix of the lines of the request id, if any
+func requestPrefix() string {
+	requestIDMu.Lock()
+	defer requestIDMu.Unlock()
+	if requestID == "" {
+		return ""
+	}
+	return "[" + requestID + "] "
+}
+
 // Debugf prints logging if logging level >= debug
 func Debugf(format string, a ...interface{}) {
 	printf(DebugLevel, format, a...)
@@ -15,6 +15,9 @@
 package logging
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -74,6 +77,33 @@ var _ = Describe("logging operations", func() {
 		Expect(loggingStderr).NotTo(Equal(currentVal))
 	})
 
+	It("Check request id prefixing the lines of an invocation", func() {
+		id := RequestID("container-a", "eth0")
+		Expect(id).To(HaveLen(8))
+		Expect(RequestID("container-a", "eth0")).To(Equal(id))
+		Expect(RequestID("container-a", "net1")).NotTo(Equal(id))
+
+		logFile := "/tmp/multus-request-id.logging"
+		os.Remove(logFile)
+		defer os.Remove(logFile)
+		SetLogFile(logFile)
+		SetLogLevel("debug")
+		SetRequestID(id)
+		Debugf("allocate %d", 1)
+		Errorf("allocate %v failed", "10.0.0.1")
+		SetRequestID("")
+		Debugf("reconcile")
+		loggingFp.Close()
+
+		data, err := ioutil.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[0]).To(HaveSuffix(" [debug] [" + id + "] allocate 1"))
+		Expect(lines[1]).To(HaveSuffix(" [error] [" + id + "] allocate 10.0.0.1 failed"))
+		Expect(lines[2]).To(HaveSuffix(" [debug] reconcile"))
+	})
+
 	// Tests public getter
 	It("Check getter for logging level with current level", func() {
 		currentLevel := loggingLevel
@@ -162,7 +162,8 @@ func (km *KubeManager) handleNodeDelEvent(n *apiv1.Node) error {
 	delList := []string{}
 
 	for _, ev := range getResp.Kvs {
-		v := strings.Trim(string(ev.Value), " \r\n\t")
+		// the values of the leases record more than the node, see IPAMLeaseOwner
+		v := etcdv3cli.IPAMLeaseOwner(ev.Value)
 		logging.Debugf("Key:%v, Value:%v, ID:%v, match:%v ", string(ev.Key), string(ev.Value), id, id == v)
 		if v == id {
 			delList = append(delList, string(ev.Key))
@@ -171,7 +172,9 @@ func (km *KubeManager) handleNodeDelEvent(n *apiv1.Node) error {
 
 	if len(delList) > 0 {
 		logging.Debugf("Going to del %v", delList)
-		etcdv3.TransDelKeys(em.Cli, delList)
+		if err := etcdv3.TransDelKeys(km.ctx, em.Cli, delList); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -295,7 +298,9 @@ func (km *KubeManager) CheckFixIP() error {
 
 	if len(delList) > 0 {
 		logging.Debugf("Going to del %v", delList)
-		etcdv3.TransDelKeys(em.Cli, delList)
+		if err := etcdv3.TransDelKeys(km.ctx, em.Cli, delList); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -164,7 +164,7 @@ var _ = Describe("Controller", func() {
 		json.Unmarshal(cniCfg, &netConf)
 		n := 3
 		for i := 0; i < n; i++ {
-			etcdv3cli.IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			etcdv3cli.IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 		}
 		keyDir := filepath.Join(em.RootKeyDir, "lease", netConf.Name)
 
@@ -204,7 +204,7 @@ var _ = Describe("Controller", func() {
 		// }
 		n := 3
 		for i := 0; i < n; i++ {
-			_, err := etcdv3cli.IPAMApplyFixIP(netConf.Name, &netConf.IPAM.Ranges[0][0], fmt.Sprintf("default:wahaha%d", i))
+			_, err := etcdv3cli.IPAMApplyFixIP(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], fmt.Sprintf("default:wahaha%d", i))
 			Expect(err).To(BeNil())
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
@@ -15,11 +15,14 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,6 +31,8 @@ import (
 	"github.com/coreos/etcd/clientv3"
 	"github.com/intel/multus-cni/etcdv3"
 	"github.com/intel/multus-cni/logging"
+	ipamAllocator "github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	ipamDisk "github.com/intel/multus-cni/multus-ipam/backend/disk"
 	ipamDocker "github.com/intel/multus-cni/multus-ipam/backend/dockercli"
 	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
 	vxEtcd "github.com/intel/multus-cni/multus-vxlan/backend/etcdv3cli"
@@ -36,8 +41,12 @@ import (
 )
 
 var (
-	defaultWaitTime   = 5 * time.Second
-	defaultTickerTime = time.Duration(5+rand.Intn(2)) * time.Minute
+	defaultWaitTime    = 5 * time.Second
+	defaultTickerTime  = time.Duration(5+rand.Intn(2)) * time.Minute
+	defaultErrorBudget = -1
+	defaultSpareBuffer = 1
+	defaultHealthTime  = 30 * time.Second
+	maxCheckBackoff    = 8 // ticks skipped at most after the failed checks
 	// ipamEtcdCheckTicker  = 1
 	// ipamLocalCheckTicker = 10
 	// vxEtcdCheckTicker    = 1
@@ -67,19 +76,195 @@ func init() {
 }
 
 type multusd struct {
-	ctx    context.Context
-	wg     *sync.WaitGroup
-	mux    sync.Mutex
-	buf    map[string]string
-	keyDir string
+	ctx         context.Context
+	wg          *sync.WaitGroup
+	mux         sync.Mutex
+	buf         map[string]string
+	keyDir      string
+	etcd        *etcdv3.Keeper
+	errorBudget int
+	spareAge    time.Duration // 0 keeps the spare ranges
+	spareBuffer int
+	leases      *ipamEtcd.LeaseView // nil unless LEASE_WATCH is set
 }
 
 func newMultusd(ctx context.Context, wg *sync.WaitGroup, keyDir string) *multusd {
+	errorBudget := defaultErrorBudget
+	if tmp := os.Getenv("CHECK_ERROR_BUDGET"); tmp != "" {
+		if b, err := strconv.Atoi(tmp); err == nil {
+			errorBudget = b
+		}
+	}
+	var spareAge time.Duration
+	if tmp := os.Getenv("SPARE_RANGE_AGE"); tmp != "" {
+		if a, err := time.ParseDuration(tmp); err == nil {
+			spareAge = a
+		} else {
+			logging.Errorf("invalid SPARE_RANGE_AGE %v, %v", tmp, err)
+		}
+	}
+	spareBuffer := defaultSpareBuffer
+	if tmp := os.Getenv("SPARE_RANGE_BUFFER"); tmp != "" {
+		if b, err := strconv.Atoi(tmp); err == nil && b >= 0 {
+			spareBuffer = b
+		}
+	}
+	// the reconcile gives back the idle ranges to the starved nodes
+	if tmp := os.Getenv("RECLAIM_WATERMARK"); tmp != "" {
+		if w, err := strconv.Atoi(tmp); err == nil && w >= 0 {
+			ipamEtcd.ReclaimWatermark = w
+		} else {
+			logging.Errorf("invalid RECLAIM_WATERMARK %v", tmp)
+		}
+	}
+	if tmp := os.Getenv("STARVE_WINDOW"); tmp != "" {
+		if w, err := time.ParseDuration(tmp); err == nil && w > 0 {
+			ipamEtcd.StarveWindow = w
+		} else {
+			logging.Errorf("invalid STARVE_WINDOW %v", tmp)
+		}
+	}
+	// the ips reserved in the grace period are never collected, as their
+	// containers may not be known to the runtime yet
+	if tmp := os.Getenv("LEASE_GRACE_PERIOD"); tmp != "" {
+		if g, err := time.ParseDuration(tmp); err == nil && g >= 0 {
+			ipamDocker.LeaseGrace = g
+		} else {
+			logging.Errorf("invalid LEASE_GRACE_PERIOD %v", tmp)
+		}
+	}
+	var leases *ipamEtcd.LeaseView
+	if watch, err := strconv.ParseBool(os.Getenv("LEASE_WATCH")); err == nil && watch {
+		leases = ipamEtcd.NewLeaseView()
+	}
 	return &multusd{
-		ctx:    ctx,
-		wg:     wg,
-		keyDir: keyDir,
-		buf:    make(map[string]string),
+		ctx:         ctx,
+		wg:          wg,
+		keyDir:      keyDir,
+		etcd:        &etcdv3.Keeper{},
+		buf:         make(map[string]string),
+		errorBudget: errorBudget,
+		spareAge:    spareAge,
+		spareBuffer: spareBuffer,
+		leases:      leases,
+	}
+}
+
+// checkSummary is what a check cycle did, logged once per cycle
+type checkSummary struct {
+	networks  int // networks reconciled
+	failed    int // networks failing to reconcile
+	orphaned  int // ranges out of the subnets of their networks
+	released  int // spare ranges released
+	coalesced int // ranges merged into others
+	staleIPs  int // ips of the containers gone released
+}
+
+func (s checkSummary) String() string {
+	return fmt.Sprintf("%d networks reconciled, %d failed, %d orphaned ranges, %d spare ranges released, %d ranges coalesced, %d stale ips released",
+		s.networks, s.failed, s.orphaned, s.released, s.coalesced, s.staleIPs)
+}
+
+// checkIPAM reconciles the ipam leases of all networks, reporting the failed
+// ones. It fails only if the reconcile as a whole does, e.g. etcd is down.
+func (d *multusd) checkIPAM() (checkSummary, error) {
+	sum := checkSummary{}
+	results, checkErr := ipamEtcd.IPAMCheckEtcdWithBudget(d.errorBudget)
+	if checkErr != nil {
+		logging.Errorf("check ipam failed, %v", checkErr)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			sum.failed++
+			logging.Errorf("check ipam of network %v failed, %v", r.Network, r.Err)
+		}
+		sum.orphaned += len(r.Orphaned)
+	}
+	sum.networks = len(results)
+	logging.Verbosef("checked ipam of %d networks", len(results))
+
+	if d.spareAge > 0 {
+		released, err := ipamEtcd.IPAMReleaseSpareRanges(d.spareAge, d.spareBuffer)
+		if err != nil {
+			logging.Errorf("release spare ranges failed, %v", err)
+		}
+		for _, r := range released {
+			logging.Verbosef("released spare range %v-%v of network %v", r.Range.RangeStart, r.Range.RangeEnd, r.Network)
+		}
+		sum.released = len(released)
+	}
+
+	coalesced, err := ipamEtcd.IPAMCoalesceRanges()
+	if err != nil {
+		logging.Errorf("coalesce ranges failed, %v", err)
+	}
+	for _, c := range coalesced {
+		logging.Verbosef("coalesced %d ranges of network %v into %v-%v", len(c.Parts), c.Network, c.Range.RangeStart, c.Range.RangeEnd)
+		sum.coalesced += len(c.Parts) - 1
+	}
+
+	if metricsFile := os.Getenv("METRICS_FILE"); metricsFile != "" {
+		if err := ipamDisk.WriteTextfile(metricsFile, os.Getenv("NET_DATA_DIR")); err != nil {
+			logging.Errorf("write metrics to %v failed, %v", metricsFile, err)
+		}
+	}
+	return sum, checkErr
+}
+
+// checkCycle runs the reconcile passes of a tick, logging what they did
+func (d *multusd) checkCycle() error {
+	sum, err := d.checkIPAM()
+	stale, e := ipamDocker.IPAMCheckLocalIPs("")
+	if e != nil {
+		logging.Errorf("check local ips failed, %v", e)
+	}
+	sum.staleIPs = stale
+	if e := vxEtcd.CacheToEtcd(); e != nil {
+		logging.Errorf("sync vxlan cache to etcd failed, %v", e)
+	}
+	logging.Verbosef("check cycle done, %v", sum)
+	return err
+}
+
+// checkBackoff skips the ticks after a failed check, mostly of etcd being down,
+// doubling them for each failure in a row up to maxCheckBackoff
+type checkBackoff struct {
+	backoff int
+	skip    int
+}
+
+// tick runs check unless the tick is skipped
+func (b *checkBackoff) tick(check func() error) {
+	if b.skip > 0 {
+		b.skip--
+		return
+	}
+	if err := check(); err != nil {
+		if b.backoff *= 2; b.backoff == 0 {
+			b.backoff = 1
+		}
+		if b.backoff > maxCheckBackoff {
+			b.backoff = maxCheckBackoff
+		}
+		b.skip = b.backoff
+		logging.Errorf("check failed, skip the next %d ticks, %v", b.skip, err)
+		return
+	}
+	b.backoff = 0
+}
+
+// checkLoop runs check on each tick until the ctx is done, backing off from
+// the failed checks
+func (d *multusd) checkLoop(tick <-chan time.Time, check func() error) {
+	b := &checkBackoff{}
+	for {
+		select {
+		case <-d.ctx.Done():
+			logging.Verbosef("ctx stop multusd")
+			return
+		case <-tick:
+			b.tick(check)
+		}
 	}
 }
 
@@ -87,15 +272,47 @@ func (d *multusd) Run() {
 	//TODO define even type
 	// events := make(chan []string)
 	logging.Verbosef("multusd is running...")
+	healthTime := defaultHealthTime
+	if tmp := os.Getenv("ETCD_HEALTH_TIME"); tmp != "" {
+		if t, err := time.ParseDuration(tmp); err == nil && t > 0 {
+			healthTime = t
+		}
+	}
+	d.wg.Add(1)
+	go func() {
+		// a rebuild closes the old client, ending the watch to restart
+		d.etcd.Run(d.ctx, healthTime)
+		d.wg.Done()
+	}()
+	d.wg.Add(1)
+	go func() {
+		d.keepNodeLease(d.ctx)
+		d.wg.Done()
+	}()
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		d.wg.Add(1)
+		go func() {
+			d.serveMetrics(d.ctx, addr)
+			d.wg.Done()
+		}()
+	}
+	if d.leases != nil {
+		d.wg.Add(1)
+		go func() {
+			d.watchLeases(d.ctx)
+			d.wg.Done()
+		}()
+	}
 	d.wg.Add(1)
 	go func() {
 		d.Watching(d.ctx, d.keyDir)
 		logging.Verbosef("Watching exited")
+		d.etcd.Close()
 		d.wg.Done()
 	}()
 
 	//todo prevent out of ord between history record and watching
-	ipamEtcd.IPAMCheckEtcd()
+	d.checkIPAM()
 	tickerTime := defaultTickerTime
 	tmp := os.Getenv("TICKER_TIME")
 	if tmp != "" {
@@ -106,37 +323,163 @@ func (d *multusd) Run() {
 	}
 	logging.Verbosef("using ticker time %v", tickerTime)
 	ticker := time.NewTicker(tickerTime)
+	defer ticker.Stop()
+	d.checkLoop(ticker.C, d.checkCycle)
+}
+
+// keepNodeLease renews the etcd lease the range keys of this node attach to,
+// three times within nodeLeaseTTL
+func (d *multusd) keepNodeLease(ctx context.Context) {
+	var em *etcdv3.EtcdMultus
+	for em == nil {
+		var err error
+		if em, err = d.etcd.Client(); err != nil {
+			logging.Errorf("get etcd client failed, %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultWaitTime):
+			}
+		}
+	}
+	if em.NodeLeaseTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(em.NodeLeaseTTL) * time.Second / 3)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-d.ctx.Done():
-			logging.Verbosef("ctx stop multusd")
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			// logging.Debugf("ticker run")
-			ipamEtcd.IPAMCheckEtcd()
-			ipamDocker.IPAMCheckLocalIPs("")
-			vxEtcd.CacheToEtcd()
+			// the client may be rebuilt in the meantime
+			if em, err := d.etcd.Client(); err != nil {
+				logging.Errorf("get etcd client failed, %v", err)
+			} else if err := em.KeepNodeLease(); err != nil {
+				logging.Errorf("keep node lease failed, %v", err)
+			}
 		}
 	}
 }
 
+// watchLeases keeps d.leases up to date by a watch on the lease dir of the
+// networks until ctx is done, logging the ranges leased by other nodes over
+// those cached by this node as they are put
+func (d *multusd) watchLeases(ctx context.Context) {
+	for ctx.Err() == nil {
+		em, err := d.etcd.Client()
+		if err == nil {
+			w := ipamEtcd.NewLeaseWatcher(em.Cli, em.RootKeyDir, d.leases)
+			w.OnPut = func(network string, l ipamEtcd.ViewLease) {
+				if l.Owner != em.Id && cachedRange(network, &l.SimpleRange) {
+					logging.Errorf("range %v-%v of %v cached by this node is leased by %v", l.RangeStart, l.RangeEnd, network, l.Owner)
+				}
+			}
+			err = w.Run(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			logging.Errorf("watch leases failed, %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(defaultWaitTime):
+		}
+	}
+}
+
+// cachedRange tells if sr overlaps a range cached by this node for network
+func cachedRange(network string, sr *ipamAllocator.SimpleRange) bool {
+	dataDir, local := os.Getenv("NET_DATA_DIR"), false
+	for _, n := range ipamDisk.GetAllNet(dataDir) {
+		local = local || n == network
+	}
+	if !local {
+		return false
+	}
+	s, err := ipamDisk.New(network, dataDir)
+	if err != nil {
+		return false
+	}
+	defer s.Close()
+	caches, err := s.LoadCache()
+	if err != nil {
+		return false
+	}
+	for _, c := range caches {
+		if c.Overlaps(sr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMetrics serves the pool utilization of the networks at /metrics of
+// addr until ctx is done, reading the leases of all nodes from etcd on each
+// scrape. The subnets of the networks are read from METRICS_SUBNETS, e.g.
+// "net1=10.1.0.0/16,10.2.0.0/16;net2=fd00::/64", the free ips of the others
+// are not reported.
+func (d *multusd) serveMetrics(ctx context.Context, addr string) {
+	subnets, err := parseNetSubnets(os.Getenv("METRICS_SUBNETS"))
+	if err != nil {
+		logging.Errorf("invalid METRICS_SUBNETS, %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		usages, err := ipamEtcd.IPAMPoolUsage(subnets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := ipamEtcd.WritePoolMetrics(w, usages); err != nil {
+			logging.Errorf("write metrics failed, %v", err)
+		}
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logging.Verbosef("serving metrics on %v", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logging.Errorf("serve metrics on %v failed, %v", addr, err)
+	}
+}
+
+// parseNetSubnets parses the subnets of the networks as net=cidr[,cidr] items
+// separated by ";"
+func parseNetSubnets(s string) (map[string][]*net.IPNet, error) {
+	subnets := map[string][]*net.IPNet{}
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return subnets, fmt.Errorf("%v is not net=cidr[,cidr]", item)
+		}
+		for _, cidr := range strings.Split(kv[1], ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return subnets, err
+			}
+			subnets[kv[0]] = append(subnets[kv[0]], ipNet)
+		}
+	}
+	return subnets, nil
+}
+
 func (d *multusd) Watching(ctx context.Context, keyPrefix string) {
 	logging.Verbosef("Watching %v", keyPrefix)
-	var cli *clientv3.Client = nil
-	for {
-		etcdMultus, err := etcdv3.New()
-		if cli != nil {
-			cli.Close()
-		}
-		cli = etcdMultus.Cli
+	for ctx.Err() == nil {
+		etcdMultus, err := d.etcd.Client()
 		if err != nil {
 			logging.Errorf("Create etcd client failed, %v", err)
 			time.Sleep(defaultWaitTime)
 			continue
 		}
-		defer cli.Close()
 		d.procHistoryRecord("")
-		rch := cli.Watch(ctx, keyPrefix, clientv3.WithPrefix())
+		rch := etcdMultus.Cli.Watch(ctx, keyPrefix, clientv3.WithPrefix())
 		for wresp := range rch {
 			for _, ev := range wresp.Events {
 				logging.Verbosef("Watch: %s %q: %q \n", ev.Type, ev.Kv.Key, ev.Kv.Value)
@@ -156,12 +499,11 @@ func (d *multusd) Watching(ctx context.Context, keyPrefix string) {
 
 func (d *multusd) procHistoryRecord(vx string) error {
 	logging.Verbosef("procHistoryRecord %v, %d", vx, len(vx))
-	etcdMultus, err := etcdv3.New()
-	cli := etcdMultus.Cli
+	etcdMultus, err := d.etcd.Client()
 	if err != nil {
 		return logging.Errorf("Create etcd client failed, %v", err)
 	}
-	defer cli.Close()
+	cli := etcdMultus.Cli
 	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
 	getResp, err := cli.Get(ctx, d.keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
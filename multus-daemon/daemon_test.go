@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Daemon", func() {
+	// run ticks n times, returning the ticks check ran on, failing on the
+	// ticks of fails
+	run := func(n int, fails map[int]bool) []int {
+		b := &checkBackoff{}
+		ran := []int{}
+		for i := 1; i <= n; i++ {
+			b.tick(func() error {
+				ran = append(ran, i)
+				if fails[i] {
+					return errors.New("etcd is down")
+				}
+				return nil
+			})
+		}
+		return ran
+	}
+
+	It("check on every tick", func() {
+		Expect(run(3, nil)).To(Equal([]int{1, 2, 3}))
+	})
+
+	It("skip the ticks doubling for each failed check in a row", func() {
+		Expect(run(7, map[int]bool{1: true, 3: true})).To(Equal([]int{1, 3, 6, 7}))
+	})
+
+	It("skip no more ticks than the max backoff", func() {
+		fails := map[int]bool{}
+		for i := 1; i <= 40; i++ {
+			fails[i] = true
+		}
+		// 1, 2, 4, 8 and then 8 ticks skipped
+		Expect(run(40, fails)).To(Equal([]int{1, 3, 6, 11, 20, 29, 38}))
+	})
+
+	It("check on the ticks of the injected ticker until the ctx is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		d := &multusd{ctx: ctx}
+		tick := make(chan time.Time)
+		done := make(chan struct{})
+		checks := 0
+		go func() {
+			d.checkLoop(tick, func() error {
+				checks++
+				return nil
+			})
+			close(done)
+		}()
+		for i := 0; i < 3; i++ {
+			tick <- time.Now()
+		}
+		cancel()
+		Eventually(done).Should(BeClosed())
+		Expect(checks).To(Equal(3))
+	})
+})
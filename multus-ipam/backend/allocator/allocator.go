@@ -15,6 +15,7 @@
 package allocator
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -26,6 +27,10 @@ import (
 	"github.com/intel/multus-cni/multus-ipam/backend"
 )
 
+// ErrNoFreeAddresses is returned by Get once no ip of the range set is free,
+// which the caller may remedy by applying a new range
+var ErrNoFreeAddresses = errors.New("no IP addresses available in range set")
+
 type IPAllocator struct {
 	rangeset *RangeSet
 	store    backend.Store
@@ -114,7 +119,7 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 	}
 
 	if reservedIP == nil {
-		return nil, fmt.Errorf("no IP addresses available in range set: %s", a.rangeset.String())
+		return nil, fmt.Errorf("%w: %s", ErrNoFreeAddresses, a.rangeset.String())
 	}
 	version := "4"
 	if reservedIP.IP.To4() == nil {
@@ -136,6 +141,18 @@ func (a *IPAllocator) Release(id string, ifname string) error {
 	return a.store.ReleaseByID(id, ifname)
 }
 
+// ReleaseByIP clears addr whichever container it is allocated to, the other
+// ips allocated in its range are left as the range itself
+func (a *IPAllocator) ReleaseByIP(addr net.IP) error {
+	if _, err := a.rangeset.RangeFor(addr); err != nil {
+		return err
+	}
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return a.store.Release(addr)
+}
+
 type RangeIter struct {
 	rangeset *RangeSet
 
@@ -148,6 +165,9 @@ type RangeIter struct {
 	// The IP and range index where we started iterating; if we hit this again, we're done.
 	startIP    net.IP
 	startRange int
+
+	// The IPs of each range which are never allocated
+	holes []ipIntervalSet
 }
 
 // GetIter encapsulates the strategy for this allocator.
@@ -159,6 +179,9 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	iter := RangeIter{
 		rangeset: a.rangeset,
 	}
+	for i := range *a.rangeset {
+		iter.holes = append(iter.holes, (*a.rangeset)[i].holes())
+	}
 
 	// Round-robin by trying to allocate from the last reserved IP + 1
 	startFromLastReservedIP := false
@@ -188,7 +211,6 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	} else {
 		iter.rangeIdx = 0
 		iter.startRange = 0
-		iter.startIP = (*a.rangeset)[0].RangeStart
 	}
 	return &iter, nil
 }
@@ -196,48 +218,43 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 // Next returns the next IP, its mask, and its gateway. Returns nil
 // if the iterator has been exhausted
 func (i *RangeIter) Next() (*net.IPNet, net.IP) {
-	r := (*i.rangeset)[i.rangeIdx]
-
-	// If this is the first time iterating and we're not starting in the middle
-	// of the range, then start at rangeStart, which is inclusive
-	if i.cur == nil {
-		i.cur = r.RangeStart
-		i.startIP = i.cur
-		if i.cur.Equal(r.Gateway) {
-			return i.Next()
+	// Every range is passed at most once more before giving up, in case there
+	// are only holes left and startIP is never hit
+	for passed := 0; passed <= len(*i.rangeset); {
+		r := (*i.rangeset)[i.rangeIdx]
+
+		// Start at rangeStart, which is inclusive, when entering a range.
+		// RangeEnd is inclusive as well, advance the range once reached.
+		var next net.IP
+		if i.cur == nil {
+			next = r.RangeStart
+		} else if !i.cur.Equal(r.RangeEnd) {
+			next = ip.NextIP(i.cur)
 		}
-		if len(r.Reserves) > 0 {
-			for _, ip := range r.Reserves {
-				if i.cur.Equal(ip) {
-					return i.Next()
-				}
+		if next != nil {
+			next = i.holes[i.rangeIdx].NextFree(next)
+			if ip.Cmp(next, r.RangeEnd) > 0 {
+				next = nil
 			}
 		}
-		return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
-	}
-
-	// If we've reached the end of this range, we need to advance the range
-	// RangeEnd is inclusive as well
-	if i.cur.Equal(r.RangeEnd) {
-		i.rangeIdx += 1
-		i.rangeIdx %= len(*i.rangeset)
-		r = (*i.rangeset)[i.rangeIdx]
-
-		i.cur = r.RangeStart
-	} else {
-		i.cur = ip.NextIP(i.cur)
-	}
+		if next == nil {
+			i.rangeIdx += 1
+			i.rangeIdx %= len(*i.rangeset)
+			i.cur = nil
+			passed++
+			continue
+		}
 
-	if i.startIP == nil {
-		i.startIP = i.cur
-	} else if i.rangeIdx == i.startRange && i.cur.Equal(i.startIP) {
-		// IF we've looped back to where we started, give up
-		return nil, nil
-	}
+		i.cur = next
+		if i.startIP == nil {
+			i.startIP = i.cur
+			i.startRange = i.rangeIdx
+		} else if i.rangeIdx == i.startRange && i.cur.Equal(i.startIP) {
+			// IF we've looped back to where we started, give up
+			return nil, nil
+		}
 
-	if i.cur.Equal(r.Gateway) {
-		return i.Next()
+		return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
 	}
-
-	return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
+	return nil, nil
 }
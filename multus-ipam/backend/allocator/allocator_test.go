@@ -15,6 +15,7 @@
 package allocator
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
@@ -112,6 +113,85 @@ var _ = Describe("host-local ip allocator", func() {
 		})
 	})
 
+	Context("RangeIter with holes", func() {
+		mkholes := func(reserves ...net.IP) IPAllocator {
+			a := mkalloc()
+			(*a.rangeset)[0].Subnet = mustSubnet("192.168.1.0/28")
+			(*a.rangeset)[0].RangeEnd = net.IP{192, 168, 1, 14}
+			(*a.rangeset)[0].Reserves = reserves
+			return a
+		}
+
+		It("should skip every hole", func() {
+			a := mkholes(net.IP{192, 168, 1, 3}, net.IP{192, 168, 1, 4}, net.IP{192, 168, 1, 5},
+				net.ParseIP("192.168.1.9"), net.IP{192, 168, 1, 11}, net.IP{192, 168, 1, 12},
+				net.IP{192, 168, 1, 13}, net.IP{192, 168, 1, 14})
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 2}))
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 6}))
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 7}))
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 8}))
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 10}))
+			Expect(r.nextip()).To(BeNil())
+		})
+
+		It("should start after the last reserved ip across holes", func() {
+			a := mkholes(net.IP{192, 168, 1, 8}, net.IP{192, 168, 1, 9}, net.IP{192, 168, 1, 10})
+			a.store.Reserve("ID", "eth0", net.IP{192, 168, 1, 7}, a.rangeID)
+			a.store.ReleaseByID("ID", "eth0")
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 11}))
+		})
+
+		It("should be exhausted when only holes remain", func() {
+			a := mkholes(net.IP{192, 168, 1, 2}, net.IP{192, 168, 1, 3}, net.IP{192, 168, 1, 4},
+				net.IP{192, 168, 1, 5}, net.IP{192, 168, 1, 6}, net.IP{192, 168, 1, 7},
+				net.IP{192, 168, 1, 8}, net.IP{192, 168, 1, 9}, net.IP{192, 168, 1, 10},
+				net.IP{192, 168, 1, 11}, net.IP{192, 168, 1, 12}, net.IP{192, 168, 1, 13},
+				net.IP{192, 168, 1, 14})
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(BeNil())
+
+			_, err := a.Get("ID", "eth0", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no IP addresses available in range set"))
+			Expect(errors.Is(err, ErrNoFreeAddresses)).To(BeTrue())
+		})
+
+		It("should never allocate from keep-out ranges", func() {
+			a := mkholes()
+			(*a.rangeset)[0].KeepOut = []SimpleRange{
+				{net.IP{192, 168, 1, 3}, net.IP{192, 168, 1, 6}},
+				{net.IP{192, 168, 1, 9}, net.IP{192, 168, 1, 13}},
+			}
+			Expect((*a.rangeset)[0].Canonicalize()).To(Succeed())
+			allocated := []string{}
+			for i := 0; ; i++ {
+				res, err := a.Get(fmt.Sprintf("ID%d", i), "eth0", nil)
+				if err != nil {
+					break
+				}
+				allocated = append(allocated, res.Address.IP.String())
+			}
+			Expect(allocated).To(Equal([]string{"192.168.1.2", "192.168.1.7", "192.168.1.8", "192.168.1.14"}))
+		})
+
+		It("should not allocate the ips left between holes twice", func() {
+			a := mkholes(net.IP{192, 168, 1, 2}, net.IP{192, 168, 1, 3}, net.IP{192, 168, 1, 5},
+				net.IP{192, 168, 1, 6}, net.IP{192, 168, 1, 7}, net.IP{192, 168, 1, 8},
+				net.IP{192, 168, 1, 9}, net.IP{192, 168, 1, 10}, net.IP{192, 168, 1, 11},
+				net.IP{192, 168, 1, 12}, net.IP{192, 168, 1, 13})
+			res, err := a.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(net.IP{192, 168, 1, 4}))
+			res, err = a.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(net.IP{192, 168, 1, 14}))
+			_, err = a.Get("ID3", "eth0", nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("when has free ip", func() {
 		It("should allocate ips in round robin", func() {
 			testCases := []AllocatorTestCase{
@@ -248,6 +328,33 @@ var _ = Describe("host-local ip allocator", func() {
 
 		})
 
+		It("should release the ips of one container only", func() {
+			alloc := mkalloc()
+			res1, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			res2, err := alloc.Get("ID2", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(alloc.Release("ID1", "eth0")).To(Succeed())
+			Expect(alloc.store.GetByID("ID1", "eth0")).To(BeEmpty())
+			ips := alloc.store.GetByID("ID2", "eth0")
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].Equal(res2.Address.IP)).To(BeTrue())
+
+			res1, err = alloc.Get("ID1", "eth0", res1.Address.IP)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.ReleaseByIP(res2.Address.IP)).To(Succeed())
+			Expect(alloc.store.GetByID("ID2", "eth0")).To(BeEmpty())
+			ips = alloc.store.GetByID("ID1", "eth0")
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].Equal(res1.Address.IP)).To(BeTrue())
+		})
+
+		It("should not release an ip out of the range set", func() {
+			alloc := mkalloc()
+			Expect(alloc.ReleaseByIP(net.IP{192, 168, 2, 5})).To(HaveOccurred())
+		})
+
 		Context("when requesting a specific IP", func() {
 			It("must allocate the requested IP", func() {
 				alloc := mkalloc()
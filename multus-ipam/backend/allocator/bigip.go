@@ -0,0 +1,42 @@
+package allocator
+
+import (
+	"math/big"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// IPToBigInt returns addr as an integer, an ipv4 in 32 bits and an ipv6 in 128
+// bits, so that the range arithmetic is shared by both families
+func IPToBigInt(addr net.IP) *big.Int {
+	if a := addr.To4(); a != nil {
+		return new(big.Int).SetBytes(a)
+	}
+	return new(big.Int).SetBytes(addr.To16())
+}
+
+// BigIntToIP returns the ipv6 of n if v6, the ipv4 of n otherwise, nil if n
+// does not fit in the family
+func BigIntToIP(n *big.Int, v6 bool) net.IP {
+	size := net.IPv4len
+	if v6 {
+		size = net.IPv6len
+	}
+	b := n.Bytes()
+	if n.Sign() < 0 || len(b) > size {
+		return nil
+	}
+	addr := make(net.IP, size)
+	copy(addr[size-len(b):], b)
+	return addr
+}
+
+// NetToBigRange returns the first and the last addresses of subnet as integers
+func NetToBigRange(subnet types.IPNet) (*big.Int, *big.Int) {
+	first := IPToBigInt(subnet.IP.Mask(subnet.Mask))
+	ones, bits := subnet.Mask.Size()
+	last := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last.Add(last, first).Sub(last, big.NewInt(1))
+	return first, last
+}
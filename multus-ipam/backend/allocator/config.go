@@ -15,8 +15,11 @@
 package allocator
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/bits"
 	"net"
 	"strconv"
 	"strings"
@@ -29,9 +32,56 @@ import (
 // The top-level network config - IPAM plugins are passed the full configuration
 // of the calling plugin, not just the IPAM section.
 
+// MaxPriority is the highest priority of an ADD, the default one is 0
+const MaxPriority = 10
+
+// The dataDirPolicy decides on the ADDs while the data dir fails, e.g. on a
+// full disk or a read-only remount. They fail by default, as the leases can
+// not be tracked. The degraded ones claim their ips in etcd only instead.
+const (
+	DataDirFatal    = "fatal"
+	DataDirDegraded = "degraded"
+)
+
+// The rangeOverlap decides on the cached ranges overlapping in a range set,
+// which would hand an ip out twice. They are merged by default, the error one
+// fails the ADD instead, to catch them while debugging.
+const (
+	RangeOverlapMerge = "merge"
+	RangeOverlapError = "error"
+)
+
+// The gatewayCheck flags the gateways out of the ranges applied by the node,
+// as the nodes of a routed fabric do not reach them on-link, unless a route of
+// the config takes them on-link. The allocate one falls back to a gateway
+// allocated from the ranges of the node, as allocGW does.
+const (
+	GatewayCheckWarn     = "warn"
+	GatewayCheckError    = "error"
+	GatewayCheckAllocate = "allocate"
+)
+
+// The leaseOwner decides on the values of the leases applied. They name the
+// node by default, the pod one names the pod whose ADD applied them too, so
+// that the operators see which workloads drove a node to grab space.
+const (
+	LeaseOwnerNode = "node"
+	LeaseOwnerPod  = "pod"
+)
+
+// The allocationOrder decides on the end of the range the applies claim the
+// free ranges from. They claim the lowest by default, the descending one the
+// highest, keeping the low ips free for the static infra.
+const (
+	AllocationAscending  = "ascending"
+	AllocationDescending = "descending"
+)
+
 var (
-	fixSuffix        = "fix"
-	defaultApplyUnit = uint32(4)
+	fixSuffix          = "fix"
+	defaultApplyUnit   = uint32(4)
+	maxApplyUnit       = uint32(16)
+	defaultMaxApplyTry = 3
 )
 
 type Net struct {
@@ -63,22 +113,62 @@ type Net struct {
 // range directly, and wish to preserve backwards compatability
 type IPAMConfig struct {
 	*Range
-	Name       string
-	Type       string         `json:"type"`
-	Routes     []*types.Route `json:"routes"`
-	DataDir    string         `json:"dataDir"`
-	ResolvConf string         `json:"resolvConf"`
-	Ranges     []RangeSet     `json:"ranges"`
-	FixRange   *Range         `json:"fixRange"`
-	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS and args
-	ApplyUnit  uint32         `json:"applyUnit,omitempty"`
-	AllocGW    bool           `json:"allocGW,omitempty"`
-	LogFile    string         `json:"logFile,omitempty"`
-	LogLevel   string         `json:"logLevel,omitempty"`
-	PodName    string
-	K8sNs      string
-	IsFixIP    bool
-	Num        int
+	Name          string
+	Type          string            `json:"type"`
+	Routes        []*types.Route    `json:"routes"`
+	RouteTables   []int             `json:"-"` // the table of each of Routes for the policy routing, 0 for the main one
+	DataDir       string            `json:"dataDir"`
+	ResolvConf    string            `json:"resolvConf"`
+	LenientDNS    bool              `json:"ignoreResolvConfErrors,omitempty"` // go on without dns once resolvConf fails to parse
+	Ranges        []RangeSet        `json:"ranges"`
+	FixRange      *Range            `json:"fixRange"`
+	IPArgs        []net.IP          `json:"-"` // Requested IPs from CNI_ARGS and args
+	Preferred     net.IP            `json:"-"` // the ip preferred by the pod with softReserve
+	ApplyUnit     uint32            `json:"applyUnit,omitempty"`
+	ReserveUnits  int               `json:"minReserveUnits,omitempty"` // apply units of each range set the warmup caches on the node
+	MaxApplyTry   int               `json:"maxApplyTry,omitempty"`     // free ranges an apply tries to claim, as other nodes may claim them first
+	ApplySpread   int               `json:"applySpread,omitempty"`     // free ranges an apply picks one of at random, the lowest if 1 or less
+	AllocOrder    string            `json:"allocationOrder,omitempty"`
+	AllocGW       bool              `json:"allocGW,omitempty"`
+	VerifyRelease bool              `json:"verifyRelease,omitempty"`
+	ReturnEmpty   bool              `json:"returnEmpty,omitempty"` // return a range to etcd once its last ip is released
+	ReturnAfter   int               `json:"returnAfter,omitempty"` // allocations a range stays drained for before returnEmpty returns it
+	Capacity      uint32            `json:"capacity,omitempty"`
+	NodeCapacity  map[string]uint32 `json:"nodeCapacity,omitempty"`
+	MetricsFile   string            `json:"metricsFile,omitempty"`
+	Pool          string            `json:"pool,omitempty"`
+	Breaker       *BreakerConf      `json:"circuitBreaker,omitempty"`
+	PinnedIPs     bool              `json:"pinnedIPs,omitempty"`
+	SoftReserve   bool              `json:"softReserve,omitempty"` // prefer the ip last allocated to the pod, if free
+	MutexShards   int               `json:"mutexShards,omitempty"` // the networks of a pool shall agree on it
+	ShardCount    int               `json:"shardCount,omitempty"`  // the mutexShards by another name, the buckets of the leases
+	DataDirPolicy string            `json:"dataDirPolicy,omitempty"`
+	ReplayLog     string            `json:"replayLog,omitempty"` // file recording the allocation decisions, see package replay
+	Events        string            `json:"events,omitempty"`    // file or "unix:<path>" socket told the ips allocated and released
+	RangeOverlap  string            `json:"rangeOverlap,omitempty"`
+	NodeRange     *NodeRangeConf    `json:"nodeRange,omitempty"` // derive the ipv4 range of the node instead of applying it
+	GatewayCheck  string            `json:"gatewayCheck,omitempty"`
+	LeaseOwner    string            `json:"leaseOwner,omitempty"`
+	Exclude       []string          `json:"exclude,omitempty"`       // cidrs, start-end ips or ips never allocated from any range
+	ExhaustedWait int               `json:"exhaustedWait,omitempty"` // seconds to apply no more from a range found exhausted
+	Parallelism   int               `json:"parallelism,omitempty"`   // range sets allocated from at once
+	StrictVersion bool              `json:"strictVersion,omitempty"` // reject the cniVersions the result can not be printed in
+	AllocTimeout  int               `json:"allocTimeout,omitempty"`  // seconds an ADD waits for the locks and retries at most
+	RootKeyDir    string            `json:"rootKeyDir,omitempty"`    // etcd root of the keys of the network, ETCD_ROOT_DIR if absent
+	LogFile       string            `json:"logFile,omitempty"`       // over the logFile of the network config
+	LogLevel      string            `json:"logLevel,omitempty"`      // over the logLevel of the network config
+	PodName       string
+	K8sNs         string
+	IsFixIP       bool
+	Num           int
+	IPFamily      int // 4 or 6 to allocate a single family, 0 for all of them
+	Priority      int // 0 to MaxPriority, the higher wins the contended ranges
+}
+
+// BreakerConf enables the circuit breaker around etcd, the zero values take the defaults
+type BreakerConf struct {
+	Failures int `json:"failures,omitempty"` // consecutive failures to open the breaker
+	Cooldown int `json:"cooldown,omitempty"` // seconds to short-circuit the calls once open
 }
 
 type IPAMEnvArgs struct {
@@ -88,20 +178,121 @@ type IPAMEnvArgs struct {
 	K8S_POD_NAME      types.UnmarshallableString `json:"k8sPodName,omitempty"`
 	Fix               types.UnmarshallableString `json:"extEnvFix,omitempty"`
 	Num               types.UnmarshallableString `json:"extEnvNum,omitempty"`
+	IPFamily          types.UnmarshallableString `json:"ipFamily,omitempty"`
+	Priority          types.UnmarshallableString `json:"priority,omitempty"`
 }
 
 type IPAMArgs struct {
-	IPs []net.IP `json:"ips"`
+	IPs      []net.IP `json:"ips"`
+	IPFamily string   `json:"ipFamily,omitempty"`
+	Priority *int     `json:"priority,omitempty"`
 }
 
 type RangeSet []Range
 
 type Range struct {
-	RangeStart net.IP      `json:"rangeStart,omitempty"` // The first ip, inclusive
-	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`   // The last ip, inclusive
-	Subnet     types.IPNet `json:"subnet"`
-	Gateway    net.IP      `json:"gateway,omitempty"`
-	Reserves   []net.IP    `json:"reserves,omitempty"`
+	RangeStart net.IP        `json:"rangeStart,omitempty"` // The first ip, inclusive
+	RangeEnd   net.IP        `json:"rangeEnd,omitempty"`   // The last ip, inclusive
+	Subnet     types.IPNet   `json:"subnet"`
+	Gateway    net.IP        `json:"gateway,omitempty"`
+	Reserves   []net.IP      `json:"reserves,omitempty"`
+	KeepOut    []SimpleRange `json:"keepOut,omitempty"` // Sub-ranges managed by others, e.g. DHCP
+	MinFree    uint32        `json:"minFree,omitempty"` // Ips kept free for the applies of priority above 0
+}
+
+// GatewayAuto is the gateway of a range claiming the first ip of the subnet,
+// as a range without gateway does
+const GatewayAuto = "auto"
+
+// dropAutoGateways removes the gateways of GatewayAuto from the ranges of the
+// ipam of conf, which can not be read as ips. conf is returned as is unless
+// one is removed, a conf failing to decode is left to the caller.
+func dropAutoGateways(conf []byte) []byte {
+	raw := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(conf))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return conf
+	}
+	ipam, ok := raw["ipam"].(map[string]interface{})
+	if !ok {
+		return conf
+	}
+	drop := func(r interface{}) bool {
+		m, ok := r.(map[string]interface{})
+		if gw, _ := m["gateway"].(string); !ok || gw != GatewayAuto {
+			return false
+		}
+		delete(m, "gateway")
+		return true
+	}
+	dropped := drop(ipam)
+	sets, _ := ipam["ranges"].([]interface{})
+	for _, set := range sets {
+		rs, _ := set.([]interface{})
+		for _, r := range rs {
+			dropped = drop(r) || dropped
+		}
+	}
+	if !dropped {
+		return conf
+	}
+	if data, err := json.Marshal(raw); err == nil {
+		return data
+	}
+	return conf
+}
+
+// routeTables returns the tables of the routes of the ipam of conf, which the
+// routes of the library do not hold, nil unless one of them has one
+func routeTables(conf []byte) ([]int, error) {
+	raw := struct {
+		IPAM struct {
+			Routes []struct {
+				Table int `json:"table"`
+			} `json:"routes"`
+		} `json:"ipam"`
+	}{}
+	if err := json.Unmarshal(conf, &raw); err != nil {
+		return nil, err
+	}
+	tables := make([]int, len(raw.IPAM.Routes))
+	set := false
+	for i, r := range raw.IPAM.Routes {
+		if r.Table < 0 {
+			return nil, fmt.Errorf("invalid table %d of route %d, it shall not be negative", r.Table, i)
+		}
+		tables[i] = r.Table
+		set = set || r.Table > 0
+	}
+	if !set {
+		return nil, nil
+	}
+	return tables, nil
+}
+
+// checkRouteGateways checks that the gateway of each route is reachable, in
+// the subnet of a range or in the dst of a route without gateway, which is
+// on-link
+func checkRouteGateways(ipam *IPAMConfig) error {
+	for _, r := range ipam.Routes {
+		if r.GW == nil {
+			continue
+		}
+		reachable := false
+		for _, set := range ipam.Ranges {
+			for _, rng := range set {
+				reachable = reachable || (*net.IPNet)(&rng.Subnet).Contains(r.GW)
+			}
+		}
+		for _, link := range ipam.Routes {
+			reachable = reachable || (link.GW == nil && link.Dst.Contains(r.GW))
+		}
+		if !reachable {
+			return fmt.Errorf("invalid route %v, its gw %v is in no subnet of the ranges nor routed on-link", r.Dst.String(), r.GW)
+		}
+	}
+	return nil
 }
 
 type SimpleRange struct {
@@ -109,24 +300,49 @@ type SimpleRange struct {
 	RangeEnd   net.IP `json:"rangeEnd,omitempty"`   // The last ip, inclusive
 }
 
+// parseExcludes parses the exclude list, each of a cidr, a start-end pair of
+// ips or a single ip
+func parseExcludes(excludes []string) ([]SimpleRange, error) {
+	srs := []SimpleRange{}
+	for _, e := range excludes {
+		var sr SimpleRange
+		if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(e)); err == nil {
+			first, last := NetToBigRange(types.IPNet(*ipNet))
+			v6 := ipNet.IP.To4() == nil
+			sr = SimpleRange{BigIntToIP(first, v6), BigIntToIP(last, v6)}
+		} else if se := strings.SplitN(e, "-", 2); len(se) == 2 {
+			sr = SimpleRange{net.ParseIP(strings.TrimSpace(se[0])), net.ParseIP(strings.TrimSpace(se[1]))}
+		} else {
+			sr = SimpleRange{net.ParseIP(strings.TrimSpace(e)), net.ParseIP(strings.TrimSpace(e))}
+		}
+		if sr.RangeStart == nil || sr.RangeEnd == nil || (sr.RangeStart.To4() == nil) != (sr.RangeEnd.To4() == nil) {
+			return nil, fmt.Errorf("invalid exclude %v, it shall be a cidr, a start-end pair of ips or an ip", e)
+		}
+		canonicalizeIP(&sr.RangeStart)
+		canonicalizeIP(&sr.RangeEnd)
+		if IPToBigInt(sr.RangeStart).Cmp(IPToBigInt(sr.RangeEnd)) > 0 {
+			return nil, fmt.Errorf("invalid exclude %v, the start is after the end", e)
+		}
+		srs = append(srs, sr)
+	}
+	return srs, nil
+}
+
 // NewIPAMConfig creates a NetworkConfig from the given network name.
 func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 	n := Net{}
-	if err := json.Unmarshal(bytes, &n); err != nil {
+	if err := json.Unmarshal(dropAutoGateways(bytes), &n); err != nil {
 		return nil, "", err
 	}
 
 	if n.IPAM == nil {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
-
-	// Logging
-	if n.LogFile != "" {
-		logging.SetLogFile(n.LogFile)
-	}
-	if n.LogLevel != "" {
-		logging.SetLogLevel(n.LogLevel)
+	tables, err := routeTables(bytes)
+	if err != nil {
+		return nil, "", err
 	}
+	n.IPAM.RouteTables = tables
 
 	// Parse custom IP from both env args *and* the top-level args config
 	if envArgs != "" {
@@ -166,11 +382,34 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 				}
 			}
 		}
+		if e.IPFamily != "" {
+			if n.IPAM.IPFamily, err = parseIPFamily(string(e.IPFamily)); err != nil {
+				return nil, "", err
+			}
+		}
+		if e.Priority != "" {
+			if n.IPAM.Priority, err = strconv.Atoi(string(e.Priority)); err != nil {
+				return nil, "", fmt.Errorf("invalid priority %v, %v", e.Priority, err)
+			}
+		}
 	}
 
 	if n.Args != nil && n.Args.A != nil && len(n.Args.A.IPs) != 0 {
 		n.IPAM.IPArgs = append(n.IPAM.IPArgs, n.Args.A.IPs...)
 	}
+	if n.Args != nil && n.Args.A != nil && n.Args.A.IPFamily != "" {
+		family, err := parseIPFamily(n.Args.A.IPFamily)
+		if err != nil {
+			return nil, "", err
+		}
+		n.IPAM.IPFamily = family
+	}
+	if n.Args != nil && n.Args.A != nil && n.Args.A.Priority != nil {
+		n.IPAM.Priority = *n.Args.A.Priority
+	}
+	if n.IPAM.Priority < 0 || n.IPAM.Priority > MaxPriority {
+		return nil, "", fmt.Errorf("invalid priority %d, it shall be within 0 and %d", n.IPAM.Priority, MaxPriority)
+	}
 
 	for idx := range n.IPAM.IPArgs {
 		if err := canonicalizeIP(&n.IPAM.IPArgs[idx]); err != nil {
@@ -194,6 +433,11 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		return nil, "", fmt.Errorf("no IP ranges specified")
 	}
 
+	excludes, err := parseExcludes(n.IPAM.Exclude)
+	if err != nil {
+		return nil, "", err
+	}
+
 	// Validate all ranges
 	numV4 := 0
 	numV6 := 0
@@ -201,6 +445,9 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		if err := n.IPAM.Ranges[i].Canonicalize(); err != nil {
 			return nil, "", fmt.Errorf("invalid range set %d: %s", i, err)
 		}
+		for j := range n.IPAM.Ranges[i] {
+			n.IPAM.Ranges[i][j].Exclude(excludes)
+		}
 
 		if n.IPAM.Ranges[i][0].RangeStart.To4() != nil {
 			numV4++
@@ -209,6 +456,10 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		}
 	}
 
+	if (n.IPAM.IPFamily == 4 && numV4 == 0) || (n.IPAM.IPFamily == 6 && numV6 == 0) {
+		return nil, "", fmt.Errorf("no range of the requested ipFamily ipv%d", n.IPAM.IPFamily)
+	}
+
 	// CNI spec 0.2.0 and below supported only one v4 and v6 address
 	if numV4 > 1 || numV6 > 1 {
 		for _, v := range types020.SupportedVersions {
@@ -228,6 +479,10 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		}
 	}
 
+	if err := checkRouteGateways(n.IPAM); err != nil {
+		return nil, "", err
+	}
+
 	n.IPAM.Name = n.Name
 
 	if n.IPAM.FixRange != nil {
@@ -236,9 +491,129 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		}
 	}
 
+	if b := n.IPAM.Breaker; b != nil && (b.Failures < 0 || b.Cooldown < 0) {
+		return nil, "", fmt.Errorf("invalid circuitBreaker %+v", *b)
+	}
+
+	if strings.Contains(n.IPAM.Pool, "/") {
+		return nil, "", fmt.Errorf("invalid pool %v, it shall not contain /", n.IPAM.Pool)
+	}
+
+	switch n.IPAM.RangeOverlap {
+	case "", RangeOverlapMerge, RangeOverlapError:
+	default:
+		return nil, "", fmt.Errorf("invalid rangeOverlap %v, it shall be %v or %v", n.IPAM.RangeOverlap, RangeOverlapMerge, RangeOverlapError)
+	}
+
+	switch n.IPAM.GatewayCheck {
+	case "", GatewayCheckWarn, GatewayCheckError, GatewayCheckAllocate:
+	default:
+		return nil, "", fmt.Errorf("invalid gatewayCheck %v, it shall be %v, %v or %v", n.IPAM.GatewayCheck, GatewayCheckWarn, GatewayCheckError, GatewayCheckAllocate)
+	}
+
+	switch n.IPAM.LeaseOwner {
+	case "", LeaseOwnerNode, LeaseOwnerPod:
+	default:
+		return nil, "", fmt.Errorf("invalid leaseOwner %v, it shall be %v or %v", n.IPAM.LeaseOwner, LeaseOwnerNode, LeaseOwnerPod)
+	}
+
+	switch n.IPAM.AllocOrder {
+	case "":
+		n.IPAM.AllocOrder = AllocationAscending
+	case AllocationAscending, AllocationDescending:
+	default:
+		return nil, "", fmt.Errorf("invalid allocationOrder %v, it shall be %v or %v", n.IPAM.AllocOrder, AllocationAscending, AllocationDescending)
+	}
+
+	switch n.IPAM.DataDirPolicy {
+	case "", DataDirFatal, DataDirDegraded:
+	default:
+		return nil, "", fmt.Errorf("invalid dataDirPolicy %v, it shall be %v or %v", n.IPAM.DataDirPolicy, DataDirFatal, DataDirDegraded)
+	}
+
+	// the mutexes of a dir are taken under the first segment of its key
+	if strings.ContainsAny(n.IPAM.RootKeyDir, "/ \t\r\n") {
+		return nil, "", fmt.Errorf("invalid rootKeyDir %q, it shall be a single key segment", n.IPAM.RootKeyDir)
+	}
+
+	if n.IPAM.ExhaustedWait < 0 {
+		return nil, "", fmt.Errorf("invalid exhaustedWait %d", n.IPAM.ExhaustedWait)
+	}
+
+	if n.IPAM.ReturnAfter < 0 {
+		return nil, "", fmt.Errorf("invalid returnAfter %d", n.IPAM.ReturnAfter)
+	}
+
+	if n.IPAM.AllocTimeout < 0 {
+		return nil, "", fmt.Errorf("invalid allocTimeout %d", n.IPAM.AllocTimeout)
+	}
+
+	if n.IPAM.Parallelism < 0 {
+		return nil, "", fmt.Errorf("invalid parallelism %d", n.IPAM.Parallelism)
+	}
+
+	if n.IPAM.MutexShards < 0 {
+		return nil, "", fmt.Errorf("invalid mutexShards %d", n.IPAM.MutexShards)
+	}
+	if n.IPAM.ShardCount < 0 {
+		return nil, "", fmt.Errorf("invalid shardCount %d, it shall not be negative", n.IPAM.ShardCount)
+	}
+	// the buckets are the shards of the lease dir, counted in MutexShards only,
+	// which the claims lock some of and the operations on the whole dir all of
+	if n.IPAM.ShardCount > 1 {
+		if n.IPAM.MutexShards > 1 && n.IPAM.MutexShards != n.IPAM.ShardCount {
+			return nil, "", fmt.Errorf("shardCount %d disagrees with mutexShards %d", n.IPAM.ShardCount, n.IPAM.MutexShards)
+		}
+		n.IPAM.MutexShards = n.IPAM.ShardCount
+	}
+
+	if n.IPAM.MaxApplyTry < 0 {
+		return nil, "", fmt.Errorf("invalid maxApplyTry %d, it shall be 1 at least", n.IPAM.MaxApplyTry)
+	}
+	if n.IPAM.MaxApplyTry == 0 {
+		n.IPAM.MaxApplyTry = defaultMaxApplyTry
+	}
+	if n.IPAM.ApplySpread < 0 {
+		return nil, "", fmt.Errorf("invalid applySpread %d, it shall not be negative", n.IPAM.ApplySpread)
+	}
+	if n.IPAM.ReserveUnits < 0 {
+		return nil, "", fmt.Errorf("invalid minReserveUnits %d, it shall not be negative", n.IPAM.ReserveUnits)
+	}
+
 	if n.IPAM.ApplyUnit == 0 {
 		n.IPAM.ApplyUnit = defaultApplyUnit
 	}
+	if n.IPAM.ApplyUnit >= 64 {
+		return nil, "", fmt.Errorf("invalid applyUnit %d, the ranges applied hold 2^applyUnit ips", n.IPAM.ApplyUnit)
+	}
+
+	// every apply fails in a subnet too small for a single apply unit
+	for i, rs := range n.IPAM.Ranges {
+		unitIPs := uint64(1) << n.IPAM.ApplyUnit
+		c := subnetApplyIPs(rs[0].Subnet)
+		if c >= unitIPs {
+			continue
+		}
+		// applyUnit 0 takes the default, a single ip fits no unit to configure
+		hint := "use a larger subnet"
+		if c >= 2 {
+			hint = fmt.Sprintf("use applyUnit %d or a larger subnet", bits.Len64(c)-1)
+		}
+		return nil, "", fmt.Errorf("range set %d has %d ips to apply in %v after the network, gateway and broadcast addresses, fewer than the %d ips of applyUnit %d, %s",
+			i, c, (*net.IPNet)(&rs[0].Subnet), unitIPs, n.IPAM.ApplyUnit, hint)
+	}
+
+	if c := n.IPAM.NodeRange; c != nil {
+		if err := c.validate(n.IPAM.Ranges); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for node, c := range n.IPAM.NodeCapacity {
+		if c == 0 {
+			return nil, "", fmt.Errorf("invalid capacity 0 of node %v", node)
+		}
+	}
 
 	if n.IPAM.Num == 0 {
 		n.IPAM.Num = 1
@@ -246,3 +621,53 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 
 	return &n, n.CNIVersion, nil
 }
+
+// NodeApplyUnit returns the apply unit scaled by the capacity of the node, every
+// doubling of the capacity doubles the size of the range the node applies
+func (c *IPAMConfig) NodeApplyUnit(node string) uint32 {
+	capacity := c.Capacity
+	if nc, ok := c.NodeCapacity[node]; ok {
+		capacity = nc
+	}
+	unit := c.ApplyUnit
+	for capacity > 1 && unit < maxApplyUnit {
+		capacity >>= 1
+		unit++
+	}
+	return unit
+}
+
+// parseIPFamily converts the ipFamily arg to 4 or 6, and to 0 for dual-stack
+func parseIPFamily(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "4", "v4", "ipv4":
+		return 4, nil
+	case "6", "v6", "ipv6":
+		return 6, nil
+	case "dual":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid ipFamily %v, it shall be ipv4, ipv6 or dual", s)
+}
+
+// subnetApplyIPs returns the ips of a subnet left to apply after the network,
+// the gateway .1 and the broadcast addresses
+func subnetApplyIPs(subnet types.IPNet) uint64 {
+	ones, size := subnet.Mask.Size()
+	if size-ones < 2 {
+		return 0
+	}
+	// the ipv6 subnets of 64 bits and more hold any unit
+	if size-ones >= 64 {
+		return math.MaxUint64
+	}
+	return uint64(1)<<uint(size-ones) - 3
+}
+
+// RangeSetFamily returns 4 or 6, the family of a canonicalized range set
+func RangeSetFamily(rs RangeSet) int {
+	if len(rs) == 0 || rs[0].RangeStart.To4() != nil {
+		return 4
+	}
+	return 6
+}
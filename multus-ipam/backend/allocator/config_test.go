@@ -15,7 +15,9 @@
 package allocator
 
 import (
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
@@ -57,8 +59,9 @@ var _ = Describe("IPAM config", func() {
 					},
 				},
 			},
-			ApplyUnit: defaultApplyUnit,
-			Num:       1,
+			ApplyUnit:   defaultApplyUnit,
+			MaxApplyTry: defaultMaxApplyTry,
+			Num:         1,
 		}))
 	})
 
@@ -131,8 +134,9 @@ var _ = Describe("IPAM config", func() {
 					},
 				},
 			},
-			ApplyUnit: defaultApplyUnit,
-			Num:       1,
+			ApplyUnit:   defaultApplyUnit,
+			MaxApplyTry: defaultMaxApplyTry,
+			Num:         1,
 		}))
 	})
 
@@ -206,8 +210,9 @@ var _ = Describe("IPAM config", func() {
 					},
 				},
 			},
-			ApplyUnit: defaultApplyUnit,
-			Num:       1,
+			ApplyUnit:   defaultApplyUnit,
+			MaxApplyTry: defaultMaxApplyTry,
+			Num:         1,
 		}))
 	})
 
@@ -385,4 +390,595 @@ var _ = Describe("IPAM config", func() {
 		_, _, err := LoadIPAMConfig([]byte(input), "")
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("Should scale the apply unit with the node capacity", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"applyUnit": 4,
+					"nodeCapacity": {
+						"big-node": 4,
+						"small-node": 1
+					}
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.NodeApplyUnit("small-node")).To(Equal(uint32(4)))
+		Expect(conf.IPAM.NodeApplyUnit("big-node")).To(Equal(uint32(6)))
+		Expect(conf.IPAM.NodeApplyUnit("other-node")).To(Equal(uint32(4)))
+
+		conf.IPAM.Capacity = 2
+		Expect(conf.IPAM.NodeApplyUnit("other-node")).To(Equal(uint32(5)))
+		Expect(conf.IPAM.NodeApplyUnit("small-node")).To(Equal(uint32(4)))
+	})
+
+	It("Should error on zero node capacity", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"nodeCapacity": {
+						"big-node": 0
+					}
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid capacity 0 of node big-node"))
+	})
+
+	It("Should error on a pool containing /", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"pool": "shared/pool"
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid pool shared/pool, it shall not contain /"))
+	})
+
+	It("Should error on negative mutex shards", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"mutexShards": -1
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid mutexShards -1"))
+	})
+
+	It("Should parse the ipFamily arg", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "2001:db8:1::/48"}]
+					]
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "IPFamily=ipv6")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.IPFamily).To(Equal(6))
+
+		conf, _, err = LoadIPAMConfig([]byte(input), "IPFamily=4")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.IPFamily).To(Equal(4))
+
+		conf, _, err = LoadIPAMConfig([]byte(input), "IPFamily=dual")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.IPFamily).To(Equal(0))
+
+		_, _, err = LoadIPAMConfig([]byte(input), "IPFamily=ipv5")
+		Expect(err).To(MatchError("invalid ipFamily ipv5, it shall be ipv4, ipv6 or dual"))
+	})
+
+	It("Should parse the priority arg", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16"
+				},
+				"args": {
+					"cni": {
+						"priority": 8
+					}
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Priority).To(Equal(8))
+
+		conf, _, err = LoadIPAMConfig([]byte(input), "Priority=3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Priority).To(Equal(8))
+
+		input = `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16"
+				}
+			}`
+		conf, _, err = LoadIPAMConfig([]byte(input), "Priority=3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Priority).To(Equal(3))
+
+		_, _, err = LoadIPAMConfig([]byte(input), "Priority=11")
+		Expect(err).To(MatchError("invalid priority 11, it shall be within 0 and 10"))
+	})
+
+	It("Should error on an unknown rangeOverlap", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"rangeOverlap": "ignore"
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid rangeOverlap ignore, it shall be merge or error"))
+	})
+
+	It("Should error on a nodeRange block wider than the subnet", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"nodeRange": {"blockPrefix": 8}
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid nodeRange blockPrefix 8 of range set 0, it shall be within 16 and 30"))
+	})
+
+	It("Should error on an unknown gatewayCheck", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"gatewayCheck": "ignore"
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid gatewayCheck ignore, it shall be warn, error or allocate"))
+	})
+
+	It("Should parse an auto gateway", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"gateway": "auto",
+					"ranges": [
+						[{"subnet": "10.2.0.0/24", "gateway": "auto"}],
+						[{"subnet": "10.3.0.0/24", "gateway": "10.3.0.254", "rangeEnd": "10.3.0.100"}]
+					]
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(conf.IPAM.Ranges)).To(Equal(3))
+		Expect(conf.IPAM.Ranges[0][0].Gateway).To(Equal(net.IP{10, 1, 0, 1}))
+		Expect(conf.IPAM.Ranges[1][0].Gateway).To(Equal(net.IP{10, 2, 0, 1}))
+		Expect(conf.IPAM.Ranges[2][0].Gateway).To(Equal(net.IP{10, 3, 0, 254}))
+		Expect(conf.IPAM.Ranges[2][0].RangeEnd).To(Equal(net.IP{10, 3, 0, 100}))
+
+		input = strings.Replace(input, `"gateway": "10.3.0.254"`, `"gateway": "gw"`, 1)
+		_, _, err = LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should parse the exclude list into the keep-out ranges", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						[{"subnet": "10.1.0.0/24"}, {"subnet": "10.1.1.0/24"}],
+						[{"subnet": "2001:db8::/64"}]
+					],
+					"exclude": ["10.1.0.16/28", "10.1.0.250-10.1.1.5", "10.1.1.100", "2001:db8::5"]
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Ranges[0][0].KeepOut).To(Equal([]SimpleRange{
+			{net.IP{10, 1, 0, 16}, net.IP{10, 1, 0, 31}},
+			{net.IP{10, 1, 0, 250}, net.IP{10, 1, 0, 255}},
+		}))
+		Expect(conf.IPAM.Ranges[0][1].KeepOut).To(Equal([]SimpleRange{
+			{net.IP{10, 1, 1, 0}, net.IP{10, 1, 1, 5}},
+			{net.IP{10, 1, 1, 100}, net.IP{10, 1, 1, 100}},
+		}))
+		Expect(conf.IPAM.Ranges[1][0].KeepOut).To(Equal([]SimpleRange{
+			{net.ParseIP("2001:db8::5"), net.ParseIP("2001:db8::5")},
+		}))
+
+		for _, exclude := range []string{"10.1.0.9-10.1.0.5", "10.1.0.5-2001:db8::5", "10.1.0.x"} {
+			bad := strings.Replace(input, `"10.1.1.100"`, fmt.Sprintf("%q", exclude), 1)
+			_, _, err = LoadIPAMConfig([]byte(bad), "")
+			Expect(err).To(HaveOccurred(), exclude)
+			Expect(err.Error()).To(HavePrefix("invalid exclude " + exclude))
+		}
+	})
+
+	It("Should error on an unknown leaseOwner", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"leaseOwner": "namespace"
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid leaseOwner namespace, it shall be node or pod"))
+	})
+
+	It("Should parse the rootKeyDir and error on a nested one", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"rootKeyDir": "tenant-a"
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.RootKeyDir).To(Equal("tenant-a"))
+
+		_, _, err = LoadIPAMConfig([]byte(strings.Replace(input, `"tenant-a"`, `"tenant-a/ipam"`, 1)), "")
+		Expect(err).To(MatchError(`invalid rootKeyDir "tenant-a/ipam", it shall be a single key segment`))
+	})
+
+	It("Should error on a negative exhaustedWait", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"exhaustedWait": -1
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid exhaustedWait -1"))
+	})
+
+	It("Should error on a negative returnAfter", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"returnAfter": -1
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid returnAfter -1"))
+	})
+
+	It("Should error on a negative allocTimeout", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"allocTimeout": -1
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid allocTimeout -1"))
+	})
+
+	It("Should error on a negative parallelism", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"parallelism": -1
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid parallelism -1"))
+	})
+
+	It("Should error on an unknown dataDirPolicy", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"dataDirPolicy": "ignore"
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid dataDirPolicy ignore, it shall be fatal or degraded"))
+	})
+
+	It("Should error on a subnet too small for an apply unit", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "%s",
+					"applyUnit": %d
+				}
+			}`
+		cases := []struct {
+			subnet string
+			unit   int
+			err    string
+		}{
+			{"10.1.2.0/32", 1, "invalid range set 0: Network 10.1.2.0/32 too small to allocate from"},
+			{"10.1.2.0/31", 1, "invalid range set 0: Network 10.1.2.0/31 too small to allocate from, RFC 3021 point-to-point /31 is not supported"},
+			{"10.1.2.0/30", 1, "range set 0 has 1 ips to apply in 10.1.2.0/30 after the network, gateway and broadcast addresses, fewer than the 2 ips of applyUnit 1, use a larger subnet"},
+			{"10.1.2.0/30", 0, "range set 0 has 1 ips to apply in 10.1.2.0/30 after the network, gateway and broadcast addresses, fewer than the 16 ips of applyUnit 4, use a larger subnet"},
+			{"10.1.2.0/29", 3, "range set 0 has 5 ips to apply in 10.1.2.0/29 after the network, gateway and broadcast addresses, fewer than the 8 ips of applyUnit 3, use applyUnit 2 or a larger subnet"},
+			{"10.1.2.0/29", 2, ""},
+			{"10.1.2.0/28", 4, "range set 0 has 13 ips to apply in 10.1.2.0/28 after the network, gateway and broadcast addresses, fewer than the 16 ips of applyUnit 4, use applyUnit 3 or a larger subnet"},
+			{"10.1.2.0/27", 4, ""},
+			{"10.1.0.0/16", 33, "range set 0 has 65533 ips to apply in 10.1.0.0/16 after the network, gateway and broadcast addresses, fewer than the 8589934592 ips of applyUnit 33, use applyUnit 15 or a larger subnet"},
+			{"10.1.0.0/16", 64, "invalid applyUnit 64, the ranges applied hold 2^applyUnit ips"},
+			{"2001:db8::/120", 8, "range set 0 has 253 ips to apply in 2001:db8::/120 after the network, gateway and broadcast addresses, fewer than the 256 ips of applyUnit 8, use applyUnit 7 or a larger subnet"},
+			{"2001:db8::/64", 32, ""},
+		}
+		for _, c := range cases {
+			_, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, c.subnet, c.unit)), "")
+			if c.err == "" {
+				Expect(err).NotTo(HaveOccurred(), c.subnet)
+			} else {
+				Expect(err).To(MatchError(c.err), c.subnet)
+			}
+		}
+	})
+
+	It("Should default maxApplyTry and error on a negative one", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"maxApplyTry": %d
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, 0)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.MaxApplyTry).To(Equal(3))
+		conf, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, 5)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.MaxApplyTry).To(Equal(5))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, -1)), "")
+		Expect(err).To(MatchError("invalid maxApplyTry -1, it shall be 1 at least"))
+	})
+
+	It("Should error on a negative applySpread", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"applySpread": %d
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, 4)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.ApplySpread).To(Equal(4))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, -1)), "")
+		Expect(err).To(MatchError("invalid applySpread -1, it shall not be negative"))
+	})
+
+	It("Should error on a negative minReserveUnits", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"minReserveUnits": %d
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, 3)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.ReserveUnits).To(Equal(3))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, -1)), "")
+		Expect(err).To(MatchError("invalid minReserveUnits -1, it shall not be negative"))
+	})
+
+	It("Should take shardCount as the mutexShards", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					%s
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, `"shardCount": 4`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.MutexShards).To(Equal(4))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, `"shardCount": -1`)), "")
+		Expect(err).To(MatchError("invalid shardCount -1, it shall not be negative"))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, `"shardCount": 4, "mutexShards": 2`)), "")
+		Expect(err).To(MatchError("shardCount 4 disagrees with mutexShards 2"))
+	})
+
+	It("Should parse the routes with distinct gateways and tables", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [[{"subnet": "10.1.0.0/16"}], [{"subnet": "10.2.0.0/24"}]],
+					"routes": [
+						{"dst": "0.0.0.0/0"},
+						{"dst": "192.168.0.0/16", "gw": "10.1.0.254", "table": 100},
+						{"dst": "172.16.0.0/12", "gw": "10.2.0.254", "table": 200},
+						{"dst": "10.9.0.0/24"},
+						{"dst": "10.10.0.0/16", "gw": "10.9.0.1"}
+					]
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Routes).To(HaveLen(5))
+		Expect(conf.IPAM.Routes[1].GW.String()).To(Equal("10.1.0.254"))
+		Expect(conf.IPAM.Routes[2].GW.String()).To(Equal("10.2.0.254"))
+		Expect(conf.IPAM.RouteTables).To(Equal([]int{0, 100, 200, 0, 0}))
+
+		// no table at all is the main one for all of them
+		conf, _, err = LoadIPAMConfig([]byte(strings.Replace(strings.Replace(input, `, "table": 100`, "", 1), `, "table": 200`, "", 1)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.RouteTables).To(BeNil())
+
+		_, _, err = LoadIPAMConfig([]byte(strings.Replace(input, `"table": 200`, `"table": -1`, 1)), "")
+		Expect(err).To(MatchError("invalid table -1 of route 2, it shall not be negative"))
+	})
+
+	It("Should error on a route gateway out of the subnets and not on-link", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16",
+					"routes": [{"dst": "192.168.0.0/16", "gw": "10.3.0.1"}]
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid route 192.168.0.0/16, its gw 10.3.0.1 is in no subnet of the ranges nor routed on-link"))
+	})
+
+	It("Should default the allocationOrder to ascending", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16"%s
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.AllocOrder).To(Equal(AllocationAscending))
+		conf, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, `, "allocationOrder": "descending"`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.AllocOrder).To(Equal(AllocationDescending))
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, `, "allocationOrder": "random"`)), "")
+		Expect(err).To(MatchError("invalid allocationOrder random, it shall be ascending or descending"))
+	})
+
+	It("Should error on an ipFamily without range", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.0.0/16"
+				},
+				"args": {
+					"cni": {
+						"ipFamily": "ipv6"
+					}
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("no range of the requested ipFamily ipv6"))
+	})
 })
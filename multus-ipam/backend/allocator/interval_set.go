@@ -0,0 +1,70 @@
+package allocator
+
+import (
+	"net"
+	"sort"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// ipInterval is an inclusive interval of IPs
+type ipInterval struct {
+	start net.IP
+	end   net.IP
+}
+
+// ipIntervalSet is a sorted set of disjoint and non-adjacent IP intervals, it
+// is used to skip the holes of a range without walking through them
+type ipIntervalSet []ipInterval
+
+func newIPIntervalSet(intervals []ipInterval) ipIntervalSet {
+	s := ipIntervalSet{}
+	for _, i := range intervals {
+		if canonicalizeIP(&i.start) != nil || canonicalizeIP(&i.end) != nil || ip.Cmp(i.start, i.end) > 0 {
+			continue
+		}
+		s = append(s, i)
+	}
+	sort.Slice(s, func(a, b int) bool {
+		return ip.Cmp(s[a].start, s[b].start) < 0
+	})
+
+	merged := ipIntervalSet{}
+	for _, i := range s {
+		if n := len(merged); n > 0 && len(merged[n-1].end) == len(i.start) &&
+			ip.Cmp(ip.NextIP(merged[n-1].end), i.start) >= 0 {
+			if ip.Cmp(i.end, merged[n-1].end) > 0 {
+				merged[n-1].end = i.end
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// find returns the interval containing addr, or nil
+func (s ipIntervalSet) find(addr net.IP) *ipInterval {
+	idx := sort.Search(len(s), func(i int) bool {
+		return ip.Cmp(s[i].start, addr) > 0
+	})
+	if idx == 0 || ip.Cmp(s[idx-1].end, addr) < 0 {
+		return nil
+	}
+	return &s[idx-1]
+}
+
+// Contains checks if addr is in one of the intervals
+func (s ipIntervalSet) Contains(addr net.IP) bool {
+	return s.find(addr) != nil
+}
+
+// NextFree returns the first IP not smaller than addr and outside of all the
+// intervals, in its canonical form
+func (s ipIntervalSet) NextFree(addr net.IP) net.IP {
+	canonicalizeIP(&addr)
+	if i := s.find(addr); i != nil {
+		return ip.NextIP(i.end)
+	}
+	return addr
+}
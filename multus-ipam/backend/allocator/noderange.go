@@ -0,0 +1,110 @@
+package allocator
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+
+	"github.com/archichris/netools/ipaddr"
+)
+
+// NodeRangeConf derives the range of every node from its index instead of
+// applying it from etcd, for the routing designs where the block of a node
+// follows its address, e.g. node 10.0.0.5 gets 10.244.5.0/24 of 10.244.0.0/16
+type NodeRangeConf struct {
+	BlockPrefix int               `json:"blockPrefix"`           // the prefix length of the block of a node
+	NodeIndexes map[string]uint32 `json:"nodeIndexes,omitempty"` // the nodes not indexed by their address
+}
+
+// lookupIP resolves the address of a node, tests replace it
+var lookupIP = net.LookupIP
+
+// validate checks the block prefix against the ipv4 subnets of the range sets
+func (c *NodeRangeConf) validate(rss []RangeSet) error {
+	for i, rs := range rss {
+		if RangeSetFamily(rs) != 4 {
+			continue
+		}
+		ones, _ := rs[0].Subnet.Mask.Size()
+		if c.BlockPrefix < ones || c.BlockPrefix > 30 {
+			return fmt.Errorf("invalid nodeRange blockPrefix %d of range set %d, it shall be within %d and 30", c.BlockPrefix, i, ones)
+		}
+	}
+	return nil
+}
+
+// NodeIndex returns the index of node among the blocks of subnet, which is
+// configured in nodeIndexes, or else the low bits of the ipv4 address of the
+// node, its name if it is an address
+func (c *NodeRangeConf) NodeIndex(node string, subnet *net.IPNet) (uint32, error) {
+	if idx, ok := c.NodeIndexes[node]; ok {
+		return idx, nil
+	}
+	addr := net.ParseIP(node).To4()
+	if addr == nil {
+		addrs, err := lookupIP(node)
+		if err != nil {
+			return 0, fmt.Errorf("no index of node %v, lookup its address failed, %v", node, err)
+		}
+		for _, a := range addrs {
+			if addr = a.To4(); addr != nil {
+				break
+			}
+		}
+		if addr == nil {
+			return 0, fmt.Errorf("no index of node %v, it has no ipv4 address", node)
+		}
+	}
+	ones, _ := subnet.Mask.Size()
+	n := uint(c.BlockPrefix - ones)
+	if n == 0 {
+		return 0, nil
+	}
+	return ipaddr.IP4ToUint32(addr) & (1<<n - 1), nil
+}
+
+// NodeBlock returns the block of index in the ipv4 subnet, split into the
+// blocks of blockPrefix
+func NodeBlock(subnet *net.IPNet, blockPrefix int, index uint32) (*net.IPNet, error) {
+	ones, bits := subnet.Mask.Size()
+	if subnet.IP.To4() == nil || bits != 32 || blockPrefix < ones || blockPrefix > 32 {
+		return nil, fmt.Errorf("invalid block prefix %d of subnet %v", blockPrefix, subnet)
+	}
+	if n := uint(blockPrefix - ones); n < 32 && uint64(index) >= uint64(1)<<n {
+		return nil, fmt.Errorf("node index %d out of the %d blocks /%d of %v", index, uint64(1)<<n, blockPrefix, subnet)
+	}
+	start := ipaddr.IP4ToUint32(subnet.IP.To4()) + index<<uint(32-blockPrefix)
+	return &net.IPNet{IP: ipaddr.Uint32ToIP4(start), Mask: net.CIDRMask(blockPrefix, 32)}, nil
+}
+
+// NodeRanges returns the range of node in r, its block clipped to the range,
+// split into the ranges of a power of 2 ips which a lease key holds
+func (c *NodeRangeConf) NodeRanges(node string, r *Range) ([]SimpleRange, error) {
+	subnet := (*net.IPNet)(&r.Subnet)
+	idx, err := c.NodeIndex(node, subnet)
+	if err != nil {
+		return nil, err
+	}
+	block, err := NodeBlock(subnet, c.BlockPrefix, idx)
+	if err != nil {
+		return nil, err
+	}
+	start := uint64(ipaddr.IP4ToUint32(block.IP))
+	end := start | uint64(^ipaddr.IP4ToUint32(net.IP(block.Mask)))
+	if s := uint64(ipaddr.IP4ToUint32(r.RangeStart.To4())); s > start {
+		start = s
+	}
+	if e := uint64(ipaddr.IP4ToUint32(r.RangeEnd.To4())); e < end {
+		end = e
+	}
+	if start > end {
+		return nil, fmt.Errorf("block %v of node %v is out of the range %v", block, node, r)
+	}
+	srs := []SimpleRange{}
+	for start <= end {
+		n := uint64(1) << uint(bits.Len64(end-start+1)-1)
+		srs = append(srs, SimpleRange{ipaddr.Uint32ToIP4(uint32(start)), ipaddr.Uint32ToIP4(uint32(start + n - 1))})
+		start += n
+	}
+	return srs, nil
+}
@@ -0,0 +1,85 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("node ranges", func() {
+	AfterEach(func() {
+		lookupIP = net.LookupIP
+	})
+
+	It("should derive disjoint blocks for the node indexes", func() {
+		sn := mustSubnet("10.244.0.0/16")
+		subnet := (*net.IPNet)(&sn)
+		blocks := []*net.IPNet{}
+		for _, idx := range []uint32{0, 1, 2, 5, 128, 255} {
+			block, err := NodeBlock(subnet, 24, idx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(block.String()).To(Equal(fmt.Sprintf("10.244.%d.0/24", idx)))
+			for _, b := range blocks {
+				Expect(b.Contains(block.IP) || block.Contains(b.IP)).To(BeFalse())
+			}
+			blocks = append(blocks, block)
+		}
+
+		_, err := NodeBlock(subnet, 24, 256)
+		Expect(err).To(MatchError("node index 256 out of the 256 blocks /24 of 10.244.0.0/16"))
+		_, err = NodeBlock(subnet, 15, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should index the nodes by nodeIndexes or their address", func() {
+		c := &NodeRangeConf{BlockPrefix: 24, NodeIndexes: map[string]uint32{"node-a": 7}}
+		sn := mustSubnet("10.244.0.0/16")
+		subnet := (*net.IPNet)(&sn)
+		lookupIP = func(host string) ([]net.IP, error) {
+			if host == "node-b" {
+				return []net.IP{net.ParseIP("fd00::9"), net.ParseIP("10.0.1.9")}, nil
+			}
+			return nil, fmt.Errorf("no such host")
+		}
+
+		idx, err := c.NodeIndex("node-a", subnet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idx).To(Equal(uint32(7)))
+		idx, err = c.NodeIndex("10.0.0.5", subnet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idx).To(Equal(uint32(5)))
+		idx, err = c.NodeIndex("node-b", subnet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idx).To(Equal(uint32(9)))
+		_, err = c.NodeIndex("node-c", subnet)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should clip the node ranges to the range and split them for the leases", func() {
+		c := &NodeRangeConf{BlockPrefix: 24}
+		r := Range{Subnet: mustSubnet("10.244.0.0/16")}
+		Expect(r.Canonicalize()).To(Succeed())
+
+		srs, err := c.NodeRanges("10.0.0.5", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srs).To(Equal([]SimpleRange{{net.IP{10, 244, 5, 0}, net.IP{10, 244, 5, 255}}}))
+
+		// the network address of the subnet is out of the first block
+		srs, err = c.NodeRanges("10.0.0.0", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srs[0]).To(Equal(SimpleRange{net.IP{10, 244, 0, 1}, net.IP{10, 244, 0, 128}}))
+		Expect(srs[len(srs)-1].RangeEnd).To(Equal(net.IP{10, 244, 0, 255}))
+		for i := 1; i < len(srs); i++ {
+			Expect(srs[i].RangeStart).To(Equal(ip.NextIP(srs[i-1].RangeEnd)))
+		}
+
+		// so is the broadcast address of the last one
+		srs, err = c.NodeRanges("10.0.0.255", &r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srs[len(srs)-1].RangeEnd).To(Equal(net.IP{10, 244, 255, 254}))
+	})
+})
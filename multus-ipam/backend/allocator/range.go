@@ -16,13 +16,12 @@ package allocator
 
 import (
 	"fmt"
-	"math"
+	"math/big"
 	"net"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/archichris/netools/ipaddr"
 	"github.com/intel/multus-cni/logging"
 )
 
@@ -37,6 +36,9 @@ func (r *Range) Canonicalize() error {
 	// a /32 or /31
 	ones, masklen := r.Subnet.Mask.Size()
 	if ones > masklen-2 {
+		if masklen == 32 && ones == 31 {
+			return fmt.Errorf("Network %s too small to allocate from, RFC 3021 point-to-point /31 is not supported", (*net.IPNet)(&r.Subnet).String())
+		}
 		return fmt.Errorf("Network %s too small to allocate from", (*net.IPNet)(&r.Subnet).String())
 	}
 
@@ -88,6 +90,21 @@ func (r *Range) Canonicalize() error {
 		r.RangeEnd = lastIP(r.Subnet)
 	}
 
+	// KeepOut: sub-ranges of the subnet which are never applied nor allocated
+	for i := range r.KeepOut {
+		k := &r.KeepOut[i]
+		if err := canonicalizeIP(&k.RangeStart); err != nil {
+			return err
+		}
+		if err := canonicalizeIP(&k.RangeEnd); err != nil {
+			return err
+		}
+		subnet := (*net.IPNet)(&r.Subnet)
+		if !subnet.Contains(k.RangeStart) || !subnet.Contains(k.RangeEnd) || ip.Cmp(k.RangeStart, k.RangeEnd) > 0 {
+			return fmt.Errorf("KeepOut %s-%s not in network %s", k.RangeStart.String(), k.RangeEnd.String(), subnet.String())
+		}
+	}
+
 	return nil
 }
 
@@ -140,6 +157,45 @@ func (r *Range) Overlaps(r1 *Range) bool {
 		r1.Contains(r.RangeEnd)
 }
 
+// holes returns the IPs of the range which are never allocated
+func (r *Range) holes() ipIntervalSet {
+	intervals := []ipInterval{}
+	if r.Gateway != nil {
+		intervals = append(intervals, ipInterval{r.Gateway, r.Gateway})
+	}
+	for _, rsv := range r.Reserves {
+		intervals = append(intervals, ipInterval{rsv, rsv})
+	}
+	for _, k := range r.KeepOut {
+		intervals = append(intervals, ipInterval{k.RangeStart, k.RangeEnd})
+	}
+	return newIPIntervalSet(intervals)
+}
+
+// Exclude keeps the ips of srs within the subnet of r out of it as keep-out
+// ranges, srs may span the range, the subnet or other families as they like.
+// r is canonicalized.
+func (r *Range) Exclude(srs []SimpleRange) {
+	first, last := NetToBigRange(r.Subnet)
+	v6 := r.Subnet.IP.To4() == nil
+	for _, sr := range srs {
+		if (sr.RangeStart.To4() == nil) != v6 {
+			continue
+		}
+		s, e := IPToBigInt(sr.RangeStart), IPToBigInt(sr.RangeEnd)
+		if e.Cmp(first) < 0 || s.Cmp(last) > 0 {
+			continue
+		}
+		if s.Cmp(first) < 0 {
+			s = first
+		}
+		if e.Cmp(last) > 0 {
+			e = last
+		}
+		r.KeepOut = append(r.KeepOut, SimpleRange{BigIntToIP(s, v6), BigIntToIP(e, v6)})
+	}
+}
+
 func (r *Range) String() string {
 	return fmt.Sprintf("%s-%s", r.RangeStart.String(), r.RangeEnd.String())
 }
@@ -188,7 +244,11 @@ func (r *SimpleRange) Contains(r1 *SimpleRange) bool {
 }
 
 func (r *SimpleRange) HostSize() uint32 {
-	return uint32(math.Log2(float64(ipaddr.IP4ToUint32(r.RangeEnd) - ipaddr.IP4ToUint32(r.RangeStart) + 1)))
+	n := new(big.Int).Sub(IPToBigInt(r.RangeEnd), IPToBigInt(r.RangeStart))
+	if n.Sign() < 0 {
+		return 0
+	}
+	return uint32(n.Add(n, big.NewInt(1)).BitLen() - 1)
 }
 
 func (r *SimpleRange) Canonicalize() error {
@@ -196,10 +256,11 @@ func (r *SimpleRange) Canonicalize() error {
 		return logging.Errorf("canonicalizeIP %v failed, %v", r.RangeStart, err)
 	}
 
-	tmp := ipaddr.Uint32AddSeg(ipaddr.IP4ToUint32(r.RangeStart), r.HostSize()) - 1
+	tmp := new(big.Int).Lsh(big.NewInt(1), uint(r.HostSize()))
+	tmp.Add(tmp, IPToBigInt(r.RangeStart)).Sub(tmp, big.NewInt(1))
 
-	if ipaddr.IP4ToUint32(r.RangeEnd) != tmp {
-		r.RangeEnd = ipaddr.Uint32ToIP4(tmp)
+	if IPToBigInt(r.RangeEnd).Cmp(tmp) != 0 {
+		r.RangeEnd = BigIntToIP(tmp, r.RangeStart.To4() == nil)
 	}
 
 	if err := canonicalizeIP(&r.RangeEnd); err != nil {
@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
 )
 
 // Contains returns true if any range in this set contains an IP
@@ -93,6 +95,52 @@ func (s *RangeSet) Canonicalize() error {
 	return nil
 }
 
+// CheckOverlaps returns an error naming the first two ranges of the set which
+// overlap, if any
+func (s *RangeSet) CheckOverlaps() error {
+	for i, r1 := range *s {
+		for _, r2 := range (*s)[i+1:] {
+			if r1.Overlaps(&r2) {
+				return fmt.Errorf("ranges %s and %s overlap", r1.String(), r2.String())
+			}
+		}
+	}
+	return nil
+}
+
+// Normalize returns the set with the overlapping ranges merged, e.g. the cache
+// ranges clipped into the same configured range, so that no ip is in two of
+// them. A merged range keeps the place and the other fields of the first one,
+// the ranges of different subnets never overlap.
+func (s *RangeSet) Normalize() RangeSet {
+	out := RangeSet{}
+	for _, r := range *s {
+		at := len(out)
+		for i := 0; i < len(out); {
+			if !out[i].Overlaps(&r) {
+				i++
+				continue
+			}
+			merged := out[i]
+			if ip.Cmp(r.RangeStart, merged.RangeStart) < 0 {
+				merged.RangeStart = r.RangeStart
+			}
+			if ip.Cmp(r.RangeEnd, merged.RangeEnd) > 0 {
+				merged.RangeEnd = r.RangeEnd
+			}
+			r = merged
+			if i < at {
+				at = i
+			}
+			out = append(out[:i], out[i+1:]...)
+			// the wider range may overlap the ones checked already
+			i = 0
+		}
+		out = append(out[:at], append(RangeSet{r}, out[at:]...)...)
+	}
+	return out
+}
+
 func (s *RangeSet) String() string {
 	out := []string{}
 	for _, r := range *s {
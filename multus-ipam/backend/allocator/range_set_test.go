@@ -67,4 +67,26 @@ var _ = Describe("range sets", func() {
 		Expect(p1.Overlaps(&p2)).To(BeTrue())
 		Expect(p2.Overlaps(&p1)).To(BeTrue())
 	})
+
+	It("should normalize overlapping ranges into a disjoint set", func() {
+		clipped := func(start, end byte) Range {
+			r := Range{Subnet: mustSubnet("192.168.0.0/24")}
+			Expect(r.Canonicalize()).To(Succeed())
+			r.RangeStart, r.RangeEnd = net.IP{192, 168, 0, start}, net.IP{192, 168, 0, end}
+			return r
+		}
+		p := RangeSet{
+			clipped(16, 31),
+			clipped(48, 63),
+			clipped(24, 39),
+			clipped(100, 110),
+			clipped(36, 50),
+			clipped(16, 31),
+		}
+		Expect(p.CheckOverlaps()).To(MatchError("ranges 192.168.0.16-192.168.0.31 and 192.168.0.24-192.168.0.39 overlap"))
+
+		n := p.Normalize()
+		Expect(n.String()).To(Equal("192.168.0.16-192.168.0.63,192.168.0.100-192.168.0.110"))
+		Expect(n.CheckOverlaps()).To(Succeed())
+	})
 })
@@ -99,7 +99,7 @@ var _ = Describe("IP ranges", func() {
 	It("Should reject a network that's too small", func() {
 		r := Range{Subnet: mustSubnet("192.0.2.0/31")}
 		err := r.Canonicalize()
-		Expect(err).Should(MatchError("Network 192.0.2.0/31 too small to allocate from"))
+		Expect(err).Should(MatchError("Network 192.0.2.0/31 too small to allocate from, RFC 3021 point-to-point /31 is not supported"))
 	})
 
 	It("should reject invalid RangeStart and RangeEnd specifications", func() {
@@ -121,6 +121,41 @@ var _ = Describe("IP ranges", func() {
 		Expect(err).Should(MatchError("RangeStart 192.0.2.50 not in network 192.0.2.0/24"))
 	})
 
+	It("should reject invalid KeepOut specifications", func() {
+		snstr := "192.0.2.0/24"
+		r := Range{Subnet: mustSubnet(snstr), KeepOut: []SimpleRange{{net.ParseIP("192.0.2.200"), net.ParseIP("192.0.3.10")}}}
+		err := r.Canonicalize()
+		Expect(err).Should(MatchError("KeepOut 192.0.2.200-192.0.3.10 not in network 192.0.2.0/24"))
+
+		r = Range{Subnet: mustSubnet(snstr), KeepOut: []SimpleRange{{net.ParseIP("192.0.2.50"), net.ParseIP("192.0.2.40")}}}
+		err = r.Canonicalize()
+		Expect(err).Should(MatchError("KeepOut 192.0.2.50-192.0.2.40 not in network 192.0.2.0/24"))
+	})
+
+	It("should keep the excluded ips within the subnet out", func() {
+		r := Range{Subnet: mustSubnet("192.0.2.0/24"), RangeStart: net.ParseIP("192.0.2.100")}
+		Expect(r.Canonicalize()).To(Succeed())
+		r.Exclude([]SimpleRange{
+			// across the start of the range
+			{net.ParseIP("192.0.2.90").To4(), net.ParseIP("192.0.2.110").To4()},
+			// across the end of the subnet
+			{net.ParseIP("192.0.2.250").To4(), net.ParseIP("192.0.3.10").To4()},
+			// out of the subnet or of another family
+			{net.ParseIP("192.0.4.1").To4(), net.ParseIP("192.0.4.9").To4()},
+			{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::9")},
+		})
+		Expect(r.KeepOut).To(Equal([]SimpleRange{
+			{net.IP{192, 0, 2, 90}, net.IP{192, 0, 2, 110}},
+			{net.IP{192, 0, 2, 250}, net.IP{192, 0, 2, 255}},
+		}))
+		Expect(r.holes().NextFree(net.IP{192, 0, 2, 100})).To(Equal(net.IP{192, 0, 2, 111}))
+
+		r6 := Range{Subnet: mustSubnet("2001:db8::/64")}
+		Expect(r6.Canonicalize()).To(Succeed())
+		r6.Exclude([]SimpleRange{{net.ParseIP("2001:db8::").To16(), net.ParseIP("2001:db8::ff").To16()}})
+		Expect(r6.KeepOut).To(Equal([]SimpleRange{{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ff")}}))
+	})
+
 	It("should parse all fields correctly", func() {
 		snstr := "192.0.2.0/24"
 		r := Range{
@@ -221,6 +256,33 @@ var _ = Describe("IP ranges", func() {
 			},
 			true),
 	)
+
+	It("should size and canonicalize ipv6 simple ranges", func() {
+		sr := SimpleRange{RangeStart: net.ParseIP("fd00::40"), RangeEnd: net.ParseIP("fd00::7f")}
+		Expect(sr.HostSize()).To(Equal(uint32(6)))
+		sr.RangeEnd = net.ParseIP("fd00::90")
+		Expect(sr.Canonicalize()).To(Succeed())
+		Expect(sr.RangeEnd).To(Equal(net.ParseIP("fd00::7f")))
+
+		sr = SimpleRange{RangeStart: net.ParseIP("fd00::"), RangeEnd: net.ParseIP("fd00::ffff:ffff:ffff:ffff")}
+		Expect(sr.HostSize()).To(Equal(uint32(64)))
+	})
+
+	It("should convert ips and subnets to integers and back", func() {
+		for _, s := range []string{"10.1.2.3", "fd00::1:2", "::ffff:ffff"} {
+			addr := net.ParseIP(s)
+			v6 := addr.To4() == nil
+			Expect(BigIntToIP(IPToBigInt(addr), v6).Equal(addr)).To(BeTrue())
+		}
+		Expect(BigIntToIP(IPToBigInt(net.ParseIP("fd00::1")), false)).To(BeNil())
+
+		first, last := NetToBigRange(mustSubnet("fd00::/64"))
+		Expect(BigIntToIP(first, true).String()).To(Equal("fd00::"))
+		Expect(BigIntToIP(last, true).String()).To(Equal("fd00::ffff:ffff:ffff:ffff"))
+		first, last = NetToBigRange(mustSubnet("10.0.0.0/24"))
+		Expect(BigIntToIP(first, false).String()).To(Equal("10.0.0.0"))
+		Expect(BigIntToIP(last, false).String()).To(Equal("10.0.0.255"))
+	})
 })
 
 func mustSubnet(s string) types.IPNet {
@@ -16,6 +16,7 @@ package disk
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"io/ioutil"
 
@@ -25,8 +26,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 	"github.com/intel/multus-cni/disk"
 	"github.com/intel/multus-cni/logging"
@@ -38,6 +43,11 @@ const LineBreak = "\r\n"
 
 var defaultDataDir = "/var/lib/cni/mulnets"
 var cacheName = "rangeset_cache"
+var poolName = "pool"
+var rootKeyDirName = "root_key_dir"
+var shardsName = "mutex_shards"
+var subnetsName = "subnets"
+var spareName = "spare_since"
 
 // Store is a simple disk-backed store that creates one file per IP
 // address in a given directory. The contents of the file are the container ID.
@@ -49,12 +59,19 @@ type Store struct {
 // Store implements the Store interface
 var _ backend.Store = &Store{}
 
+// ErrDataDirUnwritable is wrapped by the errors of New for a data dir which
+// can not be created or written, e.g. on a read-only root fs, so that it fails
+// at the store instead of at the caches and the leases later
+var ErrDataDirUnwritable = errors.New("data dir is not writable")
+
+// New returns the store of network under dataDir, the default one if empty,
+// creating its dir if needed
 func New(network, dataDir string) (*Store, error) {
 	if dataDir == "" {
 		dataDir = defaultDataDir
 	}
 	dir := filepath.Join(dataDir, network)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := checkWritable(dir); err != nil {
 		return nil, err
 	}
 
@@ -65,6 +82,23 @@ func New(network, dataDir string) (*Store, error) {
 	return &Store{lk, dir}, nil
 }
 
+// checkWritable creates dir if needed and writes a probe file into it, which
+// no lookup of the store reads as it is empty
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logging.Errorf("create data dir %v failed, %v", dir, err)
+		return fmt.Errorf("%w, create %v failed, %v", ErrDataDirUnwritable, dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".probe-")
+	if err != nil {
+		logging.Errorf("write data dir %v failed, %v", dir, err)
+		return fmt.Errorf("%w, write %v failed, %v", ErrDataDirUnwritable, dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
 func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
 	fname := GetEscapedPath(s.dataDir, ip.String())
 
@@ -107,6 +141,22 @@ func (s *Store) Release(ip net.IP) error {
 	return os.Remove(GetEscapedPath(s.dataDir, ip.String()))
 }
 
+// ReleaseByIP frees ip whichever container reserved it, telling if it was
+// reserved. The cache ranges are kept, the caller holds the lock.
+func (s *Store) ReleaseByIP(ip net.IP) (bool, error) {
+	if ip == nil {
+		return false, fmt.Errorf("ip to release is invalid")
+	}
+	err := s.Release(ip)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
 	found := false
 
@@ -118,7 +168,8 @@ func (s *Store) FindByKey(id string, ifname string, match string) (bool, error)
 		if err != nil {
 			return nil
 		}
-		if strings.TrimSpace(string(data)) == match {
+		// the ips are reserved on the interface suffixed by their range set
+		if strings.HasPrefix(strings.TrimSpace(string(data)), match) {
 			found = true
 		}
 		return nil
@@ -225,6 +276,11 @@ func (s *Store) Dir() string {
 func (s *Store) LoadCache() ([]allocator.SimpleRange, error) {
 	s.Lock()
 	defer s.Unlock()
+	return s.loadCache()
+}
+
+// loadCache reads the cache ranges, the caller holds the lock
+func (s *Store) loadCache() ([]allocator.SimpleRange, error) {
 	fname := GetEscapedPath(s.dataDir, cacheName)
 	result := []allocator.SimpleRange{}
 	_, err := os.Stat(fname)
@@ -248,7 +304,16 @@ func (s *Store) LoadCache() ([]allocator.SimpleRange, error) {
 		line = strings.TrimRight(line, "\n\r\t ")
 		pairIP := strings.Split(line, "-")
 		// logging.Debugf("load cache %v", pairIP)
-		result = append(result, allocator.SimpleRange{RangeStart: net.ParseIP(pairIP[0]), RangeEnd: net.ParseIP(pairIP[1])})
+		if len(pairIP) != 2 {
+			logging.Errorf("skip malformed cache line %q of %v", line, fname)
+			continue
+		}
+		sr := allocator.SimpleRange{RangeStart: net.ParseIP(pairIP[0]), RangeEnd: net.ParseIP(pairIP[1])}
+		if sr.RangeStart == nil || sr.RangeEnd == nil {
+			logging.Errorf("skip malformed cache line %q of %v", line, fname)
+			continue
+		}
+		result = append(result, sr)
 	}
 }
 
@@ -256,6 +321,11 @@ func (s *Store) FlashCache(srs []allocator.SimpleRange) error {
 	logging.Debugf("Going to flash cache %v", srs)
 	s.Lock()
 	defer s.Unlock()
+	return s.flashCache(srs)
+}
+
+// flashCache writes the cache ranges, the caller holds the lock
+func (s *Store) flashCache(srs []allocator.SimpleRange) error {
 	fname := GetEscapedPath(s.dataDir, cacheName)
 	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
@@ -273,20 +343,57 @@ func (s *Store) FlashCache(srs []allocator.SimpleRange) error {
 	return nil
 }
 
+// AppendCache appends sr to the cache, refusing the one overlapping a cache
+// range. A range cached already is not appended again, as the applies racing
+// on a node may cache the same range.
 func (s *Store) AppendCache(sr *allocator.SimpleRange) error {
 	logging.Debugf("Going to append cache %v", *sr)
-	caches, err := s.LoadCache()
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
 	if err != nil {
 		return err
 	}
 
 	for _, csr := range caches {
+		if csr.Match(sr) {
+			logging.Verbosef("%v is cached already", *sr)
+			return nil
+		}
 		if csr.Overlaps(sr) {
 			return logging.Errorf("%v over laps cache %v", *sr, csr)
 		}
 	}
 	caches = append(caches, *sr)
-	return s.FlashCache(caches)
+	return s.flashCache(caches)
+}
+
+// DedupCache removes the duplicates of the cache ranges, which the appends
+// racing before they were serialized may have left, telling how many
+func (s *Store) DedupCache() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return 0, err
+	}
+	uniq := []allocator.SimpleRange{}
+	for _, csr := range caches {
+		dup := false
+		for _, u := range uniq {
+			if u.Match(&csr) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			uniq = append(uniq, csr)
+		}
+	}
+	if len(uniq) == len(caches) {
+		return 0, nil
+	}
+	return len(caches) - len(uniq), s.flashCache(uniq)
 }
 
 func (s *Store) DeleteCache(sr *allocator.SimpleRange) error {
@@ -309,6 +416,271 @@ func (s *Store) DeleteCache(sr *allocator.SimpleRange) error {
 	return s.FlashCache(caches)
 }
 
+// UsedInRange returns the reserved ips in sr, the caller holds the lock
+func (s *Store) UsedInRange(sr *allocator.SimpleRange) int {
+	used := 0
+	for _, addr := range s.ReservedIPs() {
+		if ip.Cmp(addr, sr.RangeStart) >= 0 && ip.Cmp(addr, sr.RangeEnd) <= 0 {
+			used++
+		}
+	}
+	return used
+}
+
+// DeleteCacheIfUnused deletes the cache range sr unless an ip of it is
+// reserved, telling if it did. The count and the delete are done under the
+// lock a Get reserves its ip under, so the range is kept for the Get done
+// first, while the Get done later finds the range out of the cache.
+func (s *Store) DeleteCacheIfUnused(sr *allocator.SimpleRange) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.UsedInRange(sr) > 0 {
+		return false, nil
+	}
+	caches, err := s.loadCache()
+	if err != nil {
+		return false, err
+	}
+	for i, cr := range caches {
+		if cr.Match(sr) {
+			return true, s.flashCache(append(caches[:i], caches[i+1:]...))
+		}
+	}
+	return false, nil
+}
+
+// ReplaceCache replaces the cache ranges parts with sr, as the adjacent ranges
+// coalesced into one, telling if it did. Nothing is replaced unless all the
+// parts are cached.
+func (s *Store) ReplaceCache(parts []allocator.SimpleRange, sr *allocator.SimpleRange) (bool, error) {
+	logging.Debugf("Going to replace cache %v with %v", parts, *sr)
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return false, err
+	}
+	kept := []allocator.SimpleRange{}
+	for _, cr := range caches {
+		part := false
+		for i := range parts {
+			if cr.Match(&parts[i]) {
+				part = true
+				break
+			}
+		}
+		if !part {
+			kept = append(kept, cr)
+		}
+	}
+	if len(caches)-len(kept) != len(parts) {
+		return false, nil
+	}
+	return true, s.flashCache(append(kept, *sr))
+}
+
+// InCache tells if addr is in a cache range
+func (s *Store) InCache(addr net.IP) bool {
+	caches, err := s.LoadCache()
+	if err != nil {
+		return false
+	}
+	for _, cr := range caches {
+		if ip.Cmp(addr, cr.RangeStart) >= 0 && ip.Cmp(addr, cr.RangeEnd) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPool returns the pool the network applies its ranges from, "" if none
+func (s *Store) LoadPool() string {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, poolName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SavePool records the pool the network applies its ranges from, so that the
+// reconcile finds its leases without the network config
+func (s *Store) SavePool(pool string) error {
+	if s.LoadPool() == pool {
+		return nil
+	}
+	fname := GetEscapedPath(s.dataDir, poolName)
+	if pool == "" {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(fname, []byte(pool), 0644)
+}
+
+// LoadRootKeyDir returns the etcd root key dir the network config roots its
+// keys under, "" if it takes the root of the process
+func (s *Store) LoadRootKeyDir() string {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, rootKeyDirName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SaveRootKeyDir records the etcd root key dir of the network config, so that
+// the reconcile finds its leases under it
+func (s *Store) SaveRootKeyDir(dir string) error {
+	if s.LoadRootKeyDir() == dir {
+		return nil
+	}
+	fname := GetEscapedPath(s.dataDir, rootKeyDirName)
+	if dir == "" {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(fname, []byte(dir), 0644)
+}
+
+// LoadShards returns the mutex shards the network locks its lease dir in, 1 if
+// not sharded
+func (s *Store) LoadShards() int {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, shardsName))
+	if err != nil {
+		return 1
+	}
+	shards, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || shards < 1 {
+		return 1
+	}
+	return shards
+}
+
+// SaveShards records the mutex shards of the network config, so that the
+// reconcile locks its lease dir as the applies do
+func (s *Store) SaveShards(shards int) error {
+	if shards < 2 {
+		shards = 1
+	}
+	if s.LoadShards() == shards {
+		return nil
+	}
+	fname := GetEscapedPath(s.dataDir, shardsName)
+	if shards == 1 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(fname, []byte(strconv.Itoa(shards)), 0644)
+}
+
+// LoadSubnets returns the subnets the network was last configured with
+func (s *Store) LoadSubnets() []net.IPNet {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, subnetsName))
+	if err != nil {
+		return nil
+	}
+	subnets := []net.IPNet{}
+	for _, l := range strings.Fields(string(data)) {
+		if _, subnet, err := net.ParseCIDR(l); err == nil {
+			subnets = append(subnets, *subnet)
+		}
+	}
+	return subnets
+}
+
+// SaveSubnets records the subnets the network is configured with, so that the
+// reconcile finds the leases left out of them by a shrinking subnet
+func (s *Store) SaveSubnets(subnets []net.IPNet) error {
+	fname := GetEscapedPath(s.dataDir, subnetsName)
+	if len(subnets) == 0 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	lines := []string{}
+	for _, subnet := range subnets {
+		lines = append(lines, subnet.String())
+	}
+	data := strings.Join(lines, LineBreak)
+	if old, err := ioutil.ReadFile(fname); err == nil && string(old) == data {
+		return nil
+	}
+	return ioutil.WriteFile(fname, []byte(data), 0644)
+}
+
+// ReservedIPs returns the ips allocated on the network
+func (s *Store) ReservedIPs() []net.IP {
+	ips := []net.IP{}
+	files, _ := ioutil.ReadDir(s.dataDir)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if addr := net.ParseIP(file.Name()); addr != nil {
+			ips = append(ips, addr)
+		}
+	}
+	return ips
+}
+
+// RangeKey identifies a cached range in the files of the store
+func RangeKey(sr *allocator.SimpleRange) string {
+	start, end := sr.RangeStart, sr.RangeEnd
+	if start.To4() != nil {
+		start, end = start.To4(), end.To4()
+	}
+	return start.String() + "-" + end.String()
+}
+
+// LoadSpareSince returns since when the cached ranges have been found spare,
+// keyed by RangeKey
+func (s *Store) LoadSpareSince() map[string]time.Time {
+	since := map[string]time.Time{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, spareName))
+	if err != nil {
+		return since
+	}
+	for _, l := range strings.Split(string(data), LineBreak) {
+		v := strings.Fields(l)
+		if len(v) != 2 {
+			continue
+		}
+		t, err := strconv.ParseInt(v[1], 10, 64)
+		if err != nil {
+			logging.Errorf("skip malformed spare line %q of %v", l, s.dataDir)
+			continue
+		}
+		since[v[0]] = time.Unix(t, 0)
+	}
+	return since
+}
+
+// SaveSpareSince records since when the cached ranges have been found spare
+func (s *Store) SaveSpareSince(since map[string]time.Time) error {
+	fname := GetEscapedPath(s.dataDir, spareName)
+	if len(since) == 0 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	keys := []string{}
+	for k := range since {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s %d", k, since[k].Unix()))
+	}
+	return ioutil.WriteFile(fname, []byte(strings.Join(lines, LineBreak)), 0644)
+}
+
 func GetAllNet(d string) []string {
 	dir := d
 	if dir == "" {
@@ -330,12 +702,116 @@ func GetAllNet(d string) []string {
 	return networks
 }
 
+// Migrate copies the leases and the cache of every network from the data dir
+// from to the data dir to. Each network is copied under its lock into a temp
+// dir which is renamed in place once complete, so a network is either fully
+// migrated or not at all. The source is left untouched for the operator to
+// remove once the plugin is switched to the new data dir.
+func Migrate(from, to string) error {
+	if from == "" {
+		from = defaultDataDir
+	}
+	if to == "" {
+		to = defaultDataDir
+	}
+	if filepath.Clean(from) == filepath.Clean(to) {
+		return logging.Errorf("migrate %v to itself", from)
+	}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return logging.Errorf("create data dir %v failed, %v", to, err)
+	}
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		return logging.Errorf("read data dir %v failed, %v", from, err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			if err := migrateNet(file.Name(), from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateNet(network, from, to string) error {
+	dst := filepath.Join(to, network)
+	if files, _ := ioutil.ReadDir(dst); len(files) > 0 {
+		return logging.Errorf("network %v already exists in %v", network, to)
+	}
+
+	s, err := New(network, from)
+	if err != nil {
+		return logging.Errorf("open network %v in %v failed, %v", network, from, err)
+	}
+	defer s.Close()
+	s.Lock()
+	defer s.Unlock()
+
+	tmp, err := ioutil.TempDir(to, "."+network+".")
+	if err != nil {
+		return logging.Errorf("create temp dir in %v failed, %v", to, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return logging.Errorf("read %v failed, %v", s.dataDir, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.Contains(strings.ToLower(file.Name()), "lock") {
+			continue
+		}
+		if err := copyFile(filepath.Join(s.dataDir, file.Name()), filepath.Join(tmp, file.Name())); err != nil {
+			return logging.Errorf("copy %v of network %v failed, %v", file.Name(), network, err)
+		}
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return logging.Errorf("chmod %v failed, %v", tmp, err)
+	}
+	// an empty dst is left by a plugin run or a failed migration
+	os.Remove(dst)
+	if err := os.Rename(tmp, dst); err != nil {
+		return logging.Errorf("rename %v to %v failed, %v", tmp, dst, err)
+	}
+	logging.Verbosef("network %v migrated from %v to %v", network, from, to)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 // LoadRangeSetFromCache is used to load IP range set "startIP:endIP" from cache file
 // func (s *Store) LoadGW(id string, ifname string) []net.IP {
 // 	return s.GetByID(id, ifname)
 // }
 
 func LoadAllLeases(network string, d string) map[string]string {
+	return LoadLeasesOlderThan(network, d, 0)
+}
+
+// LoadLeasesOlderThan loads the ips reserved under d as LoadAllLeases does,
+// skipping those reserved in the last age by their mtime, as the container of
+// an add in flight may not be known to the runtime yet
+func LoadLeasesOlderThan(network string, d string, age time.Duration) map[string]string {
 	dataDir := d
 	if dataDir == "" {
 		dataDir = defaultDataDir
@@ -364,6 +840,10 @@ func LoadAllLeases(network string, d string) map[string]string {
 				continue
 			}
 			fulPath := filepath.Join(dir, file.Name())
+			if age > 0 && time.Since(file.ModTime()) < age {
+				logging.Debugf("file:%v is reserved in the last %v, skip it", fulPath, age)
+				continue
+			}
 			id := GetID(fulPath)
 			logging.Debugf("file:%v, id:%v", fulPath, id)
 			if id != "" {
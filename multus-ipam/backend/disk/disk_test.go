@@ -1,11 +1,17 @@
 package disk
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/intel/multus-cni/logging"
 	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
@@ -30,6 +36,26 @@ var _ = Describe("Disk", func() {
 		os.RemoveAll(filepath.Join(dataDir, network))
 	})
 
+	It("fail on a data dir which can not be created or written", func() {
+		// neither is writable by root either
+		_, err := New(network, "/proc")
+		Expect(errors.Is(err, ErrDataDirUnwritable)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("create /proc/testnet failed"))
+		_, err = New("self", "/proc")
+		Expect(errors.Is(err, ErrDataDirUnwritable)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("write /proc/self failed"))
+
+		// the probe is not left behind
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.Close()
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, network))
+		Expect(err).NotTo(HaveOccurred())
+		for _, f := range files {
+			Expect(f.Name()).NotTo(HavePrefix(".probe-"))
+		}
+	})
+
 	It("should return zero IP when gateway file does not exist", func() {
 		store, _ := New(network, dataDir)
 		gws := store.GetByID("gateway", "gateway")
@@ -117,4 +143,297 @@ var _ = Describe("Disk", func() {
 		ips = store.GetByID(id, "eth1")
 		Expect(len(ips)).To(Equal(0))
 	})
+
+	It("migrate data dir without losing leases and cache", func() {
+		from, to := filepath.Join(dataDir, "migratefrom"), filepath.Join(dataDir, "migrateto")
+		os.RemoveAll(from)
+		os.RemoveAll(to)
+		defer os.RemoveAll(from)
+		defer os.RemoveAll(to)
+
+		testNets := []string{"testnet1", "testnet2"}
+		srs := []allocator.SimpleRange{
+			{RangeStart: net.IPv4(10, 0, 101, 96).To4(), RangeEnd: net.IPv4(10, 0, 101, 111).To4()},
+			{RangeStart: net.IPv4(10, 0, 102, 96).To4(), RangeEnd: net.IPv4(10, 0, 102, 111).To4()},
+		}
+		for idx, tn := range testNets {
+			store, _ := New(tn, from)
+			store.AppendCache(&srs[idx])
+			curIP := srs[idx].RangeStart
+			for i := 0; i < 5; i++ {
+				store.Reserve(fmt.Sprintf("%s%d", tn, i), "eth0", curIP, "0")
+				curIP = ip.NextIP(curIP)
+			}
+			store.Close()
+		}
+		// left behind by a plugin run against the new data dir
+		os.MkdirAll(filepath.Join(to, "testnet2"), 0755)
+
+		Expect(Migrate(from, to)).To(Succeed())
+
+		Expect(GetAllNet(to)).To(ConsistOf(testNets))
+		oldLeases, newLeases := LoadAllLeases("", from), LoadAllLeases("", to)
+		Expect(len(newLeases)).To(Equal(10))
+		for file, id := range oldLeases {
+			rel, _ := filepath.Rel(from, file)
+			Expect(newLeases[filepath.Join(to, rel)]).To(Equal(id))
+		}
+		for idx, tn := range testNets {
+			store, _ := New(tn, to)
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].Match(&srs[idx])).To(BeTrue())
+			last, err := store.LastReservedIP("0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(last.String()).To(Equal(fmt.Sprintf("10.0.10%d.100", idx+1)))
+			store.Close()
+		}
+
+		// never overwrite a migrated network
+		Expect(Migrate(from, to)).NotTo(Succeed())
+	})
+
+	It("write the allocation as prometheus textfile", func() {
+		dir := filepath.Join(dataDir, "textfile")
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "multus-ipam.prom")
+
+		store, _ := New("testnet1", dir)
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.IPv4(10, 0, 101, 96).To4(), RangeEnd: net.IPv4(10, 0, 101, 111).To4()})
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.IPv4(10, 0, 101, 128).To4(), RangeEnd: net.IPv4(10, 0, 101, 143).To4()})
+		store.Reserve("id0", "eth0", net.IPv4(10, 0, 101, 96), "0")
+		store.Reserve("id1", "eth0", net.IPv4(10, 0, 101, 130), "0")
+		store.Reserve("id2", "eth0", net.IPv4(10, 0, 101, 131), "0")
+		store.UpdateStats(func(st *Stats) {
+			st.Allocations, st.Applies, st.PeakUsed = 3, 2, 3
+		})
+		store.Close()
+		store, _ = New("testnet2", dir)
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.IPv4(10, 0, 102, 96).To4(), RangeEnd: net.IPv4(10, 0, 102, 103).To4()})
+		store.Close()
+
+		Expect(WriteTextfile(path, dir)).To(Succeed())
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`# HELP multus_ipam_leased_ips IPs allocated to containers on this node.
+# TYPE multus_ipam_leased_ips gauge
+multus_ipam_leased_ips{network="testnet1"} 3
+multus_ipam_leased_ips{network="testnet2"} 0
+# HELP multus_ipam_free_ips IPs not allocated yet in the ranges owned by this node.
+# TYPE multus_ipam_free_ips gauge
+multus_ipam_free_ips{network="testnet1"} 29
+multus_ipam_free_ips{network="testnet2"} 8
+# HELP multus_ipam_range_ips IPs in the ranges owned by this node.
+# TYPE multus_ipam_range_ips gauge
+multus_ipam_range_ips{network="testnet1"} 32
+multus_ipam_range_ips{network="testnet2"} 8
+# HELP multus_ipam_ranges IP ranges owned by this node.
+# TYPE multus_ipam_ranges gauge
+multus_ipam_ranges{network="testnet1"} 2
+multus_ipam_ranges{network="testnet2"} 1
+# HELP multus_ipam_allocations_total IPs allocated to containers on this node.
+# TYPE multus_ipam_allocations_total counter
+multus_ipam_allocations_total{network="testnet1"} 3
+multus_ipam_allocations_total{network="testnet2"} 0
+# HELP multus_ipam_releases_total IPs released by containers on this node.
+# TYPE multus_ipam_releases_total counter
+multus_ipam_releases_total{network="testnet1"} 0
+multus_ipam_releases_total{network="testnet2"} 0
+# HELP multus_ipam_applies_total IP ranges applied from etcd by this node.
+# TYPE multus_ipam_applies_total counter
+multus_ipam_applies_total{network="testnet1"} 2
+multus_ipam_applies_total{network="testnet2"} 0
+# HELP multus_ipam_peak_leased_ips The most IPs allocated to containers at once on this node.
+# TYPE multus_ipam_peak_leased_ips gauge
+multus_ipam_peak_leased_ips{network="testnet1"} 3
+multus_ipam_peak_leased_ips{network="testnet2"} 0
+`))
+		sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"\})? [0-9]+$`)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				Expect(sample.MatchString(line)).To(BeTrue(), line)
+			}
+		}
+
+		store, _ = New("testnet1", dir)
+		store.ReleaseByID("id1", "eth0")
+		store.Close()
+		Expect(WriteTextfile(path, dir)).To(Succeed())
+		data, _ = ioutil.ReadFile(path)
+		Expect(string(data)).To(ContainSubstring(`multus_ipam_leased_ips{network="testnet1"} 2`))
+		Expect(string(data)).To(ContainSubstring(`multus_ipam_free_ips{network="testnet1"} 30`))
+		files, _ := ioutil.ReadDir(dir)
+		Expect(len(files)).To(Equal(3))
+	})
+
+	It("skip the malformed lines of cache", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		cache := "192.168.56.32-192.168.56.47\nbad-192.168.56.63\n192.168.56.64\n192.168.56.80-\n\n192.168.56.96-192.168.56.111\n"
+		ioutil.WriteFile(filepath.Join(dataDir, network, cacheName), []byte(cache), 0644)
+		caches, err := store.LoadCache()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(caches)).To(Equal(2))
+		Expect(caches[0].RangeStart.String()).To(Equal("192.168.56.32"))
+		Expect(caches[1].RangeEnd.String()).To(Equal("192.168.56.111"))
+	})
+
+	It("delete the cache range only once no ip of it is used", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		used := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+		empty := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}
+		Expect(store.FlashCache([]allocator.SimpleRange{used, empty})).To(Succeed())
+		store.Reserve("id", "eth0", net.ParseIP("192.168.56.40"), "0")
+
+		deleted, err := store.DeleteCacheIfUnused(&used)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeFalse())
+		deleted, err = store.DeleteCacheIfUnused(&empty)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeTrue())
+
+		Expect(store.InCache(net.ParseIP("192.168.56.40"))).To(BeTrue())
+		Expect(store.InCache(net.ParseIP("192.168.56.50"))).To(BeFalse())
+	})
+
+	It("load the leases older than the age only", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		store.Reserve("young", "eth0", net.ParseIP("192.168.56.33"), "0")
+		store.Reserve("old", "eth0", net.ParseIP("192.168.56.34"), "0")
+		t := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(filepath.Join(store.Dir(), "192.168.56.34"), t, t)).To(Succeed())
+
+		Expect(LoadAllLeases(network, dataDir)).To(HaveLen(2))
+		leases := LoadLeasesOlderThan(network, dataDir, time.Minute)
+		Expect(leases).To(HaveLen(1))
+		Expect(leases[filepath.Join(store.Dir(), "192.168.56.34")]).To(Equal("old"))
+		Expect(LoadLeasesOlderThan(network, dataDir, 2*time.Hour)).To(BeEmpty())
+	})
+
+	It("release one ip leaving the other ips and the cache range", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		sr := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+		Expect(store.FlashCache([]allocator.SimpleRange{sr})).To(Succeed())
+		store.Reserve("id1", "eth0", net.ParseIP("192.168.56.33"), "0")
+		store.Reserve("id2", "eth0", net.ParseIP("192.168.56.34"), "0")
+
+		released, err := store.ReleaseByIP(net.ParseIP("192.168.56.33"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeTrue())
+		Expect(store.GetByID("id1", "eth0")).To(BeEmpty())
+		Expect(store.GetByID("id2", "eth0")).To(HaveLen(1))
+		Expect(store.UsedInRange(&sr)).To(Equal(1))
+		caches, err := store.LoadCache()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caches).To(HaveLen(1))
+		Expect(caches[0].Match(&sr)).To(BeTrue())
+
+		released, err = store.ReleaseByIP(net.ParseIP("192.168.56.33"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeFalse())
+	})
+
+	It("track the drained ranges until idle for the allocations", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		used := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+		idle := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}
+		reused := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.64").To4(), RangeEnd: net.ParseIP("192.168.56.79").To4()}
+		Expect(store.FlashCache([]allocator.SimpleRange{used, idle, reused})).To(Succeed())
+		store.Reserve("id", "eth0", net.ParseIP("192.168.56.40"), "0")
+
+		for _, sr := range []allocator.SimpleRange{used, idle, reused} {
+			marked, err := store.MarkDrained(&sr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(marked).To(Equal(!sr.Match(&used)))
+		}
+		Expect(len(store.LoadDrained())).To(Equal(2))
+
+		// an allocation out of a drained range takes it back
+		ranges, err := store.IdleDrained([]net.IP{net.ParseIP("192.168.56.70")}, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(ranges)).To(Equal(0))
+		drained := store.LoadDrained()
+		Expect(len(drained)).To(Equal(1))
+		Expect(drained[0].Match(&idle)).To(BeTrue())
+		Expect(drained[0].Idle).To(Equal(1))
+
+		ranges, err = store.IdleDrained([]net.IP{net.ParseIP("192.168.56.41")}, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(ranges)).To(Equal(1))
+		Expect(ranges[0].Match(&idle)).To(BeTrue())
+		Expect(len(store.LoadDrained())).To(Equal(0))
+	})
+
+	It("replace the cache ranges coalesced only if all of them are cached", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		a := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+		b := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}
+		other := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.96").To4(), RangeEnd: net.ParseIP("192.168.56.111").To4()}
+		merged := allocator.SimpleRange{RangeStart: a.RangeStart, RangeEnd: b.RangeEnd}
+		Expect(store.FlashCache([]allocator.SimpleRange{a, other})).To(Succeed())
+
+		replaced, err := store.ReplaceCache([]allocator.SimpleRange{a, b}, &merged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replaced).To(BeFalse())
+
+		Expect(store.AppendCache(&b)).To(Succeed())
+		replaced, err = store.ReplaceCache([]allocator.SimpleRange{a, b}, &merged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replaced).To(BeTrue())
+		caches, err := store.LoadCache()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(caches)).To(Equal(2))
+		Expect(caches[0].Match(&other)).To(BeTrue())
+		Expect(caches[1].Match(&merged)).To(BeTrue())
+	})
+
+	It("record the results of the adds until deleted", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+		r := Result{
+			DNS:    types.DNS{Nameservers: []string{"10.1.1.1"}},
+			Routes: []*types.Route{{Dst: *dst}},
+		}
+		_, ok := store.LoadResult("id", "eth0")
+		Expect(ok).To(BeFalse())
+		Expect(store.SaveResult("id", "eth0", r)).To(Succeed())
+		Expect(store.SaveResult("id", "eth1", Result{})).To(Succeed())
+
+		got, ok := store.LoadResult("id", "eth0")
+		Expect(ok).To(BeTrue())
+		Expect(got.DNS.Nameservers).To(Equal(r.DNS.Nameservers))
+		Expect(len(got.Routes)).To(Equal(1))
+		Expect(got.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+
+		Expect(store.DeleteResult("id", "eth0")).To(Succeed())
+		_, ok = store.LoadResult("id", "eth0")
+		Expect(ok).To(BeFalse())
+		_, ok = store.LoadResult("id", "eth1")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("count the allocations each cache range went idle for", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		a := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+		b := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}
+		Expect(store.FlashCache([]allocator.SimpleRange{a, b})).To(Succeed())
+
+		Expect(store.TouchRanges([]net.IP{net.ParseIP("192.168.56.40")})).To(Succeed())
+		Expect(store.TouchRanges([]net.IP{net.ParseIP("192.168.56.41")})).To(Succeed())
+		Expect(store.LoadIdle()).To(Equal(map[string]int{RangeKey(&a): 0, RangeKey(&b): 2}))
+
+		// the ranges out of the cache are no longer tracked
+		Expect(store.FlashCache([]allocator.SimpleRange{b})).To(Succeed())
+		Expect(store.TouchRanges([]net.IP{net.ParseIP("192.168.56.50")})).To(Succeed())
+		Expect(store.LoadIdle()).To(Equal(map[string]int{RangeKey(&b): 0}))
+	})
 })
@@ -0,0 +1,119 @@
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+var drainedName = "drained"
+
+// DrainedRange is a cache range of which no ip is reserved, with the
+// allocations done out of it since it drained
+type DrainedRange struct {
+	allocator.SimpleRange
+	Idle int `json:"idle"`
+}
+
+// loadDrained returns the drained ranges, the caller holds the lock
+func (s *Store) loadDrained() []DrainedRange {
+	drained := []DrainedRange{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, drainedName))
+	if err != nil {
+		return drained
+	}
+	if err := json.Unmarshal(data, &drained); err != nil {
+		return []DrainedRange{}
+	}
+	return drained
+}
+
+// saveDrained writes the drained ranges, the caller holds the lock
+func (s *Store) saveDrained(drained []DrainedRange) error {
+	data, err := json.Marshal(drained)
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, drainedName)
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// LoadDrained returns the drained ranges tracked
+func (s *Store) LoadDrained() []DrainedRange {
+	s.Lock()
+	defer s.Unlock()
+	return s.loadDrained()
+}
+
+// MarkDrained tracks the cache range sr as drained unless an ip of it is
+// reserved, telling if it did
+func (s *Store) MarkDrained(sr *allocator.SimpleRange) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.UsedInRange(sr) > 0 {
+		return false, nil
+	}
+	drained := s.loadDrained()
+	for i := range drained {
+		if drained[i].Match(sr) {
+			drained[i].Idle = 0
+			return true, s.saveDrained(drained)
+		}
+	}
+	return true, s.saveDrained(append(drained, DrainedRange{SimpleRange: *sr}))
+}
+
+// IdleDrained counts an allocation of ips for the drained ranges. The ranges
+// holding one of ips are used again and no longer tracked, as the ranges out
+// of the cache. It returns the ranges idle for n allocations or more, which
+// are no longer tracked either, for the caller to return.
+func (s *Store) IdleDrained(ips []net.IP, n int) ([]allocator.SimpleRange, error) {
+	s.Lock()
+	defer s.Unlock()
+	drained := s.loadDrained()
+	if len(drained) == 0 {
+		return nil, nil
+	}
+	caches, err := s.loadCache()
+	if err != nil {
+		return nil, err
+	}
+	kept, idle := []DrainedRange{}, []allocator.SimpleRange{}
+	for _, d := range drained {
+		if !drainedCached(&d.SimpleRange, caches) || drainedUsed(&d.SimpleRange, ips) {
+			continue
+		}
+		if d.Idle++; d.Idle >= n {
+			idle = append(idle, d.SimpleRange)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return idle, s.saveDrained(kept)
+}
+
+func drainedCached(sr *allocator.SimpleRange, caches []allocator.SimpleRange) bool {
+	for _, cr := range caches {
+		if cr.Match(sr) {
+			return true
+		}
+	}
+	return false
+}
+
+func drainedUsed(sr *allocator.SimpleRange, ips []net.IP) bool {
+	for _, addr := range ips {
+		if ip.Cmp(addr, sr.RangeStart) >= 0 && ip.Cmp(addr, sr.RangeEnd) <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var exhaustedName = "exhausted"
+
+// loadExhausted returns when the ranges were found exhausted, by their keys
+func (s *Store) loadExhausted() map[string]time.Time {
+	m := map[string]time.Time{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, exhaustedName))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return map[string]time.Time{}
+	}
+	return m
+}
+
+// ExhaustedAt returns when etcd had no free range left in the range of key
+// last, zero if it had
+func (s *Store) ExhaustedAt(key string) time.Time {
+	return s.loadExhausted()[key]
+}
+
+// SetExhausted records that etcd had no free range left in the range of key
+// at t, a zero t clears it
+func (s *Store) SetExhausted(key string, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	m := s.loadExhausted()
+	if t.IsZero() {
+		if _, ok := m[key]; !ok {
+			return nil
+		}
+		delete(m, key)
+	} else {
+		m[key] = t
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, exhaustedName)
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
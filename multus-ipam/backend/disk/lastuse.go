@@ -0,0 +1,64 @@
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+var lastUseName = "lastuse"
+
+// loadIdle returns the allocations each cache range went without being
+// allocated from, by RangeKey, the caller holds the lock
+func (s *Store) loadIdle() map[string]int {
+	m := map[string]int{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, lastUseName))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return map[string]int{}
+	}
+	return m
+}
+
+// LoadIdle returns the allocations each cache range went without being
+// allocated from since its last use, by RangeKey. The ranges cached before the
+// tracking started are missing, as if used right before.
+func (s *Store) LoadIdle() map[string]int {
+	s.Lock()
+	defer s.Unlock()
+	return s.loadIdle()
+}
+
+// TouchRanges counts an allocation of ips for the cache ranges, the ranges
+// holding one of ips are used by it and the others idle for one more
+func (s *Store) TouchRanges(ips []net.IP) error {
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return err
+	}
+	old := s.loadIdle()
+	m := map[string]int{}
+	for i := range caches {
+		k := RangeKey(&caches[i])
+		if drainedUsed(&caches[i], ips) {
+			m[k] = 0
+		} else {
+			m[k] = old[k] + 1
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, lastUseName)
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
@@ -0,0 +1,79 @@
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+var resultsName = "results"
+
+// Result is the part of the result of an ADD a CHECK verifies besides the ips,
+// which the configuration may change after the ADD
+type Result struct {
+	DNS    types.DNS      `json:"dns,omitempty"`
+	Routes []*types.Route `json:"routes,omitempty"`
+}
+
+// resultKey returns the key of the result of the ADD of id on ifname
+func resultKey(id, ifname string) string {
+	return strings.TrimSpace(id) + "/" + ifname
+}
+
+// loadResults returns the results recorded, by their keys
+func (s *Store) loadResults() map[string]Result {
+	m := map[string]Result{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, resultsName))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return map[string]Result{}
+	}
+	return m
+}
+
+// saveResults writes the results by a rename, the caller holds the lock
+func (s *Store) saveResults(m map[string]Result) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, resultsName)
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// LoadResult returns the result recorded for the ADD of id on ifname, false if
+// there is none, e.g. of an ADD before the results were recorded
+func (s *Store) LoadResult(id, ifname string) (Result, bool) {
+	r, ok := s.loadResults()[resultKey(id, ifname)]
+	return r, ok
+}
+
+// SaveResult records the result of the ADD of id on ifname
+func (s *Store) SaveResult(id, ifname string, r Result) error {
+	s.Lock()
+	defer s.Unlock()
+	m := s.loadResults()
+	m[resultKey(id, ifname)] = r
+	return s.saveResults(m)
+}
+
+// DeleteResult removes the result recorded for the ADD of id on ifname
+func (s *Store) DeleteResult(id, ifname string) error {
+	s.Lock()
+	defer s.Unlock()
+	m := s.loadResults()
+	if _, ok := m[resultKey(id, ifname)]; !ok {
+		return nil
+	}
+	delete(m, resultKey(id, ifname))
+	return s.saveResults(m)
+}
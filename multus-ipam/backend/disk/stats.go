@@ -0,0 +1,55 @@
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/intel/multus-cni/logging"
+)
+
+var statsName = "stats"
+
+// Stats are the cumulative allocation counters of a network on this node, kept
+// in the data dir across the calls and the restarts of the plugin, unlike the
+// point-in-time Usage
+type Stats struct {
+	Allocations uint64 `json:"allocations"` // IPs allocated to containers
+	Releases    uint64 `json:"releases"`    // IPs released by containers
+	Applies     uint64 `json:"applies"`     // ranges applied from etcd
+	PeakUsed    uint64 `json:"peakUsed"`    // the most IPs allocated at once
+}
+
+// LoadStats returns the counters of the network, zero if there are none yet
+func (s *Store) LoadStats() Stats {
+	st := Stats{}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, statsName))
+	if err != nil {
+		return st
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		logging.Errorf("reset corrupted stats of %v, %v", s.dataDir, err)
+		return Stats{}
+	}
+	return st
+}
+
+// UpdateStats runs f on the counters of the network under the lock of the
+// store, saving them by a rename so that a crash never leaves them half
+// written
+func (s *Store) UpdateStats(f func(st *Stats)) error {
+	s.Lock()
+	defer s.Unlock()
+	st := s.LoadStats()
+	f(&st)
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, statsName)
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
@@ -0,0 +1,136 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/archichris/netools/ipaddr"
+	"github.com/intel/multus-cni/logging"
+)
+
+// Usage is the allocation state of a network on this node
+type Usage struct {
+	Ranges int    // ranges owned by this node
+	Size   uint64 // IPs in the owned ranges
+	Used   uint64 // IPs allocated to containers
+	Free   uint64 // IPs in the owned ranges not allocated yet
+}
+
+// Usage counts the allocation of the network from the cache and the leases
+func (s *Store) Usage() (*Usage, error) {
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Ranges: len(caches)}
+	for _, c := range caches {
+		u.Size += uint64(ipaddr.IP4ToUint32(c.RangeEnd)) - uint64(ipaddr.IP4ToUint32(c.RangeStart)) + 1
+	}
+	inRange := uint64(0)
+	for _, file := range files {
+		addr := net.ParseIP(file.Name())
+		if file.IsDir() || addr == nil {
+			continue
+		}
+		u.Used++
+		n := ipaddr.IP4ToUint32(addr)
+		for _, c := range caches {
+			if n >= ipaddr.IP4ToUint32(c.RangeStart) && n <= ipaddr.IP4ToUint32(c.RangeEnd) {
+				inRange++
+				break
+			}
+		}
+	}
+	u.Free = u.Size - inRange
+	return u, nil
+}
+
+var textfileMetrics = []struct {
+	name string
+	help string
+	get  func(u *Usage) uint64
+}{
+	{"multus_ipam_leased_ips", "IPs allocated to containers on this node.", func(u *Usage) uint64 { return u.Used }},
+	{"multus_ipam_free_ips", "IPs not allocated yet in the ranges owned by this node.", func(u *Usage) uint64 { return u.Free }},
+	{"multus_ipam_range_ips", "IPs in the ranges owned by this node.", func(u *Usage) uint64 { return u.Size }},
+	{"multus_ipam_ranges", "IP ranges owned by this node.", func(u *Usage) uint64 { return uint64(u.Ranges) }},
+}
+
+var statsMetrics = []struct {
+	name string
+	typ  string
+	help string
+	get  func(st *Stats) uint64
+}{
+	{"multus_ipam_allocations_total", "counter", "IPs allocated to containers on this node.", func(st *Stats) uint64 { return st.Allocations }},
+	{"multus_ipam_releases_total", "counter", "IPs released by containers on this node.", func(st *Stats) uint64 { return st.Releases }},
+	{"multus_ipam_applies_total", "counter", "IP ranges applied from etcd by this node.", func(st *Stats) uint64 { return st.Applies }},
+	{"multus_ipam_peak_leased_ips", "gauge", "The most IPs allocated to containers at once on this node.", func(st *Stats) uint64 { return st.PeakUsed }},
+}
+
+// WriteTextfile writes the allocation of all networks in the data dir to path
+// in the Prometheus text format, for the textfile collector of node_exporter.
+// The file is replaced atomically so that a scrape never reads it half written.
+func WriteTextfile(path, dataDir string) error {
+	networks := GetAllNet(dataDir)
+	sort.Strings(networks)
+	usages := map[string]*Usage{}
+	stats := map[string]Stats{}
+	for _, n := range networks {
+		s, err := New(n, dataDir)
+		if err != nil {
+			return logging.Errorf("open network %v failed, %v", n, err)
+		}
+		u, err := s.Usage()
+		stats[n] = s.LoadStats()
+		s.Close()
+		if err != nil {
+			return logging.Errorf("count usage of network %v failed, %v", n, err)
+		}
+		usages[n] = u
+	}
+
+	var buf bytes.Buffer
+	for _, m := range textfileMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, n := range networks {
+			fmt.Fprintf(&buf, "%s{network=%q} %d\n", m.name, n, m.get(usages[n]))
+		}
+	}
+	for _, m := range statsMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, n := range networks {
+			st := stats[n]
+			fmt.Fprintf(&buf, "%s{network=%q} %d\n", m.name, n, m.get(&st))
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return logging.Errorf("create temp file for %v failed, %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return logging.Errorf("write %v failed, %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return logging.Errorf("close %v failed, %v", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return logging.Errorf("chmod %v failed, %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return logging.Errorf("rename %v to %v failed, %v", tmp.Name(), path, err)
+	}
+	return nil
+}
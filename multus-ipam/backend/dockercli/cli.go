@@ -3,45 +3,56 @@ package dockercli
 import (
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
 	"github.com/intel/multus-cni/logging"
 	"github.com/intel/multus-cni/multus-ipam/backend/disk"
-	"golang.org/x/net/context"
 )
 
-func IPAMCheckLocalIPs(dir string) error {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+// LeaseGrace is how long an ip is kept after it is reserved, whether its
+// container is known to the runtime or not, as it may still be created
+var LeaseGrace = 2 * time.Minute
+
+// IPAMCheckLocalIPs releases the ips under dir of the containers gone from the
+// runtime selected by CONTAINER_RUNTIME, see NewRuntime, telling how many
+func IPAMCheckLocalIPs(dir string) (int, error) {
+	rt, err := NewRuntime()
 	if err != nil {
-		return logging.Errorf("create docker cli failed, %v", err)
+		return 0, err
 	}
-	leases := disk.LoadAllLeases("", dir)
+	defer rt.Close()
+	return CheckLocalIPs(rt, dir)
+}
+
+// CheckLocalIPs releases the ips under dir of the containers gone from rt,
+// telling how many. The ips reserved in the last LeaseGrace are kept.
+func CheckLocalIPs(rt Runtime, dir string) (int, error) {
+	released := 0
+	leases := disk.LoadLeasesOlderThan("", dir, LeaseGrace)
 	for f, id := range leases {
 		if id == "gateway" {
 			continue
 		}
-		containers, err := cli.ContainerList(context.Background(),
-			types.ContainerListOptions{Filters: filters.NewArgs(filters.KeyValuePair{"id", id})})
+		exists, err := rt.ContainerExists(id)
 		if err != nil {
 			logging.Debugf("list container %v failed, %v", id, err)
 			continue
 		}
-		if len(containers) == 0 {
+		if !exists {
 			network := filepath.Base(filepath.Dir(f))
-			s, err := disk.New(network, "")
+			s, err := disk.New(network, dir)
 			if err != nil {
 				logging.Debugf("create disk manager failed, %v", err)
 				continue
 			}
 			s.Lock()
 			curID := disk.GetID(f)
-			if curID == id {
-				os.Remove(f)
+			if curID == id && os.Remove(f) == nil {
+				released++
 			}
 			s.Unlock()
+			s.Close()
 		}
 	}
-	return nil
+	return released, nil
 }
@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/intel/multus-cni/logging"
@@ -36,6 +37,7 @@ var _ = Describe("Cli", func() {
 		curIP := ip.NextIP(startIP)
 		for i := 0; i < 5; i++ {
 			store.Reserve(fmt.Sprintf(idTmp, i), ifname, curIP, "0")
+			backdate(store, curIP)
 			curIP = ip.NextIP(curIP)
 		}
 		store.AppendCache(&allocator.SimpleRange{startIP, curIP})
@@ -50,4 +52,81 @@ var _ = Describe("Cli", func() {
 		Expect(leases[gw]).To(Equal("gateway"))
 	})
 
+	It("release the ips of the containers gone from the runtime only", func() {
+		store, _ := disk.New(network, dataDir)
+		defer store.Close()
+		alive, gone := net.IPv4(192, 168, 200, 101), net.IPv4(192, 168, 200, 102)
+		store.Reserve("alive", "eth0", alive, "0")
+		store.Reserve("gone", "eth0", gone, "0")
+		store.Reserve("unknown", "eth0", net.IPv4(192, 168, 200, 103), "0")
+		store.AppendCache(&allocator.SimpleRange{alive, net.IPv4(192, 168, 200, 103)})
+		backdate(store, alive, gone, net.IPv4(192, 168, 200, 103))
+
+		rt := &fakeRuntime{containers: map[string]bool{"alive": true, "gone": false}}
+		released, err := CheckLocalIPs(rt, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(1))
+		leases := disk.LoadAllLeases(network, dataDir)
+		Expect(len(leases)).To(Equal(2))
+		Expect(leases[filepath.Join(store.Dir(), alive.String())]).To(Equal("alive"))
+		// the ips of the containers failing to be checked are kept
+		Expect(leases[filepath.Join(store.Dir(), "192.168.200.103")]).To(Equal("unknown"))
+	})
+
+	It("keep the ips reserved within the grace period", func() {
+		store, _ := disk.New(network, dataDir)
+		defer store.Close()
+		young, old := net.IPv4(192, 168, 200, 101), net.IPv4(192, 168, 200, 102)
+		store.Reserve("young", "eth0", young, "0")
+		store.Reserve("old", "eth0", old, "0")
+		backdate(store, old)
+		Expect(disk.LoadLeasesOlderThan(network, dataDir, LeaseGrace)).To(HaveLen(1))
+
+		rt := &fakeRuntime{containers: map[string]bool{"young": false, "old": false}}
+		released, err := CheckLocalIPs(rt, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(1))
+		leases := disk.LoadAllLeases(network, dataDir)
+		Expect(leases).To(HaveLen(1))
+		Expect(leases[filepath.Join(store.Dir(), young.String())]).To(Equal("young"))
+
+		defer func(grace time.Duration) { LeaseGrace = grace }(LeaseGrace)
+		LeaseGrace = 0
+		released, err = CheckLocalIPs(rt, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(1))
+		Expect(disk.LoadAllLeases(network, dataDir)).To(BeEmpty())
+	})
+
+	It("reject an unknown container runtime", func() {
+		os.Setenv("CONTAINER_RUNTIME", "rkt")
+		defer os.Unsetenv("CONTAINER_RUNTIME")
+		_, err := NewRuntime()
+		Expect(err).To(MatchError("invalid container runtime rkt, it shall be docker, containerd or crio"))
+	})
 })
+
+// fakeRuntime knows the containers alive, it fails to check the others
+type fakeRuntime struct {
+	containers map[string]bool
+}
+
+func (r *fakeRuntime) ContainerExists(id string) (bool, error) {
+	exists, ok := r.containers[id]
+	if !ok {
+		return false, fmt.Errorf("container %v unknown", id)
+	}
+	return exists, nil
+}
+
+func (r *fakeRuntime) Close() error {
+	return nil
+}
+
+// backdate makes the ips of store reserved before the grace period
+func backdate(store *disk.Store, ips ...net.IP) {
+	t := time.Now().Add(-2 * LeaseGrace)
+	for _, addr := range ips {
+		Expect(os.Chtimes(filepath.Join(store.Dir(), addr.String()), t, t)).To(Succeed())
+	}
+}
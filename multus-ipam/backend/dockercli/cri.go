@@ -0,0 +1,48 @@
+package dockercli
+
+import (
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	"k8s.io/kubernetes/pkg/kubelet/util"
+)
+
+// criTimeout bounds the connection to the cri socket and each request
+const criTimeout = 10 * time.Second
+
+// criRuntime checks the pod sandboxes with the cri of containerd or cri-o
+type criRuntime struct {
+	conn *grpc.ClientConn
+	cli  runtimeapi.RuntimeServiceClient
+}
+
+func newCRIRuntime(endpoint string) (Runtime, error) {
+	addr, dialer, err := util.GetAddressAndDialer(endpoint)
+	if err != nil {
+		return nil, logging.Errorf("parse cri endpoint %v failed, %v", endpoint, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithDialer(dialer))
+	if err != nil {
+		return nil, logging.Errorf("connect cri runtime at %v failed, %v", endpoint, err)
+	}
+	return &criRuntime{conn: conn, cli: runtimeapi.NewRuntimeServiceClient(conn)}, nil
+}
+
+func (r *criRuntime) ContainerExists(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	defer cancel()
+	resp, err := r.cli.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{Filter: &runtimeapi.PodSandboxFilter{Id: id}})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Items) > 0, nil
+}
+
+func (r *criRuntime) Close() error {
+	return r.conn.Close()
+}
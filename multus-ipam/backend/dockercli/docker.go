@@ -0,0 +1,35 @@
+package dockercli
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/intel/multus-cni/logging"
+	"golang.org/x/net/context"
+)
+
+// dockerRuntime checks the containers with the docker api
+type dockerRuntime struct {
+	cli *client.Client
+}
+
+func newDockerRuntime() (Runtime, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, logging.Errorf("create docker cli failed, %v", err)
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func (r *dockerRuntime) ContainerExists(id string) (bool, error) {
+	containers, err := r.cli.ContainerList(context.Background(),
+		types.ContainerListOptions{Filters: filters.NewArgs(filters.KeyValuePair{"id", id})})
+	if err != nil {
+		return false, err
+	}
+	return len(containers) > 0, nil
+}
+
+func (r *dockerRuntime) Close() error {
+	return r.cli.Close()
+}
@@ -0,0 +1,47 @@
+package dockercli
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// RuntimeDocker checks the containers with the docker api, the default
+	RuntimeDocker = "docker"
+	// RuntimeContainerd checks the pod sandboxes with the cri of containerd
+	RuntimeContainerd = "containerd"
+	// RuntimeCRIO checks the pod sandboxes with the cri of cri-o
+	RuntimeCRIO = "crio"
+
+	defaultContainerdEndpoint = "unix:///run/containerd/containerd.sock"
+	defaultCRIOEndpoint       = "unix:///var/run/crio/crio.sock"
+)
+
+// Runtime tells if the container an ip was allocated for still exists, the
+// ContainerID of a CNI call is the pod sandbox of a cri runtime
+type Runtime interface {
+	ContainerExists(id string) (bool, error)
+	Close() error
+}
+
+// NewRuntime returns the runtime named by CONTAINER_RUNTIME, docker if unset,
+// a cri runtime is reached at CONTAINER_RUNTIME_ENDPOINT or its default socket
+func NewRuntime() (Runtime, error) {
+	endpoint := os.Getenv("CONTAINER_RUNTIME_ENDPOINT")
+	switch name := os.Getenv("CONTAINER_RUNTIME"); name {
+	case "", RuntimeDocker:
+		return newDockerRuntime()
+	case RuntimeContainerd:
+		if endpoint == "" {
+			endpoint = defaultContainerdEndpoint
+		}
+		return newCRIRuntime(endpoint)
+	case RuntimeCRIO:
+		if endpoint == "" {
+			endpoint = defaultCRIOEndpoint
+		}
+		return newCRIRuntime(endpoint)
+	default:
+		return nil, fmt.Errorf("invalid container runtime %v, it shall be %v, %v or %v", name, RuntimeDocker, RuntimeContainerd, RuntimeCRIO)
+	}
+}
@@ -0,0 +1,161 @@
+package etcdv3cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+// the divergences between the leases of the node in etcd and its cache
+const (
+	DivergenceMissingCache = "missing cache"     // a lease with no cache range
+	DivergenceOrphanCache  = "orphan cache"      // a cache range with no lease
+	DivergenceMismatch     = "mismatched range"  // a cache range overlapping a lease without matching it
+	DivergenceOverlap      = "overlapping lease" // a lease overlapping the lease of another owner, which keeps it
+)
+
+// Divergence is a difference between etcd and the cache the reconcile fixes
+type Divergence struct {
+	Kind   string
+	Lease  *allocator.SimpleRange // the lease in etcd, if any
+	Cache  *allocator.SimpleRange // the cache range, if any
+	Keeper string                 // the owner keeping an overlapping lease
+}
+
+func (d Divergence) String() string {
+	parts := []string{d.Kind}
+	if d.Lease != nil {
+		parts = append(parts, fmt.Sprintf("lease %v-%v", d.Lease.RangeStart, d.Lease.RangeEnd))
+	}
+	if d.Cache != nil {
+		parts = append(parts, fmt.Sprintf("cache %v-%v", d.Cache.RangeStart, d.Cache.RangeEnd))
+	}
+	if d.Keeper != "" {
+		parts = append(parts, "kept by "+d.Keeper)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ipamNetDivergences returns the divergences between the leases and the cache
+// ranges of a network, in the order the reconcile fixes them: the cache ranges
+// overlapping a lease until one matches it and the lease if none does, then
+// the cache ranges left matching no lease
+func ipamNetDivergences(leases, caches []allocator.SimpleRange) []Divergence {
+	divs := []Divergence{}
+	mismatched := map[int]bool{}
+	for i := range leases {
+		matched := false
+		for j := range caches {
+			if !caches[j].Overlaps(&leases[i]) {
+				continue
+			}
+			if caches[j].Match(&leases[i]) {
+				matched = true
+				break
+			}
+			if !mismatched[j] {
+				mismatched[j] = true
+				divs = append(divs, Divergence{Kind: DivergenceMismatch, Lease: &leases[i], Cache: &caches[j]})
+			}
+		}
+		if !matched {
+			divs = append(divs, Divergence{Kind: DivergenceMissingCache, Lease: &leases[i]})
+		}
+	}
+	for j := range caches {
+		if mismatched[j] {
+			continue
+		}
+		matched := false
+		for i := range leases {
+			if caches[j].Match(&leases[i]) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			divs = append(divs, Divergence{Kind: DivergenceOrphanCache, Cache: &caches[j]})
+		}
+	}
+	return divs
+}
+
+// NetAudit is the divergences of a network found by IPAMAuditEtcd
+type NetAudit struct {
+	Network     string
+	Err         error
+	Divergences []Divergence
+}
+
+// IPAMAuditEtcd reports the divergences between the leases of all networks in
+// etcd and the local cache, those IPAMCheckEtcd would fix, without modifying
+// either of them
+func IPAMAuditEtcd() ([]NetAudit, error) {
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Close()
+
+	leases, networks, err := ipamNetLeases(etcdMultus)
+	if err != nil {
+		return nil, err
+	}
+	audits := []NetAudit{}
+	for _, network := range networks {
+		divs, err := ipamAuditNet(etcdMultus, network, leases[network])
+		for _, d := range divs {
+			logging.Verbosef("%v of %v diverges, %v", network, etcdMultus.Id, d)
+		}
+		audits = append(audits, NetAudit{network, err, divs})
+	}
+	return audits, nil
+}
+
+// ipamAuditNet returns the divergences of network, see ipamCheckNet for the
+// reconcile fixing them
+func ipamAuditNet(em *etcdv3.EtcdMultus, network string, leases []allocator.SimpleRange) ([]Divergence, error) {
+	s, err := disk.New(network, "")
+	if err != nil {
+		return nil, logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	em = ipamNetEtcd(em, s)
+	pool := s.LoadPool()
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	losers, keepers, err := ipamFindOverlaps(em.Cli, keyDir, ipamLeaseValue(em.Id, network, pool))
+	if err != nil {
+		return nil, err
+	}
+	divs := []Divergence{}
+	lost := []allocator.SimpleRange{}
+	for i, l := range losers {
+		sr := ipamLeaseToSimleRange(strings.Trim(l.key, " \r\n\t"))
+		lost = append(lost, *sr)
+		divs = append(divs, Divergence{Kind: DivergenceOverlap, Lease: sr, Keeper: keepers[i]})
+	}
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache failed, %v", err)
+	}
+	// the cache ranges of the lost leases are deleted along with them
+	kept := []allocator.SimpleRange{}
+	for _, csr := range caches {
+		dropped := false
+		for i := range lost {
+			if csr.Match(&lost[i]) {
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			kept = append(kept, csr)
+		}
+	}
+	caches = kept
+	return append(divs, ipamNetDivergences(ipamWithoutRanges(leases, lost), caches)...), nil
+}
@@ -0,0 +1,131 @@
+package etcdv3cli
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+// bucketBlockBits sizes the blocks of ips hashed to the buckets, the 16 ips of
+// the default apply unit, a range of a larger unit spans several blocks
+const bucketBlockBits = 4
+
+// ipamRangeBuckets returns the buckets the blocks of sr hash to, each once and
+// in order, which are the shards a claim of sr locks
+func ipamRangeBuckets(sr *allocator.SimpleRange, buckets int) []int {
+	if buckets < 2 {
+		return []int{0}
+	}
+	start := new(big.Int).Rsh(allocator.IPToBigInt(sr.RangeStart), bucketBlockBits)
+	end := new(big.Int).Rsh(allocator.IPToBigInt(sr.RangeEnd), bucketBlockBits)
+	seen := map[int]bool{}
+	one := big.NewInt(1)
+	for b := start; b.Cmp(end) <= 0 && len(seen) < buckets; b = new(big.Int).Add(b, one) {
+		h := fnv.New32a()
+		h.Write(b.Bytes())
+		seen[int(h.Sum32()%uint32(buckets))] = true
+	}
+	list := []int{}
+	for bucket := range seen {
+		list = append(list, bucket)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// ipamApplyInBuckets applies an ip range from r split in buckets. The whole of
+// r is scanned for a free range without a lock, then the range found is
+// claimed under the locks of the buckets it spans only, so that the claims of
+// the ranges of different buckets go on at once. A range taken meanwhile by
+// the claim of a bucket in common is found under the locks, then the next free
+// one is tried.
+func ipamApplyInBuckets(ctx context.Context, cli *clientv3.Client, keyDir, value string, lease clientv3.LeaseID, r *allocator.Range, unit uint32, buckets, priority int, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	for i := 1; ; i++ {
+		sr, err := ipamGetFreeIPRange(ctx, cli, keyDir, r, unit, opts)
+		if err != nil {
+			return nil, err
+		}
+		key := ipamSimpleRangeToLease(keyDir, sr)
+		err = ipamClaimInBuckets(ctx, cli, keyDir, key, value, ipamLeaseRecord(value, opts.Cause, ipamRangeSubnet(r)), lease, sr, buckets, priority)
+		if err == nil {
+			return sr, nil
+		}
+		if err != etcdv3.ErrKeyExists || i >= opts.Tries {
+			return nil, logging.Errorf("write key %v to %v failed, %v", key, value, err)
+		}
+		backoff := ipamApplyBackoff(i)
+		logging.Verbosef("lease %v is claimed by another, try the next free range in %v", key, backoff)
+		if err := etcdv3.Wait(ctx, backoff); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ipamClaimInBuckets puts the lease key of sr with record under the locks of
+// its buckets, failing with etcdv3.ErrKeyExists if a lease overlapping sr is
+// put already
+func ipamClaimInBuckets(ctx context.Context, cli *clientv3.Client, keyDir, key, value, record string, lease clientv3.LeaseID, sr *allocator.SimpleRange, buckets, priority int) error {
+	list := ipamRangeBuckets(sr, buckets)
+	// as ipamApplyInDir, a higher priority backs off shorter from a bucket
+	// contended
+	if backoff := time.Duration(allocator.MaxPriority-priority) * claimBackoffStep; backoff > 0 {
+		for _, bucket := range list {
+			contended, err := etcdv3.DirBucketContended(ctx, cli, keyDir, bucket, buckets)
+			if err != nil {
+				return err
+			}
+			if contended {
+				logging.Debugf("bucket %d of %v is contended, back off %v at priority %d", bucket, keyDir, backoff, priority)
+				if err := etcdv3.Wait(ctx, backoff); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	dirMutex, err := etcdv3.LockDirBucketList(ctx, cli, keyDir, list, buckets)
+	if err != nil {
+		return err
+	}
+	defer dirMutex.Close()
+
+	leased, err := ipamRangeLeased(ctx, cli, keyDir, sr)
+	if err != nil {
+		return err
+	}
+	if leased {
+		return etcdv3.ErrKeyExists
+	}
+	logging.Debugf("Going to put %v:%v in buckets %v", key, value, list)
+	return putLease(ctx, cli, key, record, clientv3.WithLease(lease))
+}
+
+// ipamRangeLeased tells if a lease under keyDir overlaps sr
+func ipamRangeLeased(ctx context.Context, cli *clientv3.Client, keyDir string, sr *allocator.SimpleRange) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("Get %v failed, %w", keyDir, err)
+	}
+	start, end := allocator.IPToBigInt(sr.RangeStart), allocator.IPToBigInt(sr.RangeEnd)
+	for _, kv := range resp.Kvs {
+		ips, ipe := ipamLeaseToBigRange(string(kv.Key))
+		if ips.Sign() == 0 {
+			continue
+		}
+		if ips.Cmp(end) <= 0 && start.Cmp(ipe) <= 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
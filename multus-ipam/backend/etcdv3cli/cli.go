@@ -1,350 +1,2295 @@
-package etcdv3cli
-
-import (
-	"context"
-	"math"
-	"os"
-	"path/filepath"
-
-	"fmt"
-	"math/rand"
-	"net"
-
-	"strconv"
-	"strings"
-
-	"github.com/coreos/etcd/clientv3"
-
-	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/intel/multus-cni/etcdv3"
-	"github.com/archichris/netools/ipaddr"
-	"github.com/intel/multus-cni/logging"
-	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
-	"github.com/intel/multus-cni/multus-ipam/backend/disk"
-)
-
-var (
-	leaseDir      = "lease" //multus/netowrkname/key(ipsegment):value(node)
-	fixDir        = "fix"
-	staticDir     = "static"
-	rangeTemplate = "%010d-%d"
-	fixGap        = "/" // ns/name
-	maxApplyTry   = 3
-)
-
-func ipamLeaseToUint32Range(key string) (IPStart uint32, IPEnd uint32) {
-	lease := strings.Split(filepath.Base(key), "-")
-	IPStart = ipaddr.StrToUint32(lease[0])
-	hostSize := ipaddr.StrToUint32(lease[1])
-	IPEnd = ipaddr.Uint32AddSeg(IPStart, hostSize) - 1
-	return IPStart, IPEnd
-}
-
-func ipamLeaseToSimleRange(l string) *allocator.SimpleRange {
-	ips, ipe := ipamLeaseToUint32Range(l)
-	return &allocator.SimpleRange{ipaddr.Uint32ToIP4(ips), ipaddr.Uint32ToIP4(ipe)}
-}
-
-func ipamSimpleRangeToLease(keyDir string, rs *allocator.SimpleRange) string {
-	ips := ipaddr.IP4ToUint32(rs.RangeStart)
-	n := rs.HostSize()
-	return filepath.Join(keyDir, fmt.Sprintf(rangeTemplate, ips, n))
-}
-
-// IpamApplyIPRange is used to apply IP range from ectd
-func IPAMApplyIPRange(network string, r *allocator.Range, unit uint32) (*allocator.SimpleRange, error) {
-	logging.Debugf("Going to do apply IP range from %v", *r)
-	etcdMultus, err := etcdv3.New()
-	if err != nil {
-		return nil, err
-	}
-	cli, rKeyDir, id := etcdMultus.Cli, etcdMultus.RootKeyDir, etcdMultus.Id
-	defer cli.Close() // make sure to close the client
-
-	keyDir := filepath.Join(rKeyDir, leaseDir, network)
-
-	dirMutex, err := etcdv3.LockDir(cli, keyDir)
-	if err != nil {
-		return nil, err
-	}
-	defer dirMutex.Close()
-
-	rs, err := ipamGetFreeIPRange(cli, keyDir, r, unit)
-	if err != nil {
-		return nil, err
-	}
-
-	logging.Debugf("Going to put %v:%v", ipamSimpleRangeToLease(keyDir, rs), id)
-
-	_, err = cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, rs), id)
-	if err != nil {
-		return nil, logging.Errorf("write key %v to %v failed", ipamSimpleRangeToLease(keyDir, rs), id)
-	}
-
-	return rs, nil
-}
-
-// GetFreeIPRange is used to find a free IP range
-func ipamGetFreeIPRange(cli *clientv3.Client, keyDir string, r *allocator.Range, n uint32) (*allocator.SimpleRange, error) {
-	num := uint32(math.Pow(2, float64(n)))
-	logging.Debugf("ipamGetFreeIPRange(%v,%v,%v)", keyDir, *r, num)
-
-	rips, ripe := ipaddr.IP4ToUint32(r.RangeStart), ipaddr.IP4ToUint32(r.RangeEnd)
-	tmp := ipaddr.IP4ToUint32(r.Subnet.IP) + 2
-	if rips < tmp {
-		rips = tmp
-	}
-	last := rips
-
-	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
-	resp, err := cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
-	cancel()
-	if err != nil {
-		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
-	}
-	var sips, sipe uint32
-	for _, ev := range resp.Kvs {
-		logging.Debugf("Key:%v, Value:%v ", string(ev.Key), string(ev.Value))
-		ips, ipe := ipamLeaseToUint32Range(string(ev.Key))
-		if ips == 0 || ips > ripe {
-			logging.Debugf("Invalid Key %v", string(ev.Key))
-			continue
-		}
-		if ipe > ripe {
-			ipe = ripe
-		}
-		if ips-last < num {
-			last = ipe + 1
-			continue
-		}
-		break
-	}
-	if ripe-last >= num-1 {
-		sips = last
-		sipe = last + num - 1
-		logging.Debugf("get IP range (%v-%v) from (%v-%v)", sips, sipe, rips, ripe)
-		return &allocator.SimpleRange{ipaddr.Uint32ToIP4(sips), ipaddr.Uint32ToIP4(sipe)}, nil
-	}
-	return nil, logging.Errorf("apply ip range failed")
-}
-
-func IPAMGetAllLease(cli *clientv3.Client, keyDir, id string) (map[string][]allocator.SimpleRange, error) {
-	logging.Debugf("Going to get all IP lease belong to %v from %v", id, keyDir)
-	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
-	resp, err := cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
-	cancel()
-	if err != nil {
-		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
-	}
-	leases := make(map[string][]allocator.SimpleRange)
-	for _, ev := range resp.Kvs {
-		v := strings.Trim(string(ev.Value), " \r\n\t")
-		logging.Debugf("Key:%v, Value:%v, id:%v, match:%v ", string(ev.Key), v, id, v == id)
-		if v == id {
-			k := strings.Trim(string(ev.Key), " \r\n\t")
-			network := filepath.Base(filepath.Dir(k))
-			sr := ipamLeaseToSimleRange(k)
-			if _, ok := leases[network]; ok {
-				leases[network] = append(leases[network], *sr)
-			} else {
-				leases[network] = []allocator.SimpleRange{*sr}
-			}
-		}
-	}
-	return leases, nil
-}
-
-func ipamCheckNet(em *etcdv3.EtcdMultus, network string, leases []allocator.SimpleRange) {
-
-	s, err := disk.New(network, "")
-	if err != nil {
-		logging.Errorf("create disk manager failed, %v", err)
-		return
-	}
-	caches, err := s.LoadCache()
-	if err != nil {
-		logging.Errorf("get cache failed, %v", err)
-		return
-	}
-	logging.Debugf("check net:%v\nleases:%v\ncaches:%v\n", network, leases, caches)
-	keyDir := filepath.Join(em.RootKeyDir, leaseDir, network)
-	cli, id := em.Cli, em.Id
-	var last *allocator.SimpleRange
-	for _, lsr := range leases {
-		last = nil
-		for _, csr := range caches {
-			if csr.Overlaps(&lsr) {
-				if csr.Match(&lsr) {
-					last = &csr
-					break
-				} else {
-					// caches = delete(caches, csr)
-					s.DeleteCache(&csr)
-				}
-			}
-		}
-		if last == nil {
-			err := s.AppendCache(&lsr)
-			if err != nil {
-				etcdv3.TransDelKey(cli, ipamSimpleRangeToLease(keyDir, &lsr))
-			}
-		}
-	}
-
-	caches, err = s.LoadCache()
-	if err != nil {
-		logging.Errorf("get cache failed, %v", err)
-		return
-	}
-	for _, csr := range caches {
-		last = nil
-		var lsr allocator.SimpleRange
-		for _, lsr = range leases {
-			if csr.Match(&lsr) {
-				last = &csr
-				break
-			}
-		}
-		logging.Debugf("cache:%v, lease:%v, result:%v", csr, lsr, last)
-		if last == nil {
-			err = etcdv3.TransPutKey(cli, ipamSimpleRangeToLease(keyDir, &csr), id, true)
-			if err != nil {
-				logging.Debugf("going to delete error cache:%v", csr)
-				s.DeleteCache(&csr)
-			}
-		}
-	}
-}
-
-func IPAMCheckEtcd() error {
-	// logging.Debugf("Going to check IPAM")
-	etcdMultus, err := etcdv3.New()
-	cli, rKeyDir, id := etcdMultus.Cli, etcdMultus.RootKeyDir, etcdMultus.Id
-	if err != nil {
-		return err
-	}
-	defer cli.Close() // make sure to close the client
-
-	lDir := filepath.Join(rKeyDir, leaseDir)
-
-	leases, err := IPAMGetAllLease(cli, lDir, id)
-	if err != nil {
-		return err
-	}
-
-	localNets := disk.GetAllNet(os.Getenv("NET_DATA_DIR"))
-	logging.Debugf("local net: %v", localNets)
-
-	for network, lease := range leases {
-		ipamCheckNet(etcdMultus, network, lease)
-		for idx, n := range localNets {
-			if network == n {
-				if idx == 0 {
-					localNets = localNets[1:]
-				} else if idx == len(localNets)-1 {
-					localNets = localNets[:len(localNets)-1]
-				} else {
-					localNets = append(localNets[:idx], localNets[idx+1:]...)
-				}
-				break
-			}
-		}
-	}
-
-	for _, network := range localNets {
-		ipamCheckNet(etcdMultus, network, nil)
-	}
-
-	return nil
-}
-
-// GetFreeIPRange is used to find a free IP range
-func IPAMApplyFixIP(network string, r *allocator.Range, fixInfo string) (*net.IPNet, error) {
-	// netConf *allocator.Net
-	logging.Debugf("Going to do apply fix IP from %v for %v", r, network)
-	em, err := etcdv3.New()
-	if err != nil {
-		return nil, err
-	}
-	// cli, rKeyDir, id := etcdMultus.Cli, etcdMultus.RootKeyDir, etcdMultus.Id
-	defer em.Close() // make sure to close the client
-
-	keyDir := filepath.Join(em.RootKeyDir, fixDir, network)
-
-	dirMutex, err := etcdv3.LockDir(em.Cli, keyDir)
-	if err != nil {
-		return nil, err
-	}
-	defer dirMutex.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
-	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
-	cancel()
-	freeIPs := []uint32{}
-	fixIP := uint32(0)
-	rips, ripe := ipaddr.IP4ToUint32(r.RangeStart), ipaddr.IP4ToUint32(r.RangeEnd)
-	tmp := ipaddr.IP4ToUint32(r.Subnet.IP) + 2
-	if rips < tmp {
-		rips = tmp
-	}
-	last := rips
-	for _, ev := range resp.Kvs {
-		logging.Debugf("Key:%v, Value:%v, fixInfo:%v", string(ev.Key), string(ev.Value), fixInfo)
-		fix := ipaddr.StrToUint32(filepath.Base(string(ev.Key)))
-		addr := ipaddr.Uint32ToIP4(fix)
-		v := string(ev.Value)
-
-		if (ip.Cmp(r.RangeStart, addr) > 0) || (ip.Cmp(r.RangeEnd, addr) < 0) {
-			if v == fixInfo {
-				em.Cli.Delete(context.TODO(), string(ev.Key))
-			}
-			continue
-		}
-		if v == fixInfo {
-			fixIP = fix
-			break
-		}
-
-		if fix-last > 0 {
-			for i := last; i < fix; i++ {
-				freeIPs = append(freeIPs, i)
-			}
-		}
-
-		last = fix + 1
-	}
-
-	if fixIP == 0 {
-		for i := last; i < ripe+1; i++ {
-			freeIPs = append(freeIPs, i)
-		}
-		if len(freeIPs) > 0 {
-			fixIP = freeIPs[rand.Intn(len(freeIPs))]
-		} else {
-			return nil, logging.Errorf("no availble fixed ip")
-		}
-	}
-
-	key := filepath.Join(keyDir, fmt.Sprintf("%010d", fixIP))
-
-	logging.Debugf("Going to put %v:%v", key, fixInfo)
-
-	_, err = em.Cli.Put(context.TODO(), key, fixInfo)
-	if err != nil {
-		return nil, logging.Errorf("write key %v to %v failed", key, fixInfo)
-	}
-	return &net.IPNet{IP: ipaddr.Uint32ToIP4(fixIP), Mask: r.Subnet.Mask}, nil
-}
-
-// GetFreeIPRange is used to find a free IP range
-func IPAMGenFixInfo(ns, name string, n int) string {
-	return strings.Trim(ns+fixGap+name+fixGap+strconv.Itoa(n), "\r\n\t ")
-
-}
-func IPAMParseFixInfo(info string) (string, string) {
-	v := strings.Split(strings.Trim(info, " \r\n\t"), fixGap)
-	if len(v) < 2 {
-		return "waitToDel", "waitToDel"
-	}
-	return v[0], v[1]
-}
+package etcdv3cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"fmt"
+	"math/rand"
+	"net"
+
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/archichris/netools/ipaddr"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+var (
+	leaseDir      = "lease" //multus/netowrkname/key(ipsegment):value(node)
+	fixDir        = "fix"
+	staticDir     = "static"
+	staticOwner   = "static" // owner of the leases of the static ips imported
+	pinnedDir     = "pinned" //multus/pinned/networkname/key(ip):value(ns/name)
+	preferredDir  = "preferred" //multus/preferred/networkname/key(ns/name):value(ip)
+	poolDir       = "pool" //multus/pool/poolid/key(ipsegment):value(node/networkname)
+	starvedDir    = "starved" //multus/starved/networkname/key(node):value(unix time)
+	poolGap       = "/"    // node/networkname
+	rangeTemplate = "%010d-%d" // start-hostSize, see ipamEncodeLease
+	fixGap        = "/" // ns/name
+	causeGap      = "@" // owner@ns/name
+)
+
+// ErrRangeExhausted is returned when there is no free range left to apply,
+// which is not a failure of etcd
+var ErrRangeExhausted = errors.New("apply ip range failed")
+
+// ipamLeaseToBigRange returns the first and the last ips of a lease key as
+// integers, both 0 if the key is invalid. The key of an ipv6 lease is its 128
+// bits integer. The legacy keys are decoded as well, see ipamDecodeLease.
+func ipamLeaseToBigRange(key string) (*big.Int, *big.Int) {
+	start, end, _, ok := ipamDecodeLease(filepath.Base(key))
+	if !ok {
+		return big.NewInt(0), big.NewInt(0)
+	}
+	return start, end
+}
+
+// ipamLeaseToUint32Range returns the ipv4 range of a lease key, both 0 for an
+// ipv6 lease
+func ipamLeaseToUint32Range(key string) (IPStart uint32, IPEnd uint32) {
+	start, end := ipamLeaseToBigRange(key)
+	if end.BitLen() > 32 {
+		return 0, 0
+	}
+	return uint32(start.Uint64()), uint32(end.Uint64())
+}
+
+// ipamBigToIP returns the ip of an integer decoded from a lease key, the ipv6
+// addresses in use are all beyond the 32 bits of the ipv4 space
+func ipamBigToIP(n *big.Int) net.IP {
+	return allocator.BigIntToIP(n, n.BitLen() > 32)
+}
+
+func ipamLeaseToSimleRange(l string) *allocator.SimpleRange {
+	ips, ipe := ipamLeaseToBigRange(l)
+	return &allocator.SimpleRange{ipamBigToIP(ips), ipamBigToIP(ipe)}
+}
+
+func ipamSimpleRangeToLease(keyDir string, rs *allocator.SimpleRange) string {
+	return filepath.Join(keyDir, ipamEncodeLease(allocator.IPToBigInt(rs.RangeStart), uint(rs.HostSize())))
+}
+
+// ipamApplyBounds returns the first and the last ips of r to apply from as
+// integers, the network address and the gateway .1 of the subnet are never
+// applied
+func ipamApplyBounds(r *allocator.Range) (*big.Int, *big.Int) {
+	rips, ripe := allocator.IPToBigInt(r.RangeStart), allocator.IPToBigInt(r.RangeEnd)
+	first, _ := allocator.NetToBigRange(r.Subnet)
+	if first.Add(first, big.NewInt(2)); rips.Cmp(first) < 0 {
+		rips = first
+	}
+	return rips, ripe
+}
+
+// ipamCheckUnit fails if r holds fewer ips to apply than a range of unit, which
+// no apply would ever find free. The unit 0 applies a single ip.
+func ipamCheckUnit(r *allocator.Range, unit uint32) error {
+	rips, ripe := ipamApplyBounds(r)
+	n := new(big.Int).Sub(ripe, rips)
+	n.Add(n, big.NewInt(1))
+	if unitIPs := new(big.Int).Lsh(big.NewInt(1), uint(unit)); n.Cmp(unitIPs) < 0 {
+		if n.Sign() < 0 {
+			n.SetInt64(0)
+		}
+		return logging.Errorf("range %v-%v of subnet %v has %v ips to apply, fewer than the %v ips of apply unit %d",
+			r.RangeStart, r.RangeEnd, (*net.IPNet)(&r.Subnet), n, unitIPs, unit)
+	}
+	return nil
+}
+
+// ipamKeptOut returns the ips of r never applied as integer intervals, which
+// are the keep-out ranges and the gateway
+func ipamKeptOut(r *allocator.Range) [][2]*big.Int {
+	kept := [][2]*big.Int{}
+	for _, k := range r.KeepOut {
+		kept = append(kept, [2]*big.Int{allocator.IPToBigInt(k.RangeStart), allocator.IPToBigInt(k.RangeEnd)})
+	}
+	if r.Gateway != nil {
+		gw := allocator.IPToBigInt(r.Gateway)
+		kept = append(kept, [2]*big.Int{gw, gw})
+	}
+	return kept
+}
+
+// ipamLeaseKeyDir returns the dir of the leases of network, which is shared by
+// all the networks of the pool if any
+func ipamLeaseKeyDir(rKeyDir, network, pool string) string {
+	if pool == "" {
+		return filepath.Join(rKeyDir, leaseDir, network)
+	}
+	return filepath.Join(rKeyDir, poolDir, pool)
+}
+
+// ipamNetEtcd returns em rooted under the root key dir the network of s
+// recorded, em itself if it recorded none
+func ipamNetEtcd(em *etcdv3.EtcdMultus, s *disk.Store) *etcdv3.EtcdMultus {
+	root := s.LoadRootKeyDir()
+	if root == "" || root == em.RootKeyDir {
+		return em
+	}
+	netEm := *em
+	netEm.RootKeyDir = root
+	return &netEm
+}
+
+// ipamLeaseValue returns the value of a lease of network owned by id, the
+// leases of a pool also record the network they belong to
+func ipamLeaseValue(id, network, pool string) string {
+	if pool == "" {
+		return id
+	}
+	return id + poolGap + network
+}
+
+// LeaseCause is the identity of the pod whose add applies the ranges, which is
+// embedded in the values of the leases written if set, the default of
+// ApplyOptions.Cause
+var LeaseCause string
+
+// leaseRecord is the value of a lease, which tells who applied the range
+// when, for which pod and from which subnet. The network is recorded by the
+// leases of a pool.
+type leaseRecord struct {
+	Node        string `json:"node"`
+	Network     string `json:"network,omitempty"`
+	Timestamp   int64  `json:"timestamp"`
+	ApplyReason string `json:"applyReason,omitempty"`
+	Subnet      string `json:"subnet,omitempty"`
+}
+
+// ipamLeaseRecord returns the value written to a lease of owner, see
+// ipamLeaseValue, applied now for cause if any from subnet if known
+func ipamLeaseRecord(owner, cause, subnet string) string {
+	rec := leaseRecord{Node: owner, Timestamp: time.Now().Unix(), ApplyReason: cause, Subnet: subnet}
+	if v := strings.SplitN(owner, poolGap, 2); len(v) == 2 {
+		rec.Node, rec.Network = v[0], v[1]
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		// a record of strings and an integer always marshals
+		return owner
+	}
+	return string(data)
+}
+
+// ipamParseLeaseValue splits the value of a lease into its owner, as returned
+// by ipamLeaseValue, and the pod whose add applied it. The legacy values are
+// the owner only or the owner@pod.
+func ipamParseLeaseValue(v string) (owner, cause string) {
+	v = strings.Trim(v, " \r\n\t")
+	var rec leaseRecord
+	if strings.HasPrefix(v, "{") && json.Unmarshal([]byte(v), &rec) == nil {
+		owner = rec.Node
+		if rec.Network != "" {
+			owner += poolGap + rec.Network
+		}
+		return owner, rec.ApplyReason
+	}
+	parts := strings.SplitN(v, causeGap, 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// ipamLeaseOwner returns the owner of the lease of value v
+func ipamLeaseOwner(v []byte) string {
+	owner, _ := ipamParseLeaseValue(string(v))
+	return owner
+}
+
+// ipamLeaseSubnet returns the subnet the lease of value v was applied from,
+// empty if not recorded as by the legacy values
+func ipamLeaseSubnet(v []byte) string {
+	var rec leaseRecord
+	if json.Unmarshal(bytes.TrimSpace(v), &rec) != nil {
+		return ""
+	}
+	return rec.Subnet
+}
+
+// ipamRangeSubnet returns the subnet of r as recorded by the leases of r
+func ipamRangeSubnet(r *allocator.Range) string {
+	return (*net.IPNet)(&r.Subnet).String()
+}
+
+// ipamSubnetOf returns the one of subnets holding sr as recorded by the leases,
+// empty if none does
+func ipamSubnetOf(subnets []net.IPNet, sr *allocator.SimpleRange) string {
+	for i := range subnets {
+		if subnets[i].Contains(sr.RangeStart) && subnets[i].Contains(sr.RangeEnd) {
+			return subnets[i].String()
+		}
+	}
+	return ""
+}
+
+// IPAMLeaseOwner returns the owner of the lease of value v, whichever format
+// it was written in
+func IPAMLeaseOwner(v []byte) string {
+	return ipamLeaseOwner(v)
+}
+
+// IpamApplyIPRange is used to apply IP range from ectd, giving up once ctx is
+// done
+func IPAMApplyIPRange(ctx context.Context, network string, r *allocator.Range, unit uint32) (*allocator.SimpleRange, error) {
+	return IPAMApplyPoolIPRange(ctx, network, "", r, unit)
+}
+
+// IPAMApplyPoolIPRange is used to apply IP range for network from the pool
+// shared with other networks, the leases of all these networks are kept in the
+// same keyspace so that the space released by one can be borrowed by another
+func IPAMApplyPoolIPRange(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32) (*allocator.SimpleRange, error) {
+	res, err := IPAMApplyShardedIPRange(ctx, network, pool, r, unit, 1, 0, DefaultApplyOptions())
+	if err != nil {
+		return nil, err
+	}
+	return res.SimpleRange, nil
+}
+
+// ApplyResult is a range applied and the usage of the range it was applied
+// from once it is leased, for the caller to tell a network near exhaustion.
+// Free and Total are both 0 if the usage could not be read.
+type ApplyResult struct {
+	*allocator.SimpleRange
+	Free  uint64 // ips of the range neither leased nor kept out
+	Total uint64 // ips of the range not kept out
+}
+
+// Utilization returns the share of the ips of the range leased, 0 if unknown
+func (a *ApplyResult) Utilization() float64 {
+	if a.Total == 0 {
+		return 0
+	}
+	return float64(a.Total-a.Free) / float64(a.Total)
+}
+
+// IPAMApplyShardedIPRange is IPAMApplyPoolIPRange with the leases hashed to
+// shards buckets, each locked by a mutex of its own so that the nodes claiming
+// ranges of different buckets do not contend, see ipamApplyInBuckets. The
+// applies of a higher priority back off shorter from a contended bucket,
+// getting its mutex first.
+func IPAMApplyShardedIPRange(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts ApplyOptions) (*ApplyResult, error) {
+	logging.Debugf("Going to do apply IP range from %v", *r)
+	if err := ipamCheckUnit(r, unit); err != nil {
+		return nil, err
+	}
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Close() // make sure to close the client
+
+	var sr *allocator.SimpleRange
+	err = etcdMultus.RetryContext(ctx, "apply", func() error {
+		var err error
+		sr, err = ipamApplySharded(ctx, etcdMultus, network, pool, r, unit, shards, priority, opts)
+		return err
+	})
+	if err == nil || err == ErrRangeExhausted {
+		ipamMarkStarved(etcdMultus, network, err != nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &ApplyResult{SimpleRange: sr}
+	keyDir := ipamLeaseKeyDir(etcdMultus.RootKeyDir, network, pool)
+	if res.Free, res.Total, err = ipamRangeUsage(ctx, etcdMultus.Cli, keyDir, r); err != nil {
+		logging.Verbosef("read the usage of %v failed, %v", r, err)
+	}
+	return res, nil
+}
+
+func ipamApplySharded(ctx context.Context, em *etcdv3.EtcdMultus, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	cli, rKeyDir, id := em.Cli, em.RootKeyDir, em.Id
+	keyDir := ipamLeaseKeyDir(rKeyDir, network, pool)
+	value := ipamLeaseValue(id, network, pool)
+
+	// the pinned ips are only leased to the nodes running their pods
+	pinned, err := ipamGetPinnedIPs(ctx, cli, rKeyDir, network)
+	if err != nil {
+		return nil, err
+	}
+	r = ipamKeepPinnedOut(r, pinned)
+
+	// the reserve of the range is only taken by the applies of priority, which
+	// is a snapshot of the leases, the concurrent applies may breach it by a
+	// unit each
+	if r.MinFree > 0 && priority == 0 {
+		free, err := ipamFreeIPs(ctx, cli, keyDir, r)
+		if err != nil {
+			return nil, err
+		}
+		if free < uint64(r.MinFree)+uint64(1)<<unit {
+			logging.Verbosef("%d ips free in %v, the apply would take the reserve of %d", free, r, r.MinFree)
+			return nil, ErrRangeExhausted
+		}
+	}
+
+	lease, err := em.NodeLease()
+	if err != nil {
+		return nil, err
+	}
+
+	// a sharded lease dir is only claimed from in buckets, so that the
+	// networks of a pool agreeing on the shards lock it alike
+	if shards > 1 {
+		return ipamApplyInBuckets(ctx, cli, keyDir, value, lease, r, unit, shards, priority, opts)
+	}
+	return ipamApplyInDir(ctx, cli, keyDir, value, lease, r, unit, priority, opts)
+}
+
+// ipamKeepPinnedOut returns r with the pinned ips kept out, r itself if none
+func ipamKeepPinnedOut(r *allocator.Range, pinned map[string]string) *allocator.Range {
+	if len(pinned) == 0 {
+		return r
+	}
+	rp := *r
+	rp.KeepOut = append([]allocator.SimpleRange{}, r.KeepOut...)
+	v6 := r.RangeStart.To4() == nil
+	for addr := range pinned {
+		a := net.ParseIP(addr)
+		if a == nil || (a.To4() == nil) != v6 {
+			continue
+		}
+		if !v6 {
+			a = a.To4()
+		}
+		rp.KeepOut = append(rp.KeepOut, allocator.SimpleRange{RangeStart: a, RangeEnd: a})
+	}
+	return &rp
+}
+
+// ipamFreeIPs returns the ips of r neither leased under keyDir nor kept out
+func ipamFreeIPs(ctx context.Context, cli *clientv3.Client, keyDir string, r *allocator.Range) (uint64, error) {
+	rips, ripe := ipamApplyBounds(r)
+	if rips.Cmp(ripe) > 0 {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return 0, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	occupied := [][2]*big.Int{}
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToBigRange(string(ev.Key))
+		occupied = append(occupied, [2]*big.Int{ips, ipe})
+	}
+	occupied = append(occupied, ipamKeptOut(r)...)
+	ipamSortOccupied(occupied)
+	return ipamCountFree(occupied, r), nil
+}
+
+// ipamRangeUsage returns the ips of r free under keyDir, see ipamFreeIPs, and
+// those not kept out
+func ipamRangeUsage(ctx context.Context, cli *clientv3.Client, keyDir string, r *allocator.Range) (free, total uint64, err error) {
+	if free, err = ipamFreeIPs(ctx, cli, keyDir, r); err != nil {
+		return 0, 0, err
+	}
+	keptOut := ipamKeptOut(r)
+	ipamSortOccupied(keptOut)
+	return free, ipamCountFree(keptOut, r), nil
+}
+
+// ipamSortOccupied sorts the occupied intervals by their starts
+func ipamSortOccupied(occupied [][2]*big.Int) {
+	sort.Slice(occupied, func(i, j int) bool {
+		return occupied[i][0].Cmp(occupied[j][0]) < 0
+	})
+}
+
+// ipamCountFree returns the ips of r out of the occupied intervals sorted by
+// their starts
+func ipamCountFree(occupied [][2]*big.Int, r *allocator.Range) uint64 {
+	rips, ripe := ipamApplyBounds(r)
+	if rips.Cmp(ripe) > 0 {
+		return 0
+	}
+	// the occupied ips are counted once, a keep-out range may cover a lease
+	free := new(big.Int).Sub(ripe, rips)
+	free.Add(free, big.NewInt(1))
+	last := rips
+	for _, o := range occupied {
+		ips, ipe := o[0], o[1]
+		if ips.Cmp(last) < 0 {
+			ips = last
+		}
+		if ipe.Cmp(ripe) > 0 {
+			ipe = ripe
+		}
+		if ips.Cmp(ipe) > 0 {
+			continue
+		}
+		free.Sub(free, new(big.Int).Sub(ipe, ips)).Sub(free, big.NewInt(1))
+		last = new(big.Int).Add(ipe, big.NewInt(1))
+	}
+	// an ipv6 range may have more free ips than a uint64 counts
+	if !free.IsUint64() {
+		return math.MaxUint64
+	}
+	return free.Uint64()
+}
+
+// ApplyTries is the number of the free ranges an apply tries to claim, each
+// found by a new scan as the one tried before is claimed by another meanwhile,
+// the default of ApplyOptions.Tries
+var ApplyTries = 3
+
+// ApplyBackoff is the backoff before the scan after a claim lost, doubled for
+// each claim lost and jittered by up to half of it, so that the nodes racing
+// for the same range do not scan again in step
+var ApplyBackoff = 20 * time.Millisecond
+
+// ipamApplyBackoff returns the backoff after the lost claim of the try
+func ipamApplyBackoff(try int) time.Duration {
+	d := ApplyBackoff << uint(try-1)
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// ApplySpread is the number of the lowest free ranges an apply picks one of
+// at random, so that the nodes applying at once from a fresh subnet do not all
+// claim the same one. The lowest is always picked if it is 1 or less. It is
+// the default of ApplyOptions.Spread.
+var ApplySpread = 0
+
+// ApplyDescending makes the applies claim the highest free ranges instead of
+// the lowest, and spread over the highest ones, the default of
+// ApplyOptions.Descending
+var ApplyDescending = false
+
+// ApplyOptions are the options of an apply taken from the config of the
+// network, passed along the apply rather than set on the package, so that
+// the ranges of an ADD applied in parallel do not race on them
+type ApplyOptions struct {
+	Tries      int    // see ApplyTries
+	Spread     int    // see ApplySpread
+	Descending bool   // see ApplyDescending
+	Cause      string // see LeaseCause
+}
+
+// DefaultApplyOptions returns the options of the package defaults, for the
+// applies made out of an ADD, e.g. by the tools
+func DefaultApplyOptions() ApplyOptions {
+	return ApplyOptions{
+		Tries:      ApplyTries,
+		Spread:     ApplySpread,
+		Descending: ApplyDescending,
+		Cause:      LeaseCause,
+	}
+}
+
+// spreadIntn picks one of the free ranges spread over, tests seed it
+var spreadIntn = rand.Intn
+
+// claimBackoffStep is the backoff from a contended lease dir per priority
+// below allocator.MaxPriority, tests lengthen it
+var claimBackoffStep = 20 * time.Millisecond
+
+// ipamApplyInDir applies an IP range from r under the lock of the lease dir,
+// the lease key attaches to the etcd lease of the node. The lock is released
+// between the tries, so that the backoff after a claim lost does not stall
+// the other applies from the dir.
+func ipamApplyInDir(ctx context.Context, cli *clientv3.Client, keyDir, value string, lease clientv3.LeaseID, r *allocator.Range, unit uint32, priority int, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	// the mutex is granted in the order of the waiters, so a contended one is
+	// only waited for after a backoff shorter for a higher priority, letting
+	// the applies of higher priority queue first
+	if backoff := time.Duration(allocator.MaxPriority-priority) * claimBackoffStep; backoff > 0 {
+		contended, err := etcdv3.DirShardContended(ctx, cli, keyDir, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if contended {
+			logging.Debugf("lease dir %v is contended, back off %v at priority %d", keyDir, backoff, priority)
+			if err := etcdv3.Wait(ctx, backoff); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the range found free may be claimed by a writer not holding the lock of
+	// the dir in the meantime, then the next free one is tried
+	for i := 1; ; i++ {
+		rs, err := ipamClaimInDir(ctx, cli, keyDir, value, lease, r, unit, opts)
+		if err != etcdv3.ErrKeyExists {
+			return rs, err
+		}
+		if i >= opts.Tries {
+			return nil, logging.Errorf("apply from %v lost %d claims, %v", keyDir, i, err)
+		}
+		backoff := ipamApplyBackoff(i)
+		logging.Verbosef("try the next free range of %v in %v", keyDir, backoff)
+		if err := etcdv3.Wait(ctx, backoff); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ipamClaimInDir puts the lease key of the first free range of r under the
+// lock of the lease dir, failing with etcdv3.ErrKeyExists if the key is put
+// meanwhile
+func ipamClaimInDir(ctx context.Context, cli *clientv3.Client, keyDir, value string, lease clientv3.LeaseID, r *allocator.Range, unit uint32, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	dirMutex, err := etcdv3.LockDir(ctx, cli, keyDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	rs, err := ipamGetFreeIPRange(ctx, cli, keyDir, r, unit, opts)
+	if err != nil {
+		return nil, err
+	}
+	key := ipamSimpleRangeToLease(keyDir, rs)
+	logging.Debugf("Going to put %v:%v", key, value)
+	err = putLease(ctx, cli, key, ipamLeaseRecord(value, opts.Cause, ipamRangeSubnet(r)), clientv3.WithLease(lease))
+	if err == etcdv3.ErrKeyExists {
+		logging.Verbosef("lease %v is claimed by another", key)
+		return nil, err
+	}
+	if err != nil {
+		return nil, logging.Errorf("write key %v to %v failed, %v", key, value, err)
+	}
+	return rs, nil
+}
+
+// putLease puts a lease unless it exists, the caller holds the lock of the
+// lease dir already. Tests replace it to force the race.
+var putLease = etcdv3.PutKeyIfAbsent
+
+// OnScan is called with the leases an apply scanned from etcd, the replay log
+// of multus-ipam records them
+var OnScan func(keyDir string, leases []allocator.SimpleRange)
+
+// GetFreeIPRange is used to find a free IP range, spread and ordered by opts
+func ipamGetFreeIPRange(ctx context.Context, cli *clientv3.Client, keyDir string, r *allocator.Range, n uint32, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	num := new(big.Int).Lsh(big.NewInt(1), uint(n))
+	logging.Debugf("ipamGetFreeIPRange(%v,%v,%v)", keyDir, *r, num)
+
+	_, ripe := ipamApplyBounds(r)
+
+	// keep the dirs of other networks or pools sharing the prefix out
+	ctx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		logging.Errorf("Get %v failed, %v", keyDir, err)
+		return nil, fmt.Errorf("Get %v failed, %w", keyDir, err)
+	}
+	// the leases, the keep-out ranges and the gateway are all occupied
+	occupied := [][2]*big.Int{}
+	for _, ev := range resp.Kvs {
+		logging.Debugf("Key:%v, Value:%v ", string(ev.Key), string(ev.Value))
+		ips, ipe := ipamLeaseToBigRange(string(ev.Key))
+		if ips.Sign() == 0 || ips.Cmp(ripe) > 0 {
+			logging.Debugf("Invalid Key %v", string(ev.Key))
+			continue
+		}
+		occupied = append(occupied, [2]*big.Int{ips, ipe})
+	}
+	if OnScan != nil {
+		leases := make([]allocator.SimpleRange, 0, len(occupied))
+		for _, o := range occupied {
+			leases = append(leases, allocator.SimpleRange{RangeStart: ipamBigToIP(o[0]), RangeEnd: ipamBigToIP(o[1])})
+		}
+		OnScan(keyDir, leases)
+	}
+	occupied = append(occupied, ipamKeptOut(r)...)
+	ipamSortOccupied(occupied)
+
+	if srs := ipamFreeRangesIn(occupied, r, num, opts.Spread, opts.Descending); len(srs) > 0 {
+		sr := srs[0]
+		if len(srs) > 1 {
+			sr = srs[spreadIntn(len(srs))]
+		}
+		logging.Debugf("get IP range (%v-%v) from (%v-%v)", sr.RangeStart, sr.RangeEnd, r.RangeStart, r.RangeEnd)
+		return sr, nil
+	}
+	logging.Errorf("apply ip range from %v failed", keyDir)
+	return nil, ErrRangeExhausted
+}
+
+// ipamFreeRangeIn returns the first range of num ips of r out of the occupied
+// intervals sorted by their starts, nil if none is left
+func ipamFreeRangeIn(occupied [][2]*big.Int, r *allocator.Range, num *big.Int) *allocator.SimpleRange {
+	one := big.NewInt(1)
+	// both families are searched on integers, the family of the subnet picks
+	// the ips of the range found
+	v6 := r.Subnet.IP.To4() == nil
+	rips, ripe := ipamApplyBounds(r)
+	last := rips
+
+	for _, o := range occupied {
+		ips, ipe := o[0], o[1]
+		if ips.Cmp(ripe) > 0 {
+			break
+		}
+		if ipe.Cmp(ripe) > 0 {
+			ipe = ripe
+		}
+		if ips.Cmp(last) <= 0 || new(big.Int).Sub(ips, last).Cmp(num) < 0 {
+			if ipe.Cmp(last) >= 0 {
+				last = new(big.Int).Add(ipe, one)
+			}
+			continue
+		}
+		break
+	}
+	// last is the start of the gap fitting the unit, or of the tail after the
+	// leases once none does, which holds a whole unit or is not applied
+	if sipe := new(big.Int).Add(last, num); sipe.Sub(sipe, one).Cmp(ripe) <= 0 {
+		return &allocator.SimpleRange{allocator.BigIntToIP(last, v6), allocator.BigIntToIP(sipe, v6)}
+	}
+	return nil
+}
+
+// ipamLastFreeRangeIn returns the last range of num ips of r out of the
+// occupied intervals, ending at the highest free ip of a gap fitting it, nil
+// if none is left
+func ipamLastFreeRangeIn(occupied [][2]*big.Int, r *allocator.Range, num *big.Int) *allocator.SimpleRange {
+	one := big.NewInt(1)
+	v6 := r.Subnet.IP.To4() == nil
+	rips, ripe := ipamApplyBounds(r)
+	next := ripe
+
+	// by the ends downward, an interval ending lower never reaches into the
+	// gap above the end of the one before
+	byEnd := append([][2]*big.Int{}, occupied...)
+	sort.Slice(byEnd, func(i, j int) bool { return byEnd[i][1].Cmp(byEnd[j][1]) > 0 })
+	for _, o := range byEnd {
+		ips, ipe := o[0], o[1]
+		if ipe.Cmp(rips) < 0 {
+			break
+		}
+		if ips.Cmp(rips) < 0 {
+			ips = rips
+		}
+		if ipe.Cmp(next) >= 0 || new(big.Int).Sub(next, ipe).Cmp(num) < 0 {
+			if ips.Cmp(next) <= 0 {
+				next = new(big.Int).Sub(ips, one)
+			}
+			continue
+		}
+		break
+	}
+	// next is the end of the gap fitting the unit, or of the head before the
+	// leases once none does, which holds a whole unit or is not applied
+	if sips := new(big.Int).Sub(next, num); sips.Add(sips, one).Cmp(rips) >= 0 {
+		return &allocator.SimpleRange{allocator.BigIntToIP(sips, v6), allocator.BigIntToIP(next, v6)}
+	}
+	return nil
+}
+
+// ipamFreeRangesIn returns the lowest k ranges of num ips of r out of the
+// occupied intervals, or the highest if desc, fewer if fewer are left, and at
+// least the first one
+func ipamFreeRangesIn(occupied [][2]*big.Int, r *allocator.Range, num *big.Int, k int, desc bool) []*allocator.SimpleRange {
+	free := ipamFreeRangeIn
+	if desc {
+		free = ipamLastFreeRangeIn
+	}
+	occupied = append([][2]*big.Int{}, occupied...)
+	srs := []*allocator.SimpleRange{}
+	for len(srs) == 0 || len(srs) < k {
+		sr := free(occupied, r, num)
+		if sr == nil {
+			break
+		}
+		srs = append(srs, sr)
+		occupied = append(occupied, [2]*big.Int{allocator.IPToBigInt(sr.RangeStart), allocator.IPToBigInt(sr.RangeEnd)})
+		ipamSortOccupied(occupied)
+	}
+	return srs
+}
+
+// ApplyPlan is the dry run of the applies of a node from a range
+type ApplyPlan struct {
+	Range   allocator.SimpleRange   `json:"range"`
+	UnitIPs uint64                  `json:"unitIPs"`          // ips of an apply unit
+	Units   uint64                  `json:"units"`            // apply units the node could still apply
+	Capped  bool                    `json:"capped,omitempty"` // the limit was reached, more units may be left
+	Leased  []allocator.SimpleRange `json:"leased"`           // ranges of the range leased to the node
+}
+
+// IPAMPlanApplies simulates the applies of network from r until r is used up,
+// on the leases read from etcd, and counts the apply units the node could
+// still get along with the ranges of r leased to it already. Nothing is
+// written to etcd. At most limit units are simulated unless it is 0, as an
+// ipv6 range holds more than are worth counting.
+func IPAMPlanApplies(network, pool string, r *allocator.Range, unit uint32, priority int, limit uint64) (*ApplyPlan, error) {
+	if err := ipamCheckUnit(r, unit); err != nil {
+		return nil, err
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+	return ipamPlanApplies(em, network, pool, r, unit, priority, limit)
+}
+
+// ipamPlanApplies is IPAMPlanApplies on the client of em, each apply simulated
+// finds its range as ipamApplySharded does and marks it occupied for the next
+func ipamPlanApplies(em *etcdv3.EtcdMultus, network, pool string, r *allocator.Range, unit uint32, priority int, limit uint64) (*ApplyPlan, error) {
+	cli, rKeyDir := em.Cli, em.RootKeyDir
+	keyDir := ipamLeaseKeyDir(rKeyDir, network, pool)
+	value := ipamLeaseValue(em.Id, network, pool)
+
+	pinned, err := ipamGetPinnedIPs(context.Background(), cli, rKeyDir, network)
+	if err != nil {
+		return nil, err
+	}
+	r = ipamKeepPinnedOut(r, pinned)
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	plan := &ApplyPlan{
+		Range:   allocator.SimpleRange{RangeStart: r.RangeStart, RangeEnd: r.RangeEnd},
+		UnitIPs: uint64(1) << unit,
+		Leased:  []allocator.SimpleRange{},
+	}
+	rips, ripe := ipamApplyBounds(r)
+	occupied := [][2]*big.Int{}
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToBigRange(string(ev.Key))
+		if ips.Sign() == 0 || ips.Cmp(ripe) > 0 {
+			continue
+		}
+		occupied = append(occupied, [2]*big.Int{ips, ipe})
+		if ipamLeaseOwner(ev.Value) == value && ipe.Cmp(rips) >= 0 {
+			plan.Leased = append(plan.Leased, *ipamLeaseToSimleRange(strings.Trim(string(ev.Key), " \r\n\t")))
+		}
+	}
+	occupied = append(occupied, ipamKeptOut(r)...)
+	ipamSortOccupied(occupied)
+
+	// each apply takes a unit of the free ips, those of the reserve are left
+	// to the applies of priority
+	most := uint64(math.MaxUint64)
+	if r.MinFree > 0 && priority == 0 {
+		most = 0
+		if free := ipamCountFree(occupied, r); free >= uint64(r.MinFree) {
+			most = (free - uint64(r.MinFree)) / plan.UnitIPs
+		}
+	}
+	if limit > 0 && limit < most {
+		most, plan.Capped = limit, true
+	}
+
+	num := new(big.Int).Lsh(big.NewInt(1), uint(unit))
+	for plan.Units < most {
+		sr := ipamFreeRangeIn(occupied, r, num)
+		if sr == nil {
+			break
+		}
+		occupied = append(occupied, [2]*big.Int{allocator.IPToBigInt(sr.RangeStart), allocator.IPToBigInt(sr.RangeEnd)})
+		ipamSortOccupied(occupied)
+		plan.Units++
+	}
+	plan.Capped = plan.Capped && plan.Units == most
+	return plan, nil
+}
+
+// LeaseInfo is a lease with the identity of the pod whose add applied it and
+// the subnet it was applied from, each empty if not recorded
+type LeaseInfo struct {
+	allocator.SimpleRange
+	Cause  string
+	Subnet string
+}
+
+// leasePageSize is the number of keys a page of a lease walk gets from etcd
+var leasePageSize int64 = 1000
+
+// IPAMWalkLease calls f with the leases belong to id under keyDir a page at a
+// time, by the networks they were applied for, so that a huge keyspace is
+// neither held at once nor fetched in a single response. The walk stops at the
+// first error of f.
+func IPAMWalkLease(cli *clientv3.Client, keyDir, id string, f func(leases map[string][]LeaseInfo) error) error {
+	logging.Debugf("Going to walk all IP lease belong to %v from %v", id, keyDir)
+	return ipamWalkKeys(cli, keyDir, func(kvs []*mvccpb.KeyValue) error {
+		leases := make(map[string][]LeaseInfo)
+		for _, ev := range kvs {
+			owner, cause := ipamParseLeaseValue(string(ev.Value))
+			logging.Debugf("Key:%v, Value:%v, id:%v, match:%v ", string(ev.Key), string(ev.Value), id, owner == id)
+			if owner == id {
+				k := strings.Trim(string(ev.Key), " \r\n\t")
+				network := filepath.Base(filepath.Dir(k))
+				leases[network] = append(leases[network], LeaseInfo{*ipamLeaseToSimleRange(k), cause, ipamLeaseSubnet(ev.Value)})
+			}
+		}
+		if len(leases) == 0 {
+			return nil
+		}
+		return f(leases)
+	})
+}
+
+// ipamWalkKeys calls f with the keys under keyDir a page of leasePageSize at a
+// time, stopping at the first error of f
+func ipamWalkKeys(cli *clientv3.Client, keyDir string, f func(kvs []*mvccpb.KeyValue) error) error {
+	key, end := keyDir, clientv3.GetPrefixRangeEnd(keyDir)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := cli.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(leasePageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		cancel()
+		if err != nil {
+			return logging.Errorf("Get %v failed, %v", keyDir, err)
+		}
+		if len(resp.Kvs) > 0 {
+			if err := f(resp.Kvs); err != nil {
+				return err
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// the next page starts right after the last key
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// IPAMGetAllLease returns the leases belong to id under keyDir by the networks
+// they were applied for, see IPAMWalkLease for the keyspaces too large for it
+func IPAMGetAllLease(cli *clientv3.Client, keyDir, id string) (map[string][]allocator.SimpleRange, error) {
+	leases := make(map[string][]allocator.SimpleRange)
+	err := IPAMWalkLease(cli, keyDir, id, func(page map[string][]LeaseInfo) error {
+		for network, infos := range page {
+			for _, info := range infos {
+				leases[network] = append(leases[network], info.SimpleRange)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// IPAMGetAllPoolLease returns the leases belong to id in all the pools under
+// keyDir, by the networks they were applied for
+func IPAMGetAllPoolLease(cli *clientv3.Client, keyDir, id string) (map[string][]allocator.SimpleRange, error) {
+	logging.Debugf("Going to get all pool IP lease belong to %v from %v", id, keyDir)
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	leases := make(map[string][]allocator.SimpleRange)
+	for _, ev := range resp.Kvs {
+		v := strings.SplitN(ipamLeaseOwner(ev.Value), poolGap, 2)
+		if len(v) != 2 || v[0] != id {
+			continue
+		}
+		sr := ipamLeaseToSimleRange(strings.Trim(string(ev.Key), " \r\n\t"))
+		leases[v[1]] = append(leases[v[1]], *sr)
+	}
+	return leases, nil
+}
+
+func ipamCheckNet(em *etcdv3.EtcdMultus, network string, leases []allocator.SimpleRange) error {
+
+	s, err := disk.New(network, "")
+	if err != nil {
+		return logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	if n, err := s.DedupCache(); err != nil {
+		return logging.Errorf("dedup cache failed, %v", err)
+	} else if n > 0 {
+		logging.Verbosef("removed %d duplicate cache ranges of %v", n, network)
+	}
+	em = ipamNetEtcd(em, s)
+	pool, shards := s.LoadPool(), s.LoadShards()
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	cli, id := em.Cli, ipamLeaseValue(em.Id, network, pool)
+	var checkErr error
+	// the ranges leased by other nodes too are given up by the losing node
+	lost, err := ipamResolveOverlaps(cli, keyDir, id)
+	if err != nil {
+		checkErr = err
+	}
+	for _, sr := range lost {
+		if err := s.DeleteCache(&sr); err != nil {
+			checkErr = logging.Errorf("delete overlapping %v from cache failed, %v", sr, err)
+		}
+	}
+	leases = ipamWithoutRanges(leases, lost)
+	caches, err := s.LoadCache()
+	if err != nil {
+		return logging.Errorf("get cache failed, %v", err)
+	}
+	logging.Debugf("check net:%v\nleases:%v\ncaches:%v\n", network, leases, caches)
+	// the leases restored from the cache expire with the node as the applied
+	// ones, the lease of the node is granted once they are found
+	lease := clientv3.NoLease
+	for _, d := range ipamNetDivergences(leases, caches) {
+		logging.Debugf("fix %v of %v", d, network)
+		switch d.Kind {
+		case DivergenceMismatch:
+			s.DeleteCache(d.Cache)
+		case DivergenceMissingCache:
+			if err := s.AppendCache(d.Lease); err != nil {
+				checkErr = logging.Errorf("append %v to cache failed, %v", *d.Lease, err)
+				etcdv3.TransDelKey(context.Background(), cli, keyDir, shards, ipamSimpleRangeToLease(keyDir, d.Lease))
+			}
+		case DivergenceOrphanCache:
+			if lease == clientv3.NoLease {
+				if lease, err = em.NodeLease(); err != nil {
+					return logging.Errorf("get lease of node failed, %v", err)
+				}
+			}
+			record := ipamLeaseRecord(id, "", ipamSubnetOf(s.LoadSubnets(), d.Cache))
+			err = etcdv3.TransPutKey(context.Background(), cli, keyDir, shards, ipamSimpleRangeToLease(keyDir, d.Cache), record, true, clientv3.WithLease(lease))
+			if err != nil {
+				logging.Debugf("going to delete error cache:%v", *d.Cache)
+				if err := s.DeleteCache(d.Cache); err != nil {
+					checkErr = logging.Errorf("delete %v from cache failed, %v", *d.Cache, err)
+				}
+			}
+		}
+	}
+	if ReclaimWatermark > 0 && checkErr == nil {
+		if _, err := ipamReclaimNet(em, s, network, keyDir, id); err != nil {
+			logging.Errorf("give back a range of %v failed, %v", network, err)
+		}
+	}
+	return checkErr
+}
+
+// ipamOrphanedRanges returns the leases and cached ranges of network out of
+// the subnets recorded by its last ADD, as left by shrinking the subnets
+func ipamOrphanedRanges(network string, leases []allocator.SimpleRange) ([]allocator.SimpleRange, error) {
+	s, err := disk.New(network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	subnets := s.LoadSubnets()
+	if len(subnets) == 0 {
+		return nil, nil
+	}
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, err
+	}
+
+	orphaned := []allocator.SimpleRange{}
+	for _, sr := range append(append([]allocator.SimpleRange{}, leases...), caches...) {
+		contained := false
+		for _, subnet := range subnets {
+			if subnet.Contains(sr.RangeStart) && subnet.Contains(sr.RangeEnd) {
+				contained = true
+				break
+			}
+		}
+		if contained {
+			continue
+		}
+		dup := false
+		for _, o := range orphaned {
+			if o.RangeStart.Equal(sr.RangeStart) && o.RangeEnd.Equal(sr.RangeEnd) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			orphaned = append(orphaned, sr)
+		}
+	}
+	return orphaned, nil
+}
+
+// NetCheckResult is the outcome of reconciling the leases of a network
+type NetCheckResult struct {
+	Network  string
+	Err      error
+	Orphaned []allocator.SimpleRange // leased or cached out of the configured subnets
+}
+
+// checkNet is the reconcile of a network, tests replace it to inject failures
+var checkNet = ipamCheckNet
+
+func IPAMCheckEtcd() error {
+	results, err := IPAMCheckEtcdWithBudget(-1)
+	if err != nil {
+		return err
+	}
+	failed := []string{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Network)
+		}
+	}
+	if len(failed) > 0 {
+		return logging.Errorf("reconcile networks %v failed", failed)
+	}
+	return nil
+}
+
+// IPAMCheckEtcdWithBudget reconciles the leases of all networks between etcd
+// and the local cache. It goes on past the networks failing to reconcile until
+// more than budget of them failed, a negative budget never gives up. The
+// outcome of every processed network is returned, the error is only set when
+// the reconcile can not start or the budget is exceeded.
+func IPAMCheckEtcdWithBudget(budget int) ([]NetCheckResult, error) {
+	// logging.Debugf("Going to check IPAM")
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Cli.Close() // make sure to close the client
+
+	leases, networks, err := ipamNetLeases(etcdMultus)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []NetCheckResult{}
+	failed := 0
+	for _, network := range networks {
+		err := checkNet(etcdMultus, network, leases[network])
+		orphaned, e := ipamOrphanedRanges(network, leases[network])
+		if e != nil {
+			logging.Errorf("check the subnets of %v failed, %v", network, e)
+		}
+		for _, sr := range orphaned {
+			logging.Errorf("range %v-%v of %v is out of the configured subnets, release its ips before shrinking the subnet",
+				sr.RangeStart, sr.RangeEnd, network)
+		}
+		results = append(results, NetCheckResult{network, err, orphaned})
+		if err == nil {
+			continue
+		}
+		failed++
+		if budget >= 0 && failed > budget {
+			return results, logging.Errorf("%d networks failed to reconcile, exceeding the error budget %d", failed, budget)
+		}
+	}
+
+	return results, nil
+}
+
+// ipamNetLeases returns the leases belong to the node of em by the networks
+// they were applied for, and the networks to reconcile, those leased in etcd
+// and those only found locally, in order
+func ipamNetLeases(em *etcdv3.EtcdMultus) (map[string][]allocator.SimpleRange, []string, error) {
+	cli, rKeyDir, id := em.Cli, em.RootKeyDir, em.Id
+	leases, err := ipamRootLeases(cli, rKeyDir, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	localNets := disk.GetAllNet(os.Getenv("NET_DATA_DIR"))
+	logging.Debugf("local net: %v", localNets)
+
+	// the networks configured with a root key dir of their own are checked
+	// against the leases under it
+	rootLeases := map[string]map[string][]allocator.SimpleRange{rKeyDir: leases}
+	for _, n := range localNets {
+		root := ipamLocalRootKeyDir(n)
+		if root == "" || root == rKeyDir {
+			continue
+		}
+		if _, ok := rootLeases[root]; !ok {
+			if rootLeases[root], err = ipamRootLeases(cli, root, id); err != nil {
+				return nil, nil, err
+			}
+		}
+		delete(leases, n)
+		if l, ok := rootLeases[root][n]; ok {
+			leases[n] = l
+		}
+	}
+
+	// networks only found locally are checked with no lease
+	networks := []string{}
+	for network := range leases {
+		networks = append(networks, network)
+	}
+	for _, n := range localNets {
+		if _, ok := leases[n]; !ok {
+			networks = append(networks, n)
+		}
+	}
+	sort.Strings(networks)
+	return leases, networks, nil
+}
+
+// ipamRootLeases returns the leases belong to id under rKeyDir, of the
+// networks and of the pools, by the networks they were applied for
+func ipamRootLeases(cli *clientv3.Client, rKeyDir, id string) (map[string][]allocator.SimpleRange, error) {
+	leases, err := IPAMGetAllLease(cli, filepath.Join(rKeyDir, leaseDir), id)
+	if err != nil {
+		return nil, err
+	}
+	poolLeases, err := IPAMGetAllPoolLease(cli, filepath.Join(rKeyDir, poolDir), id)
+	if err != nil {
+		return nil, err
+	}
+	for network, l := range poolLeases {
+		leases[network] = append(leases[network], l...)
+	}
+	return leases, nil
+}
+
+// ipamLocalRootKeyDir returns the root key dir the local network recorded, ""
+// if none
+func ipamLocalRootKeyDir(network string) string {
+	s, err := disk.New(network, "")
+	if err != nil {
+		logging.Errorf("create disk manager of %v failed, %v", network, err)
+		return ""
+	}
+	defer s.Close()
+	return s.LoadRootKeyDir()
+}
+
+// now is replaced by tests to travel in time
+var now = time.Now
+
+// SpareRelease is a spare range released back to the subnet
+type SpareRelease struct {
+	Network string
+	Range   allocator.SimpleRange
+}
+
+// IPAMReleaseSpareRanges releases the ranges this node leased ahead of use and
+// left without any allocated ip, so that they do not fragment the subnet for
+// good. A range is spare since the first reconcile finding it so, and released
+// once spare for longer than maxAge. The ranges in use are never released, nor
+// the buffer spare ones of each network found spare the latest.
+func IPAMReleaseSpareRanges(maxAge time.Duration, buffer int) ([]SpareRelease, error) {
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Close()
+
+	networks := disk.GetAllNet(os.Getenv("NET_DATA_DIR"))
+	sort.Strings(networks)
+	released := []SpareRelease{}
+	for _, network := range networks {
+		srs, err := ipamReleaseSpareNet(etcdMultus, network, maxAge, buffer)
+		for _, sr := range srs {
+			released = append(released, SpareRelease{network, sr})
+		}
+		if err != nil {
+			logging.Errorf("release spare ranges of %v failed, %v", network, err)
+		}
+	}
+	return released, nil
+}
+
+// ipamRangeUsed tells if one of ips is in sr, of either family
+func ipamRangeUsed(sr *allocator.SimpleRange, ips []net.IP) bool {
+	v6 := sr.RangeStart.To4() == nil
+	start, end := allocator.IPToBigInt(sr.RangeStart), allocator.IPToBigInt(sr.RangeEnd)
+	for _, addr := range ips {
+		if addr == nil || (addr.To4() == nil) != v6 {
+			continue
+		}
+		n := allocator.IPToBigInt(addr)
+		if n.Cmp(start) >= 0 && n.Cmp(end) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func ipamReleaseSpareNet(em *etcdv3.EtcdMultus, network string, maxAge time.Duration, buffer int) ([]allocator.SimpleRange, error) {
+	s, err := disk.New(network, "")
+	if err != nil {
+		return nil, logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache failed, %v", err)
+	}
+	em = ipamNetEtcd(em, s)
+	pool, shards := s.LoadPool(), s.LoadShards()
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	value := ipamLeaseValue(em.Id, network, pool)
+
+	t := now()
+	ips := s.ReservedIPs()
+	old := s.LoadSpareSince()
+	since := map[string]time.Time{}
+	spare := []allocator.SimpleRange{}
+	for _, c := range caches {
+		// the single ip ranges are leased for the pinned ips, which are
+		// released with their pins
+		if c.RangeStart.Equal(c.RangeEnd) || ipamRangeUsed(&c, ips) {
+			continue
+		}
+		k := disk.RangeKey(&c)
+		since[k] = t
+		if st, ok := old[k]; ok {
+			since[k] = st
+		}
+		spare = append(spare, c)
+	}
+	sort.SliceStable(spare, func(i, j int) bool {
+		return since[disk.RangeKey(&spare[i])].After(since[disk.RangeKey(&spare[j])])
+	})
+
+	released := []allocator.SimpleRange{}
+	var releaseErr error
+	for i := range spare {
+		sr, k := &spare[i], disk.RangeKey(&spare[i])
+		if i < buffer || t.Sub(since[k]) < maxAge {
+			continue
+		}
+		if err := s.DeleteCache(sr); err != nil {
+			releaseErr = logging.Errorf("delete %v from cache failed, %v", *sr, err)
+			break
+		}
+		// an ADD may allocate from the range before it is out of the cache
+		if ipamRangeUsed(sr, s.ReservedIPs()) {
+			logging.Verbosef("spare range %v of %v is used meanwhile, keep it", *sr, network)
+			s.AppendCache(sr)
+			delete(since, k)
+			continue
+		}
+		key := ipamSimpleRangeToLease(keyDir, sr)
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := em.Cli.Get(ctx, key)
+		cancel()
+		if err == nil && len(resp.Kvs) > 0 && ipamLeaseOwner(resp.Kvs[0].Value) == value {
+			err = etcdv3.TransDelKey(context.Background(), em.Cli, keyDir, shards, key)
+		}
+		if err != nil {
+			// the range stays leased to this node, so it is cached back
+			s.AppendCache(sr)
+			releaseErr = logging.Errorf("release lease %v failed, %v", key, err)
+			break
+		}
+		logging.Verbosef("release spare range %v of %v, spare since %v", *sr, network, since[k])
+		delete(since, k)
+		released = append(released, *sr)
+	}
+	if err := s.SaveSpareSince(since); err != nil {
+		logging.Errorf("save spare ranges of %v failed, %v", network, err)
+	}
+	return released, releaseErr
+}
+
+// RebuildConflict is a range cached by this node overlapping the lease of
+// another owner in etcd
+type RebuildConflict struct {
+	Network string
+	Range   allocator.SimpleRange
+	Lease   string // key of the overlapping lease
+	Owner   string
+}
+
+// IPAMRebuildFromDisk re-asserts the ranges cached in dataDir as the leases of
+// this node, for etcd losing its data while the nodes keep theirs. It is the
+// inverse of IPAMCheckEtcd which trusts etcd over the cache. The ranges already
+// leased to this node are left as they are, and those overlapping the leases
+// of other owners are not put but returned as conflicts for the operator. The
+// lease dirs are locked as a whole, in the shards the networks recorded.
+func IPAMRebuildFromDisk(dataDir string) ([]RebuildConflict, error) {
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Close()
+
+	networks := disk.GetAllNet(dataDir)
+	sort.Strings(networks)
+	conflicts := []RebuildConflict{}
+	for _, network := range networks {
+		c, err := ipamRebuildNet(etcdMultus, network, dataDir)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, c...)
+	}
+	return conflicts, nil
+}
+
+func ipamRebuildNet(em *etcdv3.EtcdMultus, network, dataDir string) ([]RebuildConflict, error) {
+	s, err := disk.New(network, dataDir)
+	if err != nil {
+		return nil, logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache failed, %v", err)
+	}
+	em = ipamNetEtcd(em, s)
+	pool, shards, subnets := s.LoadPool(), s.LoadShards(), s.LoadSubnets()
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	cli, id := em.Cli, ipamLeaseValue(em.Id, network, pool)
+
+	dirMutex, err := etcdv3.LockDirShards(context.Background(), cli, keyDir, shards)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	leases := map[string]string{}
+	for _, ev := range resp.Kvs {
+		leases[string(ev.Key)] = ipamLeaseOwner(ev.Value)
+	}
+
+	lease, err := em.NodeLease()
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []RebuildConflict{}
+	for _, csr := range caches {
+		if start, end := csr.RangeStart.To4(), csr.RangeEnd.To4(); start != nil && end != nil {
+			csr.RangeStart, csr.RangeEnd = start, end
+		}
+		key := ipamSimpleRangeToLease(keyDir, &csr)
+		if owner, ok := leases[key]; ok && owner == id {
+			continue
+		}
+		var conflict *RebuildConflict
+		for k, owner := range leases {
+			lsr := ipamLeaseToSimleRange(k)
+			if (lsr.RangeStart.To4() == nil) != (csr.RangeStart.To4() == nil) {
+				continue
+			}
+			if csr.Overlaps(lsr) || lsr.Overlaps(&csr) {
+				conflict = &RebuildConflict{network, csr, k, owner}
+				break
+			}
+		}
+		if conflict != nil {
+			logging.Errorf("cache %v of %v conflicts with lease %v of %v", csr, network, conflict.Lease, conflict.Owner)
+			conflicts = append(conflicts, *conflict)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		_, err := cli.Put(ctx, key, ipamLeaseRecord(id, "", ipamSubnetOf(subnets, &csr)), clientv3.WithLease(lease))
+		cancel()
+		if err != nil {
+			return conflicts, logging.Errorf("write key %v to %v failed, %v", key, id, err)
+		}
+		logging.Verbosef("rebuild lease %v:%v from cache", key, id)
+		leases[key] = id
+	}
+	return conflicts, nil
+}
+
+// IPAMReclaimNode reclaims the ranges leased by a dead node by revoking its
+// etcd lease, with nodeLeaseTTL configured the lease keys of the node vanish
+// together. It tells if node had a lease alive.
+func IPAMReclaimNode(node string) (bool, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return false, err
+	}
+	defer em.Close()
+	return etcdv3.RevokeNodeLease(em.Cli, em.RootKeyDir, node)
+}
+
+// IPAMGenPinInfo returns the identity of the pod an ip is pinned to
+func IPAMGenPinInfo(ns, name string) string {
+	return strings.Trim(ns+fixGap+name, "\r\n\t ")
+}
+
+// IPAMPinIP pins addr of network to the pod of identity, so that the pod gets
+// addr on whichever node it runs. The pin is kept until deleted by the operator.
+func IPAMPinIP(network string, addr net.IP, identity string) error {
+	if addr.To4() == nil {
+		return logging.Errorf("invalid ipv4 address %v", addr)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	keyDir := filepath.Join(em.RootKeyDir, pinnedDir, network)
+	return etcdv3.TransPutKey(context.Background(), em.Cli, keyDir, 1, filepath.Join(keyDir, addr.To4().String()), identity, true)
+}
+
+// ipamGetPinnedIPs returns the identities of the pinned ips of network by ip
+func ipamGetPinnedIPs(ctx context.Context, cli *clientv3.Client, rKeyDir, network string) (map[string]string, error) {
+	keyDir := filepath.Join(rKeyDir, pinnedDir, network) + "/"
+	ctx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	pinned := map[string]string{}
+	for _, ev := range resp.Kvs {
+		pinned[filepath.Base(string(ev.Key))] = strings.Trim(string(ev.Value), " \r\n\t")
+	}
+	return pinned, nil
+}
+
+// IPAMGetPinnedIP returns the ip of network pinned to identity, nil if none
+func IPAMGetPinnedIP(network, identity string) (net.IP, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	pinned, err := ipamGetPinnedIPs(context.Background(), em.Cli, em.RootKeyDir, network)
+	if err != nil {
+		return nil, err
+	}
+	for addr, id := range pinned {
+		if id == identity {
+			return net.ParseIP(addr).To4(), nil
+		}
+	}
+	return nil, nil
+}
+
+// IPAMGetPreferredIP returns the ip of network last allocated to identity with
+// soft reserve, nil if none
+func IPAMGetPreferredIP(network, identity string) (net.IP, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	key := filepath.Join(em.RootKeyDir, preferredDir, network, identity)
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return net.ParseIP(strings.Trim(string(resp.Kvs[0].Value), " \r\n\t")), nil
+}
+
+// IPAMSetPreferredIP records addr as the ip of network preferred by identity,
+// which is only a hint, unlike a pin it reserves nothing
+func IPAMSetPreferredIP(network, identity string, addr net.IP) error {
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	keyDir := filepath.Join(em.RootKeyDir, preferredDir, network)
+	return etcdv3.TransPutKey(context.Background(), em.Cli, keyDir, 1, filepath.Join(keyDir, identity), addr.String(), false)
+}
+
+// IPAMApplyPinnedIP leases the range of the single pinned addr to this node,
+// taking it over from the node which ran the pod before. A range leased to
+// this node and covering addr is returned as is, while one leased to another
+// node is a conflict, as the pin was made after the range was leased. As addr
+// may be in any region, all the shards of the lease dir are locked.
+func IPAMApplyPinnedIP(ctx context.Context, network string, pool string, addr net.IP, shards int, opts ApplyOptions) (*allocator.SimpleRange, error) {
+	if addr.To4() == nil {
+		return nil, logging.Errorf("invalid ipv4 address %v", addr)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	value := ipamLeaseValue(em.Id, network, pool)
+
+	dirMutex, err := etcdv3.LockDirShards(ctx, em.Cli, keyDir, shards)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	getCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(getCtx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	ipN := ipaddr.IP4ToUint32(addr)
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToUint32Range(string(ev.Key))
+		if ipN < ips || ipN > ipe {
+			continue
+		}
+		owner := ipamLeaseOwner(ev.Value)
+		if owner == value {
+			return ipamLeaseToSimleRange(string(ev.Key)), nil
+		}
+		if ips != ipe {
+			return nil, logging.Errorf("pinned ip %v is in range %v leased by %v", addr, string(ev.Key), owner)
+		}
+		logging.Verbosef("take over the lease of pinned ip %v from %v", addr, owner)
+	}
+
+	lease, err := em.NodeLease()
+	if err != nil {
+		return nil, err
+	}
+	sr := &allocator.SimpleRange{RangeStart: addr.To4(), RangeEnd: addr.To4()}
+	key := ipamSimpleRangeToLease(keyDir, sr)
+	putCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	_, err = em.Cli.Put(putCtx, key, ipamLeaseRecord(value, opts.Cause, ""), clientv3.WithLease(lease))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("write key %v to %v failed, %v", key, value, err)
+	}
+	return sr, nil
+}
+
+// ErrNodeRangeConflict is returned when the node range of this node overlaps a
+// lease of another owner, i.e. the node indexes or the applies of the network
+// conflict
+var ErrNodeRangeConflict = errors.New("node range is leased by another owner")
+
+// IPAMRecordNodeRange records sr derived by this node from its index as its
+// lease, so that the tools list it with the applied ones. As no other node
+// derives it, the record takes no lock, a lease of another node overlapping it
+// is refused with ErrNodeRangeConflict.
+func IPAMRecordNodeRange(ctx context.Context, network string, pool string, sr *allocator.SimpleRange, opts ApplyOptions) error {
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	value := ipamLeaseValue(em.Id, network, pool)
+
+	getCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(getCtx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	for _, ev := range resp.Kvs {
+		owner := ipamLeaseOwner(ev.Value)
+		if owner != value && ipamLeaseToSimleRange(string(ev.Key)).Overlaps(sr) {
+			logging.Errorf("node range %v-%v overlaps %v leased by %v", sr.RangeStart, sr.RangeEnd, string(ev.Key), owner)
+			return fmt.Errorf("node range %v-%v overlaps %v leased by %v, %w", sr.RangeStart, sr.RangeEnd, string(ev.Key), owner, ErrNodeRangeConflict)
+		}
+	}
+
+	lease, err := em.NodeLease()
+	if err != nil {
+		return err
+	}
+	key := ipamSimpleRangeToLease(keyDir, sr)
+	putCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	_, err = em.Cli.Put(putCtx, key, ipamLeaseRecord(value, opts.Cause, ""), clientv3.WithLease(lease))
+	cancel()
+	if err != nil {
+		return logging.Errorf("write key %v to %v failed, %v", key, value, err)
+	}
+	return nil
+}
+
+// IPState is the cluster-wide allocation state of an IP
+type IPState int
+
+const (
+	// IPFree means no lease range or fix claim covers the IP
+	IPFree IPState = iota
+	// IPLeasedUnused means the IP is in a range leased by this node, but not used
+	IPLeasedUnused
+	// IPLeased means the IP is in a range leased by another node, whose usage is
+	// only recorded on the disk of that node
+	IPLeased
+	// IPInUse means the IP is assigned to a container
+	IPInUse
+)
+
+func (s IPState) String() string {
+	switch s {
+	case IPFree:
+		return "free"
+	case IPLeasedUnused:
+		return "leased-unused"
+	case IPLeased:
+		return "leased"
+	case IPInUse:
+		return "in-use"
+	}
+	return "unknown"
+}
+
+var (
+	leaseMapCells = uint64(256) // cells of a map at most, a cell is a block of ips
+	leaseMapRow   = uint64(64)  // cells of a row of a map
+)
+
+// IPAMLeaseMap renders the leases of network in subnet as an ASCII map for
+// the operators, see renderLeaseMap
+func IPAMLeaseMap(network, pool string, subnet *net.IPNet) (string, error) {
+	if subnet.IP.To4() == nil {
+		return "", fmt.Errorf("lease map of %v is not supported, only ipv4 is", subnet)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return "", err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return "", logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	leases := map[string][]allocator.SimpleRange{}
+	for _, ev := range resp.Kvs {
+		owner := ipamLeaseOwner(ev.Value)
+		sr := ipamLeaseToSimleRange(strings.Trim(string(ev.Key), " \r\n\t"))
+		leases[owner] = append(leases[owner], *sr)
+	}
+	return renderLeaseMap(subnet, leases), nil
+}
+
+// renderLeaseMap renders the leases of each owner in subnet, one character a
+// cell of ips in rows of leaseMapRow cells. The owners are marked by letters
+// in the order of their names, "*" marks a cell shared by owners and "." a
+// free one. The legend follows with the ips leased to each owner.
+func renderLeaseMap(subnet *net.IPNet, leases map[string][]allocator.SimpleRange) string {
+	start := uint64(ipaddr.IP4ToUint32(subnet.IP.To4()))
+	ones, bits := subnet.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+	cell := uint64(1)
+	for size/cell > leaseMapCells {
+		cell <<= 1
+	}
+	marks := bytes.Repeat([]byte{'.'}, int(size/cell))
+
+	owners := []string{}
+	for owner := range leases {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	letters := map[string]byte{}
+	used := map[string]uint64{}
+	free := size
+	for i, owner := range owners {
+		letter := byte('#')
+		if i < 26 {
+			letter = byte('A' + i)
+		} else if i < 52 {
+			letter = byte('a' + i - 26)
+		}
+		letters[owner] = letter
+		for _, sr := range leases[owner] {
+			s, e := uint64(ipaddr.IP4ToUint32(sr.RangeStart)), uint64(ipaddr.IP4ToUint32(sr.RangeEnd))
+			if e < start || s >= start+size {
+				continue
+			}
+			if s < start {
+				s = start
+			}
+			if e >= start+size {
+				e = start + size - 1
+			}
+			used[owner] += e - s + 1
+			free -= e - s + 1
+			for c := (s - start) / cell; c <= (e-start)/cell; c++ {
+				if marks[c] == '.' || marks[c] == letter {
+					marks[c] = letter
+				} else {
+					marks[c] = '*'
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v, %d ips per cell\n", subnet, cell)
+	for r := uint64(0); r < uint64(len(marks)); r += leaseMapRow {
+		end := r + leaseMapRow
+		if end > uint64(len(marks)) {
+			end = uint64(len(marks))
+		}
+		fmt.Fprintf(&buf, "%-15s %s\n", ipaddr.Uint32ToIP4(uint32(start+r*cell)), marks[r:end])
+	}
+	for _, owner := range owners {
+		fmt.Fprintf(&buf, "%c %s %d ips\n", letters[owner], owner, used[owner])
+	}
+	fmt.Fprintf(&buf, ". free %d ips\n", free)
+	return buf.String()
+}
+
+// IPAMQueryIP tells whether addr of network is allocatable cluster-wide, it
+// returns the state of the IP and the owner holding it, which is the node of
+// the lease range or the fix info of the claim.
+//
+// The result is a snapshot without any lock held, a node may lease or allocate
+// the IP right after it returns. The usage of IPs in a leased range is only
+// known by the disk of the node owning the range, so it is reported for the
+// ranges of this node only, the others are reported as IPLeased.
+func IPAMQueryIP(network string, addr net.IP, dataDir string) (IPState, string, error) {
+	if addr.To4() == nil {
+		return IPFree, "", logging.Errorf("invalid ipv4 address %v", addr)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return IPFree, "", err
+	}
+	defer em.Close()
+
+	s, err := disk.New(network, dataDir)
+	if err != nil {
+		return IPFree, "", logging.Errorf("create disk manager failed, %v", err)
+	}
+	em = ipamNetEtcd(em, s)
+	pool := s.LoadPool()
+	s.Close()
+
+	ipN := ipaddr.IP4ToUint32(addr)
+	for _, dir := range []string{fixDir, staticDir} {
+		key := filepath.Join(em.RootKeyDir, dir, network, fmt.Sprintf("%010d", ipN))
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := em.Cli.Get(ctx, key)
+		cancel()
+		if err != nil {
+			return IPFree, "", logging.Errorf("Get %v failed, %v", key, err)
+		}
+		if len(resp.Kvs) > 0 {
+			return IPInUse, strings.Trim(string(resp.Kvs[0].Value), " \r\n\t"), nil
+		}
+	}
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return IPFree, "", logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToUint32Range(string(ev.Key))
+		if ipN < ips || ipN > ipe {
+			continue
+		}
+		owner := ipamLeaseOwner(ev.Value)
+		// the range of a pool may be leased for another network of the pool
+		node, leaseNet := owner, network
+		if pool != "" {
+			if v := strings.SplitN(owner, poolGap, 2); len(v) == 2 {
+				node, leaseNet = v[0], v[1]
+			}
+		}
+		if node != em.Id {
+			return IPLeased, owner, nil
+		}
+		if _, err := os.Stat(disk.GetEscapedPath(filepath.Join(filepath.Dir(s.Dir()), leaseNet), addr.String())); err == nil {
+			return IPInUse, owner, nil
+		}
+		return IPLeasedUnused, owner, nil
+	}
+	return IPFree, "", nil
+}
+
+// IPOwner is the lease covering an ip, telling the node responsible for it
+type IPOwner struct {
+	Node    string                // the node of the lease, or the owner of the static ones
+	Network string                // the network the range was leased for, another one of a pool
+	Range   allocator.SimpleRange // the range leased
+	Cause   string                // the pod whose add applied the range, if recorded
+}
+
+// ErrIPOutOfPool is returned for an ip out of the subnets of the network, which
+// no lease ever covers
+var ErrIPOutOfPool = errors.New("ip is out of the subnets of the network")
+
+// IPAMOwnerOfIP returns the lease of network covering addr cluster-wide, nil if
+// addr is free. Unlike IPAMQueryIP it needs no data dir, so it runs anywhere.
+func IPAMOwnerOfIP(network, pool string, subnets []*net.IPNet, addr net.IP) (*IPOwner, error) {
+	if addr.To4() == nil {
+		return nil, logging.Errorf("invalid ipv4 address %v", addr)
+	}
+	in := len(subnets) == 0
+	for _, subnet := range subnets {
+		if subnet.Contains(addr) {
+			in = true
+			break
+		}
+	}
+	if !in {
+		return nil, ErrIPOutOfPool
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	ipN := ipaddr.IP4ToUint32(addr)
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToUint32Range(string(ev.Key))
+		if ipN < ips || ipN > ipe {
+			continue
+		}
+		owner, cause := ipamParseLeaseValue(string(ev.Value))
+		o := &IPOwner{Node: owner, Network: network, Range: *ipamLeaseToSimleRange(string(ev.Key)), Cause: cause}
+		if pool != "" {
+			if v := strings.SplitN(owner, poolGap, 2); len(v) == 2 {
+				o.Node, o.Network = v[0], v[1]
+			}
+		}
+		return o, nil
+	}
+	return nil, nil
+}
+
+// IPAMVerifyRelease makes sure no per-IP claim in etcd still references the
+// container after its IPs were released, deleting the stale claims it finds
+func IPAMVerifyRelease(network string, ips []net.IP, id string) error {
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	for _, dir := range []string{fixDir, staticDir} {
+		keyDir := filepath.Join(em.RootKeyDir, dir, network) + "/"
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			return logging.Errorf("Get %v failed, %v", keyDir, err)
+		}
+		for _, ev := range resp.Kvs {
+			k, v := string(ev.Key), strings.Trim(string(ev.Value), " \r\n\t")
+			for _, addr := range ips {
+				if addr.To4() == nil || filepath.Base(k) != fmt.Sprintf("%010d", ipaddr.IP4ToUint32(addr)) {
+					continue
+				}
+				if v == id {
+					logging.Errorf("claim %v still references released ip %v of %v, going to delete it", k, addr, id)
+					if err := etcdv3.TransDelKey(context.Background(), em.Cli, filepath.Dir(k), 1, k); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// IPAMReleaseIPRange releases the lease of sr applied to this node, e.g. when
+// the data dir can not track it, giving up once ctx is done
+func IPAMReleaseIPRange(ctx context.Context, network, pool string, sr *allocator.SimpleRange, shards int) error {
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+	return em.RetryContext(ctx, "release", func() error {
+		return ipamReleaseOwnLease(ctx, em, ipamLeaseKeyDir(em.RootKeyDir, network, pool), shards, ipamLeaseValue(em.Id, network, pool), sr)
+	})
+}
+
+// ipamReleaseOwnLease deletes the lease of sr unless it is owned by another,
+// under the locks of the shards of keyDir
+func ipamReleaseOwnLease(ctx context.Context, em *etcdv3.EtcdMultus, keyDir string, shards int, value string, sr *allocator.SimpleRange) error {
+	key := ipamSimpleRangeToLease(keyDir, sr)
+	getCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(getCtx, key)
+	cancel()
+	if err != nil {
+		return logging.Errorf("Get %v failed, %v", key, err)
+	}
+	if len(resp.Kvs) == 0 || ipamLeaseOwner(resp.Kvs[0].Value) != value {
+		return nil
+	}
+	return etcdv3.TransDelKey(ctx, em.Cli, keyDir, shards, key)
+}
+
+// IPAMClaimIP leases a single ip of r to this node and claims it for id in
+// the static dir, for the ADDs tracked by etcd only while the data dir fails
+func IPAMClaimIP(ctx context.Context, network, pool string, r *allocator.Range, id string, shards, priority int, opts ApplyOptions) (net.IP, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	sr, err := ipamApplySharded(ctx, em, network, pool, r, 0, shards, priority, opts)
+	if err != nil {
+		return nil, err
+	}
+	// the claim goes with the lease of the ip when the node dies
+	lease, err := em.NodeLease()
+	if err == nil {
+		key := filepath.Join(em.RootKeyDir, staticDir, network, fmt.Sprintf("%010d", ipaddr.IP4ToUint32(sr.RangeStart)))
+		err = etcdv3.PutKeyIfAbsent(ctx, em.Cli, key, id, clientv3.WithLease(lease))
+	}
+	if err != nil {
+		if e := ipamReleaseOwnLease(ctx, em, ipamLeaseKeyDir(em.RootKeyDir, network, pool), shards, ipamLeaseValue(em.Id, network, pool), sr); e != nil {
+			logging.Errorf("release lease of %v failed, %v", sr.RangeStart, e)
+		}
+		return nil, logging.Errorf("claim %v for %v failed, %v", sr.RangeStart, id, err)
+	}
+	return sr.RangeStart, nil
+}
+
+// IPAMReserveIP leases addr alone and reserves it for id in the static dir,
+// for the ADDs requesting the ip by their args. The lease is owned by the
+// static owner, so that the ranges applied skip it while the reconcile leaves
+// it out of the cache of the node, and expires with the node. It fails when a
+// lease covers addr, unless it is the reservation of id already.
+func IPAMReserveIP(ctx context.Context, network, pool string, addr net.IP, id string, shards int, opts ApplyOptions) error {
+	if addr.To4() == nil {
+		return logging.Errorf("invalid ipv4 address %v", addr)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	dirMutex, err := etcdv3.LockDirShards(ctx, em.Cli, keyDir, shards)
+	if err != nil {
+		return err
+	}
+	defer dirMutex.Close()
+
+	ipN := ipaddr.IP4ToUint32(addr)
+	key := filepath.Join(em.RootKeyDir, staticDir, network, fmt.Sprintf("%010d", ipN))
+	reqCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(reqCtx, key)
+	cancel()
+	if err != nil {
+		return logging.Errorf("Get %v failed, %v", key, err)
+	}
+	if len(resp.Kvs) > 0 {
+		if holder := strings.Trim(string(resp.Kvs[0].Value), " \r\n\t"); holder != id {
+			return logging.Errorf("ip %v of %v is reserved for %v", addr, network, holder)
+		}
+		return nil
+	}
+	reqCtx, cancel = context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err = em.Cli.Get(reqCtx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	for _, ev := range resp.Kvs {
+		if ips, ipe := ipamLeaseToUint32Range(string(ev.Key)); ipN >= ips && ipN <= ipe {
+			return logging.Errorf("ip %v of %v is in range %v leased by %v", addr, network, string(ev.Key), ipamLeaseOwner(ev.Value))
+		}
+	}
+
+	lease, err := em.NodeLease()
+	if err != nil {
+		return err
+	}
+	leaseKey := ipamSimpleRangeToLease(keyDir, &allocator.SimpleRange{RangeStart: addr.To4(), RangeEnd: addr.To4()})
+	reqCtx, cancel = context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	txn, err := em.Cli.Txn(reqCtx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0), clientv3.Compare(clientv3.CreateRevision(leaseKey), "=", 0)).
+		Then(clientv3.OpPut(key, id, clientv3.WithLease(lease)),
+			clientv3.OpPut(leaseKey, ipamLeaseRecord(ipamLeaseValue(staticOwner, network, pool), opts.Cause, ""), clientv3.WithLease(lease))).
+		Commit()
+	cancel()
+	if err != nil {
+		return logging.Errorf("reserve %v for %v failed, %v", addr, id, err)
+	}
+	if !txn.Succeeded {
+		return logging.Errorf("ip %v of %v is reserved or leased meanwhile", addr, network)
+	}
+	return nil
+}
+
+// IPAMReleaseClaims releases the ips claimed for id by IPAMClaimIP or reserved
+// for id by IPAMReserveIP
+func IPAMReleaseClaims(ctx context.Context, network, pool, id string, shards int) ([]net.IP, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	claimDir := filepath.Join(em.RootKeyDir, staticDir, network) + "/"
+	getCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(getCtx, claimDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", claimDir, err)
+	}
+	keyDir, value := ipamLeaseKeyDir(em.RootKeyDir, network, pool), ipamLeaseValue(em.Id, network, pool)
+	released := []net.IP{}
+	for _, ev := range resp.Kvs {
+		if strings.Trim(string(ev.Value), " \r\n\t") != id {
+			continue
+		}
+		addr := ipaddr.Uint32ToIP4(ipaddr.StrToUint32(filepath.Base(string(ev.Key))))
+		sr := &allocator.SimpleRange{RangeStart: addr, RangeEnd: addr}
+		if err := ipamReleaseOwnLease(ctx, em, keyDir, shards, value, sr); err != nil {
+			return released, err
+		}
+		if err := ipamReleaseOwnLease(ctx, em, keyDir, shards, ipamLeaseValue(staticOwner, network, pool), sr); err != nil {
+			return released, err
+		}
+		if err := etcdv3.TransDelKey(ctx, em.Cli, strings.TrimSuffix(claimDir, "/"), 1, string(ev.Key)); err != nil {
+			return released, err
+		}
+		released = append(released, addr)
+	}
+	return released, nil
+}
+
+// GetFreeIPRange is used to find a free IP range
+func IPAMApplyFixIP(ctx context.Context, network string, r *allocator.Range, fixInfo string) (*net.IPNet, error) {
+	// netConf *allocator.Net
+	logging.Debugf("Going to do apply fix IP from %v for %v", r, network)
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	// cli, rKeyDir, id := etcdMultus.Cli, etcdMultus.RootKeyDir, etcdMultus.Id
+	defer em.Close() // make sure to close the client
+
+	keyDir := filepath.Join(em.RootKeyDir, fixDir, network)
+
+	dirMutex, err := etcdv3.LockDir(ctx, em.Cli, keyDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	reqCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(reqCtx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	freeIPs := []uint32{}
+	fixIP := uint32(0)
+	rips, ripe := ipaddr.IP4ToUint32(r.RangeStart), ipaddr.IP4ToUint32(r.RangeEnd)
+	tmp := ipaddr.IP4ToUint32(r.Subnet.IP) + 2
+	if rips < tmp {
+		rips = tmp
+	}
+	last := rips
+	for _, ev := range resp.Kvs {
+		logging.Debugf("Key:%v, Value:%v, fixInfo:%v", string(ev.Key), string(ev.Value), fixInfo)
+		fix := ipaddr.StrToUint32(filepath.Base(string(ev.Key)))
+		addr := ipaddr.Uint32ToIP4(fix)
+		v := string(ev.Value)
+
+		if (ip.Cmp(r.RangeStart, addr) > 0) || (ip.Cmp(r.RangeEnd, addr) < 0) {
+			if v == fixInfo {
+				reqCtx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+				em.Cli.Delete(reqCtx, string(ev.Key))
+				cancel()
+			}
+			continue
+		}
+		if v == fixInfo {
+			fixIP = fix
+			break
+		}
+
+		if fix-last > 0 {
+			for i := last; i < fix; i++ {
+				freeIPs = append(freeIPs, i)
+			}
+		}
+
+		last = fix + 1
+	}
+
+	if fixIP == 0 {
+		for i := last; i < ripe+1; i++ {
+			freeIPs = append(freeIPs, i)
+		}
+		if len(freeIPs) > 0 {
+			fixIP = freeIPs[rand.Intn(len(freeIPs))]
+		} else {
+			return nil, logging.Errorf("no availble fixed ip")
+		}
+	}
+
+	key := filepath.Join(keyDir, fmt.Sprintf("%010d", fixIP))
+
+	logging.Debugf("Going to put %v:%v", key, fixInfo)
+
+	reqCtx, cancel = context.WithTimeout(ctx, etcdv3.RequestTimeout)
+	_, err = em.Cli.Put(reqCtx, key, fixInfo)
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("write key %v to %v failed", key, fixInfo)
+	}
+	return &net.IPNet{IP: ipaddr.Uint32ToIP4(fixIP), Mask: r.Subnet.Mask}, nil
+}
+
+// StaticEntry is a fixed assignment of an ip to an identity, e.g. exported by
+// the ipam migrated from
+type StaticEntry struct {
+	IP       net.IP `json:"ip"`
+	Identity string `json:"identity"`
+}
+
+// StaticConflict is an entry not imported and the reason of it
+type StaticConflict struct {
+	Entry  StaticEntry
+	Reason string
+}
+
+// IPAMImportStatic reserves the ips of entries for their identities in the
+// static dir of network. Each ip is leased as a single ip range owned by
+// static too, which keeps the applies of the nodes away from it. The entries
+// out of subnets, reserved for another identity or in a range leased already
+// are not imported but returned as conflicts, the ones imported before are
+// skipped. The lease dir is locked as a whole, in shards as configured for the
+// network.
+func IPAMImportStatic(network, pool string, subnets []*net.IPNet, entries []StaticEntry, shards int) ([]StaticConflict, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	value := ipamLeaseValue(staticOwner, network, pool)
+	staticKeyDir := filepath.Join(em.RootKeyDir, staticDir, network)
+
+	dirMutex, err := etcdv3.LockDirShards(context.Background(), em.Cli, keyDir, shards)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	leases := resp.Kvs
+	ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err = em.Cli.Get(ctx, staticKeyDir+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", staticKeyDir, err)
+	}
+	reserved := map[string]string{}
+	for _, ev := range resp.Kvs {
+		reserved[string(ev.Key)] = strings.Trim(string(ev.Value), " \r\n\t")
+	}
+
+	conflicts := []StaticConflict{}
+	for _, e := range entries {
+		conflict := func(format string, args ...interface{}) {
+			conflicts = append(conflicts, StaticConflict{e, fmt.Sprintf(format, args...)})
+		}
+		addr := e.IP.To4()
+		if addr == nil {
+			conflict("not an ipv4 address")
+			continue
+		}
+		subnet := ""
+		for _, s := range subnets {
+			if s.Contains(addr) {
+				subnet = s.String()
+				break
+			}
+		}
+		if subnet == "" {
+			conflict("out of the subnets %v", subnets)
+			continue
+		}
+		ipN := ipaddr.IP4ToUint32(addr)
+		key := filepath.Join(staticKeyDir, fmt.Sprintf("%010d", ipN))
+		if id, ok := reserved[key]; ok {
+			if id != e.Identity {
+				conflict("reserved for %v", id)
+			}
+			continue
+		}
+		owner := ""
+		for _, ev := range leases {
+			if ips, ipe := ipamLeaseToUint32Range(string(ev.Key)); ipN >= ips && ipN <= ipe {
+				owner = ipamLeaseOwner(ev.Value)
+				break
+			}
+		}
+		if owner != "" {
+			conflict("leased by %v", owner)
+			continue
+		}
+		leaseKey := ipamSimpleRangeToLease(keyDir, &allocator.SimpleRange{RangeStart: addr, RangeEnd: addr})
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		txn, err := em.Cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0), clientv3.Compare(clientv3.CreateRevision(leaseKey), "=", 0)).
+			Then(clientv3.OpPut(key, e.Identity), clientv3.OpPut(leaseKey, ipamLeaseRecord(value, "", subnet))).
+			Commit()
+		cancel()
+		if err != nil {
+			return conflicts, logging.Errorf("reserve %v for %v failed, %v", addr, e.Identity, err)
+		}
+		if !txn.Succeeded {
+			conflict("reserved or leased meanwhile")
+			continue
+		}
+		reserved[key] = e.Identity
+	}
+	return conflicts, nil
+}
+
+// GetFreeIPRange is used to find a free IP range
+func IPAMGenFixInfo(ns, name string, n int) string {
+	return strings.Trim(ns+fixGap+name+fixGap+strconv.Itoa(n), "\r\n\t ")
+
+}
+func IPAMParseFixInfo(info string) (string, string) {
+	v := strings.Split(strings.Trim(info, " \r\n\t"), fixGap)
+	if len(v) < 2 {
+		return "waitToDel", "waitToDel"
+	}
+	return v[0], v[1]
+}
@@ -2,16 +2,24 @@ package etcdv3cli
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
-	// "strings"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/intel/multus-cni/etcdv3"
 	"github.com/archichris/netools/ipaddr"
 	"github.com/intel/multus-cni/logging"
@@ -146,6 +154,58 @@ var _ = Describe("Cli", func() {
 			lease := ipamSimpleRangeToLease(keyDir, &rs)
 			Expect(lease).To(Equal("multus/testtype/testnet/" + fmt.Sprintf(rangeTemplate, ipU32, 4)))
 		})
+		It("convert ipv6 lease and simple range", func() {
+			rs := allocator.SimpleRange{net.ParseIP("fd00::40"), net.ParseIP("fd00::7f")}
+			lease := ipamSimpleRangeToLease("multus/testtype/testnet", &rs)
+			Expect(lease).To(Equal("multus/testtype/testnet/336294682933583715844663186250927177792-6"))
+			Expect(ipamLeaseToSimleRange(lease).Match(&rs)).To(BeTrue())
+			// the ipv4 views of the lease are empty
+			ips, ipe := ipamLeaseToUint32Range(lease)
+			Expect(ips).To(Equal(uint32(0)))
+			Expect(ipe).To(Equal(uint32(0)))
+		})
+		It("encode and decode the lease keys back", func() {
+			for _, c := range []struct {
+				start    string
+				hostSize uint
+				base     string
+			}{
+				{"10.0.0.16", 0, "0167772176-0"},
+				{"10.0.0.16", 4, "0167772176-4"},
+				{"192.168.56.32", 5, "3232249888-5"},
+				{"fd00::40", 6, "336294682933583715844663186250927177792-6"},
+			} {
+				start := allocator.IPToBigInt(net.ParseIP(c.start))
+				base := ipamEncodeLease(start, c.hostSize)
+				Expect(base).To(Equal(c.base))
+				ips, ipe, legacy, ok := ipamDecodeLease(base)
+				Expect(ok).To(BeTrue())
+				Expect(legacy).To(BeFalse())
+				Expect(ips.Cmp(start)).To(Equal(0))
+				Expect(new(big.Int).Sub(ipe, ips).Int64()).To(Equal(int64(1)<<c.hostSize - 1))
+			}
+			for _, base := range []string{"", "0167772176", "a-4", "0167772176-4-1", "-1-4"} {
+				_, _, _, ok := ipamDecodeLease(base)
+				Expect(ok).To(BeFalse())
+			}
+		})
+
+		It("decode the legacy keys of the first and the last ips", func() {
+			for base, want := range map[string][2]string{
+				fmt.Sprintf("%10d-%10d", 167772176, 167772199):   {"10.0.0.16", "10.0.0.39"},
+				fmt.Sprintf("%10d-%10d", 3232249888, 3232249903): {"192.168.56.32", "192.168.56.47"},
+			} {
+				ips, ipe, legacy, ok := ipamDecodeLease(base)
+				Expect(ok).To(BeTrue())
+				Expect(legacy).To(BeTrue())
+				Expect(ipamBigToIP(ips).String()).To(Equal(want[0]))
+				Expect(ipamBigToIP(ipe).String()).To(Equal(want[1]))
+			}
+			_, _, _, ok := ipamDecodeLease(fmt.Sprintf("%10d-%10d", 167772199, 167772176))
+			Expect(ok).To(BeFalse())
+			// a legacy range of any size takes the keys of powers of two
+			Expect(ipamSplitLease(big.NewInt(167772176), big.NewInt(167772199))).To(Equal([]string{"0167772176-4", "0167772192-3"}))
+		})
 	})
 	Describe("applying ip from etcd", func() {
 		var netConf *allocator.Net
@@ -170,12 +230,160 @@ var _ = Describe("Cli", func() {
 			Expect(err).To(BeNil())
 			defer em.Close()
 			keyDir := filepath.Join(em.RootKeyDir, leaseDir, "testnet")
-			sr, err := ipamGetFreeIPRange(em.Cli, keyDir, &rangeTest, unit)
+			sr, err := ipamGetFreeIPRange(context.TODO(), em.Cli, keyDir, &rangeTest, unit, ApplyOptions{})
 			Expect(err).To(BeNil())
 			Expect(ipaddr.IP4ToUint32(sr.RangeEnd) - ipaddr.IP4ToUint32(sr.RangeStart)).To(Equal(num - 1))
 
 		})
 
+		It("find the free range in the gaps and in the tail after the leases", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, "tailnet")
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.95").To4()
+			lease := func(start, end string) {
+				sr := allocator.SimpleRange{RangeStart: net.ParseIP(start).To4(), RangeEnd: net.ParseIP(end).To4()}
+				_, err := em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &sr), "other-node")
+				Expect(err).To(BeNil())
+			}
+			find := func() string {
+				sr, err := ipamGetFreeIPRange(context.TODO(), em.Cli, keyDir, &r, unit, ApplyOptions{})
+				if err != nil {
+					return err.Error()
+				}
+				return sr.RangeStart.String()
+			}
+
+			// packed at the front
+			lease("192.168.56.32", "192.168.56.47")
+			lease("192.168.56.48", "192.168.56.63")
+			Expect(find()).To(Equal("192.168.56.64"))
+			// a gap in the middle goes first
+			lease("192.168.56.80", "192.168.56.95")
+			Expect(find()).To(Equal("192.168.56.64"))
+			em.Cli.Delete(context.TODO(), keyDir+"/", clientv3.WithPrefix())
+			lease("192.168.56.32", "192.168.56.47")
+			lease("192.168.56.64", "192.168.56.79")
+			Expect(find()).To(Equal("192.168.56.48"))
+			// a tail shorter than the unit is not applied
+			lease("192.168.56.48", "192.168.56.63")
+			lease("192.168.56.80", "192.168.56.87")
+			Expect(find()).To(Equal(ErrRangeExhausted.Error()))
+			lease("192.168.56.88", "192.168.56.95")
+			Expect(find()).To(Equal(ErrRangeExhausted.Error()))
+		})
+
+		It("spread over the lowest free ranges only if configured", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			defer func() { spreadIntn = rand.Intn }()
+			opts := ApplyOptions{}
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, "spreadnet")
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.111").To4()
+			sr := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}
+			_, err = em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &sr), "other-node")
+			Expect(err).To(BeNil())
+			find := func() string {
+				sr, err := ipamGetFreeIPRange(context.TODO(), em.Cli, keyDir, &r, unit, opts)
+				Expect(err).To(BeNil())
+				return sr.RangeStart.String()
+			}
+
+			for _, spread := range []int{0, 1} {
+				opts.Spread = spread
+				Expect(find()).To(Equal("192.168.56.32"))
+			}
+			opts.Spread = 3
+			picked := map[string]bool{}
+			for seed := int64(1); seed <= 8; seed++ {
+				spreadIntn = rand.New(rand.NewSource(seed)).Intn
+				picked[find()] = true
+			}
+			Expect(len(picked)).To(BeNumerically(">", 1))
+			for start := range picked {
+				Expect([]string{"192.168.56.32", "192.168.56.64", "192.168.56.80"}).To(ContainElement(start))
+			}
+		})
+
+		It("find the highest free range first when descending", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			defer func() { spreadIntn = rand.Intn }()
+			opts := ApplyOptions{Descending: true}
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, "downnet")
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.111").To4()
+			lease := func(start, end string) {
+				sr := allocator.SimpleRange{RangeStart: net.ParseIP(start).To4(), RangeEnd: net.ParseIP(end).To4()}
+				_, err := em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &sr), "other-node")
+				Expect(err).To(BeNil())
+			}
+			find := func() string {
+				sr, err := ipamGetFreeIPRange(context.TODO(), em.Cli, keyDir, &r, unit, opts)
+				if err != nil {
+					return err.Error()
+				}
+				Expect(ipaddr.IP4ToUint32(sr.RangeEnd) - ipaddr.IP4ToUint32(sr.RangeStart)).To(Equal(num - 1))
+				return sr.RangeStart.String()
+			}
+
+			// the top of a fresh range goes first
+			Expect(find()).To(Equal("192.168.56.96"))
+			// leases in the middle leave the gaps above them first
+			lease("192.168.56.64", "192.168.56.79")
+			Expect(find()).To(Equal("192.168.56.96"))
+			lease("192.168.56.96", "192.168.56.111")
+			Expect(find()).To(Equal("192.168.56.80"))
+			lease("192.168.56.80", "192.168.56.95")
+			Expect(find()).To(Equal("192.168.56.48"))
+			// a gap shorter than the unit is skipped for the one below
+			lease("192.168.56.48", "192.168.56.55")
+			Expect(find()).To(Equal("192.168.56.32"))
+			// the highest unit of a wider gap is claimed
+			em.Cli.Delete(context.TODO(), keyDir+"/", clientv3.WithPrefix())
+			lease("192.168.56.64", "192.168.56.79")
+			lease("192.168.56.80", "192.168.56.95")
+			lease("192.168.56.96", "192.168.56.111")
+			lease("192.168.56.56", "192.168.56.63")
+			Expect(find()).To(Equal("192.168.56.40"))
+			lease("192.168.56.40", "192.168.56.55")
+			Expect(find()).To(Equal(ErrRangeExhausted.Error()))
+
+			// the spread picks one of the highest free ranges
+			em.Cli.Delete(context.TODO(), keyDir+"/", clientv3.WithPrefix())
+			lease("192.168.56.64", "192.168.56.79")
+			opts.Spread = 3
+			picked := map[string]bool{}
+			for seed := int64(1); seed <= 8; seed++ {
+				spreadIntn = rand.New(rand.NewSource(seed)).Intn
+				picked[find()] = true
+			}
+			Expect(len(picked)).To(BeNumerically(">", 1))
+			for start := range picked {
+				Expect([]string{"192.168.56.96", "192.168.56.80", "192.168.56.48"}).To(ContainElement(start))
+			}
+		})
+
+		It("fail instead of finding a range or exhaustion when etcd fails", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, "testnet")
+			// the gets of a closed client fail
+			em.Close()
+			sr, err := ipamGetFreeIPRange(context.TODO(), em.Cli, keyDir, &rangeTest, unit, ApplyOptions{})
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(Equal(ErrRangeExhausted))
+			Expect(sr).To(BeNil())
+			free, err := ipamFreeIPs(context.TODO(), em.Cli, keyDir, &rangeTest)
+			Expect(err).NotTo(BeNil())
+			Expect(free).To(BeZero())
+		})
+
 		It("apply first ip range", func() {
 			// IpamApplyIPRange is used to apply IP range from ectd
 			em, err := etcdv3.New()
@@ -186,7 +394,7 @@ var _ = Describe("Cli", func() {
 			// Expect(err).To(BeNil())
 			Expect(netConf.IPAM.IsFixIP).To(BeFalse())
 
-			sr, err := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 			logging.Debugf("name:%v, range:%v, unit:%v, sr:%v", netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit, sr)
 			Expect(err).To(BeNil())
 			Expect(ipaddr.IP4ToUint32(sr.RangeEnd) - ipaddr.IP4ToUint32(sr.RangeStart)).To(Equal(num - 1))
@@ -212,7 +420,7 @@ var _ = Describe("Cli", func() {
 			Expect(err).To(BeNil())
 			n := 4
 			for i := 0; i < n; i++ {
-				sr, err := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 				Expect(err).To(BeNil())
 				Expect(ipaddr.IP4ToUint32(sr.RangeEnd) - ipaddr.IP4ToUint32(sr.RangeStart)).To(Equal(num - 1))
 			}
@@ -249,7 +457,7 @@ var _ = Describe("Cli", func() {
 			n := 3
 			var sri *allocator.SimpleRange
 			for i := 0; i < n; i++ {
-				sr, err := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 				if i == 1 {
 					sri = sr
 				}
@@ -258,11 +466,186 @@ var _ = Describe("Cli", func() {
 			}
 			keyDir := filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)
 			l := ipamSimpleRangeToLease(keyDir, sri)
-			etcdv3.TransDelKey(em.Cli, l)
-			sr, err := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			etcdv3.TransDelKey(context.TODO(), em.Cli, keyDir, 1, l)
+			sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 			Expect(err).To(BeNil())
 			Expect(sr.Match(sri)).To(BeTrue())
 		})
+		It("never apply ip from keep-out ranges", func() {
+			r := netConf.IPAM.Ranges[0][0]
+			// 192.168.56.32-159 is split into 32-63 and 96-159
+			r.KeepOut = []allocator.SimpleRange{{net.ParseIP("192.168.56.64"), net.ParseIP("192.168.56.95")}}
+			Expect(r.Canonicalize()).To(BeNil())
+			keepOut := r.KeepOut[0]
+			srs := []*allocator.SimpleRange{}
+			for {
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &r, netConf.IPAM.ApplyUnit)
+				if err != nil {
+					break
+				}
+				Expect(sr.Overlaps(&keepOut) || keepOut.Overlaps(sr)).To(BeFalse())
+				srs = append(srs, sr)
+			}
+			Expect(len(srs)).To(Equal(6))
+			Expect(srs[0].RangeStart.String()).To(Equal("192.168.56.32"))
+			Expect(srs[1].RangeStart.String()).To(Equal("192.168.56.48"))
+			Expect(srs[2].RangeStart.String()).To(Equal("192.168.56.96"))
+			Expect(srs[5].RangeEnd.String()).To(Equal("192.168.56.159"))
+		})
+		It("skip the apply units taken by the excluded ips", func() {
+			r := netConf.IPAM.Ranges[0][0]
+			// 48-63 covers a whole unit, 70-72 leaves too few ips before 80
+			r.Exclude([]allocator.SimpleRange{
+				{RangeStart: net.ParseIP("192.168.56.48").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()},
+				{RangeStart: net.ParseIP("192.168.56.70").To4(), RangeEnd: net.ParseIP("192.168.56.72").To4()},
+			})
+			starts := []string{}
+			for i := 0; i < 3; i++ {
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &r, netConf.IPAM.ApplyUnit)
+				Expect(err).To(BeNil())
+				starts = append(starts, sr.RangeStart.String())
+			}
+			Expect(starts).To(Equal([]string{"192.168.56.32", "192.168.56.73", "192.168.56.89"}))
+		})
+
+		It("never apply the gateway", func() {
+			r := netConf.IPAM.Ranges[0][0]
+			// the gateway within 192.168.56.32-159 splits it unaligned
+			r.Gateway = net.ParseIP("192.168.56.40")
+			Expect(r.Canonicalize()).To(BeNil())
+			gw := allocator.SimpleRange{RangeStart: r.Gateway, RangeEnd: r.Gateway}
+			srs := []*allocator.SimpleRange{}
+			for {
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &r, netConf.IPAM.ApplyUnit)
+				if err != nil {
+					break
+				}
+				Expect(sr.Overlaps(&gw)).To(BeFalse())
+				srs = append(srs, sr)
+			}
+			Expect(len(srs)).To(Equal(7))
+			Expect(srs[0].RangeStart.String()).To(Equal("192.168.56.41"))
+			Expect(srs[1].RangeStart.String()).To(Equal("192.168.56.57"))
+
+			// the ips left free do not count the gateway
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			free, err := ipamFreeIPs(context.TODO(), em.Cli, filepath.Join(em.RootKeyDir, leaseDir, netConf.Name), &r)
+			Expect(err).To(BeNil())
+			Expect(free).To(Equal(uint64(128 - 1 - 7*16)))
+		})
+		It("never apply the pinned ips", func() {
+			pinned := net.ParseIP("192.168.56.40").To4()
+			Expect(IPAMPinIP(netConf.Name, pinned, "testnamespace/pinnedpod")).To(Succeed())
+			Expect(IPAMPinIP(netConf.Name, pinned, "testnamespace/otherpod")).To(Equal(etcdv3.ErrKeyExists))
+			addr, err := IPAMGetPinnedIP(netConf.Name, "testnamespace/pinnedpod")
+			Expect(err).To(BeNil())
+			Expect(addr.Equal(pinned)).To(BeTrue())
+
+			sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("192.168.56.41"))
+			sr, err = IPAMApplyPinnedIP(context.TODO(), netConf.Name, "", pinned, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.Equal(pinned) && sr.RangeEnd.Equal(pinned)).To(BeTrue())
+		})
+		It("retry the next free range when the lease is claimed meanwhile", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			claimed := ""
+			putLease = func(ctx context.Context, cli *clientv3.Client, key, value string, opts ...clientv3.OpOption) error {
+				if claimed == "" {
+					// another node wins the race for the first range found
+					claimed = key
+					em.Cli.Put(context.TODO(), key, "other-node")
+				}
+				return etcdv3.PutKeyIfAbsent(ctx, cli, key, value, opts...)
+			}
+			defer func() {
+				putLease = etcdv3.PutKeyIfAbsent
+			}()
+
+			sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("192.168.56.48"))
+
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)
+			Expect(claimed).To(Equal(filepath.Join(keyDir, fmt.Sprintf(rangeTemplate, ipaddr.IP4ToUint32(net.ParseIP("192.168.56.32")), unit))))
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, claimed)
+			cancel()
+			Expect(string(resp.Kvs[0].Value)).To(Equal("other-node"))
+			ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ = em.Cli.Get(ctx, ipamSimpleRangeToLease(keyDir, sr))
+			cancel()
+			Expect(ipamLeaseOwner(resp.Kvs[0].Value)).To(Equal(em.Id))
+		})
+		It("give up after the tries configured, backing off between them", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			tries, backoff := ApplyTries, ApplyBackoff
+			ApplyTries, ApplyBackoff = 2, 30*time.Millisecond
+			claims := 0
+			putLease = func(ctx context.Context, cli *clientv3.Client, key, value string, opts ...clientv3.OpOption) error {
+				// another node wins the race for every range found
+				claims++
+				em.Cli.Put(context.TODO(), key, "other-node")
+				return etcdv3.PutKeyIfAbsent(ctx, cli, key, value, opts...)
+			}
+			defer func() {
+				putLease = etcdv3.PutKeyIfAbsent
+				ApplyTries, ApplyBackoff = tries, backoff
+			}()
+
+			start := time.Now()
+			_, err = IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(Equal(ErrRangeExhausted))
+			Expect(claims).To(Equal(2))
+			Expect(time.Since(start)).To(BeNumerically(">=", 30*time.Millisecond))
+		})
+		It("release the lease dir while backing off and give up once the context is done", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			backoff := ApplyBackoff
+			ApplyBackoff = time.Minute
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)
+			ctx, cancel := context.WithCancel(context.Background())
+			held := make(chan bool, 1)
+			putLease = func(ctx context.Context, cli *clientv3.Client, key, value string, opts ...clientv3.OpOption) error {
+				em.Cli.Put(context.TODO(), key, "other-node")
+				// the apply backs off once the claim is lost
+				time.AfterFunc(100*time.Millisecond, func() {
+					contended, err := etcdv3.DirShardContended(context.TODO(), em.Cli, keyDir, 0, 1)
+					held <- err != nil || contended
+					cancel()
+				})
+				return etcdv3.PutKeyIfAbsent(ctx, cli, key, value, opts...)
+			}
+			defer func() {
+				putLease = etcdv3.PutKeyIfAbsent
+				ApplyBackoff = backoff
+			}()
+
+			start := time.Now()
+			_, err = IPAMApplyIPRange(ctx, netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(<-held).To(BeFalse())
+		})
+		It("double the backoff for each claim lost with a jitter of up to half", func() {
+			for try, base := range map[int]time.Duration{1: ApplyBackoff, 2: 2 * ApplyBackoff, 3: 4 * ApplyBackoff} {
+				for i := 0; i < 10; i++ {
+					d := ipamApplyBackoff(try)
+					Expect(d).To(BeNumerically(">=", base))
+					Expect(d).To(BeNumerically("<=", base+base/2))
+				}
+			}
+		})
 	})
 	Describe("verification between etcd and local", func() {
 		var netConf *allocator.Net
@@ -294,7 +677,7 @@ var _ = Describe("Cli", func() {
 			n := 5
 			var srs []*allocator.SimpleRange
 			for i := 0; i < n; i++ {
-				sr, _ := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				sr, _ := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 				srs = append(srs, sr)
 			}
 			s, _ := disk.New(netConf.Name, "")
@@ -327,15 +710,15 @@ var _ = Describe("Cli", func() {
 			n := 5
 			var srs []*allocator.SimpleRange
 			for i := 0; i < n; i++ {
-				sr, _ := IPAMApplyIPRange(netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				sr, _ := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
 				s.AppendCache(sr)
 				srs = append(srs, sr)
 			}
 
 			keyDir := filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)
 
-			etcdv3.TransDelKey(em.Cli, ipamSimpleRangeToLease(keyDir, srs[1]))
-			etcdv3.TransDelKey(em.Cli, ipamSimpleRangeToLease(keyDir, srs[3]))
+			etcdv3.TransDelKey(context.TODO(), em.Cli, keyDir, 1, ipamSimpleRangeToLease(keyDir, srs[1]))
+			etcdv3.TransDelKey(context.TODO(), em.Cli, keyDir, 1, ipamSimpleRangeToLease(keyDir, srs[3]))
 			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
 			resp, _ := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix())
 			cancel()
@@ -419,7 +802,7 @@ var _ = Describe("Cli", func() {
 			cancel()
 			Expect(len(resp.Kvs)).To(Equal(2))
 			for _, ev := range resp.Kvs {
-				Expect(string(ev.Value)).To(Equal("nodenoexsit"))
+				Expect(ipamLeaseOwner(ev.Value)).To(Equal("nodenoexsit"))
 				tmp := ipamLeaseToSimleRange(string(ev.Key))
 				findMatch := false
 				for _, sr := range tests {
@@ -431,7 +814,2159 @@ var _ = Describe("Cli", func() {
 				Expect(findMatch).To(BeTrue())
 			}
 		})
+		It("report every divergence on audit without fixing any", func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			s, _ := disk.New(netConf.Name, "")
+			defer s.Close()
+			var srs []*allocator.SimpleRange
+			for i := 0; i < 4; i++ {
+				sr, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				Expect(err).To(BeNil())
+				srs = append(srs, sr)
+			}
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)
+			// srs[0] is in sync, the lease of srs[1] is lost, the cache of
+			// srs[2] is part of it only and srs[3] is not cached
+			s.AppendCache(srs[0])
+			s.AppendCache(srs[1])
+			etcdv3.TransDelKey(context.TODO(), em.Cli, keyDir, 1, ipamSimpleRangeToLease(keyDir, srs[1]))
+			end := append(net.IP{}, srs[2].RangeStart...)
+			end[len(end)-1] += 7
+			part := allocator.SimpleRange{RangeStart: srs[2].RangeStart, RangeEnd: end}
+			s.AppendCache(&part)
+
+			audit := func() []Divergence {
+				audits, err := IPAMAuditEtcd()
+				Expect(err).To(BeNil())
+				for _, a := range audits {
+					if a.Network == netConf.Name {
+						Expect(a.Err).To(BeNil())
+						return a.Divergences
+					}
+				}
+				Fail("network not audited")
+				return nil
+			}
+			divs := audit()
+			kinds := []string{}
+			for _, d := range divs {
+				kinds = append(kinds, d.Kind)
+			}
+			Expect(kinds).To(Equal([]string{DivergenceMismatch, DivergenceMissingCache, DivergenceMissingCache, DivergenceOrphanCache}))
+			Expect(divs[0].Cache.Match(&part)).To(BeTrue())
+			Expect(divs[1].Lease.Match(srs[2])).To(BeTrue())
+			Expect(divs[2].Lease.Match(srs[3])).To(BeTrue())
+			Expect(divs[3].Cache.Match(srs[1])).To(BeTrue())
+
+			// neither the cache nor etcd is touched
+			caches, _ := s.LoadCache()
+			Expect(len(caches)).To(Equal(3))
+			resp, err := em.Cli.Get(context.TODO(), keyDir, clientv3.WithPrefix())
+			Expect(err).To(BeNil())
+			Expect(len(resp.Kvs)).To(Equal(3))
+			Expect(len(audit())).To(Equal(4))
+
+			Expect(IPAMCheckEtcd()).To(Succeed())
+			Expect(audit()).To(BeEmpty())
+		})
+
+	})
+
+	Describe("shared pool", func() {
+		var networks = []string{"poolnet-a", "poolnet-b"}
+		var pool = "sharedpool"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for _, n := range networks {
+				s, _ := disk.New(n, "")
+				caches, _ := s.LoadCache()
+				for _, csr := range caches {
+					s.DeleteCache(&csr)
+				}
+				s.SavePool("")
+				s.Close()
+			}
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("borrow the space freed by another network of the pool", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.63").To4()
+
+			sra, err := IPAMApplyPoolIPRange(context.TODO(), networks[0], pool, &r, unit)
+			Expect(err).To(BeNil())
+			srb, err := IPAMApplyPoolIPRange(context.TODO(), networks[1], pool, &r, unit)
+			Expect(err).To(BeNil())
+			Expect(sra.Overlaps(srb) || srb.Overlaps(sra)).To(BeFalse())
+			// the pool is used up by the two networks
+			_, err = IPAMApplyPoolIPRange(context.TODO(), networks[1], pool, &r, unit)
+			Expect(err).NotTo(BeNil())
+
+			keyDir := filepath.Join(em.RootKeyDir, poolDir, pool)
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, ipamSimpleRangeToLease(keyDir, sra))
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(1))
+			Expect(ipamLeaseOwner(resp.Kvs[0].Value)).To(Equal(em.Id + "/" + networks[0]))
+
+			// network a frees its range for network b to borrow
+			Expect(etcdv3.TransDelKey(context.TODO(), em.Cli, keyDir, 1, ipamSimpleRangeToLease(keyDir, sra))).To(Succeed())
+			sr, err := IPAMApplyPoolIPRange(context.TODO(), networks[1], pool, &r, unit)
+			Expect(err).To(BeNil())
+			Expect(sr.Match(sra)).To(BeTrue())
+
+			leases, err := IPAMGetAllPoolLease(em.Cli, filepath.Join(em.RootKeyDir, poolDir), em.Id)
+			Expect(err).To(BeNil())
+			Expect(leases).NotTo(HaveKey(networks[0]))
+			Expect(len(leases[networks[1]])).To(Equal(2))
+
+			// the network leases are left alone
+			ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ = em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, leaseDir), clientv3.WithPrefix())
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(0))
+		})
+
+		It("reconcile the pool leases of each network", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.63").To4()
+			sra, err := IPAMApplyPoolIPRange(context.TODO(), networks[0], pool, &r, unit)
+			Expect(err).To(BeNil())
+
+			sa, _ := disk.New(networks[0], "")
+			defer sa.Close()
+			sa.SavePool(pool)
+			sb, _ := disk.New(networks[1], "")
+			defer sb.Close()
+			sb.SavePool(pool)
+			srb := allocator.SimpleRange{net.ParseIP("192.168.56.48").To4(), net.ParseIP("192.168.56.63").To4()}
+			sb.AppendCache(&srb)
+
+			Expect(IPAMCheckEtcd()).To(Succeed())
+
+			caches, _ := sa.LoadCache()
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].Match(sra)).To(BeTrue())
+			keyDir := filepath.Join(em.RootKeyDir, poolDir, pool)
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, ipamSimpleRangeToLease(keyDir, &srb))
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(1))
+			Expect(ipamLeaseOwner(resp.Kvs[0].Value)).To(Equal(em.Id + "/" + networks[1]))
+		})
+	})
+
+	Describe("apply priority", func() {
+		var network = "prionet"
+		var step time.Duration
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(func() {
+			clean()
+			step = claimBackoffStep
+			claimBackoffStep = 50 * time.Millisecond
+		})
+		AfterEach(func() {
+			claimBackoffStep = step
+			clean()
+		})
+
+		It("let the apply of higher priority win the last range", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.47").To4()
+			keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, "")
+
+			// the lease dir is held while the two applies come in
+			holder, err := etcdv3.LockDir(context.TODO(), em.Cli, keyDir)
+			Expect(err).To(BeNil())
+			winner := make(chan int, 2)
+			apply := func(priority int) {
+				defer GinkgoRecover()
+				emp, err := etcdv3.New()
+				Expect(err).To(BeNil())
+				defer emp.Close()
+				emp.Id = fmt.Sprintf("prio-node-%d", priority)
+				if _, err := ipamApplySharded(context.TODO(), emp, network, "", &r, unit, 1, priority, DefaultApplyOptions()); err == nil {
+					winner <- priority
+				} else {
+					Expect(err).To(Equal(ErrRangeExhausted))
+					winner <- -1
+				}
+			}
+			go apply(0)
+			time.Sleep(100 * time.Millisecond)
+			go apply(allocator.MaxPriority)
+			time.Sleep(100 * time.Millisecond)
+			holder.Close()
+
+			Eventually(winner, 5*time.Second).Should(Receive(Equal(allocator.MaxPriority)))
+			Eventually(winner, 5*time.Second).Should(Receive(Equal(-1)))
+		})
+	})
+
+	Describe("apply unit", func() {
+		var network = "unitnet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("refuse a unit larger than the range and apply the ones fitting it", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.31").To4()
+
+			_, err := IPAMApplyIPRange(context.TODO(), network, &r, 5)
+			Expect(err).To(MatchError("range 192.168.56.16-192.168.56.31 of subnet 192.168.56.0/24 has 16 ips to apply, fewer than the 32 ips of apply unit 5"))
+
+			sr, err := IPAMApplyIPRange(context.TODO(), network, &r, 4)
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("192.168.56.16"))
+			Expect(sr.RangeEnd.String()).To(Equal("192.168.56.31"))
+
+			// the range is used up by the exact fit, which is no misconfiguration
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, 2)
+			Expect(err).To(Equal(ErrRangeExhausted))
+			r.RangeEnd = net.ParseIP("192.168.56.63").To4()
+			sr, err = IPAMApplyIPRange(context.TODO(), network, &r, 2)
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("192.168.56.32"))
+		})
+	})
+
+	Describe("min free", func() {
+		var network = "minfreenet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("refuse the apply taking the reserve unless of priority", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			r.KeepOut = []allocator.SimpleRange{{RangeStart: net.ParseIP("192.168.56.60").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}}
+			r.MinFree = 12
+
+			// 44 ips free, then 28
+			_, err := IPAMApplyShardedIPRange(context.TODO(), network, "", &r, unit, 0, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			_, err = IPAMApplyShardedIPRange(context.TODO(), network, "", &r, unit, 0, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+
+			// 12 ips free are all reserved
+			_, err = IPAMApplyShardedIPRange(context.TODO(), network, "", &r, unit, 0, 0, DefaultApplyOptions())
+			Expect(err).To(Equal(ErrRangeExhausted))
+			sr, err := IPAMApplyShardedIPRange(context.TODO(), network, "", &r, 2, 0, 1, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("192.168.56.48"))
+		})
+
+		It("report the usage of the range once the apply leased it", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			r.KeepOut = []allocator.SimpleRange{{RangeStart: net.ParseIP("192.168.56.60").To4(), RangeEnd: net.ParseIP("192.168.56.63").To4()}}
+			other := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.16").To4(), RangeEnd: net.ParseIP("192.168.56.31").To4()}
+			_, err = em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(ipamLeaseKeyDir(em.RootKeyDir, network, ""), &other), "other-node")
+			Expect(err).To(BeNil())
+
+			// 44 ips not kept out, 16 leased by the other node and 16 applied
+			res, err := IPAMApplyShardedIPRange(context.TODO(), network, "", &r, unit, 0, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			Expect(res.RangeStart.String()).To(Equal("192.168.56.32"))
+			Expect(res.Total).To(Equal(uint64(44)))
+			Expect(res.Free).To(Equal(uint64(12)))
+			Expect(res.Utilization()).To(BeNumerically("~", 32.0/44, 1e-9))
+			Expect((&ApplyResult{}).Utilization()).To(BeZero())
+		})
+	})
+
+	Describe("ipv6 ranges", func() {
+		var network = "v6net"
+		var r allocator.Range
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(func() {
+			clean()
+			subnet6, err := types.ParseCIDR("fd00::/64")
+			Expect(err).To(BeNil())
+			r = allocator.Range{Subnet: types.IPNet(*subnet6)}
+			Expect(r.Canonicalize()).To(Succeed())
+		})
+		AfterEach(clean)
+
+		It("tell the ipv6 ranges in use and keep the pinned ipv6 out", func() {
+			sr := &allocator.SimpleRange{RangeStart: net.ParseIP("fd00::40"), RangeEnd: net.ParseIP("fd00::7f")}
+			Expect(ipamRangeUsed(sr, []net.IP{net.ParseIP("fd00::41")})).To(BeTrue())
+			Expect(ipamRangeUsed(sr, []net.IP{net.ParseIP("fd00::80"), net.ParseIP("192.168.56.64")})).To(BeFalse())
+
+			kept := ipamKeepPinnedOut(&r, map[string]string{"fd00::5": "ns/pod", "192.168.56.5": "ns/pod"})
+			Expect(kept.KeepOut).To(Equal([]allocator.SimpleRange{{RangeStart: net.ParseIP("fd00::5"), RangeEnd: net.ParseIP("fd00::5")}}))
+		})
+
+		It("apply ranges of 64 ips from a /64 and list them back", func() {
+			first, err := IPAMApplyIPRange(context.TODO(), network, &r, 6)
+			Expect(err).To(BeNil())
+			Expect(first.RangeStart.String()).To(Equal("fd00::2"))
+			Expect(first.RangeEnd.String()).To(Equal("fd00::41"))
+			Expect(len(first.RangeStart)).To(Equal(net.IPv6len))
+			second, err := IPAMApplyIPRange(context.TODO(), network, &r, 6)
+			Expect(err).To(BeNil())
+			Expect(second.RangeStart.String()).To(Equal("fd00::42"))
+			Expect(second.RangeEnd.String()).To(Equal("fd00::81"))
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			leases, err := IPAMGetAllLease(em.Cli, filepath.Join(em.RootKeyDir, leaseDir), em.Id)
+			Expect(err).To(BeNil())
+			Expect(len(leases[network])).To(Equal(2))
+			Expect(leases[network][0].Match(first)).To(BeTrue())
+			Expect(leases[network][1].Match(second)).To(BeTrue())
+		})
+
+		It("skip the leases and keep-out ranges in the way", func() {
+			r.KeepOut = []allocator.SimpleRange{{RangeStart: net.ParseIP("fd00::2"), RangeEnd: net.ParseIP("fd00::10")}}
+			sr, err := IPAMApplyShardedIPRange(context.TODO(), network, "", &r, 6, 0, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			Expect(sr.RangeStart.String()).To(Equal("fd00::11"))
+
+			// the last 128 ips of the subnet claimed in the buckets of 4 shards
+			r.RangeStart = net.ParseIP("fd00::ffff:ffff:ffff:ff80")
+			ends := []string{}
+			for i := 0; i < 2; i++ {
+				sr, err = IPAMApplyShardedIPRange(context.TODO(), network, "", &r, 6, 4, 0, DefaultApplyOptions())
+				Expect(err).To(BeNil())
+				ends = append(ends, sr.RangeEnd.String())
+			}
+			Expect(ends).To(ConsistOf("fd00::ffff:ffff:ffff:ffbf", "fd00::ffff:ffff:ffff:ffff"))
+			_, err = IPAMApplyShardedIPRange(context.TODO(), network, "", &r, 6, 4, 0, DefaultApplyOptions())
+			Expect(err).To(Equal(ErrRangeExhausted))
+		})
+	})
+
+	Describe("duplicate applies", func() {
+		var network = "dupnet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			s.FlashCache(nil)
+			s.Close()
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("leave one lease and one cache range of the same range applied at once", func() {
+			addr := net.ParseIP("192.168.56.100").To4()
+			srs := make(chan *allocator.SimpleRange, 2)
+			errs := make(chan error, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+					sr, err := IPAMApplyPinnedIP(context.TODO(), network, "", addr, 0, DefaultApplyOptions())
+					if err == nil {
+						s, e := disk.New(network, "")
+						Expect(e).To(BeNil())
+						err = s.AppendCache(sr)
+						s.Close()
+					}
+					srs <- sr
+					errs <- err
+				}()
+			}
+			for i := 0; i < 2; i++ {
+				Eventually(errs, 5*time.Second).Should(Receive(BeNil()))
+				var sr *allocator.SimpleRange
+				Eventually(srs, 5*time.Second).Should(Receive(&sr))
+				Expect(sr.RangeStart.Equal(addr)).To(BeTrue())
+			}
 
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), ipamLeaseKeyDir(em.RootKeyDir, network, "")+"/", clientv3.WithPrefix())
+			Expect(err).To(BeNil())
+			Expect(len(resp.Kvs)).To(Equal(1))
+			s, err := disk.New(network, "")
+			Expect(err).To(BeNil())
+			defer s.Close()
+			caches, err := s.LoadCache()
+			Expect(err).To(BeNil())
+			Expect(len(caches)).To(Equal(1))
+		})
+
+		It("dedup the cache ranges on reconcile", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			sr := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.32").To4(), RangeEnd: net.ParseIP("192.168.56.47").To4()}
+			em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(ipamLeaseKeyDir(em.RootKeyDir, network, ""), &sr), em.Id)
+			s, err := disk.New(network, "")
+			Expect(err).To(BeNil())
+			defer s.Close()
+			Expect(s.FlashCache([]allocator.SimpleRange{sr, sr})).To(Succeed())
+
+			Expect(ipamCheckNet(em, network, []allocator.SimpleRange{sr})).To(Succeed())
+			caches, err := s.LoadCache()
+			Expect(err).To(BeNil())
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].Match(&sr)).To(BeTrue())
+		})
+	})
+
+	Describe("lease map", func() {
+		var network = "mapnet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("render the leases of each owner", func() {
+			_, subnet, _ := net.ParseCIDR("10.0.0.0/25")
+			leases := map[string][]allocator.SimpleRange{
+				"node-b": {{RangeStart: net.ParseIP("10.0.0.64").To4(), RangeEnd: net.ParseIP("10.0.0.79").To4()}},
+				"node-a": {
+					{RangeStart: net.ParseIP("10.0.0.16").To4(), RangeEnd: net.ParseIP("10.0.0.31").To4()},
+					{RangeStart: net.ParseIP("10.0.0.100").To4(), RangeEnd: net.ParseIP("10.0.0.103").To4()},
+				},
+			}
+			Expect(renderLeaseMap(subnet, leases)).To(Equal(`10.0.0.0/25, 1 ips per cell
+10.0.0.0        ................AAAAAAAAAAAAAAAA................................
+10.0.0.64       BBBBBBBBBBBBBBBB....................AAAA........................
+A node-a 20 ips
+B node-b 16 ips
+. free 92 ips
+`))
+
+			// a /22 is mapped in cells of 4 ips
+			_, subnet, _ = net.ParseCIDR("10.0.0.0/22")
+			m := renderLeaseMap(subnet, leases)
+			Expect(strings.Split(m, "\n")[0]).To(Equal("10.0.0.0/22, 4 ips per cell"))
+			Expect(strings.Split(m, "\n")[1]).To(Equal("10.0.0.0        ....AAAA........BBBB.....A" + strings.Repeat(".", 38)))
+		})
+
+		It("map the leases of the network in etcd", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			os.Setenv("HOSTNAME", "node-a")
+			_, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			os.Setenv("HOSTNAME", "node-b")
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+
+			_, subnet, _ := net.ParseCIDR("192.168.56.0/26")
+			m, err := IPAMLeaseMap(network, "", subnet)
+			Expect(err).To(BeNil())
+			Expect(m).To(Equal(`192.168.56.0/26, 1 ips per cell
+192.168.56.0    ................AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB................
+A node-a 16 ips
+B node-b 16 ips
+. free 32 ips
+`))
+		})
+	})
+
+	Describe("lease walk", func() {
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			leasePageSize = 1000
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("walk a large keyspace a page at a time", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			// 2000 single ip leases of two networks, every other one of this node
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir)
+			for b := 0; b < 2000; b += 100 {
+				ops := []clientv3.Op{}
+				for i := b; i < b+100; i++ {
+					ip := ipaddr.Uint32ToIP4(ipaddr.IP4ToUint32(net.ParseIP("10.0.0.0").To4()) + uint32(i))
+					owner := em.Id
+					if i%2 == 1 {
+						owner = "other"
+					}
+					key := ipamSimpleRangeToLease(filepath.Join(keyDir, fmt.Sprintf("walknet%d", i%4/2)), &allocator.SimpleRange{RangeStart: ip, RangeEnd: ip})
+					ops = append(ops, clientv3.OpPut(key, owner))
+				}
+				_, err := em.Cli.Txn(context.TODO()).Then(ops...).Commit()
+				Expect(err).To(BeNil())
+			}
+
+			leasePageSize = 150
+			pages, total, largest := 0, 0, 0
+			err = IPAMWalkLease(em.Cli, keyDir, em.Id, func(leases map[string][]LeaseInfo) error {
+				pages++
+				n := 0
+				for _, srs := range leases {
+					n += len(srs)
+				}
+				total += n
+				if n > largest {
+					largest = n
+				}
+				return nil
+			})
+			Expect(err).To(BeNil())
+			Expect(total).To(Equal(1000))
+			Expect(pages).To(Equal(14))
+			Expect(largest <= 150).To(BeTrue())
+
+			leases, err := IPAMGetAllLease(em.Cli, keyDir, em.Id)
+			Expect(err).To(BeNil())
+			Expect(len(leases["walknet0"])).To(Equal(500))
+			Expect(len(leases["walknet1"])).To(Equal(500))
+
+			// an error of the callback stops the walk
+			pages = 0
+			err = IPAMWalkLease(em.Cli, keyDir, em.Id, func(leases map[string][]LeaseInfo) error {
+				pages++
+				return fmt.Errorf("stop")
+			})
+			Expect(err).To(MatchError("stop"))
+			Expect(pages).To(Equal(1))
+		})
+	})
+
+	Describe("pool usage", func() {
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("count the leased and the free ips of the subnets", func() {
+			_, subnet1, _ := net.ParseCIDR("10.0.0.0/24")
+			_, subnet2, _ := net.ParseCIDR("10.0.2.0/25")
+			leases := map[string][]allocator.SimpleRange{
+				"node-a": {
+					{RangeStart: net.ParseIP("10.0.0.16").To4(), RangeEnd: net.ParseIP("10.0.0.31").To4()},
+					{RangeStart: net.ParseIP("10.0.2.0").To4(), RangeEnd: net.ParseIP("10.0.2.7").To4()},
+				},
+				// half in the subnet, the other half out of all subnets
+				"node-b": {
+					{RangeStart: net.ParseIP("10.0.2.120").To4(), RangeEnd: net.ParseIP("10.0.2.135").To4()},
+					{RangeStart: net.ParseIP("10.0.9.0").To4(), RangeEnd: net.ParseIP("10.0.9.3").To4()},
+				},
+			}
+			u := ipamNetUsage("usagenet", []*net.IPNet{subnet1, subnet2}, leases)
+			Expect(u.Size.String()).To(Equal("384"))
+			Expect(u.Leased.String()).To(Equal("32"))
+			Expect(u.Free().String()).To(Equal("352"))
+			Expect(u.Ranges).To(Equal(map[string]int{"node-a": 2, "node-b": 2}))
+
+			// the subnets unknown, all the leased ips count
+			u = ipamNetUsage("usagenet", nil, leases)
+			Expect(u.Size).To(BeNil())
+			Expect(u.Free()).To(BeNil())
+			Expect(u.Leased.String()).To(Equal("44"))
+
+			// an ipv6 /64 is past 64 bits once a range is out
+			_, subnet6, _ := net.ParseCIDR("fd00::/64")
+			u = ipamNetUsage("usagenet", []*net.IPNet{subnet6}, map[string][]allocator.SimpleRange{
+				"node-a": {{RangeStart: net.ParseIP("fd00::40"), RangeEnd: net.ParseIP("fd00::7f")}},
+			})
+			Expect(u.Size.String()).To(Equal("18446744073709551616"))
+			Expect(u.Free().String()).To(Equal("18446744073709551552"))
+		})
+
+		It("list the leases of all nodes decoded", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			os.Setenv("HOSTNAME", "node-a")
+			LeaseCause = "default/pod-a"
+			_, err := IPAMApplyIPRange(context.TODO(), "usagenet", &r, unit)
+			LeaseCause = ""
+			Expect(err).To(BeNil())
+			os.Setenv("HOSTNAME", "node-b")
+			_, err = IPAMApplyIPRange(context.TODO(), "usagenet", &r, unit)
+			Expect(err).To(BeNil())
+			_, err = IPAMApplyIPRange(context.TODO(), "usagenet2", &r, unit)
+			Expect(err).To(BeNil())
+
+			entries, err := IPAMListLeases("")
+			Expect(err).To(BeNil())
+			Expect(len(entries)).To(Equal(3))
+			entries, err = IPAMListLeases("usagenet")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]LeaseEntry{
+				{Network: "usagenet", Key: "test/lease/usagenet/3232249872-4", Node: "node-a", Cause: "default/pod-a",
+					Start: net.ParseIP("192.168.56.16").To4(), End: net.ParseIP("192.168.56.31").To4()},
+				{Network: "usagenet", Key: "test/lease/usagenet/3232249888-4", Node: "node-b",
+					Start: net.ParseIP("192.168.56.32").To4(), End: net.ParseIP("192.168.56.47").To4()},
+			}))
+		})
+
+		It("aggregate the leases of all nodes in etcd as metrics", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			os.Setenv("HOSTNAME", "node-a")
+			for i := 0; i < 2; i++ {
+				_, err := IPAMApplyIPRange(context.TODO(), "usagenet", &r, unit)
+				Expect(err).To(BeNil())
+			}
+			os.Setenv("HOSTNAME", "node-b")
+			_, err := IPAMApplyIPRange(context.TODO(), "usagenet", &r, unit)
+			Expect(err).To(BeNil())
+			_, err = IPAMApplyIPRange(context.TODO(), "othernet", &r, unit)
+			Expect(err).To(BeNil())
+
+			_, subnet, _ := net.ParseCIDR("192.168.56.0/24")
+			_, idle, _ := net.ParseCIDR("192.168.57.0/24")
+			usages, err := IPAMPoolUsage(map[string][]*net.IPNet{"usagenet": {subnet}, "idlenet": {idle}})
+			Expect(err).To(BeNil())
+			Expect(len(usages)).To(Equal(3))
+
+			var buf strings.Builder
+			Expect(WritePoolMetrics(&buf, usages)).To(Succeed())
+			Expect(buf.String()).To(Equal(`# HELP multus_ipam_pool_addresses IPs of the subnets of the network.
+# TYPE multus_ipam_pool_addresses gauge
+multus_ipam_pool_addresses{network="idlenet"} 256
+multus_ipam_pool_addresses{network="usagenet"} 256
+# HELP multus_ipam_leased_addresses IPs of the network in the ranges leased by the nodes.
+# TYPE multus_ipam_leased_addresses gauge
+multus_ipam_leased_addresses{network="idlenet"} 0
+multus_ipam_leased_addresses{network="othernet"} 16
+multus_ipam_leased_addresses{network="usagenet"} 48
+# HELP multus_ipam_free_addresses IPs of the subnets of the network not leased by any node.
+# TYPE multus_ipam_free_addresses gauge
+multus_ipam_free_addresses{network="idlenet"} 256
+multus_ipam_free_addresses{network="usagenet"} 208
+# HELP multus_ipam_ranges_per_node IP ranges of the network leased by the node.
+# TYPE multus_ipam_ranges_per_node gauge
+multus_ipam_ranges_per_node{network="othernet",node="node-b"} 1
+multus_ipam_ranges_per_node{network="usagenet",node="node-a"} 2
+multus_ipam_ranges_per_node{network="usagenet",node="node-b"} 1
+`))
+		})
+	})
+
+	Describe("lease owner", func() {
+		var network = "ownernet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			LeaseCause = ""
+			os.Setenv("HOSTNAME", "hostname")
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("decode the legacy values naming the node only or the pod too", func() {
+			owner, cause := ipamParseLeaseValue("node-a/net@ns/pod\n")
+			Expect([]string{owner, cause}).To(Equal([]string{"node-a/net", "ns/pod"}))
+			owner, cause = ipamParseLeaseValue("node-a")
+			Expect([]string{owner, cause}).To(Equal([]string{"node-a", ""}))
+		})
+
+		It("record the node, the time and the pod applying the lease as json", func() {
+			before := time.Now().Unix()
+			var rec leaseRecord
+			Expect(json.Unmarshal([]byte(ipamLeaseRecord("node-a/net", "ns/pod", "10.1.0.0/24")), &rec)).To(Succeed())
+			Expect(rec.Node).To(Equal("node-a"))
+			Expect(rec.Network).To(Equal("net"))
+			Expect(rec.ApplyReason).To(Equal("ns/pod"))
+			Expect(rec.Subnet).To(Equal("10.1.0.0/24"))
+			Expect(rec.Timestamp).To(BeNumerically(">=", before))
+			Expect(ipamLeaseSubnet([]byte(ipamLeaseRecord("node-a", "", "10.1.0.0/24")))).To(Equal("10.1.0.0/24"))
+			Expect(ipamLeaseSubnet([]byte("node-a@ns/pod"))).To(BeEmpty())
+			owner, cause := ipamParseLeaseValue(ipamLeaseRecord("node-a/net", "ns/pod", ""))
+			Expect([]string{owner, cause}).To(Equal([]string{"node-a/net", "ns/pod"}))
+
+			Expect(ipamLeaseRecord("node-a", "", "")).NotTo(ContainSubstring("applyReason"))
+			Expect(ipamLeaseRecord("node-a", "", "")).NotTo(ContainSubstring("subnet"))
+			owner, cause = ipamParseLeaseValue(`{"node":"node-a","timestamp":1600000000}`)
+			Expect([]string{owner, cause}).To(Equal([]string{"node-a", ""}))
+			// a value not decoded as a record is taken as a legacy one
+			owner, _ = ipamParseLeaseValue("{node-a")
+			Expect(owner).To(Equal("{node-a"))
+		})
+
+		It("get the leases of a node written as legacy and as json values", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir)
+			for k, v := range map[string]string{
+				filepath.Join(keyDir, network, "3232249872-4"):    "node-a",
+				filepath.Join(keyDir, network, "3232249888-4"):    "node-a@ns/pod-a",
+				filepath.Join(keyDir, network, "3232249904-4"):    `{"node":"node-a","timestamp":1600000000,"applyReason":"ns/pod-b"}`,
+				filepath.Join(keyDir, network, "3232249920-4"):    `{"node":"node-b","timestamp":1600000000}`,
+				filepath.Join(keyDir, "othernet", "3232249872-4"): `{"node":"node-a","timestamp":1600000000}`,
+			} {
+				_, err := em.Cli.Put(context.TODO(), k, v)
+				Expect(err).To(BeNil())
+			}
+			leases, err := IPAMGetAllLease(em.Cli, keyDir, "node-a")
+			Expect(err).To(BeNil())
+			Expect(len(leases)).To(Equal(2))
+			Expect(len(leases[network])).To(Equal(3))
+			Expect(leases[network][2].RangeStart.String()).To(Equal("192.168.56.48"))
+			Expect(len(leases["othernet"])).To(Equal(1))
+		})
+
+		It("filter the leases by node exposing the pods applying them", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.63").To4()
+			os.Setenv("HOSTNAME", "node-a")
+			old, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			LeaseCause = "testnamespace/pod-a"
+			rich, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			os.Setenv("HOSTNAME", "node-b")
+			LeaseCause = "testnamespace/pod-b"
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir)
+			infos := []LeaseInfo{}
+			err = IPAMWalkLease(em.Cli, keyDir, "node-a", func(leases map[string][]LeaseInfo) error {
+				infos = append(infos, leases[network]...)
+				return nil
+			})
+			Expect(err).To(BeNil())
+			subnet := ipamRangeSubnet(&r)
+			Expect(infos).To(Equal([]LeaseInfo{{*old, "", subnet}, {*rich, "testnamespace/pod-a", subnet}}))
+
+			leases, err := IPAMGetAllLease(em.Cli, keyDir, "node-a")
+			Expect(err).To(BeNil())
+			Expect(leases[network]).To(Equal([]allocator.SimpleRange{*old, *rich}))
+
+			// the own lease is released whatever pod applied it
+			os.Setenv("HOSTNAME", "node-a")
+			Expect(IPAMReleaseIPRange(context.TODO(), network, "", rich, 1)).To(Succeed())
+			leases, err = IPAMGetAllLease(em.Cli, keyDir, "node-a")
+			Expect(err).To(BeNil())
+			Expect(leases[network]).To(Equal([]allocator.SimpleRange{*old}))
+		})
+	})
+
+	Describe("spare ranges", func() {
+		var network = "sparenet"
+		var active = net.ParseIP("192.168.56.33").To4()
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			caches, _ := s.LoadCache()
+			for _, csr := range caches {
+				s.DeleteCache(&csr)
+			}
+			s.Release(active)
+			s.SaveSpareSince(nil)
+			s.Close()
+			now = time.Now
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("release the aged spare range keeping the active one and the buffer", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			apply := func(start, end string) *allocator.SimpleRange {
+				r := rangeTest
+				r.RangeStart, r.RangeEnd = net.ParseIP(start).To4(), net.ParseIP(end).To4()
+				sr, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+				Expect(err).To(BeNil())
+				Expect(s.AppendCache(sr)).To(Succeed())
+				return sr
+			}
+			released := func() []string {
+				rs, err := IPAMReleaseSpareRanges(time.Hour, 1)
+				Expect(err).To(BeNil())
+				ranges := []string{}
+				for _, r := range rs {
+					if r.Network == network {
+						ranges = append(ranges, disk.RangeKey(&r.Range))
+					}
+				}
+				return ranges
+			}
+			t0 := time.Now()
+
+			apply("192.168.56.32", "192.168.56.47")
+			_, err = s.Reserve("active", "eth0", active, "0")
+			Expect(err).To(BeNil())
+			aged := apply("192.168.56.64", "192.168.56.79")
+			now = func() time.Time { return t0 }
+			Expect(released()).To(BeEmpty())
+
+			// spare for 50 minutes by now, aged is not released yet
+			buffered := apply("192.168.56.48", "192.168.56.63")
+			now = func() time.Time { return t0.Add(50 * time.Minute) }
+			Expect(released()).To(BeEmpty())
+
+			// the range found spare the latest is kept as the buffer
+			now = func() time.Time { return t0.Add(90 * time.Minute) }
+			Expect(released()).To(Equal([]string{disk.RangeKey(aged)}))
+
+			caches, _ := s.LoadCache()
+			Expect(len(caches)).To(Equal(2))
+			for _, c := range caches {
+				Expect(c.Overlaps(aged) || aged.Overlaps(&c)).To(BeFalse())
+			}
+			keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, "")
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, ipamSimpleRangeToLease(keyDir, aged))
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(0))
+			ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ = em.Cli.Get(ctx, ipamSimpleRangeToLease(keyDir, buffered))
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(1))
+		})
+	})
+
+	Describe("subnet shrink", func() {
+		var network = "shrinknet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			caches, _ := s.LoadCache()
+			for _, csr := range caches {
+				s.DeleteCache(&csr)
+			}
+			s.SaveSubnets(nil)
+			s.Close()
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("flag the leases out of the shrunk subnet", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.63").To4()
+			sra, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.160").To4(), net.ParseIP("192.168.56.191").To4()
+			srb, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			s.AppendCache(sra)
+			s.AppendCache(srb)
+			// the subnet shrinks from /24 to /25, leaving srb out
+			_, shrunk, _ := net.ParseCIDR("192.168.56.0/25")
+			Expect(s.SaveSubnets([]net.IPNet{*shrunk})).To(Succeed())
+
+			results, err := IPAMCheckEtcdWithBudget(-1)
+			Expect(err).To(BeNil())
+			var result *NetCheckResult
+			for i := range results {
+				if results[i].Network == network {
+					result = &results[i]
+				}
+			}
+			Expect(result).NotTo(BeNil())
+			Expect(result.Err).To(BeNil())
+			Expect(len(result.Orphaned)).To(Equal(1))
+			Expect(result.Orphaned[0].Match(srb)).To(BeTrue())
+		})
+	})
+
+	Describe("coalesce ranges", func() {
+		var network = "coalescenet"
+		sr := func(start, end string) allocator.SimpleRange {
+			return allocator.SimpleRange{RangeStart: net.ParseIP(start).To4(), RangeEnd: net.ParseIP(end).To4()}
+		}
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			s.FlashCache(nil)
+			s.SaveSubnets(nil)
+			s.Close()
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("merge the adjacent ranges making up a power of two and leave the disjoint ones", func() {
+			_, low, _ := net.ParseCIDR("192.168.56.0/25")
+			_, high, _ := net.ParseCIDR("192.168.56.128/25")
+			caches := []allocator.SimpleRange{
+				sr("192.168.56.48", "192.168.56.63"),
+				sr("192.168.56.32", "192.168.56.47"),
+				sr("192.168.56.64", "192.168.56.79"),
+				sr("192.168.56.80", "192.168.56.95"),
+				sr("192.168.56.0", "192.168.56.15"),
+				sr("192.168.56.16", "192.168.56.31"),
+				sr("192.168.56.96", "192.168.56.99"),
+				// adjacent across the boundary of the subnets
+				sr("192.168.56.112", "192.168.56.127"),
+				sr("192.168.56.128", "192.168.56.143"),
+				// disjoint
+				sr("192.168.56.160", "192.168.56.175"),
+				sr("192.168.56.192", "192.168.56.207"),
+				// the pinned ip
+				sr("192.168.56.208", "192.168.56.208"),
+			}
+			plan := ipamCoalescePlan(caches, []net.IPNet{*low, *high})
+			merged := []string{}
+			for _, cr := range plan {
+				merged = append(merged, disk.RangeKey(&cr.Range))
+			}
+			// the merged .0-.63 and .64-.95 would make 96 ips together
+			a, b := sr("192.168.56.0", "192.168.56.63"), sr("192.168.56.64", "192.168.56.95")
+			Expect(merged).To(Equal([]string{disk.RangeKey(&a), disk.RangeKey(&b)}))
+			Expect(len(plan[0].Parts)).To(Equal(4))
+		})
+
+		It("replace the leases and the cache ranges with the merged one", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			_, ipnet, _ := net.ParseCIDR("192.168.56.0/24")
+			Expect(s.SaveSubnets([]net.IPNet{*ipnet})).To(Succeed())
+			parts := []*allocator.SimpleRange{}
+			for _, want := range []allocator.SimpleRange{
+				sr("192.168.56.32", "192.168.56.47"),
+				sr("192.168.56.48", "192.168.56.63"),
+				sr("192.168.56.96", "192.168.56.111"),
+			} {
+				r := rangeTest
+				r.RangeStart, r.RangeEnd = want.RangeStart, want.RangeEnd
+				applied, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+				Expect(err).To(BeNil())
+				Expect(s.AppendCache(applied)).To(Succeed())
+				parts = append(parts, applied)
+			}
+
+			coalesced, err := IPAMCoalesceRanges()
+			Expect(err).To(BeNil())
+			Expect(len(coalesced)).To(Equal(1))
+			merged := sr("192.168.56.32", "192.168.56.63")
+			Expect(coalesced[0].Network).To(Equal(network))
+			Expect(coalesced[0].Range.Match(&merged)).To(BeTrue())
+
+			keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, "")
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, keyDir+"/", clientv3.WithPrefix())
+			cancel()
+			keys := []string{}
+			for _, kv := range resp.Kvs {
+				keys = append(keys, string(kv.Key))
+			}
+			Expect(keys).To(ConsistOf(ipamSimpleRangeToLease(keyDir, &merged), ipamSimpleRangeToLease(keyDir, parts[2])))
+
+			caches, _ := s.LoadCache()
+			Expect(len(caches)).To(Equal(2))
+			Expect(caches[0].Match(parts[2])).To(BeTrue())
+			Expect(caches[1].Match(&merged)).To(BeTrue())
+
+			// the merged lease reconciles with the cache as any other
+			results, err := IPAMCheckEtcdWithBudget(-1)
+			Expect(err).To(BeNil())
+			for _, r := range results {
+				Expect(r.Err).To(BeNil())
+			}
+			caches, _ = s.LoadCache()
+			Expect(len(caches)).To(Equal(2))
+		})
+	})
+
+	Describe("reclaim for starved nodes", func() {
+		var network = "reclaimnet"
+		sr := func(start, end string) allocator.SimpleRange {
+			return allocator.SimpleRange{RangeStart: net.ParseIP(start).To4(), RangeEnd: net.ParseIP(end).To4()}
+		}
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			s.FlashCache(nil)
+			s.Close()
+			ReclaimWatermark = 0
+			now = time.Now
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("pick the empty range idle for the most allocations over the watermark", func() {
+			lru, used := sr("192.168.56.16", "192.168.56.31"), sr("192.168.56.32", "192.168.56.47")
+			caches := []allocator.SimpleRange{
+				sr("192.168.56.0", "192.168.56.15"),
+				lru,
+				used,
+				sr("192.168.56.64", "192.168.56.79"),
+				// the pinned ip
+				sr("192.168.56.208", "192.168.56.208"),
+			}
+			ips := []net.IP{net.ParseIP("192.168.56.40"), net.ParseIP("192.168.56.208")}
+			idle := map[string]int{
+				disk.RangeKey(&caches[0]): 3,
+				disk.RangeKey(&lru):       7,
+				disk.RangeKey(&used):      9,
+				disk.RangeKey(&caches[4]): 20,
+			}
+			// 63 ips free, the range cached before the tracking counts as used
+			Expect(ipamReclaimPick(caches, ips, idle, 40).Match(&lru)).To(BeTrue())
+			Expect(ipamReclaimPick(caches, ips, idle, 63)).To(BeNil())
+			Expect(ipamReclaimPick(caches, ips, map[string]int{}, 40).Match(&caches[0])).To(BeTrue())
+			Expect(ipamReclaimPick(caches, []net.IP{net.ParseIP("192.168.56.8"), net.ParseIP("192.168.56.20"), net.ParseIP("192.168.56.70")}, idle, 0).Match(&used)).To(BeTrue())
+		})
+
+		It("give back the least recently used empty range only while another node is starved", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			applied := []*allocator.SimpleRange{}
+			for _, want := range []allocator.SimpleRange{
+				sr("192.168.56.32", "192.168.56.47"),
+				sr("192.168.56.48", "192.168.56.63"),
+			} {
+				r := rangeTest
+				r.RangeStart, r.RangeEnd = want.RangeStart, want.RangeEnd
+				a, err := IPAMApplyIPRange(context.TODO(), network, &r, unit)
+				Expect(err).To(BeNil())
+				Expect(s.AppendCache(a)).To(Succeed())
+				applied = append(applied, a)
+			}
+			// the second range served the last allocation
+			Expect(s.TouchRanges([]net.IP{net.ParseIP("192.168.56.50")})).To(Succeed())
+			Expect(s.TouchRanges([]net.IP{net.ParseIP("192.168.56.51")})).To(Succeed())
+			ReclaimWatermark = 8
+			keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, "")
+			value := ipamLeaseValue(em.Id, network, "")
+
+			reclaimed, err := ipamReclaimNet(em, s, network, keyDir, value)
+			Expect(err).To(BeNil())
+			Expect(reclaimed).To(BeNil())
+
+			// only the other nodes starved within the window count
+			starvedKey := filepath.Join(em.RootKeyDir, starvedDir, network)
+			t0 := time.Now()
+			em.Cli.Put(context.TODO(), filepath.Join(starvedKey, em.Id), strconv.FormatInt(t0.Unix(), 10))
+			em.Cli.Put(context.TODO(), filepath.Join(starvedKey, "othernode"), strconv.FormatInt(t0.Add(-StarveWindow-time.Minute).Unix(), 10))
+			reclaimed, err = ipamReclaimNet(em, s, network, keyDir, value)
+			Expect(err).To(BeNil())
+			Expect(reclaimed).To(BeNil())
+
+			em.Cli.Put(context.TODO(), filepath.Join(starvedKey, "othernode"), strconv.FormatInt(t0.Unix(), 10))
+			reclaimed, err = ipamReclaimNet(em, s, network, keyDir, value)
+			Expect(err).To(BeNil())
+			Expect(reclaimed.Match(applied[0])).To(BeTrue())
+			caches, _ := s.LoadCache()
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].Match(applied[1])).To(BeTrue())
+			resp, _ := em.Cli.Get(context.TODO(), ipamSimpleRangeToLease(keyDir, applied[0]))
+			Expect(len(resp.Kvs)).To(Equal(0))
+
+			// the last range is kept at the watermark
+			Expect(s.TouchRanges(nil)).To(Succeed())
+			ReclaimWatermark = 16
+			reclaimed, err = ipamReclaimNet(em, s, network, keyDir, value)
+			Expect(err).To(BeNil())
+			Expect(reclaimed).To(BeNil())
+		})
+
+		It("record the node starved until it applies a range again", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.47").To4()
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(Equal(ErrRangeExhausted))
+			nodes, err := ipamStarvedNodes(em.Cli, em.RootKeyDir, network, "othernode")
+			Expect(err).To(BeNil())
+			Expect(nodes).To(Equal([]string{em.Id}))
+			nodes, err = ipamStarvedNodes(em.Cli, em.RootKeyDir, network, em.Id)
+			Expect(err).To(BeNil())
+			Expect(nodes).To(BeEmpty())
+
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.48").To4(), net.ParseIP("192.168.56.63").To4()
+			_, err = IPAMApplyIPRange(context.TODO(), network, &r, unit)
+			Expect(err).To(BeNil())
+			nodes, err = ipamStarvedNodes(em.Cli, em.RootKeyDir, network, "othernode")
+			Expect(err).To(BeNil())
+			Expect(nodes).To(BeEmpty())
+		})
+	})
+
+	Describe("mutex shards", func() {
+		var network = "shardnet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("apply from the buckets of the shards without overlapping", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.95").To4()
+			shards := 4
+
+			applied := []*allocator.SimpleRange{}
+			for i := 0; i < shards; i++ {
+				em.Id = fmt.Sprintf("shard-node-%d", i%2)
+				sr, err := ipamApplySharded(context.TODO(), em, network, "", &r, unit, shards, 0, DefaultApplyOptions())
+				Expect(err).To(BeNil())
+				for _, a := range applied {
+					Expect(a.Overlaps(sr) || sr.Overlaps(a)).To(BeFalse())
+				}
+				applied = append(applied, sr)
+			}
+			// the whole range is used up
+			_, err = ipamApplySharded(context.TODO(), em, network, "", &r, unit, shards, 0, DefaultApplyOptions())
+			Expect(err).To(Equal(ErrRangeExhausted))
+
+			// the leases are seen by an apply with a single mutex
+			_, err = ipamApplySharded(context.TODO(), em, network, "", &r, unit, 1, 0, DefaultApplyOptions())
+			Expect(err).To(Equal(ErrRangeExhausted))
+		})
+	})
+
+	Describe("lease buckets", func() {
+		var network = "bucketnet"
+		var opts ApplyOptions
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(func() {
+			clean()
+			opts = ApplyOptions{Tries: ApplyTries}
+		})
+		AfterEach(clean)
+
+		It("lock the buckets of the blocks the range spans", func() {
+			sr := func(start, end string) *allocator.SimpleRange {
+				return &allocator.SimpleRange{RangeStart: net.ParseIP(start).To4(), RangeEnd: net.ParseIP(end).To4()}
+			}
+			Expect(ipamRangeBuckets(sr("192.168.56.32", "192.168.56.47"), 1)).To(Equal([]int{0}))
+			// a range of a block hashes to a bucket, the ranges of the block
+			// to the same one
+			one := ipamRangeBuckets(sr("192.168.56.32", "192.168.56.47"), 8)
+			Expect(len(one)).To(Equal(1))
+			Expect(ipamRangeBuckets(sr("192.168.56.36", "192.168.56.39"), 8)).To(Equal(one))
+			// a larger range locks the buckets of all its blocks, in order
+			all := map[int]bool{}
+			for _, start := range []string{"192.168.56.0", "192.168.56.16", "192.168.56.32", "192.168.56.48"} {
+				end := net.ParseIP(start).To4()
+				end[3] += 15
+				all[ipamRangeBuckets(sr(start, end.String()), 8)[0]] = true
+			}
+			spanned := ipamRangeBuckets(sr("192.168.56.0", "192.168.56.63"), 8)
+			Expect(len(spanned)).To(Equal(len(all)))
+			for i, b := range spanned {
+				Expect(all[b]).To(BeTrue())
+				if i > 0 {
+					Expect(b).To(BeNumerically(">", spanned[i-1]))
+				}
+			}
+		})
+
+		It("claim ranges at once without overlapping while scanning the whole range", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.159").To4()
+			n, buckets := 8, 4
+			// the claims racing for the same lowest range retry
+			opts.Tries = n
+			applied := make([]*allocator.SimpleRange, n)
+			errs := make([]error, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					em, err := etcdv3.New()
+					Expect(err).To(BeNil())
+					defer em.Close()
+					em.Id = fmt.Sprintf("bucket-node-%d", i)
+					applied[i], errs[i] = ipamApplySharded(context.TODO(), em, network, "", &r, unit, buckets, allocator.MaxPriority, opts)
+				}(i)
+			}
+			wg.Wait()
+			for i := 0; i < n; i++ {
+				Expect(errs[i]).To(BeNil())
+				for j := 0; j < i; j++ {
+					Expect(applied[i].Overlaps(applied[j])).To(BeFalse())
+				}
+			}
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			_, err = ipamApplySharded(context.TODO(), em, network, "", &r, unit, buckets, 0, opts)
+			Expect(err).To(Equal(ErrRangeExhausted))
+		})
+	})
+
+	Describe("lease watcher", func() {
+		var keyDir = "/multus/lease/"
+		kv := func(network, start, owner string) *mvccpb.KeyValue {
+			key := keyDir + network + "/" + ipamEncodeLease(allocator.IPToBigInt(net.ParseIP(start).To4()), 4)
+			return &mvccpb.KeyValue{Key: []byte(key), Value: []byte(ipamLeaseRecord(owner, "", ""))}
+		}
+		starts := func(leases []ViewLease) []string {
+			s := []string{}
+			for _, l := range leases {
+				s = append(s, l.RangeStart.String()+"@"+l.Owner)
+			}
+			return s
+		}
+
+		It("keep the view by the watch events and sync again once compacted", func() {
+			syncs := []*clientv3.GetResponse{
+				{Header: &etcdserverpb.ResponseHeader{Revision: 10}, Kvs: []*mvccpb.KeyValue{kv("neta", "10.0.0.0", "node-a"), kv("neta", "10.0.0.16", "node-b")}},
+				{Header: &etcdserverpb.ResponseHeader{Revision: 20}, Kvs: []*mvccpb.KeyValue{kv("netc", "10.2.0.48", "node-d")}},
+			}
+			revs := make(chan int64, 2)
+			watches := make(chan chan clientv3.WatchResponse, 2)
+			puts := make(chan string, 4)
+			w := &LeaseWatcher{
+				View:   NewLeaseView(),
+				OnPut:  func(network string, l ViewLease) { puts <- network + "/" + l.RangeStart.String() + "@" + l.Owner },
+				keyDir: keyDir,
+				get: func(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+					resp := syncs[0]
+					syncs = syncs[1:]
+					return resp, nil
+				},
+				watch: func(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+					c := make(chan clientv3.WatchResponse)
+					go func() {
+						<-ctx.Done()
+						close(c)
+					}()
+					revs <- clientv3.OpGet(key, opts...).Rev()
+					watches <- c
+					return c
+				},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- w.Run(ctx) }()
+
+			var c chan clientv3.WatchResponse
+			Eventually(watches).Should(Receive(&c))
+			Expect(<-revs).To(Equal(int64(11)))
+			Expect(starts(w.View.Leases("neta"))).To(Equal([]string{"10.0.0.0@node-a", "10.0.0.16@node-b"}))
+
+			c <- clientv3.WatchResponse{Events: []*clientv3.Event{
+				{Type: mvccpb.PUT, Kv: kv("netb", "10.1.0.32", "node-c")},
+				{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: kv("neta", "10.0.0.0", "").Key}},
+			}}
+			Eventually(func() []string { return starts(w.View.Leases("neta")) }).Should(Equal([]string{"10.0.0.16@node-b"}))
+			Expect(starts(w.View.Leases("netb"))).To(Equal([]string{"10.1.0.32@node-c"}))
+			Expect(<-puts).To(Equal("netb/10.1.0.32@node-c"))
+			sr := allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.20").To4(), RangeEnd: net.ParseIP("10.0.0.40").To4()}
+			Expect(w.View.ClaimedBy("neta", &sr)).To(Equal([]string{"node-b"}))
+
+			c <- clientv3.WatchResponse{CompactRevision: 15}
+			Eventually(watches).Should(Receive(&c))
+			Expect(<-revs).To(Equal(int64(21)))
+			Expect(w.View.Leases("neta")).To(BeEmpty())
+			Expect(starts(w.View.Leases("netc"))).To(Equal([]string{"10.2.0.48@node-d"}))
+
+			cancel()
+			Eventually(done).Should(Receive(Equal(context.Canceled)))
+		})
+	})
+
+	Describe("overlapping leases", func() {
+		var network = "overlapnet"
+		var em *etcdv3.EtcdMultus
+		key := func(start string, hostSize uint) string {
+			return filepath.Join(em.RootKeyDir, leaseDir, network, ipamEncodeLease(allocator.IPToBigInt(net.ParseIP(start).To4()), hostSize))
+		}
+		BeforeEach(func() {
+			var err error
+			em, err = etcdv3.New()
+			Expect(err).To(BeNil())
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, err := disk.New(network, "")
+			Expect(err).To(BeNil())
+			s.FlashCache(nil)
+			s.Close()
+		})
+		AfterEach(func() {
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			s.FlashCache(nil)
+			s.Close()
+			em.Close()
+		})
+		put := func(k, owner string) {
+			_, err := em.Cli.Put(context.TODO(), k, ipamLeaseRecord(owner, "", ""))
+			Expect(err).To(BeNil())
+		}
+		exists := func(k string) bool {
+			resp, err := em.Cli.Get(context.TODO(), k, clientv3.WithCountOnly())
+			Expect(err).To(BeNil())
+			return resp.Count > 0
+		}
+
+		It("let the static owner and else the lower node keep a range", func() {
+			Expect(ipamOverlapWinner("node-b", "node-a")).To(Equal("node-a"))
+			Expect(ipamOverlapWinner("node-a", "node-b")).To(Equal("node-a"))
+			Expect(ipamOverlapWinner("node-a", staticOwner)).To(Equal(staticOwner))
+			Expect(ipamOverlapWinner("node-b/net2", "node-a/net1")).To(Equal("node-a/net1"))
+			Expect(ipamOverlapWinner("node-a/net2", "node-a/net1")).To(Equal("node-a/net1"))
+		})
+
+		It("delete the lease of the losing node only", func() {
+			put(key("10.0.0.0", 5), "node-b")
+			put(key("10.0.0.16", 4), "node-a")
+			put(key("10.0.0.64", 4), "node-b")
+			keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, "")
+
+			lost, err := ipamResolveOverlaps(em.Cli, keyDir, "node-a")
+			Expect(err).To(BeNil())
+			Expect(lost).To(BeEmpty())
+			Expect(exists(key("10.0.0.0", 5))).To(BeTrue())
+
+			lost, err = ipamResolveOverlaps(em.Cli, keyDir, "node-b")
+			Expect(err).To(BeNil())
+			Expect(lost).To(HaveLen(1))
+			Expect(lost[0].RangeStart.String()).To(Equal("10.0.0.0"))
+			Expect(lost[0].RangeEnd.String()).To(Equal("10.0.0.31"))
+			Expect(exists(key("10.0.0.0", 5))).To(BeFalse())
+			Expect(exists(key("10.0.0.16", 4))).To(BeTrue())
+			Expect(exists(key("10.0.0.64", 4))).To(BeTrue())
+		})
+
+		It("give up the overlapping lease and cache range on reconcile", func() {
+			sr := allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.16").To4(), RangeEnd: net.ParseIP("10.0.0.31").To4()}
+			kept := allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.32").To4(), RangeEnd: net.ParseIP("10.0.0.47").To4()}
+			put(key("10.0.0.16", 4), em.Id)
+			put(key("10.0.0.32", 4), em.Id)
+			put(key("10.0.0.20", 2), staticOwner)
+			s, err := disk.New(network, "")
+			Expect(err).To(BeNil())
+			defer s.Close()
+			Expect(s.FlashCache([]allocator.SimpleRange{sr, kept})).To(Succeed())
+
+			Expect(ipamCheckNet(em, network, []allocator.SimpleRange{sr, kept})).To(Succeed())
+			Expect(exists(key("10.0.0.16", 4))).To(BeFalse())
+			Expect(exists(key("10.0.0.32", 4))).To(BeTrue())
+			Expect(exists(key("10.0.0.20", 2))).To(BeTrue())
+			caches, err := s.LoadCache()
+			Expect(err).To(BeNil())
+			Expect(caches).To(HaveLen(1))
+			Expect(caches[0].Match(&kept)).To(BeTrue())
+		})
+	})
+
+	Describe("force release of a node", func() {
+		var em *etcdv3.EtcdMultus
+		lease := func(start string) string {
+			return ipamEncodeLease(allocator.IPToBigInt(net.ParseIP(start).To4()), 4)
+		}
+		BeforeEach(func() {
+			var err error
+			em, err = etcdv3.New()
+			Expect(err).To(BeNil())
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for k, v := range map[string]string{
+				filepath.Join(leaseDir, "neta", lease("10.0.0.16")):               "dead-node",
+				filepath.Join(leaseDir, "neta", lease("10.0.0.32")):               "live-node",
+				filepath.Join(leaseDir, "netb", lease("10.1.0.16")):               "dead-node" + causeGap + "ns/pod",
+				filepath.Join(poolDir, "poolx", lease("10.2.0.16")):               "dead-node" + poolGap + "netc",
+				filepath.Join(poolDir, "poolx", lease("10.2.0.32")):               "live-node" + poolGap + "netc",
+				filepath.Join(leaseDir, "neta", lease("10.0.0.48")):               "dead-node-2",
+				filepath.Join(staticDir, "neta", fmt.Sprintf("%010d", 167772178)): "dead-node",
+			} {
+				_, err := em.Cli.Put(context.TODO(), filepath.Join(em.RootKeyDir, k), v)
+				Expect(err).To(BeNil())
+			}
+		})
+		AfterEach(func() {
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			em.Close()
+		})
+		keys := func() []string {
+			resp, err := em.Cli.Get(context.TODO(), em.RootKeyDir+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+			Expect(err).To(BeNil())
+			left := []string{}
+			for _, kv := range resp.Kvs {
+				k, _ := filepath.Rel(em.RootKeyDir, string(kv.Key))
+				left = append(left, k)
+			}
+			return left
+		}
+
+		It("list the leases of the node only on a dry run", func() {
+			before := keys()
+			leases, err := ipamForceReleaseNode(em.Cli, em.RootKeyDir, "dead-node", true, false)
+			Expect(err).To(BeNil())
+			Expect(leases).To(HaveLen(3))
+			Expect(leases[0].Network).To(Equal("neta"))
+			Expect(leases[0].Start.String()).To(Equal("10.0.0.16"))
+			Expect(leases[0].End.String()).To(Equal("10.0.0.31"))
+			Expect(leases[1].Network).To(Equal("netb"))
+			Expect(leases[1].Cause).To(Equal("ns/pod"))
+			Expect(leases[2].Network).To(Equal("netc"))
+			Expect(keys()).To(Equal(before))
+		})
+
+		It("delete the leases owned by the node and nothing else", func() {
+			leases, err := ipamForceReleaseNode(em.Cli, em.RootKeyDir, "dead-node", false, false)
+			Expect(err).To(BeNil())
+			Expect(leases).To(HaveLen(3))
+			Expect(keys()).To(ConsistOf(
+				filepath.Join(leaseDir, "neta", lease("10.0.0.32")),
+				filepath.Join(poolDir, "poolx", lease("10.2.0.32")),
+				filepath.Join(leaseDir, "neta", lease("10.0.0.48")),
+				filepath.Join(staticDir, "neta", fmt.Sprintf("%010d", 167772178)),
+			))
+		})
+
+		It("refuse a node keeping its node lease alive unless forced", func() {
+			_, err := em.Cli.Put(context.TODO(), etcdv3.NodeLeaseKey(em.RootKeyDir, "dead-node"), "1")
+			Expect(err).To(BeNil())
+			_, err = ipamForceReleaseNode(em.Cli, em.RootKeyDir, "dead-node", false, false)
+			Expect(err).To(Equal(ErrNodeAlive))
+			Expect(keys()).To(ContainElement(filepath.Join(leaseDir, "neta", lease("10.0.0.16"))))
+
+			leases, err := ipamForceReleaseNode(em.Cli, em.RootKeyDir, "dead-node", false, true)
+			Expect(err).To(BeNil())
+			Expect(leases).To(HaveLen(3))
+			Expect(keys()).NotTo(ContainElement(filepath.Join(leaseDir, "neta", lease("10.0.0.16"))))
+		})
+
+		It("leave the leases modified since they were found", func() {
+			leases, err := ipamNodeLeases(em.Cli, em.RootKeyDir, "dead-node")
+			Expect(err).To(BeNil())
+			Expect(leases).To(HaveLen(3))
+			// another node applies the range of the first lease meanwhile
+			_, err = em.Cli.Put(context.TODO(), leases[0].Key, "new-node")
+			Expect(err).To(BeNil())
+			released, err := ipamDeleteNodeLeases(em.Cli, leases)
+			Expect(err).To(BeNil())
+			Expect(released).To(HaveLen(2))
+			resp, err := em.Cli.Get(context.TODO(), leases[0].Key)
+			Expect(err).To(BeNil())
+			Expect(string(resp.Kvs[0].Value)).To(Equal("new-node"))
+		})
+
+		It("delete all the keys of a network torn down and nothing else", func() {
+			_, err := ipamDeleteNetwork(em.Cli, em.RootKeyDir, "", 0)
+			Expect(err).To(HaveOccurred())
+			deleted, err := ipamDeleteNetwork(em.Cli, em.RootKeyDir, "neta", 4)
+			Expect(err).To(BeNil())
+			Expect(deleted).To(Equal(int64(4)))
+			Expect(keys()).To(ConsistOf(
+				filepath.Join(leaseDir, "netb", lease("10.1.0.16")),
+				filepath.Join(poolDir, "poolx", lease("10.2.0.16")),
+				filepath.Join(poolDir, "poolx", lease("10.2.0.32")),
+			))
+		})
+	})
+
+	Describe("lease key migration", func() {
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("rewrite the legacy keys keeping their values and leave the others", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			netDir := filepath.Join(em.RootKeyDir, leaseDir, "migratenet")
+			poolKeyDir := filepath.Join(em.RootKeyDir, poolDir, "migratepool")
+			kvs := map[string]string{
+				filepath.Join(netDir, fmt.Sprintf("%10d-%10d", 167772176, 167772199)):     "node-a",
+				filepath.Join(netDir, "0167772224-4"):                                     "node-b",
+				filepath.Join(poolKeyDir, fmt.Sprintf("%10d-%10d", 167772416, 167772431)): "node-a/migratenet",
+			}
+			for k, v := range kvs {
+				_, err := em.Cli.Put(context.TODO(), k, v)
+				Expect(err).To(BeNil())
+			}
+
+			migrated, err := IPAMMigrateLeaseKeys(0)
+			Expect(err).To(BeNil())
+			Expect(migrated).To(HaveLen(2))
+
+			resp, err := em.Cli.Get(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			Expect(err).To(BeNil())
+			got := map[string]string{}
+			for _, kv := range resp.Kvs {
+				got[string(kv.Key)] = string(kv.Value)
+			}
+			Expect(got).To(Equal(map[string]string{
+				filepath.Join(netDir, "0167772176-4"):     "node-a",
+				filepath.Join(netDir, "0167772192-3"):     "node-a",
+				filepath.Join(netDir, "0167772224-4"):     "node-b",
+				filepath.Join(poolKeyDir, "0167772416-4"): "node-a/migratenet",
+			}))
+
+			// nothing is left to migrate
+			migrated, err = IPAMMigrateLeaseKeys(0)
+			Expect(err).To(BeNil())
+			Expect(migrated).To(BeEmpty())
+		})
+
+		It("rewrite the legacy keys of a dir only under its mutexes", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			netDir := filepath.Join(em.RootKeyDir, leaseDir, "migratenet")
+			legacyKey := filepath.Join(netDir, fmt.Sprintf("%10d-%10d", 167772176, 167772191))
+			_, err = em.Cli.Put(context.TODO(), legacyKey, "node-a")
+			Expect(err).To(BeNil())
+
+			dirMutex, err := etcdv3.LockDirShards(context.TODO(), em.Cli, netDir, 2)
+			Expect(err).To(BeNil())
+			done := make(chan []LeaseKeyMigration, 1)
+			go func() {
+				defer GinkgoRecover()
+				migrated, err := IPAMMigrateLeaseKeys(2)
+				Expect(err).To(BeNil())
+				done <- migrated
+			}()
+			Consistently(done, 500*time.Millisecond).ShouldNot(Receive())
+			dirMutex.Close()
+			var migrated []LeaseKeyMigration
+			Eventually(done, 5*time.Second).Should(Receive(&migrated))
+			Expect(migrated).To(Equal([]LeaseKeyMigration{{Key: legacyKey, Keys: []string{filepath.Join(netDir, "0167772176-4")}}}))
+		})
+	})
+
+	Describe("apply plan", func() {
+		var network = "plannet"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		keys := func() int64 {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), em.RootKeyDir, clientv3.WithPrefix(), clientv3.WithCountOnly())
+			Expect(err).To(BeNil())
+			return resp.Count
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("count the units the applies get until the range is used up", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.16").To4(), net.ParseIP("192.168.56.95").To4()
+			r.KeepOut = []allocator.SimpleRange{{RangeStart: net.ParseIP("192.168.56.50").To4(), RangeEnd: net.ParseIP("192.168.56.53").To4()}}
+			em.Id = "other-node"
+			_, err = ipamApplySharded(context.TODO(), em, network, "", &r, 3, 1, 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+			mine, err := IPAMApplyIPRange(context.TODO(), network, &r, 2)
+			Expect(err).To(BeNil())
+
+			before := keys()
+			plan, err := IPAMPlanApplies(network, "", &r, 2, 0, 0)
+			Expect(err).To(BeNil())
+			Expect(keys()).To(Equal(before))
+			Expect(plan.UnitIPs).To(Equal(uint64(4)))
+			Expect(plan.Capped).To(BeFalse())
+			Expect(plan.Leased).To(HaveLen(1))
+			Expect(plan.Leased[0].RangeStart.String()).To(Equal(mine.RangeStart.String()))
+
+			applied := uint64(0)
+			for {
+				if _, err := IPAMApplyIPRange(context.TODO(), network, &r, 2); err != nil {
+					Expect(err).To(Equal(ErrRangeExhausted))
+					break
+				}
+				applied++
+			}
+			Expect(applied).To(BeNumerically(">", 0))
+			Expect(plan.Units).To(Equal(applied))
+		})
+
+		It("count the units of the shards left out of the reserve", func() {
+			r := rangeTest
+			r.RangeStart, r.RangeEnd = net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.95").To4()
+			r.MinFree = 20
+			shards := 4
+
+			plan, err := IPAMPlanApplies(network, "", &r, unit, 0, 0)
+			Expect(err).To(BeNil())
+			capped, err := IPAMPlanApplies(network, "", &r, unit, 0, 1)
+			Expect(err).To(BeNil())
+			Expect(capped.Units).To(Equal(uint64(1)))
+			Expect(capped.Capped).To(BeTrue())
+
+			applied := uint64(0)
+			for {
+				if _, err := IPAMApplyShardedIPRange(context.TODO(), network, "", &r, unit, shards, 0, DefaultApplyOptions()); err != nil {
+					Expect(err).To(Equal(ErrRangeExhausted))
+					break
+				}
+				applied++
+			}
+			// 64 ips free, the reserve of 20 leaves room for 2 units of 16
+			Expect(applied).To(Equal(uint64(2)))
+			Expect(plan.Units).To(Equal(applied))
+			Expect(plan.Capped).To(BeFalse())
+		})
+	})
+
+	Describe("reconcile with error budget", func() {
+		var networks = []string{"budgetnet-a", "budgetnet-b", "budgetnet-c"}
+		var leases = map[string]allocator.SimpleRange{
+			"budgetnet-a": {net.IPv4(192, 168, 100, 128).To4(), net.IPv4(192, 168, 100, 143).To4()},
+			"budgetnet-b": {net.IPv4(192, 168, 101, 128).To4(), net.IPv4(192, 168, 101, 143).To4()},
+			"budgetnet-c": {net.IPv4(192, 168, 102, 128).To4(), net.IPv4(192, 168, 102, 143).To4()},
+		}
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for _, n := range networks {
+				s, _ := disk.New(n, "")
+				caches, _ := s.LoadCache()
+				for _, csr := range caches {
+					s.DeleteCache(&csr)
+				}
+				s.Close()
+			}
+		}
+		BeforeEach(func() {
+			clean()
+			em, _ := etcdv3.New()
+			defer em.Close()
+			for _, n := range networks {
+				sr := leases[n]
+				keyDir := filepath.Join(em.RootKeyDir, leaseDir, n)
+				em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &sr), em.Id)
+			}
+			checkNet = func(em *etcdv3.EtcdMultus, network string, l []allocator.SimpleRange) error {
+				if network == "budgetnet-b" {
+					return fmt.Errorf("injected failure")
+				}
+				return ipamCheckNet(em, network, l)
+			}
+		})
+		AfterEach(func() {
+			checkNet = ipamCheckNet
+			clean()
+		})
+
+		cached := func(network string) bool {
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			caches, _ := s.LoadCache()
+			sr := leases[network]
+			return len(caches) == 1 && caches[0].Match(&sr)
+		}
+
+		It("reconcile the other networks and report the failed one", func() {
+			results, err := IPAMCheckEtcdWithBudget(-1)
+			Expect(err).To(BeNil())
+			outcome := map[string]error{}
+			for _, r := range results {
+				outcome[r.Network] = r.Err
+			}
+			Expect(outcome).To(HaveKey("budgetnet-a"))
+			Expect(outcome).To(HaveKey("budgetnet-c"))
+			Expect(outcome["budgetnet-a"]).To(BeNil())
+			Expect(outcome["budgetnet-b"]).To(MatchError("injected failure"))
+			Expect(outcome["budgetnet-c"]).To(BeNil())
+			Expect(cached("budgetnet-a")).To(BeTrue())
+			Expect(cached("budgetnet-b")).To(BeFalse())
+			Expect(cached("budgetnet-c")).To(BeTrue())
+
+			Expect(IPAMCheckEtcd()).NotTo(Succeed())
+		})
+
+		It("stop once the error budget is exceeded", func() {
+			results, err := IPAMCheckEtcdWithBudget(0)
+			Expect(err).NotTo(BeNil())
+			Expect(len(results)).To(Equal(2))
+			Expect(results[0].Network).To(Equal("budgetnet-a"))
+			Expect(results[0].Err).To(BeNil())
+			Expect(results[1].Network).To(Equal("budgetnet-b"))
+			Expect(results[1].Err).NotTo(BeNil())
+			Expect(cached("budgetnet-a")).To(BeTrue())
+			Expect(cached("budgetnet-c")).To(BeFalse())
+
+			_, err = IPAMCheckEtcdWithBudget(1)
+			Expect(err).To(BeNil())
+			Expect(cached("budgetnet-c")).To(BeTrue())
+		})
+	})
+
+	Describe("root key dir of a network", func() {
+		var network = "rootnet"
+		var tenantRange = allocator.SimpleRange{net.IPv4(192, 168, 103, 128).To4(), net.IPv4(192, 168, 103, 143).To4()}
+		var otherRange = allocator.SimpleRange{net.IPv4(192, 168, 103, 160).To4(), net.IPv4(192, 168, 103, 175).To4()}
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			em.Cli.Delete(context.TODO(), "tenant-a", clientv3.WithPrefix())
+			s, _ := disk.New(network, "")
+			defer s.Close()
+			caches, _ := s.LoadCache()
+			for _, csr := range caches {
+				s.DeleteCache(&csr)
+			}
+			s.SaveRootKeyDir("")
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("reconcile the network against the leases under its root key dir", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			// the network of the same name under the root of the process is
+			// another network
+			_, err = em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(filepath.Join(em.RootKeyDir, leaseDir, network), &otherRange), em.Id)
+			Expect(err).To(BeNil())
+			tenantKey := ipamSimpleRangeToLease(filepath.Join("tenant-a", leaseDir, network), &tenantRange)
+			_, err = em.Cli.Put(context.TODO(), tenantKey, em.Id)
+			Expect(err).To(BeNil())
+			s, err := disk.New(network, "")
+			Expect(err).To(BeNil())
+			Expect(s.SaveRootKeyDir("tenant-a")).To(Succeed())
+			s.Close()
+
+			Expect(IPAMCheckEtcd()).To(Succeed())
+			s, err = disk.New(network, "")
+			Expect(err).To(BeNil())
+			defer s.Close()
+			caches, err := s.LoadCache()
+			Expect(err).To(BeNil())
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].Match(&tenantRange)).To(BeTrue())
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, leaseDir, network)+"/", clientv3.WithPrefix())
+			Expect(err).To(BeNil())
+			Expect(len(resp.Kvs)).To(Equal(1))
+			Expect(string(resp.Kvs[0].Key)).To(Equal(ipamSimpleRangeToLease(filepath.Join(em.RootKeyDir, leaseDir, network), &otherRange)))
+		})
+	})
+
+	Describe("verify release", func() {
+		var network = "testnet"
+		BeforeEach(func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		})
+		AfterEach(func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		})
+
+		It("delete the claim still referencing the released ip", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			released := net.IPv4(192, 168, 56, 40)
+			other := net.IPv4(192, 168, 56, 41)
+			staleKey := filepath.Join(em.RootKeyDir, staticDir, network, fmt.Sprintf("%010d", ipaddr.IP4ToUint32(released)))
+			otherKey := filepath.Join(em.RootKeyDir, staticDir, network, fmt.Sprintf("%010d", ipaddr.IP4ToUint32(other)))
+			em.Cli.Put(context.TODO(), staleKey, "123456789")
+			em.Cli.Put(context.TODO(), otherKey, "987654321")
+
+			err = IPAMVerifyRelease(network, []net.IP{released}, "123456789")
+			Expect(err).To(BeNil())
+
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, staticDir, network), clientv3.WithPrefix())
+			cancel()
+			Expect(len(resp.Kvs)).To(Equal(1))
+			Expect(string(resp.Kvs[0].Key)).To(Equal(otherKey))
+		})
+	})
+
+	Describe("query ip", func() {
+		var network = "testquery"
+		var dataDir = "/tmp"
+		BeforeEach(func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+		AfterEach(func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+
+		It("report the state of each ip", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, network)
+			local := allocator.SimpleRange{net.ParseIP("192.168.56.32").To4(), net.ParseIP("192.168.56.47").To4()}
+			remote := allocator.SimpleRange{net.ParseIP("192.168.56.48").To4(), net.ParseIP("192.168.56.63").To4()}
+			em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &local), em.Id)
+			em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &remote), "othernode")
+			fixIP := net.ParseIP("192.168.56.130")
+			fixKey := filepath.Join(em.RootKeyDir, fixDir, network, fmt.Sprintf("%010d", ipaddr.IP4ToUint32(fixIP)))
+			em.Cli.Put(context.TODO(), fixKey, IPAMGenFixInfo("ns", "pod", 0))
+
+			s, err := disk.New(network, dataDir)
+			Expect(err).To(BeNil())
+			s.Reserve("123456789", "eth0", net.ParseIP("192.168.56.33"), "0")
+			s.Close()
+
+			state, owner, err := IPAMQueryIP(network, net.ParseIP("192.168.56.100"), dataDir)
+			Expect(err).To(BeNil())
+			Expect(state).To(Equal(IPFree))
+			Expect(owner).To(Equal(""))
+
+			state, owner, err = IPAMQueryIP(network, net.ParseIP("192.168.56.34"), dataDir)
+			Expect(err).To(BeNil())
+			Expect(state).To(Equal(IPLeasedUnused))
+			Expect(owner).To(Equal(em.Id))
+
+			state, owner, err = IPAMQueryIP(network, net.ParseIP("192.168.56.33"), dataDir)
+			Expect(err).To(BeNil())
+			Expect(state).To(Equal(IPInUse))
+			Expect(owner).To(Equal(em.Id))
+
+			state, owner, err = IPAMQueryIP(network, net.ParseIP("192.168.56.50"), dataDir)
+			Expect(err).To(BeNil())
+			Expect(state).To(Equal(IPLeased))
+			Expect(owner).To(Equal("othernode"))
+
+			state, owner, err = IPAMQueryIP(network, fixIP, dataDir)
+			Expect(err).To(BeNil())
+			Expect(state).To(Equal(IPInUse))
+			Expect(owner).To(Equal(IPAMGenFixInfo("ns", "pod", 0)))
+		})
+	})
+
+	Describe("owner of ip", func() {
+		var network = "testowner"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("find the node owning the ip cluster-wide", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, leaseDir, network)
+			leased := allocator.SimpleRange{net.ParseIP("192.168.56.48").To4(), net.ParseIP("192.168.56.63").To4()}
+			em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, &leased), "othernode@ns/pod")
+			poolKeyDir := ipamLeaseKeyDir(em.RootKeyDir, "", "testpool")
+			em.Cli.Put(context.TODO(), ipamSimpleRangeToLease(poolKeyDir, &leased), "poolnode"+poolGap+"othernet")
+			_, subnet, _ := net.ParseCIDR("192.168.56.0/24")
+			subnets := []*net.IPNet{subnet}
+
+			owner, err := IPAMOwnerOfIP(network, "", subnets, net.ParseIP("192.168.56.50"))
+			Expect(err).To(BeNil())
+			Expect(*owner).To(Equal(IPOwner{Node: "othernode", Network: network, Range: leased, Cause: "ns/pod"}))
+
+			owner, err = IPAMOwnerOfIP(network, "testpool", subnets, net.ParseIP("192.168.56.63"))
+			Expect(err).To(BeNil())
+			Expect(*owner).To(Equal(IPOwner{Node: "poolnode", Network: "othernet", Range: leased}))
+
+			owner, err = IPAMOwnerOfIP(network, "", subnets, net.ParseIP("192.168.56.64"))
+			Expect(err).To(BeNil())
+			Expect(owner).To(BeNil())
+
+			_, err = IPAMOwnerOfIP(network, "", subnets, net.ParseIP("192.168.57.50"))
+			Expect(err).To(Equal(ErrIPOutOfPool))
+		})
+	})
+
+	Describe("node lease", func() {
+		var netConf *allocator.Net
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(func() {
+			cfg := strings.Replace(string(etcdCfg), `"endpoints"`, `"nodeLeaseTTL": 2, "endpoints"`, 1)
+			ioutil.WriteFile("/tmp/etcd.conf", []byte(cfg), 0666)
+			netConf, _, _ = allocator.LoadIPAMConfig(cniCfg, "")
+			clean()
+		})
+		AfterEach(clean)
+
+		// leaseKeys returns the etcd lease of each range key of network
+		leaseKeys := func() map[string]clientv3.LeaseID {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, leaseDir, netConf.Name)+"/", clientv3.WithPrefix())
+			Expect(err).To(BeNil())
+			leases := map[string]clientv3.LeaseID{}
+			for _, kv := range resp.Kvs {
+				leases[string(kv.Key)] = clientv3.LeaseID(kv.Lease)
+			}
+			return leases
+		}
+
+		It("attach the range keys of a node to one lease expiring together", func() {
+			for i := 0; i < 3; i++ {
+				_, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				Expect(err).To(BeNil())
+			}
+			_, err := IPAMApplyPinnedIP(context.TODO(), netConf.Name, "", net.ParseIP("192.168.56.150"), 0, DefaultApplyOptions())
+			Expect(err).To(BeNil())
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			lease, err := em.NodeLease()
+			Expect(err).To(BeNil())
+			Expect(lease).NotTo(Equal(clientv3.NoLease))
+			leases := leaseKeys()
+			Expect(len(leases)).To(Equal(4))
+			for _, l := range leases {
+				Expect(l).To(Equal(lease))
+			}
+
+			// kept alive past the ttl
+			for i := 0; i < 6; i++ {
+				Expect(em.KeepNodeLease()).To(Succeed())
+				time.Sleep(500 * time.Millisecond)
+			}
+			Expect(len(leaseKeys())).To(Equal(4))
+
+			// the keepalive stops, as on a dead node
+			Eventually(func() int { return len(leaseKeys()) }, 10*time.Second, 500*time.Millisecond).Should(Equal(0))
+		})
+
+		It("attach the lease restored from the cache to the lease of the node", func() {
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			sr := allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.64").To4(), RangeEnd: net.ParseIP("192.168.56.79").To4()}
+			s, err := disk.New(netConf.Name, "")
+			Expect(err).To(BeNil())
+			Expect(s.FlashCache([]allocator.SimpleRange{sr})).To(Succeed())
+			defer func() {
+				s.FlashCache(nil)
+				s.Close()
+			}()
+
+			Expect(ipamCheckNet(em, netConf.Name, nil)).To(Succeed())
+			lease, err := em.NodeLease()
+			Expect(err).To(BeNil())
+			leases := leaseKeys()
+			key := ipamSimpleRangeToLease(ipamLeaseKeyDir(em.RootKeyDir, netConf.Name, ""), &sr)
+			Expect(leases).To(Equal(map[string]clientv3.LeaseID{key: lease}))
+			// the lease restored is a record as the applied ones
+			resp, err := em.Cli.Get(context.TODO(), key)
+			Expect(err).To(BeNil())
+			var rec leaseRecord
+			Expect(json.Unmarshal(resp.Kvs[0].Value, &rec)).To(Succeed())
+			Expect(rec.Node).To(Equal(em.Id))
+
+			// the restored lease expires with the node as well
+			Eventually(func() int { return len(leaseKeys()) }, 10*time.Second, 500*time.Millisecond).Should(Equal(0))
+		})
+
+		It("reclaim a dead node by revoking its lease", func() {
+			os.Setenv("HOSTNAME", "deadnode")
+			for i := 0; i < 2; i++ {
+				_, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+				Expect(err).To(BeNil())
+			}
+			os.Setenv("HOSTNAME", "hostname")
+			_, err := IPAMApplyIPRange(context.TODO(), netConf.Name, &netConf.IPAM.Ranges[0][0], netConf.IPAM.ApplyUnit)
+			Expect(err).To(BeNil())
+			Expect(len(leaseKeys())).To(Equal(3))
+
+			revoked, err := IPAMReclaimNode("deadnode")
+			Expect(err).To(BeNil())
+			Expect(revoked).To(BeTrue())
+			Expect(len(leaseKeys())).To(Equal(1))
+
+			revoked, err = IPAMReclaimNode("deadnode")
+			Expect(err).To(BeNil())
+			Expect(revoked).To(BeFalse())
+		})
+	})
+
+	Describe("rebuild from disk", func() {
+		var network = "rebuildnet"
+		var dataDirs = map[string]string{"node-a": "/tmp/testrebuild-a", "node-b": "/tmp/testrebuild-b"}
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for _, d := range dataDirs {
+				os.RemoveAll(d)
+			}
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		cache := func(node string, srs ...string) {
+			s, err := disk.New(network, dataDirs[node])
+			Expect(err).To(BeNil())
+			defer s.Close()
+			for _, sr := range srs {
+				ips := strings.Split(sr, "-")
+				Expect(s.AppendCache(&allocator.SimpleRange{net.ParseIP(ips[0]), net.ParseIP(ips[1])})).To(Succeed())
+			}
+		}
+		rebuild := func(node string) []RebuildConflict {
+			os.Setenv("HOSTNAME", node)
+			conflicts, err := IPAMRebuildFromDisk(dataDirs[node])
+			Expect(err).To(BeNil())
+			return conflicts
+		}
+
+		It("re-assert the cached ranges of each node without overlapping", func() {
+			cache("node-a", "192.168.56.32-192.168.56.47", "192.168.56.48-192.168.56.63")
+			// node-b kept a stale range now owned by node-a
+			cache("node-b", "192.168.56.64-192.168.56.79", "192.168.56.48-192.168.56.63")
+
+			Expect(rebuild("node-a")).To(BeEmpty())
+			conflicts := rebuild("node-b")
+			Expect(len(conflicts)).To(Equal(1))
+			Expect(conflicts[0].Network).To(Equal(network))
+			Expect(conflicts[0].Range.RangeStart.String()).To(Equal("192.168.56.48"))
+			Expect(conflicts[0].Owner).To(Equal("node-a"))
+			// rebuilding again changes nothing
+			Expect(rebuild("node-a")).To(BeEmpty())
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, err := em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, leaseDir, network)+"/", clientv3.WithPrefix())
+			cancel()
+			Expect(err).To(BeNil())
+			owners := map[string]string{}
+			srs := []*allocator.SimpleRange{}
+			for _, ev := range resp.Kvs {
+				sr := ipamLeaseToSimleRange(string(ev.Key))
+				for _, other := range srs {
+					Expect(sr.Overlaps(other) || other.Overlaps(sr)).To(BeFalse())
+				}
+				srs = append(srs, sr)
+				// the leases rebuilt are records as the applied ones
+				var rec leaseRecord
+				Expect(json.Unmarshal(ev.Value, &rec)).To(Succeed())
+				owners[sr.RangeStart.String()] = ipamLeaseOwner(ev.Value)
+			}
+			Expect(owners).To(Equal(map[string]string{
+				"192.168.56.32": "node-a",
+				"192.168.56.48": "node-a",
+				"192.168.56.64": "node-b",
+			}))
+		})
+
+		It("lock the lease dir in the shards the network recorded", func() {
+			cache("node-a", "192.168.56.32-192.168.56.47")
+			s, err := disk.New(network, dataDirs["node-a"])
+			Expect(err).To(BeNil())
+			Expect(s.SaveShards(4)).To(Succeed())
+			s.Close()
+
+			Expect(rebuild("node-a")).To(BeEmpty())
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, err := em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, leaseDir, network)+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+			cancel()
+			Expect(err).To(BeNil())
+			Expect(resp.Count).To(Equal(int64(1)))
+		})
+
+		It("re-assert the cached ipv6 ranges", func() {
+			cache("node-a", "fd00::2-fd00::41")
+			cache("node-b", "fd00::42-fd00::81", "fd00::2-fd00::41")
+
+			Expect(rebuild("node-a")).To(BeEmpty())
+			conflicts := rebuild("node-b")
+			Expect(len(conflicts)).To(Equal(1))
+			Expect(conflicts[0].Range.RangeStart.String()).To(Equal("fd00::2"))
+			Expect(conflicts[0].Owner).To(Equal("node-a"))
+
+			em, err := etcdv3.New()
+			Expect(err).To(BeNil())
+			defer em.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, err := em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, leaseDir, network)+"/", clientv3.WithPrefix())
+			cancel()
+			Expect(err).To(BeNil())
+			owners := map[string]string{}
+			for _, ev := range resp.Kvs {
+				owners[ipamLeaseToSimleRange(string(ev.Key)).RangeStart.String()] = ipamLeaseOwner(ev.Value)
+			}
+			Expect(owners).To(Equal(map[string]string{"fd00::2": "node-a", "fd00::42": "node-b"}))
+		})
 	})
 
 	Describe("testing apply fix ip", func() {
@@ -472,7 +3007,7 @@ var _ = Describe("Cli", func() {
 				pod := podName + strconv.Itoa(i)
 				for v := 0; v < n; v++ {
 					fixInfo := IPAMGenFixInfo(namespace, pod, v)
-					network, err := IPAMApplyFixIP(netConf.Name, netConf.IPAM.FixRange, fixInfo)
+					network, err := IPAMApplyFixIP(context.TODO(), netConf.Name, netConf.IPAM.FixRange, fixInfo)
 					Expect(err).To(BeNil())
 					lease = append(lease, network)
 				}
@@ -493,7 +3028,7 @@ var _ = Describe("Cli", func() {
 				ifIndex := i % n
 				pod := podName + strconv.Itoa(podIndex)
 				fixInfo := IPAMGenFixInfo(namespace, pod, ifIndex)
-				network, err := IPAMApplyFixIP(netConf.Name, netConf.IPAM.FixRange, fixInfo)
+				network, err := IPAMApplyFixIP(context.TODO(), netConf.Name, netConf.IPAM.FixRange, fixInfo)
 				Expect(err).To(BeNil())
 				logging.Debugf("network: info:%v, net:%v", fixInfo, network)
 				Expect(lease[i].String()).To(Equal(network.String()))
@@ -0,0 +1,193 @@
+package etcdv3cli
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+// CoalescedRange is a range of adjacent ranges leased to this node merged into
+// one lease
+type CoalescedRange struct {
+	Network string
+	Parts   []allocator.SimpleRange
+	Range   allocator.SimpleRange
+}
+
+// IPAMCoalesceRanges merges the adjacent ranges this node leased for each
+// network into single leases, in etcd and in the cache, so that the ranges
+// applied unit by unit do not pile up. A lease key holds a power of two ips,
+// so only the ranges making up such a size together are merged, and never
+// across the subnets recorded by the last ADD of the network. The single ip
+// ranges of the pinned ips are left alone.
+func IPAMCoalesceRanges() ([]CoalescedRange, error) {
+	etcdMultus, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer etcdMultus.Close()
+
+	networks := disk.GetAllNet(os.Getenv("NET_DATA_DIR"))
+	sort.Strings(networks)
+	coalesced := []CoalescedRange{}
+	for _, network := range networks {
+		crs, err := ipamCoalesceNet(etcdMultus, network)
+		coalesced = append(coalesced, crs...)
+		if err != nil {
+			logging.Errorf("coalesce ranges of %v failed, %v", network, err)
+		}
+	}
+	return coalesced, nil
+}
+
+func ipamCoalesceNet(em *etcdv3.EtcdMultus, network string) ([]CoalescedRange, error) {
+	s, err := disk.New(network, "")
+	if err != nil {
+		return nil, logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	subnets := s.LoadSubnets()
+	if len(subnets) == 0 {
+		return nil, nil
+	}
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache failed, %v", err)
+	}
+	em = ipamNetEtcd(em, s)
+	pool := s.LoadPool()
+	keyDir := ipamLeaseKeyDir(em.RootKeyDir, network, pool)
+	value := ipamLeaseValue(em.Id, network, pool)
+
+	coalesced := []CoalescedRange{}
+	for _, cr := range ipamCoalescePlan(caches, subnets) {
+		cr.Network = network
+		merged, err := ipamCoalesceLeases(em.Cli, keyDir, value, &cr)
+		if err != nil {
+			return coalesced, err
+		}
+		if !merged {
+			continue
+		}
+		// the reconcile replaces the parts cached with the merged lease if
+		// the cache fails to follow
+		if replaced, err := s.ReplaceCache(cr.Parts, &cr.Range); err != nil || !replaced {
+			logging.Errorf("replace cache %v of %v with %v failed, %v", cr.Parts, network, cr.Range, err)
+		}
+		logging.Verbosef("coalesced ranges %v of %v into %v", cr.Parts, network, cr.Range)
+		coalesced = append(coalesced, cr)
+	}
+	return coalesced, nil
+}
+
+// ipamCoalescePlan returns the groups of the adjacent ranges of caches to
+// merge, each group making up a power of two ips within one of subnets
+func ipamCoalescePlan(caches []allocator.SimpleRange, subnets []net.IPNet) []CoalescedRange {
+	groups := []CoalescedRange{}
+	for _, c := range caches {
+		if c.RangeStart.Equal(c.RangeEnd) {
+			continue
+		}
+		groups = append(groups, CoalescedRange{Parts: []allocator.SimpleRange{c}, Range: c})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return allocator.IPToBigInt(groups[i].Range.RangeStart).Cmp(allocator.IPToBigInt(groups[j].Range.RangeStart)) < 0
+	})
+	// the merged ranges may merge again with their neighbours
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i+1 < len(groups); i++ {
+			a, b := &groups[i].Range, &groups[i+1].Range
+			if !ipamCoalescible(a, b, subnets) {
+				continue
+			}
+			groups[i] = CoalescedRange{
+				Parts: append(groups[i].Parts, groups[i+1].Parts...),
+				Range: allocator.SimpleRange{RangeStart: a.RangeStart, RangeEnd: b.RangeEnd},
+			}
+			groups = append(groups[:i+1], groups[i+2:]...)
+			merged = true
+		}
+	}
+	plan := []CoalescedRange{}
+	for _, g := range groups {
+		if len(g.Parts) > 1 {
+			plan = append(plan, g)
+		}
+	}
+	return plan
+}
+
+// ipamCoalescible tells if b follows a right away within one of subnets,
+// making up a power of two ips together
+func ipamCoalescible(a, b *allocator.SimpleRange, subnets []net.IPNet) bool {
+	if (a.RangeStart.To4() == nil) != (b.RangeStart.To4() == nil) {
+		return false
+	}
+	start, end := allocator.IPToBigInt(a.RangeStart), allocator.IPToBigInt(b.RangeEnd)
+	next := new(big.Int).Add(allocator.IPToBigInt(a.RangeEnd), big.NewInt(1))
+	if next.Cmp(allocator.IPToBigInt(b.RangeStart)) != 0 {
+		return false
+	}
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	if new(big.Int).And(size, new(big.Int).Sub(size, big.NewInt(1))).Sign() != 0 {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(a.RangeStart) && subnet.Contains(b.RangeEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipamCoalesceLeases replaces the leases of the parts of cr with the lease of
+// its range in one transaction, telling if it did. Nothing is replaced unless
+// all the parts are leased to value and stay so. The merged lease keeps the
+// value and the etcd lease of the first part.
+func ipamCoalesceLeases(cli *clientv3.Client, keyDir, value string, cr *CoalescedRange) (bool, error) {
+	cmps := []clientv3.Cmp{}
+	ops := []clientv3.Op{}
+	var first *clientv3.GetResponse
+	for i := range cr.Parts {
+		key := ipamSimpleRangeToLease(keyDir, &cr.Parts[i])
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := cli.Get(ctx, key)
+		cancel()
+		if err != nil {
+			return false, logging.Errorf("Get %v failed, %v", key, err)
+		}
+		if len(resp.Kvs) == 0 || ipamLeaseOwner(resp.Kvs[0].Value) != value {
+			logging.Verbosef("%v is not leased to %v, skip coalescing %v", key, value, cr.Parts)
+			return false, nil
+		}
+		if first == nil {
+			first = resp
+		}
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision))
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+	key := ipamSimpleRangeToLease(keyDir, &cr.Range)
+	cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+	ops = append(ops, clientv3.OpPut(key, string(first.Kvs[0].Value), clientv3.WithLease(clientv3.LeaseID(first.Kvs[0].Lease))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	txn, err := cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	cancel()
+	if err != nil {
+		return false, logging.Errorf("coalesce %v into %v failed, %v", cr.Parts, key, err)
+	}
+	if !txn.Succeeded {
+		logging.Verbosef("leases of %v changed meanwhile, skip coalescing", cr.Parts)
+	}
+	return txn.Succeeded, nil
+}
@@ -0,0 +1,176 @@
+package etcdv3cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+)
+
+// ErrNodeAlive is returned by IPAMForceReleaseNode for a node keeping its
+// node lease alive, which may still run, unless forced
+var ErrNodeAlive = errors.New("node keeps its node lease alive")
+
+// nodeLeaseKey is a lease key of a node as found, the delete only goes through
+// if the key is not modified since
+type nodeLeaseKey struct {
+	LeaseEntry
+	rev int64
+}
+
+// IPAMForceReleaseNode deletes the leases owned by node in all the networks
+// and the pools, for a node decommissioned without releasing them. It returns
+// the leases deleted, or those it would delete if dryRun. The leases modified
+// since they were found, e.g. applied by another node meanwhile, are left. A
+// node keeping its node lease alive is refused with ErrNodeAlive unless force.
+func IPAMForceReleaseNode(node string, dryRun, force bool) ([]LeaseEntry, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+	return ipamForceReleaseNode(em.Cli, em.RootKeyDir, node, dryRun, force)
+}
+
+func ipamForceReleaseNode(cli *clientv3.Client, rKeyDir, node string, dryRun, force bool) ([]LeaseEntry, error) {
+	if strings.TrimSpace(node) == "" {
+		return nil, fmt.Errorf("node to release the leases of is empty")
+	}
+	if !dryRun && !force {
+		key := etcdv3.NodeLeaseKey(rKeyDir, node)
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := cli.Get(ctx, key, clientv3.WithCountOnly())
+		cancel()
+		if err != nil {
+			return nil, logging.Errorf("Get %v failed, %v", key, err)
+		}
+		if resp.Count > 0 {
+			logging.Errorf("node %v keeps its node lease alive, its leases are not released", node)
+			return nil, ErrNodeAlive
+		}
+	}
+	leases, err := ipamNodeLeases(cli, rKeyDir, node)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		entries := []LeaseEntry{}
+		for _, l := range leases {
+			entries = append(entries, l.LeaseEntry)
+		}
+		return entries, nil
+	}
+	return ipamDeleteNodeLeases(cli, leases)
+}
+
+// ipamNodeLeases returns the lease keys owned by node in the lease dirs of the
+// networks and of the pools, by the order of the keys
+func ipamNodeLeases(cli *clientv3.Client, rKeyDir, node string) ([]nodeLeaseKey, error) {
+	leases := []nodeLeaseKey{}
+	for _, dir := range []string{leaseDir, poolDir} {
+		err := ipamWalkKeys(cli, filepath.Join(rKeyDir, dir)+"/", func(kvs []*mvccpb.KeyValue) error {
+			for _, kv := range kvs {
+				if e, ok := ipamNodeLeaseEntry(dir, kv, node); ok {
+					leases = append(leases, nodeLeaseKey{LeaseEntry: e, rev: kv.ModRevision})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leases, nil
+}
+
+// ipamNodeLeaseEntry returns the lease of kv if owned by node, the value of a
+// pool lease records its network after the owner
+func ipamNodeLeaseEntry(dir string, kv *mvccpb.KeyValue, node string) (LeaseEntry, bool) {
+	key := strings.Trim(string(kv.Key), " \r\n\t")
+	if _, _, _, ok := ipamDecodeLease(filepath.Base(key)); !ok {
+		return LeaseEntry{}, false
+	}
+	owner, cause := ipamParseLeaseValue(string(kv.Value))
+	network := filepath.Base(filepath.Dir(key))
+	if dir == poolDir {
+		v := strings.SplitN(owner, poolGap, 2)
+		if len(v) != 2 {
+			return LeaseEntry{}, false
+		}
+		owner, network = v[0], v[1]
+	}
+	if owner != node {
+		return LeaseEntry{}, false
+	}
+	sr := ipamLeaseToSimleRange(key)
+	return LeaseEntry{Network: network, Key: key, Node: owner, Cause: cause, Subnet: ipamLeaseSubnet(kv.Value), Start: sr.RangeStart, End: sr.RangeEnd}, true
+}
+
+// ipamDeleteNodeLeases deletes the leases unless modified since they were
+// found, returning those deleted
+func ipamDeleteNodeLeases(cli *clientv3.Client, leases []nodeLeaseKey) ([]LeaseEntry, error) {
+	released := []LeaseEntry{}
+	for _, l := range leases {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		txn, err := cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(l.Key), "=", l.rev)).
+			Then(clientv3.OpDelete(l.Key)).
+			Commit()
+		cancel()
+		if err != nil {
+			return released, logging.Errorf("delete lease %v of node %v failed, %v", l.Key, l.Node, err)
+		}
+		if !txn.Succeeded {
+			logging.Verbosef("lease %v is modified since it was found, leave it", l.Key)
+			continue
+		}
+		logging.Verbosef("released lease %v of node %v", l.Key, l.Node)
+		released = append(released, l.LeaseEntry)
+	}
+	return released, nil
+}
+
+// networkDirs are the dirs holding keys of a network under their own mutex
+var networkDirs = []string{leaseDir, fixDir, staticDir, pinnedDir, preferredDir, starvedDir}
+
+// IPAMDeleteNetwork deletes all the keys of network, for a network torn down,
+// each dir by a single delete under its mutexes, which shards is the
+// mutexShards of the network for. It returns the number of keys deleted. The
+// leases of the network in a shared pool are not under its dirs and are left.
+func IPAMDeleteNetwork(network string, shards int) (int64, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return 0, err
+	}
+	defer em.Close()
+	return ipamDeleteNetwork(em.Cli, em.RootKeyDir, network, shards)
+}
+
+func ipamDeleteNetwork(cli *clientv3.Client, rKeyDir, network string, shards int) (int64, error) {
+	if strings.TrimSpace(network) == "" || strings.Contains(network, "/") {
+		return 0, fmt.Errorf("invalid network %q to delete the keys of", network)
+	}
+	var deleted int64
+	for _, dir := range networkDirs {
+		// only the lease dir is sharded, see ipamApplySharded
+		n := 0
+		if dir == leaseDir {
+			n = shards
+		}
+		d, err := etcdv3.TransDelPrefix(context.Background(), cli, filepath.Join(rKeyDir, dir, network), n)
+		if err != nil {
+			return deleted, err
+		}
+		if d > 0 {
+			logging.Verbosef("deleted %d keys of network %v under %v", d, network, dir)
+		}
+		deleted += d
+	}
+	return deleted, nil
+}
@@ -0,0 +1,175 @@
+package etcdv3cli
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+)
+
+// The base of a lease key is the first ip of the range as a decimal integer,
+// zero padded to 10 digits so that the ipv4 keys sort by their ips, and the
+// log2 of the ips leased, e.g. 3232249888-4 for 192.168.56.32-192.168.56.47.
+// The integer of an ipv6 ip is its 128 bits, which is wider than the padding.
+//
+// The legacy keys of host-etcd, "%10d-%10d", hold the first and the last ips
+// padded by spaces instead. They are decoded too, telling them legacy, until
+// IPAMMigrateLeaseKeys rewrites them.
+
+// maxHostSize is the log2 of the ips of the largest lease, the whole ipv6 space
+const maxHostSize = 128
+
+// ipamEncodeLease returns the base of the key of the lease of 1<<hostSize ips
+// from start
+func ipamEncodeLease(start *big.Int, hostSize uint) string {
+	return fmt.Sprintf(rangeTemplate, start, hostSize)
+}
+
+// ipamDecodeLease returns the first and the last ips of the lease of the key
+// base as integers, telling if the key is of the legacy format. ok is false if
+// base is no lease key at all.
+func ipamDecodeLease(base string) (start, end *big.Int, legacy, ok bool) {
+	parts := strings.Split(base, "-")
+	if len(parts) != 2 {
+		return nil, nil, false, false
+	}
+	first, second := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	start, ok1 := new(big.Int).SetString(first, 10)
+	last, ok2 := new(big.Int).SetString(second, 10)
+	if !ok1 || !ok2 || start.Sign() < 0 {
+		return nil, nil, false, false
+	}
+	// a host size is never padded and never above maxHostSize, the last ip
+	// of a legacy key is padded to 10 digits, so above it even if not padded
+	legacy = first != parts[0] || second != parts[1] || last.Cmp(big.NewInt(maxHostSize)) > 0
+	if !legacy {
+		end = new(big.Int).Lsh(big.NewInt(1), uint(last.Uint64()))
+		end.Add(end, start).Sub(end, big.NewInt(1))
+		return start, end, false, true
+	}
+	if last.Cmp(start) < 0 {
+		return nil, nil, false, false
+	}
+	return start, last, true, true
+}
+
+// ipamSplitLease returns the bases of the keys covering start-end, a lease
+// holds a power of two ips so a range of other sizes takes several
+func ipamSplitLease(start, end *big.Int) []string {
+	bases := []string{}
+	one := big.NewInt(1)
+	next := new(big.Int).Set(start)
+	for next.Cmp(end) <= 0 {
+		left := new(big.Int).Sub(end, next)
+		left.Add(left, one)
+		hostSize := uint(left.BitLen() - 1)
+		bases = append(bases, ipamEncodeLease(next, hostSize))
+		next = new(big.Int).Add(next, new(big.Int).Lsh(one, hostSize))
+	}
+	return bases
+}
+
+// LeaseKeyMigration is a legacy lease key rewritten in the format of the keys
+type LeaseKeyMigration struct {
+	Key  string
+	Keys []string
+}
+
+// IPAMMigrateLeaseKeys rewrites the legacy lease keys of all the networks and
+// pools in the format of the keys, keeping their values and their etcd leases.
+// The keys of a lease dir are rewritten under the mutexes of its shards, each
+// in one transaction unless it changes meanwhile, so a migration run again
+// only rewrites the keys left.
+func IPAMMigrateLeaseKeys(shards int) ([]LeaseKeyMigration, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	migrated := []LeaseKeyMigration{}
+	for _, dir := range []string{leaseDir, poolDir} {
+		// the legacy keys by their lease dirs, in the order of the dirs
+		legacy := map[string][]*mvccpb.KeyValue{}
+		keyDirs := []string{}
+		err := ipamWalkKeys(em.Cli, filepath.Join(em.RootKeyDir, dir)+"/", func(kvs []*mvccpb.KeyValue) error {
+			for _, kv := range kvs {
+				if _, _, old, ok := ipamDecodeLease(filepath.Base(string(kv.Key))); ok && old {
+					keyDir := filepath.Dir(string(kv.Key))
+					if _, ok := legacy[keyDir]; !ok {
+						keyDirs = append(keyDirs, keyDir)
+					}
+					legacy[keyDir] = append(legacy[keyDir], kv)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+		for _, keyDir := range keyDirs {
+			m, err := ipamMigrateLeaseDir(em.Cli, keyDir, legacy[keyDir], shards)
+			migrated = append(migrated, m...)
+			if err != nil {
+				return migrated, err
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// ipamMigrateLeaseDir rewrites the legacy keys kvs of keyDir under the
+// mutexes of its shards
+func ipamMigrateLeaseDir(cli *clientv3.Client, keyDir string, kvs []*mvccpb.KeyValue, shards int) ([]LeaseKeyMigration, error) {
+	dirMutex, err := etcdv3.LockDirShards(context.Background(), cli, keyDir, shards)
+	if err != nil {
+		return nil, err
+	}
+	defer dirMutex.Close()
+
+	migrated := []LeaseKeyMigration{}
+	for _, kv := range kvs {
+		m, err := ipamMigrateLeaseKey(cli, kv)
+		if err != nil {
+			return migrated, err
+		}
+		if m != nil {
+			migrated = append(migrated, *m)
+		}
+	}
+	return migrated, nil
+}
+
+// ipamMigrateLeaseKey replaces the legacy key of kv with the keys covering its
+// range, nil if the key changed since kv was read
+func ipamMigrateLeaseKey(cli *clientv3.Client, kv *mvccpb.KeyValue) (*LeaseKeyMigration, error) {
+	key := string(kv.Key)
+	start, end, _, _ := ipamDecodeLease(filepath.Base(key))
+	m := &LeaseKeyMigration{Key: key}
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)}
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	for _, base := range ipamSplitLease(start, end) {
+		newKey := filepath.Join(filepath.Dir(key), base)
+		m.Keys = append(m.Keys, newKey)
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0))
+		ops = append(ops, clientv3.OpPut(newKey, string(kv.Value), clientv3.WithLease(clientv3.LeaseID(kv.Lease))))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	txn, err := cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("migrate lease key %v failed, %v", key, err)
+	}
+	if !txn.Succeeded {
+		logging.Verbosef("lease key %v changed meanwhile or its ips are leased by another key, skip migrating it", key)
+		return nil, nil
+	}
+	logging.Verbosef("migrate lease key %v to %v", key, m.Keys)
+	return m, nil
+}
@@ -0,0 +1,137 @@
+package etcdv3cli
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+// overlapLease is a lease key found by a scan for the ranges leased by several
+// owners, the delete only goes through if the key is not modified since
+type overlapLease struct {
+	key        string
+	owner      string
+	start, end *big.Int
+	rev        int64
+}
+
+// ipamOverlapWinner returns which of the owners a and b keeps a range both of
+// them lease. The static leases have no node to give them up so they always
+// keep it, else the lower node does, so that every node resolves an overlap
+// the same way.
+func ipamOverlapWinner(a, b string) string {
+	na, nb := strings.SplitN(a, poolGap, 2)[0], strings.SplitN(b, poolGap, 2)[0]
+	switch {
+	case na == staticOwner:
+		return a
+	case nb == staticOwner:
+		return b
+	case na != nb && na < nb, na == nb && a < b:
+		return a
+	}
+	return b
+}
+
+// ipamFindOverlaps scans all the leases under keyDir for those of id
+// overlapping the leases of other owners, as left by two nodes racing to apply
+// the same ips. It returns the leases of id losing an overlap, see
+// ipamOverlapWinner, with the owners keeping them.
+func ipamFindOverlaps(cli *clientv3.Client, keyDir, id string) ([]overlapLease, []string, error) {
+	leases := []overlapLease{}
+	err := ipamWalkKeys(cli, keyDir+"/", func(kvs []*mvccpb.KeyValue) error {
+		for _, kv := range kvs {
+			start, end, _, ok := ipamDecodeLease(filepath.Base(strings.Trim(string(kv.Key), " \r\n\t")))
+			if !ok {
+				continue
+			}
+			leases = append(leases, overlapLease{string(kv.Key), ipamLeaseOwner(kv.Value), start, end, kv.ModRevision})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(leases, func(i, j int) bool { return leases[i].start.Cmp(leases[j].start) < 0 })
+
+	// the leases overlapping one follow it by the order of their first ips
+	winners := map[int]string{}
+	for i := range leases {
+		for j := i + 1; j < len(leases) && leases[j].start.Cmp(leases[i].end) <= 0; j++ {
+			a, b := leases[i], leases[j]
+			if a.owner == b.owner || (a.owner != id && b.owner != id) {
+				continue
+			}
+			if winner := ipamOverlapWinner(a.owner, b.owner); a.owner == id && winner != id {
+				winners[i] = winner
+			} else if b.owner == id && winner != id {
+				winners[j] = winner
+			}
+		}
+	}
+
+	losers, keepers := []overlapLease{}, []string{}
+	for i, l := range leases {
+		if winner, ok := winners[i]; ok {
+			losers, keepers = append(losers, l), append(keepers, winner)
+		}
+	}
+	return losers, keepers, nil
+}
+
+// ipamResolveOverlaps deletes the leases of id losing an overlap, see
+// ipamFindOverlaps, unless modified since they were found, and returns their
+// ranges
+func ipamResolveOverlaps(cli *clientv3.Client, keyDir, id string) ([]allocator.SimpleRange, error) {
+	losers, keepers, err := ipamFindOverlaps(cli, keyDir, id)
+	if err != nil {
+		return nil, err
+	}
+	lost := []allocator.SimpleRange{}
+	for i, l := range losers {
+		winner := keepers[i]
+		sr := ipamLeaseToSimleRange(strings.Trim(l.key, " \r\n\t"))
+		logging.Errorf("range %v-%v leased by %v overlaps a lease of %v, which keeps it, the ips allocated in it may be duplicated",
+			sr.RangeStart, sr.RangeEnd, id, winner)
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		txn, err := cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(l.key), "=", l.rev)).
+			Then(clientv3.OpDelete(l.key)).
+			Commit()
+		cancel()
+		if err != nil {
+			return lost, logging.Errorf("delete overlapping lease %v failed, %v", l.key, err)
+		}
+		if !txn.Succeeded {
+			logging.Verbosef("lease %v is modified since it was found, leave it", l.key)
+			continue
+		}
+		lost = append(lost, *sr)
+	}
+	return lost, nil
+}
+
+// ipamWithoutRanges returns the ranges of srs not overlapping any of drop
+func ipamWithoutRanges(srs, drop []allocator.SimpleRange) []allocator.SimpleRange {
+	kept := []allocator.SimpleRange{}
+	for _, sr := range srs {
+		overlapped := false
+		for i := range drop {
+			if sr.Overlaps(&drop[i]) {
+				overlapped = true
+				break
+			}
+		}
+		if !overlapped {
+			kept = append(kept, sr)
+		}
+	}
+	return kept
+}
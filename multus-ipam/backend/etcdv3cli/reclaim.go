@@ -0,0 +1,123 @@
+package etcdv3cli
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+// ReclaimWatermark is the free ips of its cached ranges over which a node
+// gives back an empty range of a network another node is starved of, 0 never
+// does. The daemon sets it from its config.
+var ReclaimWatermark = 0
+
+// StarveWindow is how long a node counts as starved after an apply found no
+// free range for it
+var StarveWindow = 10 * time.Minute
+
+// ipamMarkStarved records in etcd that this node found no free range of
+// network to apply, or clears the record once it applied one
+func ipamMarkStarved(em *etcdv3.EtcdMultus, network string, starved bool) {
+	key := filepath.Join(em.RootKeyDir, starvedDir, network, em.Id)
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	defer cancel()
+	var err error
+	if starved {
+		_, err = em.Cli.Put(ctx, key, strconv.FormatInt(now().Unix(), 10))
+	} else {
+		_, err = em.Cli.Delete(ctx, key)
+	}
+	if err != nil {
+		logging.Errorf("record node %v starved of %v as %v failed, %v", em.Id, network, starved, err)
+	}
+}
+
+// ipamStarvedNodes returns the nodes other than self starved of network
+// within the StarveWindow
+func ipamStarvedNodes(cli *clientv3.Client, rKeyDir, network, self string) ([]string, error) {
+	keyDir := filepath.Join(rKeyDir, starvedDir, network) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := cli.Get(ctx, keyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
+	}
+	nodes := []string{}
+	for _, kv := range resp.Kvs {
+		node := filepath.Base(string(kv.Key))
+		at, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if node == self || err != nil || now().Sub(time.Unix(at, 0)) > StarveWindow {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// ipamReclaimPick returns the empty range of caches to give back, the one
+// idle for the most allocations, nil unless the free ips of caches exceed
+// watermark. The single ip ranges of the pinned ips are left alone.
+func ipamReclaimPick(caches []allocator.SimpleRange, ips []net.IP, idle map[string]int, watermark int) *allocator.SimpleRange {
+	free := big.NewInt(0)
+	var pick *allocator.SimpleRange
+	for i := range caches {
+		c := &caches[i]
+		if c.RangeStart.Equal(c.RangeEnd) {
+			continue
+		}
+		used := 0
+		for _, addr := range ips {
+			if ip.Cmp(addr, c.RangeStart) >= 0 && ip.Cmp(addr, c.RangeEnd) <= 0 {
+				used++
+			}
+		}
+		size := new(big.Int).Sub(allocator.IPToBigInt(c.RangeEnd), allocator.IPToBigInt(c.RangeStart))
+		free.Add(free, size.Add(size, big.NewInt(int64(1-used))))
+		if used == 0 && (pick == nil || idle[disk.RangeKey(c)] > idle[disk.RangeKey(pick)]) {
+			pick = c
+		}
+	}
+	if free.Cmp(big.NewInt(int64(watermark))) <= 0 {
+		return nil
+	}
+	return pick
+}
+
+// ipamReclaimNet gives back the least recently used empty range of network
+// cached in s while another node is starved of it and this node holds more
+// than ReclaimWatermark free ips, returning the range given back
+func ipamReclaimNet(em *etcdv3.EtcdMultus, s *disk.Store, network, keyDir, value string) (*allocator.SimpleRange, error) {
+	starved, err := ipamStarvedNodes(em.Cli, em.RootKeyDir, network, em.Id)
+	if err != nil || len(starved) == 0 {
+		return nil, err
+	}
+	caches, err := s.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache failed, %v", err)
+	}
+	sr := ipamReclaimPick(caches, s.ReservedIPs(), s.LoadIdle(), ReclaimWatermark)
+	if sr == nil {
+		return nil, nil
+	}
+	// an ADD may allocate from the range until it is out of the cache
+	if deleted, err := s.DeleteCacheIfUnused(sr); err != nil || !deleted {
+		return nil, err
+	}
+	if err := ipamReleaseOwnLease(context.Background(), em, keyDir, s.LoadShards(), value, sr); err != nil {
+		// the range stays leased to this node, so it is cached back
+		s.AppendCache(sr)
+		return nil, err
+	}
+	logging.Verbosef("gave back range %v of %v to the starved nodes %v", *sr, network, starved)
+	return sr, nil
+}
@@ -0,0 +1,217 @@
+package etcdv3cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+// NetUsage is the utilization of the subnets of a network cluster-wide
+type NetUsage struct {
+	Network string
+	Size    *big.Int       // IPs of the subnets, nil if the subnets are unknown
+	Leased  *big.Int       // IPs of the subnets in the ranges leased by any node
+	Ranges  map[string]int // ranges leased by each node
+}
+
+// Free returns the IPs of the subnets not leased by any node, nil if the
+// subnets are unknown
+func (u *NetUsage) Free() *big.Int {
+	if u.Size == nil {
+		return nil
+	}
+	free := new(big.Int).Sub(u.Size, u.Leased)
+	if free.Sign() < 0 {
+		return free.SetInt64(0)
+	}
+	return free
+}
+
+// IPAMGetNetLease returns the leases of all nodes under keyDir, by the
+// networks they were applied for and then by the nodes owning them, unlike
+// IPAMGetAllLease which filters the leases of a single id
+func IPAMGetNetLease(cli *clientv3.Client, keyDir string) (map[string]map[string][]allocator.SimpleRange, error) {
+	leases := make(map[string]map[string][]allocator.SimpleRange)
+	err := ipamWalkKeys(cli, keyDir, func(kvs []*mvccpb.KeyValue) error {
+		for _, ev := range kvs {
+			k := strings.Trim(string(ev.Key), " \r\n\t")
+			network, owner := filepath.Base(filepath.Dir(k)), ipamLeaseOwner(ev.Value)
+			if leases[network] == nil {
+				leases[network] = make(map[string][]allocator.SimpleRange)
+			}
+			leases[network][owner] = append(leases[network][owner], *ipamLeaseToSimleRange(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// LeaseEntry is a lease key of a network with the node owning it and the range
+// it decodes to
+type LeaseEntry struct {
+	Network string `json:"network"`
+	Key     string `json:"key"`
+	Node    string `json:"node"`
+	Cause   string `json:"cause,omitempty"`  // the pod whose add applied the lease, if recorded
+	Subnet  string `json:"subnet,omitempty"` // the subnet the lease was applied from, if recorded
+	Start   net.IP `json:"start"`
+	End     net.IP `json:"end"`
+}
+
+// IPAMListLeases returns the leases of network in etcd in the order of the
+// keys, the leases of all networks if network is empty. The leases of the
+// shared pools are not listed.
+func IPAMListLeases(network string) ([]LeaseEntry, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	keyDir := filepath.Join(em.RootKeyDir, leaseDir)
+	if network != "" {
+		keyDir = ipamLeaseKeyDir(em.RootKeyDir, network, "") + "/"
+	}
+	entries := []LeaseEntry{}
+	err = ipamWalkKeys(em.Cli, keyDir, func(kvs []*mvccpb.KeyValue) error {
+		for _, ev := range kvs {
+			k := strings.Trim(string(ev.Key), " \r\n\t")
+			owner, cause := ipamParseLeaseValue(string(ev.Value))
+			sr := ipamLeaseToSimleRange(k)
+			entries = append(entries, LeaseEntry{
+				Network: filepath.Base(filepath.Dir(k)),
+				Key:     k,
+				Node:    owner,
+				Cause:   cause,
+				Subnet:  ipamLeaseSubnet(ev.Value),
+				Start:   sr.RangeStart,
+				End:     sr.RangeEnd,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// IPAMPoolUsage returns the utilization of the networks leasing ranges in etcd
+// and of the networks of subnets, by the names of the networks. The leases of
+// the shared pools are not counted.
+func IPAMPoolUsage(subnets map[string][]*net.IPNet) ([]NetUsage, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	leases, err := IPAMGetNetLease(em.Cli, filepath.Join(em.RootKeyDir, leaseDir))
+	if err != nil {
+		return nil, err
+	}
+	networks := []string{}
+	for network := range leases {
+		networks = append(networks, network)
+	}
+	for network := range subnets {
+		if _, ok := leases[network]; !ok {
+			networks = append(networks, network)
+		}
+	}
+	sort.Strings(networks)
+	usages := []NetUsage{}
+	for _, network := range networks {
+		usages = append(usages, *ipamNetUsage(network, subnets[network], leases[network]))
+	}
+	return usages, nil
+}
+
+// ipamNetUsage counts the leases of network by their owners. The subnet size
+// less the IPs leased within it makes the free IPs, the leases out of subnets
+// count in the ranges of the owners only. Without subnets, the IPs of all the
+// leases count as leased and the size is unknown.
+func ipamNetUsage(network string, subnets []*net.IPNet, leases map[string][]allocator.SimpleRange) *NetUsage {
+	u := &NetUsage{Network: network, Leased: big.NewInt(0), Ranges: make(map[string]int)}
+	if len(subnets) > 0 {
+		u.Size = big.NewInt(0)
+	}
+	one := big.NewInt(1)
+	for _, subnet := range subnets {
+		first, last := allocator.NetToBigRange(types.IPNet(*subnet))
+		u.Size.Add(u.Size, new(big.Int).Sub(last, first)).Add(u.Size, one)
+	}
+	for owner, srs := range leases {
+		u.Ranges[owner] += len(srs)
+		for _, sr := range srs {
+			s, e := allocator.IPToBigInt(sr.RangeStart), allocator.IPToBigInt(sr.RangeEnd)
+			if len(subnets) == 0 {
+				u.Leased.Add(u.Leased, new(big.Int).Sub(e, s)).Add(u.Leased, one)
+				continue
+			}
+			for _, subnet := range subnets {
+				first, last := allocator.NetToBigRange(types.IPNet(*subnet))
+				if (sr.RangeStart.To4() == nil) != (subnet.IP.To4() == nil) || e.Cmp(first) < 0 || s.Cmp(last) > 0 {
+					continue
+				}
+				if s.Cmp(first) < 0 {
+					s = first
+				}
+				if e.Cmp(last) > 0 {
+					e = last
+				}
+				u.Leased.Add(u.Leased, new(big.Int).Sub(e, s)).Add(u.Leased, one)
+				break
+			}
+		}
+	}
+	return u
+}
+
+// WritePoolMetrics writes usages to w in the Prometheus text format
+func WritePoolMetrics(w io.Writer, usages []NetUsage) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP multus_ipam_pool_addresses IPs of the subnets of the network.\n# TYPE multus_ipam_pool_addresses gauge\n")
+	for _, u := range usages {
+		if u.Size != nil {
+			fmt.Fprintf(&buf, "multus_ipam_pool_addresses{network=%q} %v\n", u.Network, u.Size)
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP multus_ipam_leased_addresses IPs of the network in the ranges leased by the nodes.\n# TYPE multus_ipam_leased_addresses gauge\n")
+	for _, u := range usages {
+		fmt.Fprintf(&buf, "multus_ipam_leased_addresses{network=%q} %v\n", u.Network, u.Leased)
+	}
+	fmt.Fprintf(&buf, "# HELP multus_ipam_free_addresses IPs of the subnets of the network not leased by any node.\n# TYPE multus_ipam_free_addresses gauge\n")
+	for _, u := range usages {
+		if free := u.Free(); free != nil {
+			fmt.Fprintf(&buf, "multus_ipam_free_addresses{network=%q} %v\n", u.Network, free)
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP multus_ipam_ranges_per_node IP ranges of the network leased by the node.\n# TYPE multus_ipam_ranges_per_node gauge\n")
+	for _, u := range usages {
+		nodes := []string{}
+		for node := range u.Ranges {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			fmt.Fprintf(&buf, "multus_ipam_ranges_per_node{network=%q,node=%q} %d\n", u.Network, node, u.Ranges[node])
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,196 @@
+package etcdv3cli
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+// ViewLease is a range leased in a network and its owner
+type ViewLease struct {
+	allocator.SimpleRange
+	Owner string
+}
+
+// LeaseView is the leases of the networks under the lease dir, kept up to
+// date by a LeaseWatcher so that they are known without scanning etcd
+type LeaseView struct {
+	mu     sync.RWMutex
+	leases map[string]map[string]ViewLease // network -> key -> lease
+}
+
+// NewLeaseView returns an empty view
+func NewLeaseView() *LeaseView {
+	return &LeaseView{leases: map[string]map[string]ViewLease{}}
+}
+
+// Leases returns the leases of network by the order of their first ips
+func (v *LeaseView) Leases(network string) []ViewLease {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	leases := []ViewLease{}
+	for _, l := range v.leases[network] {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return allocator.IPToBigInt(leases[i].RangeStart).Cmp(allocator.IPToBigInt(leases[j].RangeStart)) < 0
+	})
+	return leases
+}
+
+// ClaimedBy returns the owners of the leases of network overlapping sr
+func (v *LeaseView) ClaimedBy(network string, sr *allocator.SimpleRange) []string {
+	owners := []string{}
+	for _, l := range v.Leases(network) {
+		if l.Overlaps(sr) {
+			owners = append(owners, l.Owner)
+		}
+	}
+	return owners
+}
+
+// viewLeaseKey returns the network and the lease of a key of the lease dir,
+// ok is false for the other keys, e.g. of the locks of the dir
+func viewLeaseKey(key string, value []byte) (string, ViewLease, bool) {
+	key = strings.Trim(key, " \r\n\t")
+	if _, _, _, ok := ipamDecodeLease(filepath.Base(key)); !ok {
+		return "", ViewLease{}, false
+	}
+	return filepath.Base(filepath.Dir(key)), ViewLease{*ipamLeaseToSimleRange(key), ipamLeaseOwner(value)}, true
+}
+
+// reset replaces the leases of the view with those of kvs
+func (v *LeaseView) reset(kvs []*mvccpb.KeyValue) {
+	leases := map[string]map[string]ViewLease{}
+	for _, kv := range kvs {
+		network, l, ok := viewLeaseKey(string(kv.Key), kv.Value)
+		if !ok {
+			continue
+		}
+		if leases[network] == nil {
+			leases[network] = map[string]ViewLease{}
+		}
+		leases[network][string(kv.Key)] = l
+	}
+	v.mu.Lock()
+	v.leases = leases
+	v.mu.Unlock()
+}
+
+// apply updates the view by ev, returning the network and the lease put by
+// it, ok is false for the deletes and the other keys
+func (v *LeaseView) apply(ev *clientv3.Event) (string, ViewLease, bool) {
+	network, l, ok := viewLeaseKey(string(ev.Kv.Key), ev.Kv.Value)
+	if !ok {
+		return "", ViewLease{}, false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if ev.Type == mvccpb.DELETE {
+		delete(v.leases[network], string(ev.Kv.Key))
+		return "", ViewLease{}, false
+	}
+	if v.leases[network] == nil {
+		v.leases[network] = map[string]ViewLease{}
+	}
+	v.leases[network][string(ev.Kv.Key)] = l
+	return network, l, true
+}
+
+// LeaseWatcher keeps a LeaseView of the leases of the networks by a watch on
+// their lease dir, reading all of them again once the watch fails, e.g. as
+// its revision is compacted
+type LeaseWatcher struct {
+	View *LeaseView
+	// OnPut is called with the leases put once the view is synced
+	OnPut  func(network string, l ViewLease)
+	keyDir string
+	get    func(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	watch  func(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// NewLeaseWatcher returns a watcher of the leases under rKeyDir on cli,
+// keeping view
+func NewLeaseWatcher(cli *clientv3.Client, rKeyDir string, view *LeaseView) *LeaseWatcher {
+	return &LeaseWatcher{
+		View:   view,
+		keyDir: filepath.Join(rKeyDir, leaseDir) + "/",
+		get:    cli.Get,
+		watch:  cli.Watch,
+	}
+}
+
+// Run syncs the view and follows the watch until ctx is done or a sync fails,
+// syncing again whenever the watch fails
+func (w *LeaseWatcher) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		rev, err := w.sync(ctx)
+		if err != nil {
+			return err
+		}
+		w.follow(ctx, rev)
+	}
+	return ctx.Err()
+}
+
+// sync reads all the leases into the view a page at a time, all the pages at
+// the revision of the first, which is returned
+func (w *LeaseWatcher) sync(ctx context.Context) (int64, error) {
+	kvs := []*mvccpb.KeyValue{}
+	key, end := w.keyDir, clientv3.GetPrefixRangeEnd(w.keyDir)
+	var rev int64
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(leasePageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		gctx, cancel := context.WithTimeout(ctx, etcdv3.RequestTimeout)
+		resp, err := w.get(gctx, key, opts...)
+		cancel()
+		if err != nil {
+			return 0, logging.Errorf("Get %v failed, %v", w.keyDir, err)
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		kvs = append(kvs, resp.Kvs...)
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	w.View.reset(kvs)
+	logging.Verbosef("synced %d leases of %v at revision %d", len(kvs), w.keyDir, rev)
+	return rev, nil
+}
+
+// follow applies the events after rev to the view until the watch fails or
+// ctx is done
+func (w *LeaseWatcher) follow(ctx context.Context, rev int64) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for wresp := range w.watch(wctx, w.keyDir, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+		if wresp.CompactRevision != 0 {
+			logging.Verbosef("watch of %v is compacted at %d, sync again", w.keyDir, wresp.CompactRevision)
+			return
+		}
+		if err := wresp.Err(); err != nil {
+			logging.Errorf("watch of %v failed, %v", w.keyDir, err)
+			return
+		}
+		for _, ev := range wresp.Events {
+			if network, l, ok := w.View.apply(ev); ok && w.OnPut != nil {
+				w.OnPut(network, l)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package events tells the controllers outside of the runtime which ips the
+// containers got and gave back, as lines of json appended to a file or sent to
+// a unix socket.
+package events
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	Allocated = "allocated" // an ip allocated to a container
+	Released  = "released"  // an ip of a container released
+)
+
+// socketPrefix marks the targets which are unix sockets instead of files
+const socketPrefix = "unix:"
+
+// socketTimeout bounds the wait on the listener of a socket, a slow controller
+// shall not hold up the CNI call
+const socketTimeout = time.Second
+
+// Event is an ip allocated or released on the node
+type Event struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Network     string    `json:"network"`
+	Node        string    `json:"node,omitempty"`
+	ContainerID string    `json:"containerId"`
+	IfName      string    `json:"ifName,omitempty"`
+	IP          string    `json:"ip"`
+}
+
+// Emitter sends the events to a file, or to a unix socket if its target is
+// "unix:<path>"
+type Emitter struct {
+	target string
+}
+
+// Open returns the emitter of target, the file is created on the first emit
+func Open(target string) *Emitter {
+	return &Emitter{target}
+}
+
+// Emit sends evs as lines of json in a single write, which keeps the lines of
+// concurrent calls apart
+func (e *Emitter) Emit(evs []Event) error {
+	if len(evs) == 0 {
+		return nil
+	}
+	data := []byte{}
+	for i := range evs {
+		if evs[i].Time.IsZero() {
+			evs[i].Time = time.Now()
+		}
+		line, err := json.Marshal(&evs[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if strings.HasPrefix(e.target, socketPrefix) {
+		conn, err := net.DialTimeout("unix", strings.TrimPrefix(e.target, socketPrefix), socketTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(socketTimeout))
+		_, err = conn.Write(data)
+		return err
+	}
+	f, err := os.OpenFile(e.target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
@@ -0,0 +1,135 @@
+// Package replay records the allocation decisions of multus-ipam to a log,
+// which a test replays with a Player standing in for etcd to reproduce the
+// exact sequence of a node.
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+)
+
+const (
+	OpApply   = "apply"   // a range applied from etcd
+	OpAlloc   = "alloc"   // the ips allocated to a container
+	OpRelease = "release" // the ips of a container released
+)
+
+// Record is a decision of a CNI call, with the inputs it was made on
+type Record struct {
+	Time    time.Time               `json:"time"`
+	Op      string                  `json:"op"`
+	Network string                  `json:"network"`
+	Node    string                  `json:"node,omitempty"`
+	ID      string                  `json:"id,omitempty"`
+	IfName  string                  `json:"ifName,omitempty"`
+	Cache   []allocator.SimpleRange `json:"cache,omitempty"`  // alloc: the cached ranges before
+	Range   *allocator.SimpleRange  `json:"range,omitempty"`  // apply: the range applied from
+	Unit    uint32                  `json:"unit,omitempty"`   // apply: the apply unit
+	Leases  []allocator.SimpleRange `json:"leases,omitempty"` // apply: the leases etcd scanned
+	Result  *allocator.SimpleRange  `json:"result,omitempty"` // apply: the range applied
+	IPs     []string                `json:"ips,omitempty"`    // alloc: the ips allocated
+	Err     string                  `json:"err,omitempty"`
+}
+
+// Log appends the records of the CNI calls of a node to a file
+type Log struct {
+	path string
+}
+
+// Open returns the log of path, the file is created on the first append
+func Open(path string) *Log {
+	return &Log{path}
+}
+
+// Append appends r as a line of json, a single write of the line keeps the
+// appends of concurrent calls apart
+func (l *Log) Append(r *Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Load reads the records of the log at path in order
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []Record{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("invalid record at line %d of %v, %v", n, path, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Player replays the applies recorded, standing in for etcd. The allocations
+// and releases are left to the test, which runs them in the recorded order.
+type Player struct {
+	applies []Record
+	next    int
+}
+
+// NewPlayer returns a player of the applies of records
+func NewPlayer(records []Record) *Player {
+	p := &Player{}
+	for _, r := range records {
+		if r.Op == OpApply {
+			p.applies = append(p.applies, r)
+		}
+	}
+	return p
+}
+
+// Apply returns the result of the next apply recorded, it has the signature
+// of etcdv3cli.IPAMApplyShardedIPRange. It fails once the replay diverges
+// from the record, i.e. the apply is not the one recorded next.
+func (p *Player) Apply(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+	if p.next >= len(p.applies) {
+		return nil, fmt.Errorf("replay diverges, apply %v-%v of %v is not recorded", r.RangeStart, r.RangeEnd, network)
+	}
+	rec := p.applies[p.next]
+	p.next++
+	if rec.Network != network || rec.Unit != unit || rec.Range == nil ||
+		!rec.Range.RangeStart.Equal(r.RangeStart) || !rec.Range.RangeEnd.Equal(r.RangeEnd) {
+		return nil, fmt.Errorf("replay diverges at apply %d, %v-%v/%d of %v is not the one recorded",
+			p.next, r.RangeStart, r.RangeEnd, unit, network)
+	}
+	switch rec.Err {
+	case "":
+		// the usage of the range is not recorded
+		return &etcdv3cli.ApplyResult{SimpleRange: rec.Result}, nil
+	case etcdv3cli.ErrRangeExhausted.Error():
+		return nil, etcdv3cli.ErrRangeExhausted
+	}
+	return nil, fmt.Errorf("%s", rec.Err)
+}
+
+// Done tells if all the applies recorded are replayed
+func (p *Player) Done() bool {
+	return p.next == len(p.applies)
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+)
+
+// commands are run by the operator from the command line, instead of by the
+// container runtime through CNI
+var commands = map[string]func(args []string) error{
+	"migrate-datadir":    cmdMigrateDataDir,
+	"rebuild-from-disk":  cmdRebuildFromDisk,
+	"lease-map":          cmdLeaseMap,
+	"reclaim-node":       cmdReclaimNode,
+	"import-static":      cmdImportStatic,
+	"owner-of-ip":        cmdOwnerOfIP,
+	"leases":             cmdLeases,
+	"plan":               cmdPlan,
+	"migrate-lease-keys": cmdMigrateLeaseKeys,
+	"force-release":      cmdForceRelease,
+	"delete-network":     cmdDeleteNetwork,
+	"warmup":             cmdWarmup,
+	"reconcile":          cmdReconcile,
+}
+
+// runCommand runs the command named by args[0], it returns false when args do
+// not name a command, leaving them to CNI
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	setupLogging(nil)
+	return true, cmd(args[1:])
+}
+
+func cmdMigrateDataDir(args []string) error {
+	fs := flag.NewFlagSet("migrate-datadir", flag.ContinueOnError)
+	from := fs.String("from", "", "data dir to migrate from")
+	to := fs.String("to", "", "data dir to migrate to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return fmt.Errorf("both --from and --to are required")
+	}
+	if err := disk.Migrate(*from, *to); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "migrated %v to %v, update dataDir of the networks before removing %v\n", *from, *to, *from)
+	return nil
+}
+
+func cmdMigrateLeaseKeys(args []string) error {
+	fs := flag.NewFlagSet("migrate-lease-keys", flag.ContinueOnError)
+	shards := fs.Int("mutex-shards", 0, "mutexShards of the networks")
+	rootKeyDir := fs.String("root-key-dir", "", "etcd root of the keys to migrate, ETCD_ROOT_DIR if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	etcdv3.SetRootKeyDir(*rootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+	migrated, err := etcdv3cli.IPAMMigrateLeaseKeys(*shards)
+	for _, m := range migrated {
+		fmt.Fprintf(os.Stdout, "%v -> %v\n", m.Key, strings.Join(m.Keys, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "migrated %d legacy lease keys\n", len(migrated))
+	return nil
+}
+
+func cmdRebuildFromDisk(args []string) error {
+	fs := flag.NewFlagSet("rebuild-from-disk", flag.ContinueOnError)
+	dataDir := fs.String("data-dir", "", "data dir of the networks, the default one if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	conflicts, err := etcdv3cli.IPAMRebuildFromDisk(*dataDir)
+	if err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stdout, "%v: cache %v-%v conflicts with lease %v of %v\n",
+			c.Network, c.Range.RangeStart, c.Range.RangeEnd, c.Lease, c.Owner)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d cached ranges conflict with the leases of other nodes", len(conflicts))
+	}
+	return nil
+}
+
+func cmdLeaseMap(args []string) error {
+	fs := flag.NewFlagSet("lease-map", flag.ContinueOnError)
+	network := fs.String("network", "", "network to map the leases of")
+	pool := fs.String("pool", "", "pool of the network, if any")
+	subnet := fs.String("subnet", "", "subnet to map, e.g. 10.1.0.0/24")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *subnet == "" {
+		fs.Usage()
+		return fmt.Errorf("both --network and --subnet are required")
+	}
+	_, ipNet, err := net.ParseCIDR(*subnet)
+	if err != nil {
+		return err
+	}
+	m, err := etcdv3cli.IPAMLeaseMap(*network, *pool, ipNet)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stdout, m)
+	return nil
+}
+
+func cmdReclaimNode(args []string) error {
+	fs := flag.NewFlagSet("reclaim-node", flag.ContinueOnError)
+	node := fs.String("node", "", "dead node to reclaim the ranges of")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *node == "" {
+		fs.Usage()
+		return fmt.Errorf("--node is required")
+	}
+	revoked, err := etcdv3cli.IPAMReclaimNode(*node)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("node %v has no lease alive, nodeLeaseTTL may be unset", *node)
+	}
+	fmt.Fprintf(os.Stdout, "reclaimed the ranges of node %v\n", *node)
+	return nil
+}
+
+func cmdForceRelease(args []string) error {
+	fs := flag.NewFlagSet("force-release", flag.ContinueOnError)
+	node := fs.String("node", "", "decommissioned node to delete the leases of")
+	dryRun := fs.Bool("dry-run", false, "only list the leases of the node")
+	force := fs.Bool("force", false, "delete the leases even if the node keeps its node lease alive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *node == "" {
+		fs.Usage()
+		return fmt.Errorf("--node is required")
+	}
+	leases, err := etcdv3cli.IPAMForceReleaseNode(*node, *dryRun, *force)
+	for _, l := range leases {
+		fmt.Fprintf(os.Stdout, "%v\t%v-%v\t%v\n", l.Network, l.Start, l.End, l.Key)
+	}
+	if err == etcdv3cli.ErrNodeAlive {
+		return fmt.Errorf("node %v keeps its node lease alive, make sure it is gone and rerun with --force", *node)
+	}
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stdout, "would release %d leases of node %v\n", len(leases), *node)
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "released %d leases of node %v\n", len(leases), *node)
+	return nil
+}
+
+func cmdDeleteNetwork(args []string) error {
+	fs := flag.NewFlagSet("delete-network", flag.ContinueOnError)
+	network := fs.String("network", "", "network torn down to delete the keys of")
+	shards := fs.Int("mutex-shards", 0, "mutexShards of the network")
+	rootKeyDir := fs.String("root-key-dir", "", "etcd root of the keys of the network, ETCD_ROOT_DIR if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" {
+		fs.Usage()
+		return fmt.Errorf("--network is required")
+	}
+	etcdv3.SetRootKeyDir(*rootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+	deleted, err := etcdv3cli.IPAMDeleteNetwork(*network, *shards)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "deleted %d keys of network %v\n", deleted, *network)
+	return nil
+}
+
+func cmdReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	checkOnly := fs.Bool("check-only", false, "report the divergences between etcd and the cache without fixing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*checkOnly {
+		results, err := etcdv3cli.IPAMCheckEtcdWithBudget(-1)
+		for _, r := range results {
+			if r.Err != nil {
+				fmt.Fprintf(os.Stdout, "%v: %v\n", r.Network, r.Err)
+			}
+		}
+		return err
+	}
+	audits, err := etcdv3cli.IPAMAuditEtcd()
+	if err != nil {
+		return err
+	}
+	diverged := 0
+	for _, a := range audits {
+		if a.Err != nil {
+			fmt.Fprintf(os.Stdout, "%v: %v\n", a.Network, a.Err)
+		}
+		for _, d := range a.Divergences {
+			fmt.Fprintf(os.Stdout, "%v: %v\n", a.Network, d)
+		}
+		diverged += len(a.Divergences)
+	}
+	if diverged > 0 {
+		return fmt.Errorf("%d divergences between etcd and the cache", diverged)
+	}
+	return nil
+}
+
+func cmdImportStatic(args []string) error {
+	fs := flag.NewFlagSet("import-static", flag.ContinueOnError)
+	network := fs.String("network", "", "network to reserve the ips in")
+	pool := fs.String("pool", "", "pool of the network, if any")
+	subnets := fs.String("subnet", "", "subnets of the network, comma separated, e.g. 10.1.0.0/24")
+	file := fs.String("file", "", "csv of ip,identity lines or json of [{\"ip\", \"identity\"}] to import")
+	shards := fs.Int("mutex-shards", 0, "mutexShards of the network")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *subnets == "" || *file == "" {
+		fs.Usage()
+		return fmt.Errorf("--network, --subnet and --file are required")
+	}
+	ipNets, err := parseSubnets(*subnets)
+	if err != nil {
+		return err
+	}
+	entries, err := loadStaticEntries(*file)
+	if err != nil {
+		return err
+	}
+	conflicts, err := etcdv3cli.IPAMImportStatic(*network, *pool, ipNets, entries, *shards)
+	if err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stdout, "%v: %v for %v not imported, %v\n", *network, c.Entry.IP, c.Entry.Identity, c.Reason)
+	}
+	fmt.Fprintf(os.Stdout, "%v: %d of %d entries imported\n", *network, len(entries)-len(conflicts), len(entries))
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d entries conflict", len(conflicts))
+	}
+	return nil
+}
+
+// loadStaticEntries reads the entries of a json array, or else of csv lines of
+// ip,identity, a header line and the lines starting with # are skipped
+func loadStaticEntries(path string) ([]etcdv3cli.StaticEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []etcdv3cli.StaticEntry{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid json of %v, %v", path, err)
+		}
+		return entries, nil
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv of %v, %v", path, err)
+	}
+	for i, rec := range records {
+		addr := net.ParseIP(strings.TrimSpace(rec[0]))
+		if addr == nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid ip %v of %v", rec[0], path)
+		}
+		entries = append(entries, etcdv3cli.StaticEntry{IP: addr, Identity: strings.TrimSpace(rec[1])})
+	}
+	return entries, nil
+}
+
+func cmdOwnerOfIP(args []string) error {
+	fs := flag.NewFlagSet("owner-of-ip", flag.ContinueOnError)
+	network := fs.String("network", "", "network of the ip")
+	pool := fs.String("pool", "", "pool of the network, if any")
+	subnets := fs.String("subnet", "", "subnets of the network, comma separated, to tell the ips out of them")
+	addr := fs.String("ip", "", "ip to find the owner of")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *addr == "" {
+		fs.Usage()
+		return fmt.Errorf("both --network and --ip are required")
+	}
+	ip := net.ParseIP(*addr)
+	if ip == nil {
+		return fmt.Errorf("invalid ip %v", *addr)
+	}
+	ipNets := []*net.IPNet{}
+	if *subnets != "" {
+		var err error
+		if ipNets, err = parseSubnets(*subnets); err != nil {
+			return err
+		}
+	}
+	owner, err := etcdv3cli.IPAMOwnerOfIP(*network, *pool, ipNets, ip)
+	if err != nil {
+		return fmt.Errorf("%v of %v: %v", ip, *network, err)
+	}
+	if owner == nil {
+		fmt.Fprintf(os.Stdout, "%v of %v is free, no lease covers it\n", ip, *network)
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "%v of %v is owned by node %v, leased %v-%v for %v", ip, *network, owner.Node,
+		owner.Range.RangeStart, owner.Range.RangeEnd, owner.Network)
+	if owner.Cause != "" {
+		fmt.Fprintf(os.Stdout, " by pod %v", owner.Cause)
+	}
+	fmt.Fprintln(os.Stdout)
+	return nil
+}
+
+// parseSubnets parses the comma separated subnets of a flag
+func parseSubnets(subnets string) ([]*net.IPNet, error) {
+	ipNets := []*net.IPNet{}
+	for _, s := range strings.Split(subnets, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// leaseRow is a lease listed with the ips of it allocated on this node
+type leaseRow struct {
+	etcdv3cli.LeaseEntry
+	Used int `json:"used"`
+}
+
+func cmdLeases(args []string) error {
+	fs := flag.NewFlagSet("leases", flag.ContinueOnError)
+	network := fs.String("network", "", "network to list the leases of, all networks if empty")
+	dataDir := fs.String("data-dir", "", "data dir of the networks, the default one if empty")
+	asJSON := fs.Bool("json", false, "print the leases as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	entries, err := etcdv3cli.IPAMListLeases(*network)
+	if err != nil {
+		return err
+	}
+	rows, err := localLeaseUse(entries, *dataDir)
+	if err != nil {
+		return err
+	}
+	return printLeases(os.Stdout, rows, *asJSON)
+}
+
+// localLeaseUse counts the ips of each lease allocated in the disk store of
+// this node, which are none for the leases of the other nodes
+func localLeaseUse(entries []etcdv3cli.LeaseEntry, dataDir string) ([]leaseRow, error) {
+	local := map[string]bool{}
+	for _, n := range disk.GetAllNet(dataDir) {
+		local[n] = true
+	}
+	reserved := map[string][]net.IP{}
+	rows := []leaseRow{}
+	for _, e := range entries {
+		if _, ok := reserved[e.Network]; !ok && local[e.Network] {
+			store, err := disk.New(e.Network, dataDir)
+			if err != nil {
+				return nil, err
+			}
+			reserved[e.Network] = store.ReservedIPs()
+			store.Close()
+		}
+		row := leaseRow{LeaseEntry: e}
+		for _, addr := range reserved[e.Network] {
+			if ip.Cmp(addr, e.Start) >= 0 && ip.Cmp(addr, e.End) <= 0 {
+				row.Used++
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// printLeases prints rows as a table grouped by the networks, or as a json
+// array
+func printLeases(w io.Writer, rows []leaseRow, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tNODE\tSTART\tEND\tUSED\tKEY")
+	for _, r := range rows {
+		start, end := allocator.IPToBigInt(r.Start), allocator.IPToBigInt(r.End)
+		size := end.Sub(end, start).Add(end, big.NewInt(1))
+		node := r.Node
+		if r.Cause != "" {
+			node += "@" + r.Cause
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%d/%v\t%v\n", r.Network, node, r.Start, r.End, r.Used, size, r.Key)
+	}
+	return tw.Flush()
+}
+
+// planReport is the dry run of the allocations of count more pods of a network
+// on this node
+type planReport struct {
+	Network   string         `json:"network"`
+	Count     int            `json:"count"`
+	Pods      uint64         `json:"pods"` // pods the network could still take, at least if capped
+	Fits      bool           `json:"fits"`
+	RangeSets []planRangeSet `json:"rangeSets"`
+}
+
+// planRangeSet is the dry run of the allocations from a range set, each pod
+// taking num ips of it
+type planRangeSet struct {
+	Index     int                    `json:"index"`
+	LocalFree uint64                 `json:"localFree"` // ips free in the ranges leased to this node
+	Applies   []*etcdv3cli.ApplyPlan `json:"applies"`
+}
+
+// free returns the ips the range set could still allocate, from the ranges
+// leased already and from those left to apply
+func (p *planRangeSet) free() uint64 {
+	free := p.LocalFree
+	for _, a := range p.Applies {
+		ips := a.Units * a.UnitIPs
+		if a.UnitIPs != 0 && ips/a.UnitIPs != a.Units || free+ips < free {
+			return math.MaxUint64
+		}
+		free += ips
+	}
+	return free
+}
+
+func cmdPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	conf := fs.String("conf", "", "network configuration file")
+	count := fs.Int("count", 1, "pods to fit")
+	limit := fs.Uint64("max-units", 65536, "apply units simulated at most per range, 0 for no limit")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *conf == "" || *count < 1 {
+		fs.Usage()
+		return fmt.Errorf("--conf and a positive --count are required")
+	}
+	data, err := ioutil.ReadFile(*conf)
+	if err != nil {
+		return err
+	}
+	netConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	etcdv3.SetRootKeyDir(netConf.IPAM.RootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+	report, err := planAllocation(netConf, *count, *limit)
+	if err != nil {
+		return err
+	}
+	if err := printPlan(os.Stdout, report, *asJSON); err != nil {
+		return err
+	}
+	if !report.Fits {
+		return fmt.Errorf("%d pods of %v do not fit, %d do", report.Count, report.Network, report.Pods)
+	}
+	return nil
+}
+
+// planAllocation simulates the allocations of count pods of the network, from
+// the ranges leased to this node first and then from the ranges left to apply
+// in etcd, as allocateIP does. Neither etcd nor the data dir is written.
+func planAllocation(netConf *allocator.Net, count int, limit uint64) (*planReport, error) {
+	ipamConf := netConf.IPAM
+	if ipamConf.IsFixIP || ipamConf.NodeRange != nil {
+		return nil, fmt.Errorf("plan of %v is not supported, its ips are not applied from etcd", ipamConf.Name)
+	}
+	applyUnit := ipamConf.NodeApplyUnit(etcdv3.NodeId())
+
+	var reserved []net.IP
+	for _, n := range disk.GetAllNet(ipamConf.DataDir) {
+		if n != ipamConf.Name {
+			continue
+		}
+		store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		reserved = store.ReservedIPs()
+		store.Close()
+	}
+
+	report := &planReport{Network: ipamConf.Name, Count: count, Pods: math.MaxUint64, RangeSets: []planRangeSet{}}
+	allocated := map[int]bool{}
+	for idx, rs := range ipamConf.Ranges {
+		// the ips of a pod come from the first range set of each family
+		family := allocator.RangeSetFamily(rs)
+		if allocated[family] || (ipamConf.IPFamily != 0 && ipamConf.IPFamily != family) {
+			continue
+		}
+		allocated[family] = true
+		prs := planRangeSet{Index: idx}
+		for i := range rs {
+			a, err := etcdv3cli.IPAMPlanApplies(ipamConf.Name, ipamConf.Pool, &rs[i], applyUnit, ipamConf.Priority, limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range a.Leased {
+				size := new(big.Int).Sub(allocator.IPToBigInt(l.RangeEnd), allocator.IPToBigInt(l.RangeStart))
+				prs.LocalFree += size.Uint64() + 1
+				for _, addr := range reserved {
+					if ip.Cmp(addr, l.RangeStart) >= 0 && ip.Cmp(addr, l.RangeEnd) <= 0 {
+						prs.LocalFree--
+					}
+				}
+			}
+			prs.Applies = append(prs.Applies, a)
+		}
+		if pods := prs.free() / uint64(ipamConf.Num); pods < report.Pods {
+			report.Pods = pods
+		}
+		report.RangeSets = append(report.RangeSets, prs)
+	}
+	if len(report.RangeSets) == 0 {
+		report.Pods = 0
+	}
+	report.Fits = report.Pods >= uint64(count)
+	return report, nil
+}
+
+// printPlan prints the report as a table of the ranges, or as json
+func printPlan(w io.Writer, report *planReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANGESET\tSTART\tEND\tLEASED\tUNITS\tUNIT IPS")
+	for _, prs := range report.RangeSets {
+		for _, a := range prs.Applies {
+			units := fmt.Sprint(a.Units)
+			if a.Capped {
+				units += "+"
+			}
+			fmt.Fprintf(tw, "%d\t%v\t%v\t%d\t%v\t%d\n", prs.Index, a.Range.RangeStart, a.Range.RangeEnd, len(a.Leased), units, a.UnitIPs)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fits := "fit"
+	if !report.Fits {
+		fits = "do not fit"
+	}
+	_, err := fmt.Fprintf(w, "%d pods of %v %s, %d could still be allocated\n", report.Count, report.Network, fits, report.Pods)
+	return err
+}
+
+func cmdWarmup(args []string) error {
+	fs := flag.NewFlagSet("warmup", flag.ContinueOnError)
+	conf := fs.String("conf", "", "network configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *conf == "" {
+		fs.Usage()
+		return fmt.Errorf("--conf is required")
+	}
+	data, err := ioutil.ReadFile(*conf)
+	if err != nil {
+		return err
+	}
+	netConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	etcdv3.SetRootKeyDir(netConf.IPAM.RootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout(netConf.IPAM))
+	defer cancel()
+	applied, err := warmup(ctx, netConf)
+	for idx, n := range applied {
+		fmt.Fprintf(os.Stdout, "range set %d: applied %d units\n", idx, n)
+	}
+	return err
+}
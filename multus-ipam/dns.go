@@ -20,8 +20,29 @@ import (
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
 )
 
+// loadDNS returns the dns of the resolvConf of ipamConf, none without it. As
+// the pod still gets its ips without dns, a resolvConf failing to parse is
+// only logged if ignoreResolvConfErrors.
+func loadDNS(ipamConf *allocator.IPAMConfig) (types.DNS, error) {
+	if ipamConf.ResolvConf == "" {
+		return types.DNS{}, nil
+	}
+	logging.Debugf("ipamConf.ResolvConf=%v", ipamConf.ResolvConf)
+	dns, err := parseResolvConf(ipamConf.ResolvConf)
+	if err != nil && ipamConf.LenientDNS {
+		logging.Errorf("parseResolvConf failed, %v, go on without dns", err)
+		return types.DNS{}, nil
+	}
+	if err != nil {
+		return types.DNS{}, logging.Errorf("parseResolvConf failed, %v", err)
+	}
+	return *dns, nil
+}
+
 // parseResolvConf parses an existing resolv.conf in to a DNS struct
 func parseResolvConf(filename string) (*types.DNS, error) {
 	fp, err := os.Open(filename)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+)
+
+// the codes of the errors printed to the runtime, those below 100 are of the
+// CNI spec, the others of the plugin
+const (
+	errCodeInvalidConfig   uint = 7
+	errCodeTryAgainLater   uint = 11
+	errCodeInternal        uint = 100
+	errCodeEtcdUnavailable uint = 101
+)
+
+// cniError returns err as the error of the CNI spec, coded by its cause so
+// that the runtime can tell e.g. an ADD to retry later from a configuration to
+// fix. The errors coded already are returned as they are.
+func cniError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*types.Error); ok {
+		return e
+	}
+	return codedError(err, err)
+}
+
+// codedError returns err coded by cause, the error err was made from without
+// wrapping it
+func codedError(cause, err error) error {
+	return &types.Error{Code: errCode(cause), Msg: err.Error()}
+}
+
+// configError returns err of the configuration coded as invalid
+func configError(err error) error {
+	return &types.Error{Code: errCodeInvalidConfig, Msg: err.Error()}
+}
+
+// errCode classifies err, the pool exhausted or the etcd contended past the
+// allocTimeout pass once the ips are released or the contention is over
+func errCode(err error) uint {
+	var exhausted *exhaustedError
+	switch {
+	case etcdv3.Unavailable(err):
+		return errCodeEtcdUnavailable
+	case errors.Is(err, etcdv3.ErrInvalidId):
+		return errCodeInvalidConfig
+	case errors.As(err, &exhausted), errors.Is(err, etcdv3cli.ErrRangeExhausted),
+		errors.Is(err, allocator.ErrNoFreeAddresses), errors.Is(err, etcdv3.ErrDeadline):
+		return errCodeTryAgainLater
+	}
+	return errCodeInternal
+}
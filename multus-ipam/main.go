@@ -15,41 +15,83 @@
 package main
 
 import (
-	// "encoding/json"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	// "flag"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/intel/multus-cni/etcdv3"
 	"github.com/intel/multus-cni/logging"
 	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
 	"github.com/intel/multus-cni/multus-ipam/backend/disk"
 	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"github.com/intel/multus-cni/multus-ipam/backend/events"
+	"github.com/intel/multus-cni/multus-ipam/backend/replay"
 )
 
-func init() {
-	//for debug
-	logging.SetLogFile("/var/log/multus-ipam.log")
-	logging.SetLogLevel("debug")
+// the log of the plugin when the config sets none
+const (
+	defaultLogFile  = "/var/log/multus-ipam.log"
+	defaultLogLevel = "debug"
+)
+
+// setupLogging logs to the logFile at the logLevel of the ipam config, else of
+// the network config, else the defaults. A nil netConf, e.g. of a config
+// failing to load, takes the defaults.
+func setupLogging(netConf *allocator.Net) {
+	file, level := defaultLogFile, defaultLogLevel
+	if netConf != nil {
+		for _, c := range [][2]string{{netConf.LogFile, netConf.LogLevel}, {netConf.IPAM.LogFile, netConf.IPAM.LogLevel}} {
+			if c[0] != "" {
+				file = c[0]
+			}
+			if c[1] != "" {
+				level = c[1]
+			}
+		}
+	}
+	logging.SetLogFile(file)
+	logging.SetLogLevel(level)
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("multus-ipam"))
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, supportedVersions, bv.BuildString("multus-ipam"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
 
 	netConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
+		setupLogging(nil)
 		return err
 	}
+	setupLogging(netConf)
 
 	ipamConf := netConf.IPAM
 
@@ -66,46 +108,163 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
 	}
 
+	// the pods keep the dns and the routes the ADD gave them, a change of the
+	// configuration since would leave them inconsistent
+	added, ok := store.LoadResult(args.ContainerID, args.IfName)
+	if !ok {
+		return nil
+	}
+	want := disk.Result{Routes: ipamConf.Routes}
+	if want.DNS, err = loadDNS(ipamConf); err != nil {
+		return err
+	}
+	if err := checkResult(&added, &want); err != nil {
+		return logging.Errorf("check %v of container %v failed, %v", args.IfName, args.ContainerID, err)
+	}
+
+	return nil
+}
+
+// checkResult tells how the dns and the routes added differ from those the
+// configuration gives now
+func checkResult(added, want *disk.Result) error {
+	a, err := json.Marshal(added.DNS)
+	if err != nil {
+		return err
+	}
+	w, err := json.Marshal(want.DNS)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, w) {
+		return fmt.Errorf("dns %s added differs from dns %s configured", a, w)
+	}
+	if a, err = json.Marshal(added.Routes); err != nil {
+		return err
+	}
+	if w, err = json.Marshal(want.Routes); err != nil {
+		return err
+	}
+	if len(added.Routes) > 0 || len(want.Routes) > 0 {
+		if !bytes.Equal(a, w) {
+			return fmt.Errorf("routes %s added differ from routes %s configured", a, w)
+		}
+	}
 	return nil
 }
 
+// defaultCmdTimeout bounds the etcd calls of an ADD or a DEL of a network
+// without allocTimeout, so that a hung etcd fails the command before the
+// runtime gives up on the process
+const defaultCmdTimeout = time.Minute
+
+// cmdTimeout returns the bound of the etcd calls of a command on ipamConf, the
+// allocTimeout if configured
+func cmdTimeout(ipamConf *allocator.IPAMConfig) time.Duration {
+	if ipamConf.AllocTimeout > 0 {
+		return time.Duration(ipamConf.AllocTimeout) * time.Second
+	}
+	return defaultCmdTimeout
+}
+
+// cmdAdd allocates the ips of the container, the errors coded for the runtime
 func cmdAdd(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
+	return cniError(add(context.Background(), args))
+}
+
+func add(ctx context.Context, args *skel.CmdArgs) error {
 	netConf, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
-	logging.Debugf("%v", args)
 	if err != nil {
-		return logging.Errorf("LoadIPAMConfig failed, %v", err)
+		setupLogging(nil)
+		return configError(logging.Errorf("LoadIPAMConfig failed, %v", err))
 	}
+	setupLogging(netConf)
+	logging.Debugf("%v", args)
 
 	ipamConf := netConf.IPAM
 
+	if ipamConf.StrictVersion {
+		if err := checkVersion(confVersion); err != nil {
+			logging.Errorf("%v", err)
+			return &types.Error{Code: types.ErrIncompatibleCNIVersion, Msg: err.Error()}
+		}
+	}
+
+	etcdv3.SetRootKeyDir(ipamConf.RootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout(ipamConf))
+	defer cancel()
+
 	result := &current.Result{}
 
-	if ipamConf.ResolvConf != "" {
-		logging.Debugf("ipamConf.ResolvConf=%v", ipamConf.ResolvConf)
-		dns, err := parseResolvConf(ipamConf.ResolvConf)
-		if err != nil {
-			return logging.Errorf("parseResolvConf failed, %v", err)
-		}
-		result.DNS = *dns
+	if result.DNS, err = loadDNS(ipamConf); err != nil {
+		return err
 	}
 
 	// logging.Debugf("ipamConf.ApplyUnit=%v", ipamConf.ApplyUnit)
 
+	degraded := ipamConf.DataDirPolicy == allocator.DataDirDegraded && ipamConf.IsFixIP == false
 	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
 	if err != nil {
-		return logging.Errorf("disk.New(%v, %v) failed, %v", ipamConf.Name, ipamConf.DataDir, err)
+		if !degraded {
+			return logging.Errorf("disk.New(%v, %v) failed, %v", ipamConf.Name, ipamConf.DataDir, err)
+		}
+		logging.Errorf("data dir of %v fails, allocate tracked by etcd only, %v", ipamConf.Name, err)
+		if result.IPs, err = allocateEtcdOnly(ctx, ipamConf, args.ContainerID); err != nil {
+			return err
+		}
+		result.Routes = ipamConf.Routes
+		emitEvents(ipamConf, events.Allocated, args.ContainerID, args.IfName, resultIPs(result))
+		return printResult(result, confVersion, ipamConf.RouteTables)
 	}
 	defer store.Close()
 
-	if ipamConf.IsFixIP == false {
-		result.IPs, err = allocateIP(netConf, store, args.ContainerID, args.IfName)
+	var pinned net.IP
+	if ipamConf.PinnedIPs && ipamConf.IsFixIP == false && ipamConf.PodName != "" {
+		pinned, err = etcdv3cli.IPAMGetPinnedIP(ipamConf.Name, etcdv3cli.IPAMGenPinInfo(ipamConf.K8sNs, ipamConf.PodName))
 		if err != nil {
-			return logging.Errorf("allocateIP failed, %v", err)
+			return codedError(err, logging.Errorf("get pinned ip failed, %v", err))
+		}
+	}
+
+	// the ip preferred by the pod is only tried, losing it never fails the add
+	soft := ipamConf.SoftReserve && pinned == nil && ipamConf.IsFixIP == false && ipamConf.PodName != ""
+	if soft {
+		pref, perr := etcdv3cli.IPAMGetPreferredIP(ipamConf.Name, etcdv3cli.IPAMGenPinInfo(ipamConf.K8sNs, ipamConf.PodName))
+		if perr != nil {
+			logging.Errorf("get preferred ip failed, %v", perr)
+		}
+		ipamConf.Preferred = pref
+	}
+
+	if len(ipamConf.IPArgs) > 0 && ipamConf.IsFixIP == false {
+		result.IPs, err = allocateRequestedIPs(ctx, ipamConf, args.ContainerID)
+		if err != nil {
+			return codedError(err, logging.Errorf("allocate requested IPs %v failed, %v", ipamConf.IPArgs, err))
+		}
+	} else if pinned != nil {
+		result.IPs, err = allocatePinnedIP(ctx, netConf, store, args.ContainerID, args.IfName, pinned)
+		if err != nil {
+			return codedError(err, logging.Errorf("allocate pinned IP %v failed, %v", pinned, err))
+		}
+	} else if ipamConf.IsFixIP == false {
+		result.IPs, err = allocateIP(ctx, netConf, store, args.ContainerID, args.IfName)
+		if err != nil && degraded {
+			if perr := probeDataDir(store.Dir()); perr != nil {
+				logging.Errorf("data dir %v fails, allocate tracked by etcd only, %v", store.Dir(), perr)
+				result.IPs, err = allocateEtcdOnly(ctx, ipamConf, args.ContainerID)
+			}
+		}
+		if err != nil {
+			return codedError(err, logging.Errorf("allocateIP failed, %v", err))
 		}
 	} else {
-		result.IPs, err = allocateFixIP(netConf)
+		result.IPs, err = allocateFixIP(ctx, netConf)
 		if err != nil {
-			return logging.Errorf("allocate fix IP failed, %v", err)
+			return codedError(err, logging.Errorf("allocate fix IP failed, %v", err))
 		}
 	}
 
@@ -113,7 +272,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// logging.Debugf("AllocGW is %v", ipamConf.AllocGW)
 
-	if ipamConf.AllocGW == true {
+	allocGW := ipamConf.AllocGW
+	if !allocGW && ipamConf.GatewayCheck != "" && ipamConf.IsFixIP == false {
+		if allocGW, err = checkGateways(ipamConf, store, result); err != nil {
+			releaseIP(ctx, ipamConf, store, args.ContainerID, args.IfName)
+			return err
+		}
+	}
+
+	if allocGW == true {
 		gwsLocal := store.GetByID("gateway", "gateway")
 		var gw net.IP
 		// logging.Debugf("choose gw form %v", gwsLocal)
@@ -135,7 +302,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 
 		if gw == nil {
-			r, err := allocateIP(netConf, store, "gateway", "gateway")
+			r, err := allocateIP(ctx, netConf, store, "gateway", "gateway")
 			if err == nil {
 				gw = r[0].Address.IP
 			} else {
@@ -148,43 +315,376 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	}
 	logging.Debugf("IPs: %v", result.IPs)
-	return types.PrintResult(result, confVersion)
+	if soft && len(result.IPs) > 0 && !result.IPs[0].Address.IP.Equal(ipamConf.Preferred) {
+		identity := etcdv3cli.IPAMGenPinInfo(ipamConf.K8sNs, ipamConf.PodName)
+		if err := etcdv3cli.IPAMSetPreferredIP(ipamConf.Name, identity, result.IPs[0].Address.IP); err != nil {
+			logging.Errorf("record preferred ip %v of %v failed, %v", result.IPs[0].Address.IP, identity, err)
+		}
+	}
+	if err := store.SaveResult(args.ContainerID, args.IfName, disk.Result{DNS: result.DNS, Routes: result.Routes}); err != nil {
+		logging.Errorf("record result of container %v failed, %v", args.ContainerID, err)
+	}
+	if ipamConf.StrictVersion {
+		r, err := versionedResult(result, confVersion, ipamConf.RouteTables)
+		if err != nil {
+			releaseIP(ctx, ipamConf, store, args.ContainerID, args.IfName)
+			return logging.Errorf("%v", err)
+		}
+		emitEvents(ipamConf, events.Allocated, args.ContainerID, args.IfName, resultIPs(result))
+		writeMetrics(ipamConf)
+		return writeResult(r)
+	}
+	emitEvents(ipamConf, events.Allocated, args.ContainerID, args.IfName, resultIPs(result))
+	writeMetrics(ipamConf)
+	return printResult(result, confVersion, ipamConf.RouteTables)
 }
 
+// checkVersion checks that confVersion is a cniVersion the result can be
+// printed in
+func checkVersion(confVersion string) error {
+	supported := supportedVersions.SupportedVersions()
+	for _, v := range supported {
+		if v != "" && v == confVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported cniVersion %q, it shall be one of %v", confVersion, supported)
+}
+
+// versionedResult converts result to confVersion, failing instead of dropping
+// the ips the version can not hold, e.g. more than one ipv4 of 0.2.0
+func versionedResult(result *current.Result, confVersion string, tables []int) (types.Result, error) {
+	if err := checkVersion(confVersion); err != nil {
+		return nil, err
+	}
+	r, err := convertResult(result, confVersion, tables)
+	if err != nil {
+		return nil, fmt.Errorf("convert the result to cniVersion %v failed, %v", confVersion, err)
+	}
+	back, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("convert the result of cniVersion %v back failed, %v", confVersion, err)
+	}
+	if r.Version() != confVersion || len(back.IPs) != len(result.IPs) {
+		return nil, fmt.Errorf("result of %d ips can not be expressed in cniVersion %v", len(result.IPs), confVersion)
+	}
+	return r, nil
+}
+
+// returnEmptyRanges returns the cache ranges of the ips released to etcd once
+// no ip of them is used. The single ip ranges of the pinned ips are kept for
+// their pins, the ranges derived for the node range are kept for the node.
+func returnEmptyRanges(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, released []net.IP) {
+	caches, err := store.LoadCache()
+	if err != nil {
+		logging.Errorf("load cache of %v failed, %v", ipamConf.Name, err)
+		return
+	}
+	for _, cr := range caches {
+		if cr.RangeStart.To4() != nil {
+			if ipamConf.NodeRange != nil {
+				continue
+			}
+			cr.RangeStart, cr.RangeEnd = cr.RangeStart.To4(), cr.RangeEnd.To4()
+		}
+		if ip.Cmp(cr.RangeStart, cr.RangeEnd) == 0 {
+			continue
+		}
+		for _, addr := range released {
+			if ip.Cmp(addr, cr.RangeStart) < 0 || ip.Cmp(addr, cr.RangeEnd) > 0 {
+				continue
+			}
+			// with returnAfter the range is returned once it stays drained
+			// for that many allocations, see returnIdleRanges
+			if ipamConf.ReturnAfter > 0 {
+				if marked, err := store.MarkDrained(&cr); err != nil {
+					logging.Errorf("mark %v of %v drained failed, %v", cr, ipamConf.Name, err)
+				} else if marked {
+					logging.Verbosef("last ip of %v released, return it after %d allocations", cr, ipamConf.ReturnAfter)
+				}
+				break
+			}
+			deleted, err := store.DeleteCacheIfUnused(&cr)
+			if err != nil {
+				logging.Errorf("delete cache %v of %v failed, %v", cr, ipamConf.Name, err)
+			} else if deleted {
+				logging.Verbosef("last ip of %v released, return it", cr)
+				if err := etcdv3cli.IPAMReleaseIPRange(ctx, ipamConf.Name, ipamConf.Pool, &cr, ipamConf.MutexShards); err != nil {
+					logging.Errorf("return %v of %v failed, the reconcile cleans it up, %v", cr, ipamConf.Name, err)
+				}
+			}
+			break
+		}
+	}
+}
+
+// returnIdleRanges returns to etcd the drained ranges none of the ips of
+// returnAfter allocations were taken from
+func returnIdleRanges(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, ipConfs []*current.IPConfig) {
+	ips := []net.IP{}
+	for _, ipConf := range ipConfs {
+		ips = append(ips, ipConf.Address.IP)
+	}
+	idle, err := store.IdleDrained(ips, ipamConf.ReturnAfter)
+	if err != nil {
+		logging.Errorf("count the drained ranges of %v failed, %v", ipamConf.Name, err)
+		return
+	}
+	for _, sr := range idle {
+		deleted, err := store.DeleteCacheIfUnused(&sr)
+		if err != nil {
+			logging.Errorf("delete cache %v of %v failed, %v", sr, ipamConf.Name, err)
+		} else if deleted {
+			logging.Verbosef("%v idle for %d allocations, return it", sr, ipamConf.ReturnAfter)
+			if err := etcdv3cli.IPAMReleaseIPRange(ctx, ipamConf.Name, ipamConf.Pool, &sr, ipamConf.MutexShards); err != nil {
+				logging.Errorf("return %v of %v failed, the reconcile cleans it up, %v", sr, ipamConf.Name, err)
+			}
+		}
+	}
+}
+
+// checkGateways checks that the gateways of the ips allocated are reachable
+// on-link, in a range cached by the node or routed by a route of the config.
+// It tells if a gateway is to be allocated for the gatewayCheck allocate.
+func checkGateways(ipamConf *allocator.IPAMConfig, store *disk.Store, result *current.Result) (bool, error) {
+	caches, err := store.LoadCache()
+	if err != nil {
+		return false, logging.Errorf("get cache of %v failed, %v", ipamConf.Name, err)
+	}
+	for _, ipConf := range result.IPs {
+		gw := ipConf.Gateway
+		if gw == nil || gatewayReachable(gw, caches, ipamConf.Routes) {
+			continue
+		}
+		switch ipamConf.GatewayCheck {
+		case allocator.GatewayCheckWarn:
+			logging.Errorf("gateway %v of %v is out of the ranges of the node and not routed on-link", gw, ipConf.Address.IP)
+		case allocator.GatewayCheckError:
+			return false, logging.Errorf("gateway %v of %v is out of the ranges of the node and not routed on-link", gw, ipConf.Address.IP)
+		case allocator.GatewayCheckAllocate:
+			logging.Verbosef("gateway %v of %v is unreachable, allocate one of the node", gw, ipConf.Address.IP)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gatewayReachable tells if gw is in one of the ranges cached, or in the dst
+// of a route without a gateway
+func gatewayReachable(gw net.IP, caches []allocator.SimpleRange, routes []*types.Route) bool {
+	if gw4 := gw.To4(); gw4 != nil {
+		gw = gw4
+	}
+	for _, c := range caches {
+		if gw.To4() != nil {
+			c.RangeStart, c.RangeEnd = c.RangeStart.To4(), c.RangeEnd.To4()
+		}
+		if len(c.RangeStart) == len(gw) && ip.Cmp(c.RangeStart, gw) <= 0 && ip.Cmp(gw, c.RangeEnd) <= 0 {
+			return true
+		}
+	}
+	for _, r := range routes {
+		if r.GW == nil && r.Dst.Contains(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdDel releases the ips of the container, the errors coded for the runtime
 func cmdDel(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
+	return cniError(del(context.Background(), args))
+}
+
+func del(ctx context.Context, args *skel.CmdArgs) error {
 	netConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
-		return err
+		setupLogging(nil)
+		return configError(logging.Errorf("LoadIPAMConfig failed, %v", err))
 	}
+	setupLogging(netConf)
 
 	ipamConf := netConf.IPAM
+	etcdv3.SetRootKeyDir(ipamConf.RootKeyDir)
+	defer etcdv3.SetRootKeyDir("")
+
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout(ipamConf))
+	defer cancel()
 
 	if ipamConf.IsFixIP == false {
+		if ipamConf.DataDirPolicy == allocator.DataDirDegraded || len(ipamConf.IPArgs) > 0 {
+			// the ADD may have been tracked by etcd only, as the requested ips are
+			if _, err := etcdv3cli.IPAMReleaseClaims(ctx, ipamConf.Name, ipamConf.Pool, args.ContainerID, ipamConf.MutexShards); err != nil {
+				return err
+			}
+		}
 		store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
 		if err != nil {
+			if ipamConf.DataDirPolicy == allocator.DataDirDegraded {
+				logging.Errorf("data dir of %v fails, only the ips tracked by etcd are released, %v", ipamConf.Name, err)
+				return nil
+			}
 			return err
 		}
 		defer store.Close()
 
-		// Loop through all ranges, releasing all IPs, even if an error occurs
-		var errors []string
-		for idx, rangeset := range ipamConf.Ranges {
-			ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		var released []net.IP
+		if ipamConf.VerifyRelease || ipamConf.Events != "" {
+			store.Lock()
+			released = store.GetByID(args.ContainerID, args.IfName)
+			store.Unlock()
+		}
 
-			err := ipAllocator.Release(args.ContainerID, args.IfName)
-			if err != nil {
+		errors := releaseIP(ctx, ipamConf, store, args.ContainerID, args.IfName)
+		if err := store.DeleteResult(args.ContainerID, args.IfName); err != nil {
+			logging.Errorf("remove result of container %v failed, %v", args.ContainerID, err)
+		}
+
+		if ipamConf.VerifyRelease {
+			if err := verifyRelease(netConf.Name, store, args.ContainerID, args.IfName, released); err != nil {
 				errors = append(errors, err.Error())
 			}
 		}
 
+		if errors == nil {
+			emitEvents(ipamConf, events.Released, args.ContainerID, args.IfName, released)
+		}
+		writeMetrics(ipamConf)
+
 		if errors != nil {
-			return fmt.Errorf(strings.Join(errors, ";"))
+			return fmt.Errorf("%s", strings.Join(errors, ";"))
 		}
 	}
 	return nil
 }
 
-func formRangeSets(origin []allocator.RangeSet, network string, unit uint32, store *disk.Store) ([]allocator.RangeSet, error) {
+// releaseIP releases the ips of the container from all the range sets, even
+// if an error occurs
+func releaseIP(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, containerID, ifName string) []string {
+	var errors []string
+	reserved := store.ReservedIPs()
+	used := len(reserved)
+	for idx, rangeset := range ipamConf.Ranges {
+		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
+
+		err := ipAllocator.Release(containerID, ifName)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if released := used - len(store.ReservedIPs()); released > 0 {
+		updateStats(store, func(st *disk.Stats) {
+			st.Releases += uint64(released)
+		})
+		if ipamConf.ReturnEmpty {
+			left := map[string]bool{}
+			for _, addr := range store.ReservedIPs() {
+				left[addr.String()] = true
+			}
+			freed := []net.IP{}
+			for _, addr := range reserved {
+				if !left[addr.String()] {
+					freed = append(freed, addr)
+				}
+			}
+			returnEmptyRanges(ctx, ipamConf, store, freed)
+		}
+	}
+	recordReplay(ipamConf, &replay.Record{Op: replay.OpRelease, ID: containerID, IfName: ifName, Err: strings.Join(errors, ";")})
+	return errors
+}
+
+// updateStats updates the cumulative counters of the network, a failure only
+// loses the counts
+func updateStats(store *disk.Store, f func(st *disk.Stats)) {
+	if err := store.UpdateStats(f); err != nil {
+		logging.Errorf("update stats of %v failed, %v", store.Dir(), err)
+	}
+}
+
+// touchRanges counts the allocation of ipConfs for the idle cache ranges, which
+// the reconcile gives back first, a failure only loses the count
+func touchRanges(store *disk.Store, ipConfs []*current.IPConfig) {
+	ips := []net.IP{}
+	for _, ipConf := range ipConfs {
+		ips = append(ips, ipConf.Address.IP)
+	}
+	if err := store.TouchRanges(ips); err != nil {
+		logging.Errorf("count the idle ranges of %v failed, %v", store.Dir(), err)
+	}
+}
+
+// recordReplay appends rec to the replay log of the network, if configured
+func recordReplay(ipamConf *allocator.IPAMConfig, rec *replay.Record) {
+	if ipamConf.ReplayLog == "" {
+		return
+	}
+	rec.Network, rec.Node = ipamConf.Name, etcdv3.NodeId()
+	if err := replay.Open(ipamConf.ReplayLog).Append(rec); err != nil {
+		logging.Errorf("append to replay log %v failed, %v", ipamConf.ReplayLog, err)
+	}
+}
+
+// emitEvents tells the controllers the event of ips of the container through
+// the events target of the network, if configured, a failure only loses them
+func emitEvents(ipamConf *allocator.IPAMConfig, event, containerID, ifName string, ips []net.IP) {
+	if ipamConf.Events == "" {
+		return
+	}
+	evs := []events.Event{}
+	for _, addr := range ips {
+		evs = append(evs, events.Event{Event: event, Network: ipamConf.Name, Node: etcdv3.NodeId(), ContainerID: containerID, IfName: ifName, IP: addr.String()})
+	}
+	if err := events.Open(ipamConf.Events).Emit(evs); err != nil {
+		logging.Errorf("emit %v events to %v failed, %v", event, ipamConf.Events, err)
+	}
+}
+
+// resultIPs are the ips of result
+func resultIPs(result *current.Result) []net.IP {
+	ips := []net.IP{}
+	for _, ipc := range result.IPs {
+		ips = append(ips, ipc.Address.IP)
+	}
+	return ips
+}
+
+// writeMetrics refreshes the metrics textfile of the node, if configured
+func writeMetrics(ipamConf *allocator.IPAMConfig) {
+	if ipamConf.MetricsFile == "" {
+		return
+	}
+	if err := disk.WriteTextfile(ipamConf.MetricsFile, ipamConf.DataDir); err != nil {
+		logging.Errorf("write metrics to %v failed, %v", ipamConf.MetricsFile, err)
+	}
+}
+
+// verifyRelease makes sure nothing references the IPs released for the container
+// anymore, cleaning up the lease files and etcd claims which were left behind
+func verifyRelease(network string, store *disk.Store, id string, ifName string, released []net.IP) error {
+	var err error
+	store.Lock()
+	stale := store.GetByID(id, ifName)
+	for _, ip := range stale {
+		logging.Errorf("lease of %v still references %v after release, going to clean it", ip, id)
+		if e := store.Release(ip); e != nil && !os.IsNotExist(e) {
+			err = logging.Errorf("clean stale lease of %v failed, %v", ip, e)
+		}
+	}
+	store.Unlock()
+
+	released = append(released, stale...)
+	if len(released) > 0 {
+		if e := etcdv3cli.IPAMVerifyRelease(network, released, id); e != nil {
+			logging.Errorf("verify etcd claims of %v failed, %v", id, e)
+		}
+	}
+	return err
+}
+
+func formRangeSets(origin []allocator.RangeSet, network string, unit uint32, store *disk.Store, overlap string) ([]allocator.RangeSet, error) {
 	// load IP range set from local cache, "IPStart-IPEnd"
 	cacheRangeSet, err := store.LoadCache()
 	if err != nil {
@@ -193,100 +693,779 @@ func formRangeSets(origin []allocator.RangeSet, network string, unit uint32, sto
 
 	logging.Debugf("Origin: %v, Cache: %v", origin, cacheRangeSet)
 
+	// the ranges left out of the subnets by shrinking them are still leased,
+	// they are kept for the reconcile to report but never allocated from
+	for _, cr := range cacheRangeSet {
+		if !subnetsContain(origin, &cr) {
+			logging.Errorf("cache range %v-%v of %v is out of the configured subnets, no ip is allocated from it",
+				cr.RangeStart, cr.RangeEnd, network)
+		}
+	}
+
 	// RangeSets to find
 	rss := []allocator.RangeSet{}
 	for _, rso := range origin {
 		rs := allocator.RangeSet{}
 		for _, ro := range rso {
 			for _, cr := range cacheRangeSet {
-				if ro.Contains(cr.RangeStart) || ro.Contains(cr.RangeEnd) {
+				// the cache is parsed in 16 bytes form, which ip.Cmp does not
+				// treat as equal to the canonical 4 bytes form of the range
+				start, end := cr.RangeStart, cr.RangeEnd
+				if start.To4() != nil {
+					start, end = start.To4(), end.To4()
+				}
+				if start == nil || end == nil {
+					logging.Errorf("skip invalid cache range %v of %v", cr, network)
+					continue
+				}
+				// the single ip ranges are leased for the pinned ips only
+				if ip.Cmp(start, end) == 0 {
+					continue
+				}
+				if ro.Contains(start) || ro.Contains(end) {
 					r := ro
-					if ip.Cmp(ro.RangeStart, cr.RangeStart) < 0 {
-						r.RangeStart = cr.RangeStart
+					if ip.Cmp(ro.RangeStart, start) < 0 {
+						r.RangeStart = start
 					}
-					if ip.Cmp(ro.RangeEnd, cr.RangeEnd) > 0 {
-						r.RangeEnd = cr.RangeEnd
+					if ip.Cmp(ro.RangeEnd, end) > 0 {
+						r.RangeEnd = end
 					}
 					rs = append(rs, r)
-				} else {
-					subnet := (*net.IPNet)(&ro.Subnet)
-					if !(subnet.Contains(cr.RangeStart) && subnet.Contains(cr.RangeEnd)) {
-						store.DeleteCache(&cr)
-					}
 				}
 			}
 		}
+		// the clipped ranges may overlap, e.g. on duplicated cache lines
+		if overlap == allocator.RangeOverlapError {
+			if err := rs.CheckOverlaps(); err != nil {
+				return nil, logging.Errorf("cache ranges of %v overlap, %v", network, err)
+			}
+		} else if n := rs.Normalize(); len(n) != len(rs) {
+			logging.Errorf("merged the overlapping cache ranges of %v, %v", network, rs.String())
+			rs = n
+		}
 		rss = append(rss, rs)
 	}
 	logging.Debugf("Rangesets: %v", rss)
 	return rss, nil
 }
 
-func allocateIP(netConf *allocator.Net, store *disk.Store, containerID string, ifName string) ([]*current.IPConfig, error) {
+// subnetsContain tells if sr is within one of the subnets of rss
+func subnetsContain(rss []allocator.RangeSet, sr *allocator.SimpleRange) bool {
+	for _, rs := range rss {
+		for _, r := range rs {
+			subnet := (*net.IPNet)(&r.Subnet)
+			if subnet.Contains(sr.RangeStart) && subnet.Contains(sr.RangeEnd) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configuredSubnets returns the distinct subnets of rss
+func configuredSubnets(rss []allocator.RangeSet) []net.IPNet {
+	subnets := []net.IPNet{}
+	seen := map[string]bool{}
+	for _, rs := range rss {
+		for _, r := range rs {
+			subnet := net.IPNet(r.Subnet)
+			if !seen[subnet.String()] {
+				seen[subnet.String()] = true
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+	return subnets
+}
+
+// allocateIP allocates the ips of the container, counting them in the stats of
+// the network and recording the allocation to the replay log if configured
+func allocateIP(ctx context.Context, netConf *allocator.Net, store *disk.Store, containerID string, ifName string) ([]*current.IPConfig, error) {
+	var cache []allocator.SimpleRange
+	if netConf.IPAM.ReplayLog != "" {
+		cache, _ = store.LoadCache()
+	}
+	IPs, err := allocateFromRanges(ctx, netConf, store, containerID, ifName)
+	if err == nil {
+		touchRanges(store, IPs)
+		used := uint64(len(store.ReservedIPs()))
+		updateStats(store, func(st *disk.Stats) {
+			st.Allocations += uint64(len(IPs))
+			if used > st.PeakUsed {
+				st.PeakUsed = used
+			}
+		})
+	}
+	if netConf.IPAM.ReplayLog == "" {
+		return IPs, err
+	}
+	rec := &replay.Record{Op: replay.OpAlloc, ID: containerID, IfName: ifName, Cache: cache}
+	for _, ipConf := range IPs {
+		rec.IPs = append(rec.IPs, ipConf.Address.IP.String())
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	recordReplay(netConf.IPAM, rec)
+	return IPs, err
+}
+
+// applyOptions returns the options of the applies from etcd of ipamConf, passed
+// to each apply as the ranges may be applied in parallel
+func applyOptions(ipamConf *allocator.IPAMConfig) etcdv3cli.ApplyOptions {
+	opts := etcdv3cli.ApplyOptions{
+		Tries:      ipamConf.MaxApplyTry,
+		Spread:     ipamConf.ApplySpread,
+		Descending: ipamConf.AllocOrder == allocator.AllocationDescending,
+	}
+	if ipamConf.LeaseOwner == allocator.LeaseOwnerPod && ipamConf.PodName != "" {
+		opts.Cause = etcdv3cli.IPAMGenPinInfo(ipamConf.K8sNs, ipamConf.PodName)
+	}
+	return opts
+}
+
+// saveNetConf records in store the pool, the root key dir and the subnets of
+// the network, which the daemon reads back
+func saveNetConf(ipamConf *allocator.IPAMConfig, store *disk.Store) error {
+	if err := store.SavePool(ipamConf.Pool); err != nil {
+		return logging.Errorf("save pool %v failed, %v", ipamConf.Pool, err)
+	}
+	if err := store.SaveRootKeyDir(ipamConf.RootKeyDir); err != nil {
+		return logging.Errorf("save root key dir %v failed, %v", ipamConf.RootKeyDir, err)
+	}
+	if err := store.SaveShards(ipamConf.MutexShards); err != nil {
+		return logging.Errorf("save mutex shards %v failed, %v", ipamConf.MutexShards, err)
+	}
+	if err := store.SaveSubnets(configuredSubnets(ipamConf.Ranges)); err != nil {
+		return logging.Errorf("save subnets of %v failed, %v", ipamConf.Name, err)
+	}
+	return nil
+}
+
+func allocateFromRanges(ctx context.Context, netConf *allocator.Net, store *disk.Store, containerID string, ifName string) ([]*current.IPConfig, error) {
 
 	ipamConf := netConf.IPAM
+	applyUnit := ipamConf.NodeApplyUnit(etcdv3.NodeId())
+
+	if err := saveNetConf(ipamConf, store); err != nil {
+		return nil, err
+	}
 
 	// genereate the ip ranges that can be allocated locally
-	rss, err := formRangeSets(ipamConf.Ranges, ipamConf.Name, ipamConf.ApplyUnit, store)
+	rss, err := formRangeSets(ipamConf.Ranges, ipamConf.Name, applyUnit, store, ipamConf.RangeOverlap)
 	if err != nil {
 		return nil, err
 	}
+	applied := &appliedRanges{}
+	if coldNode(rss) {
+		if rss, err = coldStart(ctx, ipamConf, store, applyUnit, applied); err != nil {
+			returnAppliedRanges(ipamConf, store, applied)
+			return nil, err
+		}
+	}
 	logging.Debugf("allocate ip from %v", rss)
-	allocs := []*allocator.IPAllocator{}
-	IPs := []*current.IPConfig{}
+
+	// one ip of each family for each of the ips requested, from the first
+	// range set of the family, only of the requested family if any
+	type job struct {
+		idx       int
+		subIfName string
+	}
+	jobs := []job{}
+	groups := [][]int{} // the jobs of each range set, run in order
+	group := map[int]int{}
 	for s := 0; s < ipamConf.Num; s++ {
-		subIfName := ifName + "." + strconv.Itoa(s)
-		for idx, rs := range rss {
-			var err error = nil
-			var ipConf *current.IPConfig = nil
-			var alloc *allocator.IPAllocator = nil
-			if len(rs) > 0 {
-				alloc = allocator.NewIPAllocator(&rs, store, idx)
-				logging.Debugf("allocator(%v, %v, %v) return %v", rs, store, idx, alloc)
+		allocated := map[int]bool{}
+		for idx := range rss {
+			family := allocator.RangeSetFamily(ipamConf.Ranges[idx])
+			if allocated[family] || (ipamConf.IPFamily != 0 && ipamConf.IPFamily != family) {
+				continue
+			}
+			allocated[family] = true
+			g, ok := group[idx]
+			if !ok {
+				g = len(groups)
+				group[idx] = g
+				groups = append(groups, nil)
+			}
+			groups[g] = append(groups[g], len(jobs))
+			jobs = append(jobs, job{idx, ifName + "." + strconv.Itoa(s)})
+		}
+	}
+
+	IPs := make([]*current.IPConfig, len(jobs))
+	errs := forEachParallel(ipamConf, store, len(groups), func(g int, store *disk.Store) error {
+		for _, j := range groups[g] {
+			ipConf, err := allocateInRangeSet(ctx, ipamConf, store, rss[jobs[j].idx], jobs[j].idx, containerID, jobs[j].subIfName, applyUnit, applied)
+			if err != nil {
+				return err
+			}
+			IPs[j] = ipConf
+		}
+		return nil
+	})
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		// Deallocate all already allocated IPs
+		for j, ipConf := range IPs {
+			if ipConf != nil {
+				alloc := allocator.NewIPAllocator(&rss[jobs[j].idx], store, jobs[j].idx)
+				_ = alloc.Release(containerID, jobs[j].subIfName)
+			}
+		}
+		returnAppliedRanges(ipamConf, store, applied)
+		return nil, err
+	}
+
+	if ipamConf.ReturnEmpty && ipamConf.ReturnAfter > 0 {
+		returnIdleRanges(ctx, ipamConf, store, IPs)
+	}
+
+	logging.Debugf("Return IPS: %v", IPs)
+	return IPs, nil
+}
+
+// allocateInRangeSet allocates an ip of the range set idx, applying a new range
+// from etcd once rs is used up, which is recorded in applied
+func allocateInRangeSet(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, rs allocator.RangeSet, idx int, containerID, subIfName string, applyUnit uint32, applied *appliedRanges) (*current.IPConfig, error) {
+	var err error = nil
+	var ipConf *current.IPConfig = nil
+	var alloc *allocator.IPAllocator = nil
+	if len(rs) > 0 {
+		alloc = allocator.NewIPAllocator(&rs, store, idx)
+		logging.Debugf("allocator(%v, %v, %v) return %v", rs, store, idx, alloc)
+		// the preferred ip is only reused from the ranges of this node
+		if pref := ipamConf.Preferred; pref != nil && strings.HasSuffix(subIfName, ".0") {
+			if _, rerr := rs.RangeFor(pref); rerr == nil {
+				if ipConf, err = alloc.Get(containerID, subIfName, pref); err != nil {
+					logging.Verbosef("preferred ip %v of %v is taken, allocate another, %v", pref, containerID, err)
+				}
+			}
+		}
+		if ipConf == nil {
+			ipConf, err = alloc.Get(containerID, subIfName, nil)
+		}
+		// a release may have returned the range since rs was loaded, the ip
+		// reserved then is given back and a new range applied instead
+		if ipConf != nil && ipamConf.ReturnEmpty && !store.InCache(ipConf.Address.IP) {
+			logging.Verbosef("range of %v was returned meanwhile, apply another", ipConf.Address.IP)
+			_ = alloc.Release(containerID, subIfName)
+			ipConf, err = nil, fmt.Errorf("%w, the range of %v was returned", allocator.ErrNoFreeAddresses, ipConf.Address.IP)
+		}
+	} else {
+		logging.Verbosef("no range of range set %d is cached", idx)
+		err = allocator.ErrNoFreeAddresses
+	}
+	//try most 3 times
+	for i := 0; i < 3; i++ {
+		if errors.Is(err, allocator.ErrNoFreeAddresses) {
+			var ro *allocator.Range
+			var sr *allocator.SimpleRange
+			ro, sr, err = applyRangeSetIPRange(ctx, ipamConf, store, idx, applyUnit)
+			// logging.Debugf("apply new ip range(%v, %v, %v) return %v, %v, %v", ipamConf.Name, &ipamConf.Ranges[idx][0].Subnet, ipamConf.ApplyUnit, sIP, eIP, err)
+			if err == nil {
+				// store.AppendRangeToCache(fmt.Sprintf("%s-%s", sIP.String(), eIP.String()))
+				if err = cacheRange(ctx, ipamConf, store, sr); err != nil {
+					break
+				}
+				applied.add(sr)
+				r := *ro
+				r.RangeStart, r.RangeEnd = sr.RangeStart, sr.RangeEnd
+				alloc = allocator.NewIPAllocator(&(allocator.RangeSet{r}), store, idx)
+				logging.Debugf("NewIPAllocator(%v, %v, %v) return %v", allocator.RangeSet{r}, store, idx, alloc)
 				ipConf, err = alloc.Get(containerID, subIfName, nil)
-			} else {
-				err = logging.Errorf("no IP addresses available in range set")
-			}
-			//try most 3 times
-			for i := 0; i < 3; i++ {
-				if err != nil && strings.Contains(err.Error(), "no IP addresses available in range set") {
-					var sr *allocator.SimpleRange
-					sr, err = etcdv3cli.IPAMApplyIPRange(netConf.Name, &ipamConf.Ranges[idx][0], ipamConf.ApplyUnit)
-					// logging.Debugf("apply new ip range(%v, %v, %v) return %v, %v, %v", ipamConf.Name, &ipamConf.Ranges[idx][0].Subnet, ipamConf.ApplyUnit, sIP, eIP, err)
-					if err == nil {
-						// store.AppendRangeToCache(fmt.Sprintf("%s-%s", sIP.String(), eIP.String()))
-						store.AppendCache(sr)
-						r := ipamConf.Ranges[idx][0]
-						r.RangeStart, r.RangeEnd = sr.RangeStart, sr.RangeEnd
-						alloc = allocator.NewIPAllocator(&(allocator.RangeSet{r}), store, idx)
-						logging.Debugf("NewIPAllocator(%v, %v, %v) return %v", allocator.RangeSet{r}, store, idx, alloc)
-						ipConf, err = alloc.Get(containerID, subIfName, nil)
-						if err != nil {
-							logging.Errorf("alloc ip from range %v failed, %v", r, err)
-							continue
-						}
-					}
+				if err != nil {
+					logging.Errorf("alloc ip from range %v failed, %v", r, err)
+					continue
 				}
+			}
+		}
+		break
+	}
+	if err == etcdv3cli.ErrRangeExhausted {
+		return nil, newExhaustedError(ipamConf, store, idx)
+	}
+	if err != nil {
+		logging.Errorf("failed to allocate for range %d: %v", idx, err)
+		return nil, fmt.Errorf("failed to allocate for range %d: %w", idx, err)
+	}
+	return ipConf, nil
+}
+
+// applyRangeSetIPRange applies a new ip range from the ranges of the range set
+// idx in order, going on to the next range once one is exhausted, and returns
+// the range it applied from along with the range applied. The lease keys hold
+// the ips themselves, so the ranges of the different subnets never collide.
+func applyRangeSetIPRange(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, idx int, unit uint32) (*allocator.Range, *allocator.SimpleRange, error) {
+	var err error
+	for i := range ipamConf.Ranges[idx] {
+		r := &ipamConf.Ranges[idx][i]
+		var sr *allocator.SimpleRange
+		if sr, err = applyIPRange(ctx, ipamConf, store, r, unit); err == nil {
+			return r, sr, nil
+		}
+		if err != etcdv3cli.ErrRangeExhausted {
+			return nil, nil, err
+		}
+		logging.Verbosef("range %v of range set %d of %v is exhausted, try the next", r, idx, ipamConf.Name)
+	}
+	return nil, nil, err
+}
+
+// forEachParallel runs f for 0..n-1, at most parallelism of them at once, and
+// returns their errors. The concurrent runs get stores of their own, as the
+// lock of a store does not keep the other goroutines of the process out. No
+// more runs start once one fails.
+func forEachParallel(ipamConf *allocator.IPAMConfig, store *disk.Store, n int, f func(i int, store *disk.Store) error) []error {
+	errs := make([]error, n)
+	// the replay log records the applies in order
+	if ipamConf.Parallelism < 2 || ipamConf.ReplayLog != "" || n < 2 {
+		for i := 0; i < n; i++ {
+			if errs[i] = f(i, store); errs[i] != nil {
 				break
 			}
+		}
+		return errs
+	}
+	var wg sync.WaitGroup
+	var failed int32
+	sem := make(chan struct{}, ipamConf.Parallelism)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s, err := disk.New(ipamConf.Name, filepath.Dir(store.Dir()))
+			if err == nil {
+				err = f(i, s)
+				s.Close()
+			}
 			if err != nil {
-				// Deallocate all already allocated IPs
-				for _, alloc := range allocs {
-					_ = alloc.Release(containerID, ifName)
-				}
-				return nil, logging.Errorf("failed to allocate for range %d: %v", idx, err)
+				errs[i] = err
+				atomic.StoreInt32(&failed, 1)
 			}
-			allocs = append(allocs, alloc)
-			IPs = append(IPs, ipConf)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// coldNode checks if no range of any range set is cached yet
+func coldNode(rss []allocator.RangeSet) bool {
+	for _, rs := range rss {
+		if len(rs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// coldStart applies the initial range of each range set of the requested
+// family, trying the ranges of the set in order until one has free space. The
+// ranges applied are recorded in applied.
+func coldStart(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, unit uint32, applied *appliedRanges) ([]allocator.RangeSet, error) {
+	rss := make([]allocator.RangeSet, len(ipamConf.Ranges))
+	errs := forEachParallel(ipamConf, store, len(ipamConf.Ranges), func(idx int, store *disk.Store) error {
+		rso := ipamConf.Ranges[idx]
+		if ipamConf.IPFamily != 0 && ipamConf.IPFamily != allocator.RangeSetFamily(rso) {
+			return nil
+		}
+		ro, sr, err := applyRangeSetIPRange(ctx, ipamConf, store, idx, unit)
+		if err == etcdv3cli.ErrRangeExhausted {
+			return newExhaustedError(ipamConf, store, idx)
+		}
+		if err != nil {
+			logging.Errorf("apply the initial range of range set %d failed, %v", idx, err)
+			return fmt.Errorf("apply the initial range of range set %d failed, %w", idx, err)
+		}
+		if err := cacheRange(ctx, ipamConf, store, sr); err != nil {
+			return err
+		}
+		applied.add(sr)
+		r := *ro
+		r.RangeStart, r.RangeEnd = sr.RangeStart, sr.RangeEnd
+		rss[idx] = allocator.RangeSet{r}
+		logging.Verbosef("apply the initial range %v of range set %d", *sr, idx)
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rss, nil
+}
+
+// appliedRanges are the ranges an allocation applied and cached, which the
+// range sets allocated in parallel add to
+type appliedRanges struct {
+	mu  sync.Mutex
+	srs []allocator.SimpleRange
+}
+
+func (a *appliedRanges) add(sr *allocator.SimpleRange) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.srs = append(a.srs, *sr)
+	a.mu.Unlock()
+}
+
+// returnAppliedRanges returns to etcd the ranges applied by a failed allocation
+// unless an ip of them is taken meanwhile, so that the failed add does not keep
+// them. The ranges cached before the allocation are never returned here, nor
+// the ranges derived for the node range, which are kept for the node.
+func returnAppliedRanges(ipamConf *allocator.IPAMConfig, store *disk.Store, applied *appliedRanges) {
+	applied.mu.Lock()
+	srs := applied.srs
+	applied.mu.Unlock()
+	for _, sr := range srs {
+		if ipamConf.NodeRange != nil && sr.RangeStart.To4() != nil {
+			continue
+		}
+		deleted, err := store.DeleteCacheIfUnused(&sr)
+		if err != nil {
+			logging.Errorf("delete cache %v of %v failed, %v", sr, ipamConf.Name, err)
+		} else if deleted {
+			logging.Verbosef("allocation failed, return %v applied for it", sr)
+			// the allocation may have failed for its context being done
+			if err := etcdv3cli.IPAMReleaseIPRange(context.Background(), ipamConf.Name, ipamConf.Pool, &sr, ipamConf.MutexShards); err != nil {
+				logging.Errorf("return %v of %v failed, the reconcile cleans it up, %v", sr, ipamConf.Name, err)
+			}
+		}
+	}
+}
+
+// allocatePinnedIP allocates the ip pinned to the pod, leasing it to this node
+// first unless a range of the cache covers it already
+func allocatePinnedIP(ctx context.Context, netConf *allocator.Net, store *disk.Store, containerID string, ifName string, pinned net.IP) ([]*current.IPConfig, error) {
+	ipamConf := netConf.IPAM
+
+	idx := -1
+	for i, rs := range ipamConf.Ranges {
+		if _, err := rs.RangeFor(pinned); err == nil {
+			idx = i
 			break
 		}
 	}
+	if idx < 0 {
+		return nil, logging.Errorf("pinned ip %v is out of the ranges of %v", pinned, ipamConf.Name)
+	}
 
-	logging.Debugf("Return IPS: %v", IPs)
-	return IPs, nil
+	caches, err := store.LoadCache()
+	if err != nil {
+		return nil, err
+	}
+	covered := false
+	for _, cr := range caches {
+		if cr.RangeStart.To4() != nil {
+			cr.RangeStart, cr.RangeEnd = cr.RangeStart.To4(), cr.RangeEnd.To4()
+		}
+		if ip.Cmp(cr.RangeStart, pinned) <= 0 && ip.Cmp(cr.RangeEnd, pinned) >= 0 {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		sr, err := etcdv3cli.IPAMApplyPinnedIP(ctx, ipamConf.Name, ipamConf.Pool, pinned, ipamConf.MutexShards, applyOptions(ipamConf))
+		if err != nil {
+			return nil, err
+		}
+		if err := cacheRange(ctx, ipamConf, store, sr); err != nil {
+			return nil, err
+		}
+	}
+
+	alloc := allocator.NewIPAllocator(&ipamConf.Ranges[idx], store, idx)
+	ipConf, err := alloc.Get(containerID, ifName+".0", pinned)
+	if err != nil {
+		return nil, err
+	}
+	if ipamConf.Num > 1 {
+		logging.Verbosef("only the pinned ip %v is allocated to %v of %d", pinned, containerID, ipamConf.Num)
+	}
+	return []*current.IPConfig{ipConf}, nil
+}
+
+// probeDataDir makes sure dir is writable, as the data dir may turn full or
+// read-only under a running node
+func probeDataDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write([]byte{0}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// appendCache is the cache of a range in the data dir, tests replace it to
+// inject failures
+var appendCache = (*disk.Store).AppendCache
+
+// cacheRange caches the range applied from etcd. A range failed to be cached
+// is leased to the node with no local record, so its lease is rolled back,
+// unless a stale cache range overlapping it tracks it already.
+func cacheRange(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, sr *allocator.SimpleRange) error {
+	err := appendCache(store, sr)
+	if err == nil {
+		return nil
+	}
+	if caches, e := store.LoadCache(); e == nil {
+		for _, cr := range caches {
+			if cr.Overlaps(sr) {
+				logging.Errorf("cache %v of %v failed, %v", *sr, ipamConf.Name, err)
+				return nil
+			}
+		}
+	}
+	if e := etcdv3cli.IPAMReleaseIPRange(ctx, ipamConf.Name, ipamConf.Pool, sr, ipamConf.MutexShards); e != nil {
+		logging.Errorf("roll back the lease of %v of %v failed, %v", *sr, ipamConf.Name, e)
+	}
+	return logging.Errorf("data dir %v fails to cache %v, %v", store.Dir(), *sr, err)
+}
+
+// allocateEtcdOnly allocates an ipv4 tracked by etcd only, for the degraded
+// dataDirPolicy while the data dir fails
+func allocateEtcdOnly(ctx context.Context, ipamConf *allocator.IPAMConfig, containerID string) ([]*current.IPConfig, error) {
+	for idx, rs := range ipamConf.Ranges {
+		if allocator.RangeSetFamily(rs) != 4 || (ipamConf.IPFamily != 0 && ipamConf.IPFamily != 4) {
+			continue
+		}
+		r := &ipamConf.Ranges[idx][0]
+		addr, err := etcdv3cli.IPAMClaimIP(ctx, ipamConf.Name, ipamConf.Pool, r, containerID, ipamConf.MutexShards, ipamConf.Priority, applyOptions(ipamConf))
+		if err != nil {
+			logging.Errorf("claim ip of range set %d failed, %v", idx, err)
+			return nil, fmt.Errorf("claim ip of range set %d failed, %w", idx, err)
+		}
+		return []*current.IPConfig{{
+			Version: "4",
+			Address: net.IPNet{IP: addr, Mask: r.Subnet.Mask},
+			Gateway: r.Gateway,
+		}}, nil
+	}
+	return nil, logging.Errorf("no ipv4 range set to claim an ip from")
+}
+
+// allocateRequestedIPs reserves the ips requested by the args for the
+// container in etcd, which tracks them alone as the ips claimed by
+// allocateEtcdOnly. The ips reserved are released if one of them fails.
+func allocateRequestedIPs(ctx context.Context, ipamConf *allocator.IPAMConfig, containerID string) ([]*current.IPConfig, error) {
+	ipConfs := []*current.IPConfig{}
+	for _, addr := range ipamConf.IPArgs {
+		var r *allocator.Range
+		for _, rs := range ipamConf.Ranges {
+			if r, _ = rs.RangeFor(addr); r != nil {
+				break
+			}
+		}
+		err := fmt.Errorf("requested ip %v is out of the ranges of %v", addr, ipamConf.Name)
+		if r != nil && addr.Equal(r.Gateway) {
+			err = fmt.Errorf("requested ip %v is the gateway of %v", addr, ipamConf.Name)
+		} else if r != nil {
+			err = etcdv3cli.IPAMReserveIP(ctx, ipamConf.Name, ipamConf.Pool, addr, containerID, ipamConf.MutexShards, applyOptions(ipamConf))
+		}
+		if err != nil {
+			if _, e := etcdv3cli.IPAMReleaseClaims(ctx, ipamConf.Name, ipamConf.Pool, containerID, ipamConf.MutexShards); e != nil {
+				logging.Errorf("release the ips reserved for %v failed, %v", containerID, e)
+			}
+			return nil, err
+		}
+		version := "4"
+		if addr.To4() == nil {
+			version = "6"
+		}
+		ipConfs = append(ipConfs, &current.IPConfig{
+			Version: version,
+			Address: net.IPNet{IP: addr, Mask: r.Subnet.Mask},
+			Gateway: r.Gateway,
+		})
+	}
+	return ipConfs, nil
+}
+
+// now is replaced by tests to travel in time
+var now = time.Now
+
+// exhaustedError fails an ADD on a range set with no free range left in etcd,
+// which keeps failing until the ips are released, unlike a failure of etcd.
+// retryIn hints the cooldown of the exhaustedWait, if any.
+type exhaustedError struct {
+	rangeSet int
+	retryIn  time.Duration
+}
+
+func (e *exhaustedError) Error() string {
+	msg := fmt.Sprintf("failed to allocate for range %d: %v, the subnet is exhausted", e.rangeSet, etcdv3cli.ErrRangeExhausted)
+	if e.retryIn > 0 {
+		msg += fmt.Sprintf(", retry in %v", e.retryIn)
+	}
+	return msg
+}
+
+func newExhaustedError(ipamConf *allocator.IPAMConfig, store *disk.Store, idx int) error {
+	e := &exhaustedError{rangeSet: idx}
+	for i := range ipamConf.Ranges[idx] {
+		if d := exhaustedRetryIn(ipamConf, store, &ipamConf.Ranges[idx][i]); d > e.retryIn {
+			e.retryIn = d
+		}
+	}
+	logging.Errorf("%v", e)
+	return e
 }
 
-func allocateFixIP(netConf *allocator.Net) ([]*current.IPConfig, error) {
+// exhaustedRetryIn returns the cooldown left of r found exhausted, in which
+// it is not applied from again
+func exhaustedRetryIn(ipamConf *allocator.IPAMConfig, store *disk.Store, r *allocator.Range) time.Duration {
+	if ipamConf.ExhaustedWait <= 0 {
+		return 0
+	}
+	at := store.ExhaustedAt(r.String())
+	if at.IsZero() {
+		return 0
+	}
+	left := at.Add(time.Duration(ipamConf.ExhaustedWait) * time.Second).Sub(now())
+	if left < 0 {
+		return 0
+	}
+	return left.Round(time.Second)
+}
+
+// applyPoolIPRange is the apply of ip range from etcd, tests replace it to inject failures
+var applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+
+// utilizationWarning is the share of the ips of a range leased over which an
+// apply crossing it is logged, for the operators to add subnets in time
+const utilizationWarning = 0.9
+
+// warnUtilization logs the apply of res if it leased the range r past the
+// utilizationWarning
+func warnUtilization(network string, r *allocator.Range, res *etcdv3cli.ApplyResult) {
+	if res.Total == 0 || res.SimpleRange == nil {
+		return
+	}
+	applied := new(big.Int).Sub(allocator.IPToBigInt(res.RangeEnd), allocator.IPToBigInt(res.RangeStart))
+	applied.Add(applied, big.NewInt(1))
+	before := &etcdv3cli.ApplyResult{Free: res.Free + applied.Uint64(), Total: res.Total}
+	if res.Utilization() >= utilizationWarning && before.Utilization() < utilizationWarning {
+		logging.Errorf("range %v of %v is %.0f%% leased with %d ips free, add a subnet before it is exhausted",
+			r, network, res.Utilization()*100, res.Free)
+	}
+}
+
+// applyIPRange applies a new ip range in r from etcd, through the circuit
+// breaker if configured
+func applyIPRange(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, r *allocator.Range, unit uint32) (*allocator.SimpleRange, error) {
+	if ipamConf.NodeRange != nil && r.RangeStart.To4() != nil {
+		return nodeIPRange(ctx, ipamConf, store, r)
+	}
+	if exhaustedRetryIn(ipamConf, store, r) > 0 {
+		logging.Verbosef("range %v of %v was found exhausted, no apply until the cooldown passes", r, ipamConf.Name)
+		return nil, etcdv3cli.ErrRangeExhausted
+	}
+	var breaker *etcdv3.Breaker
+	if b := ipamConf.Breaker; b != nil {
+		breaker = etcdv3.NewBreaker(filepath.Dir(store.Dir()), b.Failures, time.Duration(b.Cooldown)*time.Second)
+		if err := breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+	var leases []allocator.SimpleRange
+	if ipamConf.ReplayLog != "" {
+		etcdv3cli.OnScan = func(keyDir string, l []allocator.SimpleRange) {
+			leases = append(leases, l...)
+		}
+		defer func() { etcdv3cli.OnScan = nil }()
+	}
+	res, err := applyPoolIPRange(ctx, ipamConf.Name, ipamConf.Pool, r, unit, ipamConf.MutexShards, ipamConf.Priority, applyOptions(ipamConf))
+	var sr *allocator.SimpleRange
+	if err == nil {
+		sr = res.SimpleRange
+		warnUtilization(ipamConf.Name, r, res)
+	}
+	if ipamConf.ReplayLog != "" {
+		rec := &replay.Record{Op: replay.OpApply, Range: &allocator.SimpleRange{RangeStart: r.RangeStart, RangeEnd: r.RangeEnd}, Unit: unit, Leases: leases, Result: sr}
+		if err != nil {
+			rec.Err = err.Error()
+		}
+		recordReplay(ipamConf, rec)
+	}
+	if err == nil {
+		updateStats(store, func(st *disk.Stats) {
+			st.Applies++
+		})
+	}
+	if ipamConf.ExhaustedWait > 0 && (err == nil || err == etcdv3cli.ErrRangeExhausted) {
+		at := time.Time{}
+		if err != nil {
+			at = now()
+		}
+		if e := store.SetExhausted(r.String(), at); e != nil {
+			logging.Errorf("record the exhaustion of %v failed, %v", r, e)
+		}
+	}
+	if breaker != nil {
+		if err == nil || err == etcdv3cli.ErrRangeExhausted {
+			breaker.Success()
+		} else if err != etcdv3.ErrDeadline && !errors.Is(err, context.Canceled) {
+			breaker.Failure()
+		}
+	}
+	return sr, err
+}
+
+// nodeIPRange returns the next range of the node range in r not cached yet,
+// which the node derives without etcd, recording it as a lease to be listed. A
+// range leased by another owner is refused rather than allocated twice.
+func nodeIPRange(ctx context.Context, ipamConf *allocator.IPAMConfig, store *disk.Store, r *allocator.Range) (*allocator.SimpleRange, error) {
+	srs, err := ipamConf.NodeRange.NodeRanges(etcdv3.NodeId(), r)
+	if err != nil {
+		return nil, logging.Errorf("derive the node range of %v failed, %v", ipamConf.Name, err)
+	}
+	caches, err := store.LoadCache()
+	if err != nil {
+		return nil, logging.Errorf("get cache of %v failed, %v", ipamConf.Name, err)
+	}
+	for i := range srs {
+		sr := &srs[i]
+		cached := false
+		for _, c := range caches {
+			c.RangeStart, c.RangeEnd = c.RangeStart.To4(), c.RangeEnd.To4()
+			if c.Overlaps(sr) || sr.Overlaps(&c) {
+				cached = true
+				break
+			}
+		}
+		if cached {
+			continue
+		}
+		if err := recordNodeRange(ctx, ipamConf.Name, ipamConf.Pool, sr, applyOptions(ipamConf)); err != nil {
+			if errors.Is(err, etcdv3cli.ErrNodeRangeConflict) {
+				return nil, err
+			}
+			logging.Errorf("record node range %v of %v failed, %v", *sr, ipamConf.Name, err)
+		}
+		return sr, nil
+	}
+	return nil, etcdv3cli.ErrRangeExhausted
+}
+
+// recordNodeRange is the record of a node range in etcd, tests replace it
+var recordNodeRange = etcdv3cli.IPAMRecordNodeRange
+
+func allocateFixIP(ctx context.Context, netConf *allocator.Net) ([]*current.IPConfig, error) {
 	ipamConf := netConf.IPAM
 	if (ipamConf.PodName == "") || (ipamConf.K8sNs == "") {
 		return nil, logging.Errorf("missing fix infor PodName(%v), K8sNs(%v)", ipamConf.PodName, ipamConf.K8sNs)
@@ -295,7 +1474,7 @@ func allocateFixIP(netConf *allocator.Net) ([]*current.IPConfig, error) {
 	IPs := []*current.IPConfig{}
 	for i := 0; i < ipamConf.Num; i++ {
 		fixInfo := etcdv3cli.IPAMGenFixInfo(ipamConf.K8sNs, ipamConf.PodName, i)
-		n, err := etcdv3cli.IPAMApplyFixIP(netConf.Name, ipamConf.FixRange, fixInfo)
+		n, err := etcdv3cli.IPAMApplyFixIP(ctx, netConf.Name, ipamConf.FixRange, fixInfo)
 		if err != nil {
 			return nil, err
 		}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
 	// "github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"github.com/coreos/etcd/clientv3"
@@ -11,10 +17,19 @@ import (
 	"github.com/intel/multus-cni/logging"
 	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
 	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"github.com/intel/multus-cni/multus-ipam/backend/events"
+	"github.com/intel/multus-cni/multus-ipam/backend/replay"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 var _ = Describe("Main", func() {
@@ -202,4 +217,2444 @@ var _ = Describe("Main", func() {
 		})
 	})
 
+	Describe("form range sets", func() {
+		var dataDir = "/tmp"
+		var network = "testform"
+		BeforeEach(func() {
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+		AfterEach(func() {
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+		It("skip the malformed cache lines", func() {
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			cache := "192.168.56.32-192.168.56.47\nbad-192.168.56.63\n192.168.56.64\n192.168.56.80-\n\n"
+			ioutil.WriteFile(filepath.Join(store.Dir(), "rangeset_cache"), []byte(cache), 0644)
+
+			subnet, _ := types.ParseCIDR("192.168.56.0/24")
+			origin := []allocator.RangeSet{{{Subnet: types.IPNet(*subnet)}}}
+			Expect(origin[0].Canonicalize()).To(Succeed())
+			var rss []allocator.RangeSet
+			Expect(func() {
+				rss, err = formRangeSets(origin, network, 4, store, "")
+			}).NotTo(Panic())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(rss)).To(Equal(1))
+			Expect(len(rss[0])).To(Equal(1))
+			Expect(rss[0][0].RangeStart.String()).To(Equal("192.168.56.32"))
+			Expect(rss[0][0].RangeEnd.String()).To(Equal("192.168.56.47"))
+		})
+
+		It("merge the overlapping cache ranges without allocating an ip twice", func() {
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			cache := "192.168.56.32-192.168.56.47\n192.168.56.40-192.168.56.55\n192.168.56.32-192.168.56.47\n"
+			ioutil.WriteFile(filepath.Join(store.Dir(), "rangeset_cache"), []byte(cache), 0644)
+
+			subnet, _ := types.ParseCIDR("192.168.56.0/24")
+			origin := []allocator.RangeSet{{{Subnet: types.IPNet(*subnet)}}}
+			Expect(origin[0].Canonicalize()).To(Succeed())
+
+			_, err = formRangeSets(origin, network, 4, store, allocator.RangeOverlapError)
+			Expect(err).To(HaveOccurred())
+
+			rss, err := formRangeSets(origin, network, 4, store, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rss[0].String()).To(Equal("192.168.56.32-192.168.56.55"))
+
+			alloc := allocator.NewIPAllocator(&rss[0], store, 0)
+			seen := map[string]bool{}
+			for i := 0; ; i++ {
+				ipConf, err := alloc.Get(fmt.Sprintf("%d", i), "eth0", nil)
+				if err != nil {
+					break
+				}
+				Expect(seen[ipConf.Address.IP.String()]).To(BeFalse())
+				seen[ipConf.Address.IP.String()] = true
+			}
+			Expect(len(seen)).To(Equal(24))
+		})
+	})
+
+	Describe("circuit breaker", func() {
+		var dataDir = "/tmp/testbreakerdata"
+		var calls int
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			calls = 0
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				calls++
+				return nil, fmt.Errorf("etcd is down")
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("short-circuit the adds once etcd failed too many times", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(cniCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			netConf.IPAM.Breaker = &allocator.BreakerConf{Failures: 2, Cooldown: 60}
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+				Expect(err).To(MatchError(ContainSubstring("etcd is down")))
+			}
+			Expect(calls).To(Equal(2))
+			_, err = allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).To(MatchError(ContainSubstring("circuit breaker is open")))
+			Expect(calls).To(Equal(2))
+		})
+
+		It("not count the exhausted ranges as failures", func() {
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				calls++
+				return nil, etcdv3cli.ErrRangeExhausted
+			}
+			netConf, _, err := allocator.LoadIPAMConfig(cniCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			netConf.IPAM.Breaker = &allocator.BreakerConf{Failures: 1}
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			for i := 0; i < 3; i++ {
+				_, err = allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+				Expect(err).To(MatchError(ContainSubstring(etcdv3cli.ErrRangeExhausted.Error())))
+			}
+			Expect(calls).To(Equal(3))
+		})
+	})
+
+	Describe("cold start", func() {
+		var dataDir = "/tmp/testcolddata"
+		var coldCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testcold",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"ranges": [
+					[
+						{"subnet": "10.10.0.0/24"},
+						{"subnet": "10.10.1.0/24"}
+					]
+				]
+			}
+		}`)
+		var applied []string
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applied = nil
+			// the first range of the set is used up by the other nodes
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				applied = append(applied, r.Subnet.IP.String())
+				if r.Subnet.IP.String() == "10.10.0.0" {
+					return nil, etcdv3cli.ErrRangeExhausted
+				}
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: r.RangeStart, RangeEnd: net.IPv4(10, 10, 1, 16).To4()}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("apply the initial range before allocating the first ip", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(coldCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			ips, err := allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(ips)).To(Equal(1))
+			Expect(ips[0].Address.IP.String()).To(Equal("10.10.1.2"))
+			Expect(applied).To(Equal([]string{"10.10.0.0", "10.10.1.0"}))
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].RangeStart.String()).To(Equal("10.10.1.1"))
+
+			// the node is warm, the cached range serves the next ip
+			ips, err = allocateIP(context.TODO(), netConf, store, "987654321", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips[0].Address.IP.String()).To(Equal("10.10.1.3"))
+			Expect(len(applied)).To(Equal(2))
+		})
+	})
+
+	Describe("warmup", func() {
+		var dataDir = "/tmp/testwarmupdata"
+		var warmupCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testwarmup",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testwarmupdata",
+				"minReserveUnits": %d,
+				"ranges": [[{"subnet": "10.47.0.0/24"}]]
+			}
+		}`
+		var applies int
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applies = 0
+			// the subnet holds 3 free units of 16 ips
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				if applies == 3 {
+					return nil, etcdv3cli.ErrRangeExhausted
+				}
+				applies++
+				start := byte(applies * 16)
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: net.IPv4(10, 47, 0, start).To4(), RangeEnd: net.IPv4(10, 47, 0, start+15).To4()}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("claim exactly minReserveUnits when the subnet has room", func() {
+			netConf, _, err := allocator.LoadIPAMConfig([]byte(fmt.Sprintf(warmupCfg, 2)), "")
+			Expect(err).NotTo(HaveOccurred())
+			applied, err := warmup(context.TODO(), netConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applied).To(Equal([]int{2}))
+			Expect(applies).To(Equal(2))
+
+			// the units cached already count, a second warmup claims none
+			applied, err = warmup(context.TODO(), netConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applied).To(Equal([]int{0}))
+			Expect(applies).To(Equal(2))
+
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(2))
+		})
+
+		It("stop early without failing once the subnet is exhausted", func() {
+			netConf, _, err := allocator.LoadIPAMConfig([]byte(fmt.Sprintf(warmupCfg, 5)), "")
+			Expect(err).NotTo(HaveOccurred())
+			applied, err := warmup(context.TODO(), netConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applied).To(Equal([]int{3}))
+			Expect(applies).To(Equal(3))
+		})
+	})
+
+	Describe("range set subnets", func() {
+		var dataDir = "/tmp/testsubnetsdata"
+		var subnetsCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testsubnets",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"applyUnit": 2,
+				"ranges": [
+					[
+						{"subnet": "10.12.0.0/24", "rangeStart": "10.12.0.4", "rangeEnd": "10.12.0.7"},
+						{"subnet": "10.12.1.0/24"}
+					]
+				]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("apply from the next subnet of the range set once the first is exhausted", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(subnetsCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			first := netConf.IPAM.Ranges[0][0]
+			second := netConf.IPAM.Ranges[0][1]
+			for i := 0; i < 4; i++ {
+				ips, err := allocateIP(context.TODO(), netConf, store, fmt.Sprintf("container-%d", i), "eth0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(first.Contains(ips[0].Address.IP)).To(BeTrue())
+			}
+			ips, err := allocateIP(context.TODO(), netConf, store, "container-4", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(second.Contains(ips[0].Address.IP)).To(BeTrue())
+			Expect(ips[0].Address.Mask).To(Equal(second.Subnet.Mask))
+
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(2))
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			leases, err := etcdv3cli.IPAMGetAllLease(em.Cli, filepath.Join(em.RootKeyDir, "lease"), em.Id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(leases["testsubnets"])).To(Equal(2))
+		})
+
+		It("roll into the next subnet once the first is full and back once it is released", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(subnetsCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			// a single apply unit in each subnet
+			second := &netConf.IPAM.Ranges[0][1]
+			second.RangeStart, second.RangeEnd = net.ParseIP("10.12.1.4").To4(), net.ParseIP("10.12.1.7").To4()
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			r, first, err := applyRangeSetIPRange(context.TODO(), netConf.IPAM, store, 0, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r).To(Equal(&netConf.IPAM.Ranges[0][0]))
+			Expect(first.RangeStart.String()).To(Equal("10.12.0.4"))
+			r, next, err := applyRangeSetIPRange(context.TODO(), netConf.IPAM, store, 0, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r).To(Equal(second))
+			Expect(next.RangeStart.String()).To(Equal("10.12.1.4"))
+			_, _, err = applyRangeSetIPRange(context.TODO(), netConf.IPAM, store, 0, 2)
+			Expect(err).To(Equal(etcdv3cli.ErrRangeExhausted))
+
+			// the leases of both subnets are listed and reclaimed alike
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			leases, err := etcdv3cli.IPAMGetAllLease(em.Cli, filepath.Join(em.RootKeyDir, "lease"), em.Id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(leases["testsubnets"])).To(Equal(2))
+			// each lease records the subnet it was applied from
+			subnets := map[string]string{}
+			err = etcdv3cli.IPAMWalkLease(em.Cli, filepath.Join(em.RootKeyDir, "lease"), em.Id, func(page map[string][]etcdv3cli.LeaseInfo) error {
+				for _, info := range page["testsubnets"] {
+					subnets[info.RangeStart.String()] = info.Subnet
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subnets).To(Equal(map[string]string{"10.12.0.4": "10.12.0.0/24", "10.12.1.4": "10.12.1.0/24"}))
+			Expect(etcdv3cli.IPAMReleaseIPRange(context.TODO(), netConf.Name, "", first, 1)).To(Succeed())
+			r, again, err := applyRangeSetIPRange(context.TODO(), netConf.IPAM, store, 0, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r).To(Equal(&netConf.IPAM.Ranges[0][0]))
+			Expect(again.RangeStart.String()).To(Equal("10.12.0.4"))
+		})
+	})
+
+	Describe("apply on exhaustion", func() {
+		var dataDir = "/tmp/testnofreedata"
+		var nofreeCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testnofree",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"ranges": [[{"subnet": "10.14.0.0/24"}]]
+			}
+		}`)
+		var applies int
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applies = 0
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				applies++
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: net.IPv4(10, 14, 0, 16).To4(), RangeEnd: net.IPv4(10, 14, 0, 31).To4()}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("apply a new range only once the cached ranges have no free ip", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(nofreeCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			full := allocator.SimpleRange{RangeStart: net.IPv4(10, 14, 0, 4).To4(), RangeEnd: net.IPv4(10, 14, 0, 5).To4()}
+			Expect(store.AppendCache(&full)).To(Succeed())
+			for i, addr := range []net.IP{full.RangeStart, full.RangeEnd} {
+				reserved, err := store.Reserve(fmt.Sprintf("other-%d", i), "eth0.0", addr, "0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+			}
+
+			ips, err := allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips[0].Address.IP.String()).To(Equal("10.14.0.16"))
+			Expect(applies).To(Equal(1))
+
+			// a duplicate allocation fails on its own, no range is applied
+			_, err = allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, allocator.ErrNoFreeAddresses)).To(BeFalse())
+			Expect(applies).To(Equal(1))
+		})
+	})
+
+	Describe("subnet shrink", func() {
+		var dataDir = "/tmp/testshrinkdata"
+		var shrunkCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testshrink",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"ranges": [[{"subnet": "10.20.0.0/25"}]]
+			}
+		}`)
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+		})
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+		})
+
+		It("keep the cache ranges out of the shrunk subnet without allocating from them", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(shrunkCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			// cached while the subnet was 10.20.0.0/24
+			orphaned := allocator.SimpleRange{RangeStart: net.IPv4(10, 20, 0, 160).To4(), RangeEnd: net.IPv4(10, 20, 0, 175).To4()}
+			Expect(store.AppendCache(&orphaned)).To(Succeed())
+			Expect(store.AppendCache(&allocator.SimpleRange{RangeStart: net.IPv4(10, 20, 0, 16).To4(), RangeEnd: net.IPv4(10, 20, 0, 31).To4()})).To(Succeed())
+
+			ips, err := allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(ips)).To(Equal(1))
+			Expect(orphaned.Contains(&allocator.SimpleRange{RangeStart: ips[0].Address.IP, RangeEnd: ips[0].Address.IP})).To(BeFalse())
+
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(2))
+			subnets := store.LoadSubnets()
+			Expect(len(subnets)).To(Equal(1))
+			Expect(subnets[0].String()).To(Equal("10.20.0.0/25"))
+		})
+	})
+
+	Describe("ip family", func() {
+		var dataDir = "/tmp/testfamilydata"
+		var dualCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testfamily",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"ranges": [
+					[{"subnet": "10.10.0.0/16"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				]
+			}
+		}`)
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: r.RangeStart, RangeEnd: r.RangeEnd}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		allocate := func(args string) []*current.IPConfig {
+			netConf, _, err := allocator.LoadIPAMConfig(dualCfg, args)
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			ips, err := allocateIP(context.TODO(), netConf, store, "123456789", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			return ips
+		}
+
+		It("allocate only ipv4 for an ipv4 request", func() {
+			ips := allocate("IPFamily=ipv4")
+			Expect(len(ips)).To(Equal(1))
+			Expect(ips[0].Address.IP.To4()).NotTo(BeNil())
+		})
+
+		It("allocate only ipv6 for an ipv6 request", func() {
+			ips := allocate("IPFamily=ipv6")
+			Expect(len(ips)).To(Equal(1))
+			Expect(ips[0].Address.IP.To4()).To(BeNil())
+		})
+
+		It("allocate both families for a dual request", func() {
+			for _, args := range []string{"", "IPFamily=dual"} {
+				os.RemoveAll(dataDir)
+				ips := allocate(args)
+				Expect(len(ips)).To(Equal(2))
+				Expect(ips[0].Address.IP.To4()).NotTo(BeNil())
+				Expect(ips[1].Address.IP.To4()).To(BeNil())
+			}
+		})
+	})
+
+	Describe("pinned ip", func() {
+		var network = "testpinned"
+		var dataDirs = map[string]string{"node-a": "/tmp/testpinned-a", "node-b": "/tmp/testpinned-b"}
+		var pinnedCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testpinned",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "%s",
+				"pinnedIPs": true,
+				"ranges": [
+					[{
+						"subnet": "192.168.56.0/24",
+						"rangeStart": "192.168.56.32",
+						"rangeEnd": "192.168.56.159"
+					}]
+				]
+			}
+		}`
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for _, d := range dataDirs {
+				os.RemoveAll(d)
+			}
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		cmdArgs := func(node, containerID string) *skel.CmdArgs {
+			os.Setenv("HOSTNAME", node)
+			return &skel.CmdArgs{
+				ContainerID: containerID,
+				IfName:      "eth0",
+				Args:        "K8S_POD_NAME=pinnedpod;K8S_POD_NAMESPACE=testnamespace",
+				StdinData:   []byte(fmt.Sprintf(pinnedCfg, dataDirs[node])),
+			}
+		}
+		allocated := func(node, containerID string) []string {
+			store, err := disk.New(network, dataDirs[node])
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			ips := []string{}
+			for _, ip := range store.GetByID(containerID, "eth0.0") {
+				ips = append(ips, ip.String())
+			}
+			return ips
+		}
+
+		It("allocate the same ip to the pod rescheduled to another node", func() {
+			pinned := net.ParseIP("192.168.56.100").To4()
+			Expect(etcdv3cli.IPAMPinIP(network, pinned, "testnamespace/pinnedpod")).To(Succeed())
+
+			Expect(cmdAdd(cmdArgs("node-a", "container-a"))).To(Succeed())
+			Expect(allocated("node-a", "container-a")).To(Equal([]string{"192.168.56.100"}))
+			Expect(cmdDel(cmdArgs("node-a", "container-a"))).To(Succeed())
+
+			Expect(cmdAdd(cmdArgs("node-b", "container-b"))).To(Succeed())
+			Expect(allocated("node-b", "container-b")).To(Equal([]string{"192.168.56.100"}))
+
+			// the pinned ip follows the pod, leaving the other pods to the ranges
+			state, owner, err := etcdv3cli.IPAMQueryIP(network, pinned, dataDirs["node-b"])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).To(Equal(etcdv3cli.IPInUse))
+			Expect(owner).To(Equal("node-b"))
+			args := cmdArgs("node-a", "container-c")
+			args.Args = "K8S_POD_NAME=otherpod;K8S_POD_NAMESPACE=testnamespace"
+			Expect(cmdAdd(args)).To(Succeed())
+			other := allocated("node-a", "container-c")
+			Expect(len(other)).To(Equal(1))
+			Expect(other[0]).NotTo(Equal("192.168.56.100"))
+		})
+	})
+
+	Describe("commands", func() {
+		It("leave the args not naming a command to CNI", func() {
+			ok, err := runCommand([]string{})
+			Expect(ok).To(BeFalse())
+			Expect(err).NotTo(HaveOccurred())
+			ok, _ = runCommand([]string{"-h"})
+			Expect(ok).To(BeFalse())
+		})
+
+		It("migrate data dir", func() {
+			from, to := "/tmp/migratefrom", "/tmp/migrateto"
+			defer os.RemoveAll(from)
+			defer os.RemoveAll(to)
+			store, err := disk.New("testnet", from)
+			Expect(err).NotTo(HaveOccurred())
+			store.Reserve("123456789", "eth0", net.IPv4(192, 168, 56, 40), "0")
+			store.Close()
+
+			ok, err := runCommand([]string{"migrate-datadir", "--from", from})
+			Expect(ok).To(BeTrue())
+			Expect(err).To(HaveOccurred())
+
+			ok, err = runCommand([]string{"migrate-datadir", "--from", from, "--to", to})
+			Expect(ok).To(BeTrue())
+			Expect(err).NotTo(HaveOccurred())
+			store, err = disk.New("testnet", to)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			Expect(store.FindByID("123456789", "eth0")).To(BeTrue())
+		})
+	})
+
+	Describe("leases", func() {
+		var dataDir = "/tmp/leasesdir"
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+		})
+
+		entries := []etcdv3cli.LeaseEntry{
+			{Network: "net1", Key: "multus/lease/net1/3232249872-4", Node: "node-a",
+				Start: net.ParseIP("192.168.56.16").To4(), End: net.ParseIP("192.168.56.31").To4()},
+			{Network: "net1", Key: "multus/lease/net1/3232249888-4", Node: "node-b", Cause: "default/pod-b",
+				Start: net.ParseIP("192.168.56.32").To4(), End: net.ParseIP("192.168.56.47").To4()},
+			{Network: "net2", Key: "multus/lease/net2/3232249872-2", Node: "node-a",
+				Start: net.ParseIP("192.168.56.16").To4(), End: net.ParseIP("192.168.56.19").To4()},
+		}
+
+		It("count the ips of the leases allocated on this node", func() {
+			store, err := disk.New("net1", dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("192.168.56.16").To4(), RangeEnd: net.ParseIP("192.168.56.31").To4()})
+			store.Reserve("id0", "eth0", net.ParseIP("192.168.56.17"), "0")
+			store.Reserve("id1", "eth0", net.ParseIP("192.168.56.20"), "0")
+			store.Close()
+
+			rows, err := localLeaseUse(entries, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(rows)).To(Equal(3))
+			Expect(rows[0].Used).To(Equal(2))
+			Expect(rows[1].Used).To(Equal(0))
+			Expect(rows[2].Used).To(Equal(0))
+			// the network not on this node is left alone
+			_, err = os.Stat(filepath.Join(dataDir, "net2"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("print the leases as a table or json", func() {
+			rows := []leaseRow{{entries[0], 2}, {entries[1], 0}, {entries[2], 1}}
+			var buf bytes.Buffer
+			Expect(printLeases(&buf, rows, false)).To(Succeed())
+			Expect(buf.String()).To(Equal(`NETWORK  NODE                  START          END            USED  KEY
+net1     node-a                192.168.56.16  192.168.56.31  2/16  multus/lease/net1/3232249872-4
+net1     node-b@default/pod-b  192.168.56.32  192.168.56.47  0/16  multus/lease/net1/3232249888-4
+net2     node-a                192.168.56.16  192.168.56.19  1/4   multus/lease/net2/3232249872-2
+`))
+
+			buf.Reset()
+			Expect(printLeases(&buf, rows[2:], true)).To(Succeed())
+			Expect(buf.String()).To(MatchJSON(`[{"network": "net2", "key": "multus/lease/net2/3232249872-2", "node": "node-a",
+				"start": "192.168.56.16", "end": "192.168.56.19", "used": 1}]`))
+		})
+	})
+
+	Describe("verify release", func() {
+		var dataDir = "/tmp"
+		var network = "testverify"
+		BeforeEach(func() {
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+		AfterEach(func() {
+			os.RemoveAll(filepath.Join(dataDir, network))
+		})
+		It("clean the stale lease left after release", func() {
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			staleIP := net.IPv4(192, 168, 56, 40)
+			otherIP := net.IPv4(192, 168, 56, 41)
+			store.Reserve("123456789", "eth0", staleIP, "0")
+			store.Reserve("987654321", "eth0", otherIP, "0")
+
+			// the lease file of 123456789 survived the release
+			err = verifyRelease(network, store, "123456789", "eth0", []net.IP{staleIP})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(store.GetByID("123456789", "eth0"))).To(Equal(0))
+			Expect(len(store.GetByID("987654321", "eth0"))).To(Equal(1))
+		})
+	})
+
+	Describe("data dir policy", func() {
+		// root writes through the read-only bits, so a regular file stands in
+		// for the data dir the node fails to write
+		var dataDir = "/tmp/testrodata"
+		var policyCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testpolicy",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testrodata",
+				%s
+				"ranges": [[{"subnet": "10.30.0.0/24"}]]
+			}
+		}`
+		var args = func(policy string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData:   []byte(fmt.Sprintf(policyCfg, policy)),
+			}
+		}
+		var keys = func(dir string) map[string]string {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, dir, "testpolicy")+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			kvs := map[string]string{}
+			for _, kv := range resp.Kvs {
+				kvs[string(kv.Key)] = string(kv.Value)
+			}
+			return kvs
+		}
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			Expect(ioutil.WriteFile(dataDir, []byte{}, 0444)).To(Succeed())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		})
+
+		It("fail the add by default", func() {
+			Expect(cmdAdd(args(""))).NotTo(Succeed())
+			Expect(cmdAdd(args(`"dataDirPolicy": "fatal",`))).NotTo(Succeed())
+			Expect(len(keys("lease"))).To(Equal(0))
+			Expect(len(keys("static"))).To(Equal(0))
+		})
+
+		It("allocate the ip tracked by etcd only when degraded", func() {
+			Expect(cmdAdd(args(`"dataDirPolicy": "degraded",`))).To(Succeed())
+			claims := keys("static")
+			Expect(len(claims)).To(Equal(1))
+			for _, id := range claims {
+				Expect(id).To(Equal("123456789"))
+			}
+			Expect(len(keys("lease"))).To(Equal(1))
+
+			Expect(cmdDel(args(`"dataDirPolicy": "degraded",`))).To(Succeed())
+			Expect(len(keys("static"))).To(Equal(0))
+			Expect(len(keys("lease"))).To(Equal(0))
+		})
+	})
+
+	Describe("allocation stats", func() {
+		var dataDir = "/tmp/teststatsdata"
+		var statsCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "teststats",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"applyUnit": 1,
+				"ranges": [[{"subnet": "10.60.0.0/24"}]]
+			}
+		}`)
+		var applies int
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applies = 0
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				// ranges of 2 ips from .2 on
+				start := ip.NextIP(ip.NextIP(r.Subnet.IP))
+				for i := 0; i < applies*2; i++ {
+					start = ip.NextIP(start)
+				}
+				applies++
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: start, RangeEnd: ip.NextIP(start)}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("count the allocations across add and del cycles and restarts", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(statsCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, id := range []string{"a", "b", "c"} {
+				_, err := allocateIP(context.TODO(), netConf, store, id, "eth0")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "b", "eth0")).To(BeEmpty())
+			_, err = allocateIP(context.TODO(), netConf, store, "d", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			for _, id := range []string{"a", "c", "d"} {
+				Expect(releaseIP(context.TODO(), netConf.IPAM, store, id, "eth0")).To(BeEmpty())
+			}
+			// releasing again counts nothing
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "a", "eth0")).To(BeEmpty())
+			store.Close()
+
+			// the counters survive the restart of the plugin
+			store, err = disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			Expect(store.LoadStats()).To(Equal(disk.Stats{Allocations: 4, Releases: 4, Applies: uint64(applies), PeakUsed: 3}))
+			Expect(applies).To(Equal(2))
+		})
+	})
+
+	Describe("events", func() {
+		var dataDir = "/tmp/testeventsdata"
+		var eventsFile = "/tmp/testevents.jsonl"
+		var args = func(target string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData: []byte(fmt.Sprintf(`{
+					"cniVersion": "0.3.1",
+					"name": "testevents",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": "/tmp/testeventsdata",
+						"events": "%s",
+						"ranges": [[{"subnet": "10.61.0.0/24"}]]
+					}
+				}`, target)),
+			}
+		}
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			os.Remove(eventsFile)
+			resultOut = &bytes.Buffer{}
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: net.IPv4(10, 61, 0, 16).To4(), RangeEnd: net.IPv4(10, 61, 0, 31).To4()}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			resultOut = os.Stdout
+			os.RemoveAll(dataDir)
+			os.Remove(eventsFile)
+		})
+
+		It("append an allocated and a released line of json", func() {
+			Expect(cmdAdd(args(eventsFile))).To(Succeed())
+			Expect(cmdDel(args(eventsFile))).To(Succeed())
+			data, err := ioutil.ReadFile(eventsFile)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			Expect(len(lines)).To(Equal(2))
+			for i, kind := range []string{events.Allocated, events.Released} {
+				ev := map[string]interface{}{}
+				Expect(json.Unmarshal([]byte(lines[i]), &ev)).To(Succeed())
+				Expect(ev["event"]).To(Equal(kind))
+				Expect(ev["network"]).To(Equal("testevents"))
+				Expect(ev["node"]).To(Equal(etcdv3.NodeId()))
+				Expect(ev["containerId"]).To(Equal("123456789"))
+				Expect(ev["ifName"]).To(Equal("eth0"))
+				Expect(ev["ip"]).To(Equal("10.61.0.16"))
+				_, err := time.Parse(time.RFC3339Nano, ev["time"].(string))
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("not fail the add and del when the events fail", func() {
+			for _, target := range []string{"/proc/testnet/events", "unix:/tmp/testevents.sock"} {
+				Expect(cmdAdd(args(target))).To(Succeed())
+				Expect(cmdDel(args(target))).To(Succeed())
+			}
+		})
+	})
+
+	Describe("return empty", func() {
+		var dataDir = "/tmp/testreturndata"
+		var returnCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testreturn",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"returnEmpty": true,
+				"ranges": [[{"subnet": "10.70.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		var leases = func() int {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, "lease", "testreturn")+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			return len(resp.Kvs)
+		}
+
+		It("return the range once its last ip is released", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(returnCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocateIP(context.TODO(), netConf, store, "b", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leases()).To(Equal(1))
+
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "a", "eth0")).To(BeNil())
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			Expect(leases()).To(Equal(1))
+
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "b", "eth0")).To(BeNil())
+			caches, err = store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(0))
+			Expect(leases()).To(Equal(0))
+		})
+
+		It("apply a new range for the allocation racing with the return", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(returnCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			returned := allocator.SimpleRange{RangeStart: caches[0].RangeStart.To4(), RangeEnd: caches[0].RangeEnd.To4()}
+
+			// the allocation loaded the cache before the release returned it
+			r := netConf.IPAM.Ranges[0][0]
+			r.RangeStart, r.RangeEnd = returned.RangeStart, returned.RangeEnd
+			stale := allocator.RangeSet{r}
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "a", "eth0")).To(BeNil())
+			Expect(leases()).To(Equal(0))
+
+			ipConf, err := allocateInRangeSet(context.TODO(), netConf.IPAM, store, stale, 0, "b", "eth0.0", 4, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.InCache(ipConf.Address.IP)).To(BeTrue())
+			ips := store.GetByID("b", "eth0.0")
+			Expect(len(ips)).To(Equal(1))
+			Expect(ips[0].Equal(ipConf.Address.IP)).To(BeTrue())
+			// the range is leased again along with the cache
+			Expect(leases()).To(Equal(1))
+		})
+	})
+
+	Describe("return after", func() {
+		var dataDir = "/tmp/testreturnafterdata"
+		var returnCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testreturnafter",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"returnEmpty": true,
+				"returnAfter": 2,
+				"applyUnit": 2,
+				"ranges": [[{"subnet": "10.71.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		var leases = func() int {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, "lease", "testreturnafter")+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			return len(resp.Kvs)
+		}
+
+		It("return the drained range once idle for returnAfter allocations", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(returnCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			// 4 ips fill the first range, the fifth applies the second
+			for i := 0; i < 5; i++ {
+				_, err = allocateIP(context.TODO(), netConf, store, fmt.Sprintf("c%d", i), "eth0")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(leases()).To(Equal(2))
+			for i := 0; i < 4; i++ {
+				Expect(releaseIP(context.TODO(), netConf.IPAM, store, fmt.Sprintf("c%d", i), "eth0")).To(BeNil())
+			}
+			// the drained range is kept until idle long enough
+			Expect(leases()).To(Equal(2))
+			Expect(len(store.LoadDrained())).To(Equal(1))
+
+			_, err = allocateIP(context.TODO(), netConf, store, "d0", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leases()).To(Equal(2))
+			_, err = allocateIP(context.TODO(), netConf, store, "d1", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leases()).To(Equal(1))
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			Expect(len(store.LoadDrained())).To(Equal(0))
+		})
+	})
+
+	Describe("cache rollback", func() {
+		var dataDir = "/tmp/testrollbackdata"
+		var rollbackCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testrollback",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"ranges": [[{"subnet": "10.60.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(func() {
+			appendCache = (*disk.Store).AppendCache
+			clean()
+		})
+
+		It("roll back the lease applied when the cache write fails", func() {
+			appendCache = func(s *disk.Store, sr *allocator.SimpleRange) error {
+				return fmt.Errorf("no space left on device")
+			}
+			netConf, _, err := allocator.LoadIPAMConfig(rollbackCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no space left on device"))
+
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, "lease", netConf.Name)+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(resp.Kvs)).To(Equal(0))
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(0))
+		})
+
+		It("return the ranges applied by an allocation failing late", func() {
+			dualCfg := []byte(`{
+				"cniVersion": "0.3.1",
+				"name": "testrollback",
+				"type": "macvlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [[{"subnet": "10.60.0.0/24"}], [{"subnet": "10.61.0.0/24"}]]
+				}
+			}`)
+			// the range of the first range set is applied and cached, the
+			// cache of the second fails
+			appendCache = func(s *disk.Store, sr *allocator.SimpleRange) error {
+				if sr.RangeStart.To4()[1] == 61 {
+					return fmt.Errorf("no space left on device")
+				}
+				return s.AppendCache(sr)
+			}
+			netConf, _, err := allocator.LoadIPAMConfig(dualCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			keyDir := filepath.Join(em.RootKeyDir, "lease", netConf.Name) + "/"
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).To(HaveOccurred())
+			resp, err := em.Cli.Get(context.TODO(), keyDir, clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(resp.Kvs)).To(Equal(0))
+			caches, err := store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(0))
+
+			// the range of the first range set cached by an add before is kept
+			singleConf, _, err := allocator.LoadIPAMConfig(rollbackCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocateIP(context.TODO(), singleConf, store, "b", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocateIP(context.TODO(), netConf, store, "c", "eth0")
+			Expect(err).To(HaveOccurred())
+			resp, err = em.Cli.Get(context.TODO(), keyDir, clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(resp.Kvs)).To(Equal(1))
+			caches, err = store.LoadCache()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(caches)).To(Equal(1))
+			Expect(caches[0].RangeStart.To4()[1]).To(Equal(byte(60)))
+		})
+	})
+
+	Describe("soft reserve", func() {
+		var network = "testsoft"
+		var dataDir = "/tmp/testsoftdata"
+		var softCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testsoft",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testsoftdata",
+				"softReserve": true,
+				"ranges": [[{"subnet": "10.50.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		cmdArgs := func(containerID string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: containerID,
+				IfName:      "eth0",
+				Args:        "K8S_POD_NAME=softpod;K8S_POD_NAMESPACE=testnamespace",
+				StdinData:   softCfg,
+			}
+		}
+		allocated := func(containerID string) net.IP {
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			ips := store.GetByID(containerID, "eth0.0")
+			Expect(len(ips)).To(Equal(1))
+			return ips[0]
+		}
+		preferred := func() net.IP {
+			ip, err := etcdv3cli.IPAMGetPreferredIP(network, "testnamespace/softpod")
+			Expect(err).NotTo(HaveOccurred())
+			return ip
+		}
+
+		It("reuse the preferred ip when it is free", func() {
+			Expect(cmdAdd(cmdArgs("container-a"))).To(Succeed())
+			first := allocated("container-a")
+			Expect(preferred().Equal(first)).To(BeTrue())
+			Expect(cmdDel(cmdArgs("container-a"))).To(Succeed())
+
+			// round-robin would go on to the next ip
+			Expect(cmdAdd(cmdArgs("container-b"))).To(Succeed())
+			Expect(allocated("container-b").Equal(first)).To(BeTrue())
+		})
+
+		It("allocate another ip when the preferred one is taken", func() {
+			Expect(cmdAdd(cmdArgs("container-a"))).To(Succeed())
+			first := allocated("container-a")
+			Expect(cmdDel(cmdArgs("container-a"))).To(Succeed())
+
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			reserved, err := store.Reserve("other", "eth0.0", first, "0")
+			store.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+
+			Expect(cmdAdd(cmdArgs("container-b"))).To(Succeed())
+			second := allocated("container-b")
+			Expect(second.Equal(first)).To(BeFalse())
+			Expect(preferred().Equal(second)).To(BeTrue())
+		})
+	})
+
+	Describe("alloc timeout", func() {
+		var dataDir = "/tmp/testtimeoutdata"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("fail the add contended past allocTimeout", func() {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			// another node holds the lease dir for longer than the add may wait
+			holder, err := etcdv3.LockDir(context.TODO(), em.Cli, filepath.Join(em.RootKeyDir, "lease", "testtimeout"))
+			Expect(err).NotTo(HaveOccurred())
+			defer holder.Close()
+
+			args := &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData: []byte(`{
+					"cniVersion": "0.3.1",
+					"name": "testtimeout",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": "/tmp/testtimeoutdata",
+						"allocTimeout": 1,
+						"ranges": [[{"subnet": "10.70.0.0/24"}]]
+					}
+				}`),
+			}
+			start := time.Now()
+			err = cmdAdd(args)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(etcdv3.ErrDeadline.Error()))
+			Expect(time.Since(start)).To(BeNumerically("<", 3*time.Second))
+		})
+	})
+
+	Describe("strict version", func() {
+		var ips = func(addrs ...string) *current.Result {
+			result := &current.Result{}
+			for _, a := range addrs {
+				ipn, err := types.ParseCIDR(a)
+				Expect(err).NotTo(HaveOccurred())
+				result.IPs = append(result.IPs, &current.IPConfig{Version: "4", Address: *ipn})
+			}
+			return result
+		}
+
+		It("accept the supported cniVersions", func() {
+			for _, v := range []string{"0.2.0", "0.3.1", current.ImplementedSpecVersion, cniVersion100} {
+				r, err := versionedResult(ips("10.40.0.2/24"), v, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.Version()).To(Equal(v))
+			}
+		})
+
+		It("reject the unsupported cniVersions", func() {
+			_, err := versionedResult(ips("10.40.0.2/24"), "9.9.9", nil)
+			Expect(err).To(MatchError(HavePrefix(`unsupported cniVersion "9.9.9"`)))
+			_, err = versionedResult(ips("10.40.0.2/24"), "", nil)
+			Expect(err).To(MatchError(HavePrefix(`unsupported cniVersion ""`)))
+		})
+
+		It("reject the result the cniVersion can not hold", func() {
+			_, err := versionedResult(ips("10.40.0.2/24", "10.41.0.2/24"), "0.2.0", nil)
+			Expect(err).To(MatchError("result of 2 ips can not be expressed in cniVersion 0.2.0"))
+			_, err = versionedResult(ips("10.40.0.2/24", "10.41.0.2/24"), "0.3.1", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fail the add of an unsupported cniVersion before allocating", func() {
+			applies := 0
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				applies++
+				return nil, etcdv3cli.ErrRangeExhausted
+			}
+			defer func() { applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange }()
+			args := &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData: []byte(`{
+					"cniVersion": "9.9.9",
+					"name": "teststrict",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": "/tmp/teststrictdata",
+						"strictVersion": true,
+						"ranges": [[{"subnet": "10.40.0.0/24"}]]
+					}
+				}`),
+			}
+			defer os.RemoveAll("/tmp/teststrictdata")
+			Expect(cmdAdd(args)).To(MatchError(HavePrefix(`unsupported cniVersion "9.9.9"`)))
+			Expect(applies).To(Equal(0))
+		})
+	})
+
+	Describe("result versions", func() {
+		var dataDir = "/tmp/testresultdata"
+		var resolvConf = "/tmp/testresult-resolv.conf"
+		var out *bytes.Buffer
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+			os.Remove(resolvConf)
+		}
+		BeforeEach(func() {
+			clean()
+			Expect(ioutil.WriteFile(resolvConf, []byte("nameserver 10.45.0.53\nsearch example.com\n"), 0644)).To(Succeed())
+			out = &bytes.Buffer{}
+			resultOut = out
+		})
+		AfterEach(func() {
+			resultOut = os.Stdout
+			clean()
+		})
+		addVersioned := func(cniVersion, containerID string) map[string]interface{} {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				IfName:      "eth0",
+				StdinData: []byte(fmt.Sprintf(`{
+					"cniVersion": %q,
+					"name": "testresult",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": %q,
+						"resolvConf": %q,
+						"routes": [{"dst": "0.0.0.0/0"}],
+						"ranges": [[{"subnet": "10.45.0.0/24", "gateway": "10.45.0.1"}]]
+					}
+				}`, cniVersion, dataDir, resolvConf)),
+			}
+			out.Reset()
+			Expect(cmdAdd(args)).To(Succeed())
+			printed := map[string]interface{}{}
+			Expect(json.Unmarshal(out.Bytes(), &printed)).To(Succeed())
+			return printed
+		}
+
+		It("print the result in the shape of the cniVersion of the config", func() {
+			for i, v := range []string{"0.3.1", "0.4.0", cniVersion100} {
+				printed := addVersioned(v, fmt.Sprintf("container-%d", i))
+				Expect(printed["cniVersion"]).To(Equal(v))
+				Expect(printed["ips"]).To(HaveLen(1))
+				ipc := printed["ips"].([]interface{})[0].(map[string]interface{})
+				Expect(ipc["address"]).To(HavePrefix("10.45.0."))
+				Expect(ipc["address"]).To(HaveSuffix("/24"))
+				Expect(ipc["gateway"]).To(Equal("10.45.0.1"))
+				if v == cniVersion100 {
+					// the ips of 1.0.0 no longer tell their version
+					Expect(ipc).NotTo(HaveKey("version"))
+				} else {
+					Expect(ipc["version"]).To(Equal("4"))
+				}
+				Expect(printed["routes"]).To(Equal([]interface{}{map[string]interface{}{"dst": "0.0.0.0/0"}}))
+				Expect(printed["dns"]).To(Equal(map[string]interface{}{
+					"nameservers": []interface{}{"10.45.0.53"},
+					"search":      []interface{}{"example.com"},
+				}))
+			}
+		})
+
+		It("fail on a resolvConf failing to parse unless ignoreResolvConfErrors", func() {
+			conf := func(lenient bool) []byte {
+				return []byte(fmt.Sprintf(`{
+					"cniVersion": "0.3.1",
+					"name": "testresult",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": %q,
+						"resolvConf": "/tmp/testresult-missing/resolv.conf",
+						"ignoreResolvConfErrors": %v,
+						"ranges": [[{"subnet": "10.45.0.0/24", "gateway": "10.45.0.1"}]]
+					}
+				}`, dataDir, lenient))
+			}
+			err := cmdAdd(&skel.CmdArgs{ContainerID: "container-strict", IfName: "eth0", StdinData: conf(false)})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("parseResolvConf failed"))
+
+			out.Reset()
+			args := &skel.CmdArgs{ContainerID: "container-lenient", IfName: "eth0", StdinData: conf(true)}
+			Expect(cmdAdd(args)).To(Succeed())
+			printed := map[string]interface{}{}
+			Expect(json.Unmarshal(out.Bytes(), &printed)).To(Succeed())
+			Expect(printed["ips"]).To(HaveLen(1))
+			dns, _ := printed["dns"].(map[string]interface{})
+			Expect(dns).To(BeEmpty())
+			Expect(cmdCheck(args)).To(Succeed())
+		})
+
+		It("print the tables of the routes in 1.0.0 only", func() {
+			add := func(cniVersion, containerID string) []interface{} {
+				args := &skel.CmdArgs{
+					ContainerID: containerID,
+					IfName:      "eth0",
+					StdinData: []byte(fmt.Sprintf(`{
+						"cniVersion": %q,
+						"name": "testresult",
+						"type": "macvlan",
+						"ipam": {
+							"type": "multus-ipam",
+							"dataDir": %q,
+							"routes": [
+								{"dst": "0.0.0.0/0"},
+								{"dst": "192.168.0.0/16", "gw": "10.45.0.254", "table": 100},
+								{"dst": "172.16.0.0/12", "gw": "10.45.0.253", "table": 200}
+							],
+							"ranges": [[{"subnet": "10.45.0.0/24", "gateway": "10.45.0.1"}]]
+						}
+					}`, cniVersion, dataDir)),
+				}
+				out.Reset()
+				Expect(cmdAdd(args)).To(Succeed())
+				printed := map[string]interface{}{}
+				Expect(json.Unmarshal(out.Bytes(), &printed)).To(Succeed())
+				return printed["routes"].([]interface{})
+			}
+
+			routes := add(cniVersion100, "container-table")
+			Expect(routes).To(Equal([]interface{}{
+				map[string]interface{}{"dst": "0.0.0.0/0"},
+				map[string]interface{}{"dst": "192.168.0.0/16", "gw": "10.45.0.254", "table": float64(100)},
+				map[string]interface{}{"dst": "172.16.0.0/12", "gw": "10.45.0.253", "table": float64(200)},
+			}))
+			routes = add("0.4.0", "container-notable")
+			Expect(routes).To(Equal([]interface{}{
+				map[string]interface{}{"dst": "0.0.0.0/0"},
+				map[string]interface{}{"dst": "192.168.0.0/16", "gw": "10.45.0.254"},
+				map[string]interface{}{"dst": "172.16.0.0/12", "gw": "10.45.0.253"},
+			}))
+		})
+
+		It("convert the result of 1.0.0 back to the older versions", func() {
+			result := &current.Result{Routes: []*types.Route{}}
+			ipn, err := types.ParseCIDR("10.45.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			result.IPs = []*current.IPConfig{{Version: "4", Address: *ipn, Gateway: net.ParseIP("10.45.0.1")}}
+			r, err := versionedResult(result, cniVersion100, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Version()).To(Equal(cniVersion100))
+			back, err := r.GetAsVersion("0.4.0")
+			Expect(err).NotTo(HaveOccurred())
+			cur, err := current.NewResultFromResult(back)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cur.IPs).To(HaveLen(1))
+			Expect(cur.IPs[0].Version).To(Equal("4"))
+			Expect(cur.IPs[0].Address.String()).To(Equal("10.45.0.2/24"))
+		})
+	})
+
+	Describe("parallel allocation", func() {
+		var dataDir = "/tmp/testparalleldata"
+		var parallelCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testparallel",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"applyUnit": 1,
+				"parallelism": 2,
+				"ranges": [
+					[{"subnet": "10.70.0.0/24"}],
+					[{"subnet": "fd00:70::/64"}]
+				]
+			}
+		}`)
+		var mu sync.Mutex
+		var inflight, maxInflight int
+		var applies map[int]int
+		var failAt map[int]int
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			inflight, maxInflight = 0, 0
+			applies, failAt = map[int]int{}, map[int]int{}
+			// ranges of 2 ips after the gateway, slow enough to overlap
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				family := 6
+				if r.RangeStart.To4() != nil {
+					family = 4
+				}
+				mu.Lock()
+				n := applies[family]
+				applies[family]++
+				if inflight++; inflight > maxInflight {
+					maxInflight = inflight
+				}
+				mu.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+				if failAt[family] == n+1 {
+					return nil, fmt.Errorf("etcd unavailable")
+				}
+				start := ip.NextIP(r.RangeStart)
+				for i := 0; i < n*2; i++ {
+					start = ip.NextIP(start)
+				}
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: start, RangeEnd: ip.NextIP(start)}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("allocate from the range sets at once, in the order of the ips requested", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(parallelCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			netConf.IPAM.Num = 3
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			IPs, err := allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(maxInflight).To(Equal(2))
+			Expect(applies).To(Equal(map[int]int{4: 2, 6: 2}))
+			addrs := []string{}
+			for _, ipConf := range IPs {
+				addrs = append(addrs, ipConf.Address.IP.String())
+			}
+			Expect(addrs).To(Equal([]string{
+				"10.70.0.2", "fd00:70::2",
+				"10.70.0.3", "fd00:70::3",
+				"10.70.0.4", "fd00:70::4",
+			}))
+			Expect(len(store.GetByID("a", "eth0.2"))).To(Equal(2))
+		})
+
+		It("roll back all the range sets on a failure of one", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(parallelCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			netConf.IPAM.Num = 3
+			// ipv6 fails to apply its second range, after ipv4 allocated
+			failAt[6] = 2
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).To(MatchError(ContainSubstring("etcd unavailable")))
+			Expect(applies[4]).To(Equal(2))
+			for s := 0; s < 3; s++ {
+				Expect(store.GetByID("a", fmt.Sprintf("eth0.%d", s))).To(BeEmpty())
+			}
+			Expect(store.ReservedIPs()).To(BeEmpty())
+		})
+
+		It("apply from etcd at once with the options of the network", func() {
+			// the applies run in goroutines of their own, go test -race finds
+			// them racing on a setting of the package
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			defer em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			cfg := strings.Replace(string(parallelCfg), `"applyUnit": 1,`, `"applyUnit": 2, "leaseOwner": "pod",`, 1)
+			cfg = strings.Replace(cfg, `[{"subnet": "fd00:70::/64"}]`, `[{"subnet": "10.71.0.0/24"}]`, 1)
+			netConf, _, err := allocator.LoadIPAMConfig([]byte(cfg), "")
+			Expect(err).NotTo(HaveOccurred())
+			netConf.IPAM.K8sNs, netConf.IPAM.PodName = "default", "pod-a"
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			IPs, err := allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(IPs)).To(Equal(2))
+			Expect(netConf.IPAM.Ranges[0][0].Contains(IPs[0].Address.IP)).To(BeTrue())
+			Expect(netConf.IPAM.Ranges[1][0].Contains(IPs[1].Address.IP)).To(BeTrue())
+			infos := []etcdv3cli.LeaseInfo{}
+			err = etcdv3cli.IPAMWalkLease(em.Cli, filepath.Join(em.RootKeyDir, "lease"), em.Id, func(leases map[string][]etcdv3cli.LeaseInfo) error {
+				infos = append(infos, leases[netConf.Name]...)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(infos)).To(Equal(2))
+			for _, info := range infos {
+				Expect(info.Cause).To(Equal("default/pod-a"))
+			}
+		})
+	})
+
+	Describe("import static", func() {
+		var network = "teststatic"
+		var file = "/tmp/teststatic.csv"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.Remove(file)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+		keys := func(dir string) map[string]string {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, dir, network)+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			kvs := map[string]string{}
+			for _, kv := range resp.Kvs {
+				kvs[filepath.Base(string(kv.Key))] = string(kv.Value)
+			}
+			return kvs
+		}
+
+		It("reserve the valid entries and report the conflicts", func() {
+			// 10.50.0.2-10.50.0.5 is leased to a node
+			r := allocator.Range{Subnet: types.IPNet{IP: net.IP{10, 50, 0, 0}, Mask: net.CIDRMask(24, 32)}}
+			Expect(r.Canonicalize()).To(Succeed())
+			_, err := etcdv3cli.IPAMApplyIPRange(context.TODO(), network, &r, 2)
+			Expect(err).NotTo(HaveOccurred())
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = em.Cli.Put(context.TODO(), filepath.Join(em.RootKeyDir, "static", network, "0171048980"), "ns/taken")
+			em.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(file, []byte(`ip,identity
+# migrated from the old ipam
+10.50.0.100,ns/pod-a
+10.50.0.101, ns/pod-b
+10.50.0.3,ns/leased
+10.60.0.1,ns/outside
+10.50.0.20,ns/other
+`), 0644)).To(Succeed())
+			args := []string{"--network", network, "--subnet", "10.50.0.0/24", "--file", file}
+			Expect(cmdImportStatic(args)).To(MatchError("3 entries conflict"))
+
+			Expect(keys("static")).To(Equal(map[string]string{
+				"0171048980": "ns/taken",
+				"0171049060": "ns/pod-a",
+				"0171049061": "ns/pod-b",
+			}))
+			leases := keys("lease")
+			for _, k := range []string{"0171049060-0", "0171049061-0"} {
+				Expect(leases[k]).To(ContainSubstring(`"node":"static"`))
+				Expect(etcdv3cli.IPAMLeaseOwner([]byte(leases[k]))).To(Equal("static"))
+			}
+			Expect(len(leases)).To(Equal(3))
+
+			// importing again skips the entries imported, from json as well
+			Expect(ioutil.WriteFile(file, []byte(`[{"ip": "10.50.0.100", "identity": "ns/pod-a"}]`), 0644)).To(Succeed())
+			Expect(cmdImportStatic(args)).To(Succeed())
+			Expect(len(keys("static"))).To(Equal(3))
+		})
+	})
+
+	Describe("requested ip", func() {
+		var network = "testrequested"
+		var dataDir = "/tmp/testrequested"
+		var requestedCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testrequested",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "%s",
+				"applyUnit": 2,
+				"ranges": [
+					[{
+						"subnet": "192.168.56.0/24",
+						"rangeStart": "192.168.56.100",
+						"rangeEnd": "192.168.56.107"
+					}]
+				]
+			}
+		}`
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		cmdArgs := func(containerID, args string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: containerID,
+				IfName:      "eth0",
+				Args:        args,
+				StdinData:   []byte(fmt.Sprintf(requestedCfg, dataDir)),
+			}
+		}
+		keys := func(dir string) map[string]string {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, dir, network)+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			kvs := map[string]string{}
+			for _, kv := range resp.Kvs {
+				kvs[filepath.Base(string(kv.Key))] = string(kv.Value)
+			}
+			return kvs
+		}
+
+		It("reserve the requested ip until the container is deleted", func() {
+			Expect(cmdAdd(cmdArgs("container-a", "IP=192.168.56.101"))).To(Succeed())
+			Expect(keys("static")).To(Equal(map[string]string{"3232249957": "container-a"}))
+			Expect(keys("lease")).To(Equal(map[string]string{"3232249957-0": "static"}))
+			// an ADD retried keeps the reservation
+			Expect(cmdAdd(cmdArgs("container-a", "IP=192.168.56.101"))).To(Succeed())
+
+			err := cmdAdd(cmdArgs("container-b", "IP=192.168.56.101"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is reserved for container-a"))
+			err = cmdAdd(cmdArgs("container-b", "IP=192.168.56.120"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("out of the ranges"))
+
+			// the dynamic allocation skips the reserved ip
+			Expect(cmdAdd(cmdArgs("container-c", ""))).To(Succeed())
+			store, err := disk.New(network, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			used := store.GetByID("container-c", "eth0.0")
+			store.Close()
+			Expect(len(used)).To(Equal(1))
+			Expect(used[0].String()).To(Equal("192.168.56.102"))
+			// the reserved ip conflicts with the lease of the node as well
+			err = cmdAdd(cmdArgs("container-b", "IP=192.168.56.103"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("leased by"))
+
+			Expect(cmdDel(cmdArgs("container-a", "IP=192.168.56.101"))).To(Succeed())
+			Expect(keys("static")).To(BeEmpty())
+			Expect(cmdAdd(cmdArgs("container-b", "IP=192.168.56.101"))).To(Succeed())
+			Expect(keys("static")).To(Equal(map[string]string{"3232249957": "container-b"}))
+		})
+	})
+
+	Describe("exhausted wait", func() {
+		var dataDir = "/tmp/testexhausteddata"
+		var exhaustedCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testexhausted",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"exhaustedWait": 30,
+				"ranges": [[{"subnet": "10.90.0.0/24"}]]
+			}
+		}`)
+		var applies int
+		var applyErr error
+		var clock time.Time
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applies = 0
+			clock = time.Now()
+			now = func() time.Time { return clock }
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				applies++
+				return nil, applyErr
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			now = time.Now
+			os.RemoveAll(dataDir)
+		})
+
+		It("apply no more from an exhausted subnet until the cooldown passes", func() {
+			applyErr = etcdv3cli.ErrRangeExhausted
+			netConf, _, err := allocator.LoadIPAMConfig(exhaustedCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+			Expect(err).To(MatchError("failed to allocate for range 0: apply ip range failed, the subnet is exhausted, retry in 30s"))
+			Expect(applies).To(Equal(1))
+
+			clock = clock.Add(10 * time.Second)
+			_, err = allocateIP(context.TODO(), netConf, store, "b", "eth0")
+			Expect(err).To(MatchError("failed to allocate for range 0: apply ip range failed, the subnet is exhausted, retry in 20s"))
+			Expect(applies).To(Equal(1))
+
+			clock = clock.Add(20 * time.Second)
+			_, err = allocateIP(context.TODO(), netConf, store, "c", "eth0")
+			Expect(err).To(HaveOccurred())
+			Expect(applies).To(Equal(2))
+		})
+
+		It("retry a transient failure at once", func() {
+			applyErr = fmt.Errorf("etcd request timeout")
+			netConf, _, err := allocator.LoadIPAMConfig(exhaustedCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			for i := 1; i <= 3; i++ {
+				_, err = allocateIP(context.TODO(), netConf, store, "a", "eth0")
+				Expect(err).To(HaveOccurred())
+				_, exhausted := err.(*exhaustedError)
+				Expect(exhausted).To(BeFalse())
+				Expect(applies).To(Equal(i))
+			}
+		})
+	})
+
+	Describe("gateway check", func() {
+		var dataDir = "/tmp/testgwcheckdata"
+		var gwCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testgwcheck",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testgwcheckdata",
+				"applyUnit": 2,
+				%s
+				"ranges": [[{"subnet": "10.80.0.0/24", "gateway": "10.80.0.1"}]]
+			}
+		}`
+		var args = func(check string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData:   []byte(fmt.Sprintf(gwCfg, check)),
+			}
+		}
+		var allocated = func(id, ifName string) []net.IP {
+			store, err := disk.New("testgwcheck", dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			return store.GetByID(id, ifName)
+		}
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			// the node applies .16-.19, leaving the gateway out
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				return &etcdv3cli.ApplyResult{SimpleRange: &allocator.SimpleRange{RangeStart: net.IP{10, 80, 0, 16}, RangeEnd: net.IP{10, 80, 0, 19}}}, nil
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("fail the add on a gateway out of the applied range", func() {
+			Expect(cmdAdd(args(`"gatewayCheck": "error",`))).NotTo(Succeed())
+			Expect(allocated("123456789", "eth0.0")).To(BeEmpty())
+		})
+
+		It("pass the gateway routed on-link", func() {
+			Expect(cmdAdd(args(`"gatewayCheck": "error", "routes": [{"dst": "10.80.0.0/24"}],`))).To(Succeed())
+			Expect(len(allocated("123456789", "eth0.0"))).To(Equal(1))
+		})
+
+		It("only warn of the gateway by default of the check", func() {
+			Expect(cmdAdd(args(`"gatewayCheck": "warn",`))).To(Succeed())
+			Expect(len(allocated("123456789", "eth0.0"))).To(Equal(1))
+			Expect(allocated("gateway", "gateway.0")).To(BeEmpty())
+		})
+
+		It("fall back to a gateway allocated from the applied range", func() {
+			Expect(cmdAdd(args(`"gatewayCheck": "allocate",`))).To(Succeed())
+			gws := allocated("gateway", "gateway.0")
+			Expect(len(gws)).To(Equal(1))
+			Expect(ip.Cmp(gws[0], net.IP{10, 80, 0, 16}) >= 0 && ip.Cmp(gws[0], net.IP{10, 80, 0, 19}) <= 0).To(BeTrue())
+		})
+	})
+
+	Describe("node range", func() {
+		var dataDirs = map[string]string{"node-a": "/tmp/testnoderangea", "node-b": "/tmp/testnoderangeb"}
+		var nodeRangeCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testnoderange",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"nodeRange": {"blockPrefix": 28, "nodeIndexes": {"node-a": 1, "node-b": 2}},
+				"ranges": [[{"subnet": "10.70.0.0/16"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			for _, d := range dataDirs {
+				os.RemoveAll(d)
+			}
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		It("allocate from the block of the node, recording it as the lease", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(nodeRangeCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			for node, idx := range map[string]int{"node-a": 1, "node-b": 2} {
+				os.Setenv("HOSTNAME", node)
+				_, block, _ := net.ParseCIDR(fmt.Sprintf("10.70.0.%d/28", idx*16))
+				store, err := disk.New(netConf.Name, dataDirs[node])
+				Expect(err).NotTo(HaveOccurred())
+				for i := 0; i < 16; i++ {
+					IPs, err := allocateIP(context.TODO(), netConf, store, fmt.Sprintf("%s-%d", node, i), "eth0")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(block.Contains(IPs[0].Address.IP)).To(BeTrue())
+				}
+				// a node has its block only
+				_, err = allocateIP(context.TODO(), netConf, store, node+"-full", "eth0")
+				Expect(err).To(HaveOccurred())
+				store.Close()
+
+				em, err := etcdv3.New()
+				Expect(err).NotTo(HaveOccurred())
+				leases, err := etcdv3cli.IPAMGetAllLease(em.Cli, filepath.Join(em.RootKeyDir, "lease"), node)
+				em.Close()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(leases[netConf.Name]).To(Equal([]allocator.SimpleRange{{
+					RangeStart: net.IP{10, 70, 0, byte(idx * 16)},
+					RangeEnd:   net.IP{10, 70, 0, byte(idx*16 + 15)},
+				}}))
+			}
+		})
+
+		It("refuse the block of the node leased by another node", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(nodeRangeCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			// node-b holds the block of node-a, e.g. by a stale index
+			os.Setenv("HOSTNAME", "node-b")
+			block := &allocator.SimpleRange{RangeStart: net.IP{10, 70, 0, 16}, RangeEnd: net.IP{10, 70, 0, 31}}
+			Expect(etcdv3cli.IPAMRecordNodeRange(context.TODO(), netConf.Name, "", block, etcdv3cli.DefaultApplyOptions())).To(Succeed())
+
+			os.Setenv("HOSTNAME", "node-a")
+			store, err := disk.New(netConf.Name, dataDirs["node-a"])
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			_, err = allocateIP(context.TODO(), netConf, store, "node-a-0", "eth0")
+			Expect(errors.Is(err, etcdv3cli.ErrNodeRangeConflict)).To(BeTrue())
+		})
+	})
+
+	Describe("replay log", func() {
+		var dataDirs = []string{"/tmp/testreplaydata", "/tmp/testreplaydata2"}
+		var logFile = "/tmp/testreplay.log"
+		var replayCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testreplay",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"applyUnit": 1,
+				"replayLog": "/tmp/testreplay.log",
+				"ranges": [[{"subnet": "10.40.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			for _, d := range dataDirs {
+				os.RemoveAll(d)
+			}
+			os.Remove(logFile)
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+		}
+		BeforeEach(clean)
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			clean()
+		})
+		sameRanges := func(a, b []allocator.SimpleRange) bool {
+			if len(a) != len(b) {
+				return false
+			}
+			for i := range a {
+				if !a[i].RangeStart.Equal(b[i].RangeStart) || !a[i].RangeEnd.Equal(b[i].RangeEnd) {
+					return false
+				}
+			}
+			return true
+		}
+
+		It("replay a recorded session deterministically", func() {
+			netConf, _, err := allocator.LoadIPAMConfig(replayCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := disk.New(netConf.Name, dataDirs[0])
+			Expect(err).NotTo(HaveOccurred())
+			for _, id := range []string{"a", "b", "c"} {
+				_, err := allocateIP(context.TODO(), netConf, store, id, "eth0")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(releaseIP(context.TODO(), netConf.IPAM, store, "b", "eth0")).To(BeEmpty())
+			for _, id := range []string{"d", "e"} {
+				_, err := allocateIP(context.TODO(), netConf, store, id, "eth0")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			store.Close()
+
+			records, err := replay.Load(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			ops := map[string]int{}
+			for _, rec := range records {
+				ops[rec.Op]++
+				// the later applies scanned the leases of the earlier ones
+				if rec.Op == replay.OpApply && ops[rec.Op] > 1 {
+					Expect(len(rec.Leases)).To(Equal(ops[rec.Op] - 1))
+				}
+			}
+			Expect(ops[replay.OpAlloc]).To(Equal(5))
+			Expect(ops[replay.OpRelease]).To(Equal(1))
+			Expect(ops[replay.OpApply]).To(BeNumerically(">=", 2))
+
+			// replay on a fresh node, the player stands in for etcd
+			netConf.IPAM.ReplayLog = ""
+			player := replay.NewPlayer(records)
+			applyPoolIPRange = player.Apply
+			store, err = disk.New(netConf.Name, dataDirs[1])
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			for _, rec := range records {
+				switch rec.Op {
+				case replay.OpAlloc:
+					cache, _ := store.LoadCache()
+					Expect(sameRanges(cache, rec.Cache)).To(BeTrue(), rec.ID)
+					ips, err := allocateIP(context.TODO(), netConf, store, rec.ID, rec.IfName)
+					Expect(err).NotTo(HaveOccurred())
+					got := []string{}
+					for _, ipConf := range ips {
+						got = append(got, ipConf.Address.IP.String())
+					}
+					Expect(got).To(Equal(rec.IPs))
+				case replay.OpRelease:
+					Expect(releaseIP(context.TODO(), netConf.IPAM, store, rec.ID, rec.IfName)).To(BeEmpty())
+				}
+			}
+			Expect(player.Done()).To(BeTrue())
+		})
+	})
+
+	Describe("check", func() {
+		var dataDir = "/tmp/testcheckdata"
+		var resolvConf = "/tmp/testcheck-resolv.conf"
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+			os.Remove(resolvConf)
+		}
+		BeforeEach(func() {
+			clean()
+			Expect(ioutil.WriteFile(resolvConf, []byte("nameserver 10.1.1.1\nsearch example.com\n"), 0644)).To(Succeed())
+		})
+		AfterEach(clean)
+
+		cmdArgs := func(routes string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: "123456789",
+				IfName:      "eth0",
+				StdinData: []byte(`{
+					"cniVersion": "0.3.1",
+					"name": "testcheck",
+					"type": "macvlan",
+					"ipam": {
+						"type": "multus-ipam",
+						"dataDir": "/tmp/testcheckdata",
+						"resolvConf": "/tmp/testcheck-resolv.conf",
+						"routes": ` + routes + `,
+						"ranges": [[{"subnet": "10.80.0.0/24"}]]
+					}
+				}`),
+			}
+		}
+
+		It("pass while the dns and the routes stay as added", func() {
+			routes := `[{"dst": "0.0.0.0/0"}]`
+			Expect(cmdAdd(cmdArgs(routes))).To(Succeed())
+			Expect(cmdCheck(cmdArgs(routes))).To(Succeed())
+			Expect(cmdDel(cmdArgs(routes))).To(Succeed())
+
+			store, err := disk.New("testcheck", dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			_, ok := store.LoadResult("123456789", "eth0")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("fail once the routes diverge from those added", func() {
+			Expect(cmdAdd(cmdArgs(`[{"dst": "0.0.0.0/0"}]`))).To(Succeed())
+			err := cmdCheck(cmdArgs(`[{"dst": "10.0.0.0/8", "gw": "10.80.0.1"}]`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("routes"))
+		})
+
+		It("fail once the dns diverges from that added", func() {
+			routes := `[{"dst": "0.0.0.0/0"}]`
+			Expect(cmdAdd(cmdArgs(routes))).To(Succeed())
+			Expect(ioutil.WriteFile(resolvConf, []byte("nameserver 10.2.2.2\n"), 0644)).To(Succeed())
+			err := cmdCheck(cmdArgs(routes))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dns"))
+		})
+	})
+
+	Describe("plan", func() {
+		var dataDir = "/tmp/testplandata"
+		var planCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testplan",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testplandata",
+				"applyUnit": 2,
+				"ranges": [[{
+					"subnet": "192.168.56.0/24",
+					"rangeStart": "192.168.56.100",
+					"rangeEnd": "192.168.56.123"
+				}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(clean)
+		AfterEach(clean)
+
+		snapshot := func() []string {
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			resp, err := em.Cli.Get(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			state := []string{}
+			for _, kv := range resp.Kvs {
+				state = append(state, string(kv.Key)+"="+string(kv.Value))
+			}
+			filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					content, _ := ioutil.ReadFile(path)
+					state = append(state, path+"="+string(content))
+				}
+				return nil
+			})
+			return state
+		}
+		addPod := func(i int) error {
+			return cmdAdd(&skel.CmdArgs{ContainerID: fmt.Sprintf("container-%d", i), IfName: "eth0", StdinData: planCfg})
+		}
+
+		It("tell the pods still fitting as many as are allocated until exhaustion", func() {
+			for i := 0; i < 3; i++ {
+				Expect(addPod(i)).To(Succeed())
+			}
+			netConf, _, err := allocator.LoadIPAMConfig(planCfg, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			before := snapshot()
+			report, err := planAllocation(netConf, 30, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshot()).To(Equal(before))
+			// 1 ip left of the range applied and 5 units of 4 ips to apply
+			Expect(report.RangeSets).To(HaveLen(1))
+			Expect(report.RangeSets[0].LocalFree).To(Equal(uint64(1)))
+			Expect(report.Pods).To(Equal(uint64(21)))
+			Expect(report.Fits).To(BeFalse())
+
+			fits, err := planAllocation(netConf, 21, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fits.Fits).To(BeTrue())
+
+			allocated := uint64(0)
+			for i := 3; addPod(i) == nil; i++ {
+				allocated++
+			}
+			Expect(allocated).To(Equal(report.Pods))
+		})
+	})
+
+	Describe("error codes", func() {
+		var dataDir = "/tmp/testerrcodedata"
+		var cmdArgs = func(stdin string) *skel.CmdArgs {
+			return &skel.CmdArgs{ContainerID: "123456789", IfName: "eth0", StdinData: []byte(stdin)}
+		}
+		var codeCfg = `{
+			"cniVersion": "0.3.1",
+			"name": "testerrcode",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testerrcodedata",
+				"ranges": [[{"subnet": "10.90.0.0/24"}]]
+			}
+		}`
+		var applyErr error
+		var printed = func(err error) map[string]interface{} {
+			out, merr := json.Marshal(err)
+			Expect(merr).NotTo(HaveOccurred())
+			fields := map[string]interface{}{}
+			Expect(json.Unmarshal(out, &fields)).To(Succeed())
+			return fields
+		}
+		BeforeEach(func() {
+			os.RemoveAll(dataDir)
+			applyPoolIPRange = func(ctx context.Context, network string, pool string, r *allocator.Range, unit uint32, shards, priority int, opts etcdv3cli.ApplyOptions) (*etcdv3cli.ApplyResult, error) {
+				return nil, applyErr
+			}
+		})
+		AfterEach(func() {
+			applyPoolIPRange = etcdv3cli.IPAMApplyShardedIPRange
+			os.RemoveAll(dataDir)
+		})
+
+		It("code an invalid configuration", func() {
+			for _, cmd := range []func(*skel.CmdArgs) error{cmdAdd, cmdDel} {
+				err := cmd(cmdArgs(`{"cniVersion": "0.3.1", "name": "testerrcode", "ipam": {`))
+				Expect(err).To(HaveOccurred())
+				Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeInvalidConfig))
+			}
+		})
+
+		It("code an invalid node id as an invalid configuration", func() {
+			applyErr = fmt.Errorf("%w, HOSTNAME and /etc/cni/net.d/multus.d/etcd/id are both empty", etcdv3.ErrInvalidId)
+			err := cmdAdd(cmdArgs(codeCfg))
+			Expect(err).To(HaveOccurred())
+			Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeInvalidConfig))
+		})
+
+		It("code an exhausted pool to try again later", func() {
+			applyErr = etcdv3cli.ErrRangeExhausted
+			err := cmdAdd(cmdArgs(codeCfg))
+			Expect(err).To(HaveOccurred())
+			Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeTryAgainLater))
+			Expect(printed(err)["msg"]).To(ContainSubstring("the subnet is exhausted"))
+		})
+
+		It("code etcd unreachable apart", func() {
+			applyErr = fmt.Errorf("%w, endpoints are all unreachable", etcdv3.ErrUnavailable)
+			err := cmdAdd(cmdArgs(codeCfg))
+			Expect(err).To(HaveOccurred())
+			Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeEtcdUnavailable))
+
+			applyErr = &etcdv3.BreakerOpenError{Failures: 5, RetryIn: time.Second}
+			err = cmdAdd(cmdArgs(codeCfg))
+			Expect(err).To(HaveOccurred())
+			Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeEtcdUnavailable))
+		})
+
+		It("code the other failures as internal", func() {
+			applyErr = errors.New("etcdserver: permission denied")
+			err := cmdAdd(cmdArgs(codeCfg))
+			Expect(err).To(HaveOccurred())
+			Expect(printed(err)["code"]).To(BeEquivalentTo(errCodeInternal))
+			Expect(printed(err)["msg"]).To(ContainSubstring("permission denied"))
+		})
+	})
+
+	Describe("root key dir", func() {
+		var dataDir = "/tmp/testrootdata"
+		var rootCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testroot",
+			"type": "macvlan",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testrootdata",
+				"rootKeyDir": "tenant-a",
+				"ranges": [[{"subnet": "10.46.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			em.Cli.Delete(context.TODO(), "tenant-a", clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+		}
+		BeforeEach(func() {
+			clean()
+			resultOut = &bytes.Buffer{}
+		})
+		AfterEach(func() {
+			resultOut = os.Stdout
+			clean()
+		})
+
+		It("put the keys of the network under the root key dir of its config", func() {
+			args := &skel.CmdArgs{ContainerID: "container-a", IfName: "eth0", StdinData: rootCfg}
+			Expect(cmdAdd(args)).To(Succeed())
+			// the root of the config does not outlive the add
+			Expect(etcdv3.RootKeyDir()).To(Equal(""))
+
+			em, err := etcdv3.New()
+			Expect(err).NotTo(HaveOccurred())
+			defer em.Close()
+			Expect(em.RootKeyDir).NotTo(Equal("tenant-a"))
+			resp, err := em.Cli.Get(context.TODO(), "tenant-a/lease/testroot/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(resp.Kvs)).To(Equal(1))
+			resp, err = em.Cli.Get(context.TODO(), filepath.Join(em.RootKeyDir, "lease", "testroot")+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(resp.Kvs)).To(Equal(0))
+
+			store, err := disk.New("testroot", dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			Expect(store.LoadRootKeyDir()).To(Equal("tenant-a"))
+		})
+	})
+
+	Describe("request id", func() {
+		var dataDir = "/tmp/testrequestdata"
+		var logFile = "/tmp/testrequest.log"
+		var requestCfg = []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "testrequest",
+			"type": "macvlan",
+			"logFile": "/tmp/testrequest.log",
+			"logLevel": "debug",
+			"ipam": {
+				"type": "multus-ipam",
+				"dataDir": "/tmp/testrequestdata",
+				"ranges": [[{"subnet": "10.47.0.0/24"}]]
+			}
+		}`)
+		clean := func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			em.Cli.Delete(context.TODO(), em.RootKeyDir, clientv3.WithPrefix())
+			os.RemoveAll(dataDir)
+			os.Remove(logFile)
+		}
+		BeforeEach(func() {
+			clean()
+			resultOut = &bytes.Buffer{}
+		})
+		AfterEach(func() {
+			resultOut = os.Stdout
+			logging.SetLogFile("/tmp/multus-test.log")
+			clean()
+		})
+
+		It("prefix the lines logged by the add and the del of an interface with its id", func() {
+			args := &skel.CmdArgs{ContainerID: "container-r", IfName: "eth0", StdinData: requestCfg}
+			Expect(cmdAdd(args)).To(Succeed())
+			Expect(cmdDel(args)).To(Succeed())
+			logging.Debugf("after the del")
+
+			data, err := ioutil.ReadFile(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			Expect(len(lines)).To(BeNumerically(">", 2))
+			// the lines of a multi-line message follow the line of its header
+			header := regexp.MustCompile(`^\S+ \[(debug|verbose|error)\] `)
+			prefix := "[" + logging.RequestID("container-r", "eth0") + "] "
+			for _, l := range lines[:len(lines)-1] {
+				if h := header.FindString(l); h != "" {
+					Expect(l).To(HavePrefix(h + prefix))
+				}
+			}
+			Expect(lines[len(lines)-1]).To(HaveSuffix("] after the del"))
+			Expect(lines[len(lines)-1]).NotTo(ContainSubstring(prefix))
+		})
+	})
+
+	Describe("logging config", func() {
+		var logFile = "/tmp/testlogging.log"
+		var netLogFile = "/tmp/testlogging-net.log"
+		load := func(conf string) *allocator.Net {
+			netConf, _, err := allocator.LoadIPAMConfig([]byte(conf), "")
+			Expect(err).NotTo(HaveOccurred())
+			return netConf
+		}
+		BeforeEach(func() {
+			os.Remove(logFile)
+			os.Remove(netLogFile)
+		})
+		AfterEach(func() {
+			logging.SetLogFile("/tmp/multus-test.log")
+			logging.SetLogLevel("debug")
+			os.Remove(logFile)
+			os.Remove(netLogFile)
+		})
+
+		It("log to the file at the level of the ipam config over the network config", func() {
+			setupLogging(load(`{
+				"name": "testlogging",
+				"logFile": "/tmp/testlogging-net.log",
+				"logLevel": "debug",
+				"ipam": {
+					"type": "multus-ipam",
+					"logFile": "/tmp/testlogging.log",
+					"logLevel": "error",
+					"ranges": [[{"subnet": "10.48.0.0/24"}]]
+				}
+			}`))
+			Expect(logging.GetLoggingLevel()).To(Equal(logging.ErrorLevel))
+			logging.Debugf("not logged")
+			logging.Errorf("logged")
+			data, err := ioutil.ReadFile(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("] logged"))
+			Expect(string(data)).NotTo(ContainSubstring("not logged"))
+			_, err = os.Stat(netLogFile)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("take the network config and then the defaults for the unset ones", func() {
+			setupLogging(load(`{
+				"name": "testlogging",
+				"logFile": "/tmp/testlogging-net.log",
+				"ipam": {
+					"type": "multus-ipam",
+					"logLevel": "verbose",
+					"ranges": [[{"subnet": "10.48.0.0/24"}]]
+				}
+			}`))
+			Expect(logging.GetLoggingLevel()).To(Equal(logging.VerboseLevel))
+			logging.Verbosef("logged")
+			data, err := ioutil.ReadFile(netLogFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("] logged"))
+
+			logging.SetLogLevel("error")
+			setupLogging(nil)
+			Expect(logging.GetLoggingLevel()).To(Equal(logging.DebugLevel))
+		})
+	})
 })
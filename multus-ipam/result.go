@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/intel/multus-cni/logging"
+)
+
+// cniVersion100 is the cniVersion 1.0.0 of the spec, which the cni library in
+// use predates, its results are converted here
+const cniVersion100 = "1.0.0"
+
+// supportedVersions are the cniVersions of the library and 1.0.0
+var supportedVersions = version.PluginSupports(append(version.All.SupportedVersions(), cniVersion100)...)
+
+// resultOut is where the results are printed, tests capture it
+var resultOut io.Writer = os.Stdout
+
+// ipConfig100 is an ip of the result of cniVersion 1.0.0, which no longer
+// tells the version of the ip
+type ipConfig100 struct {
+	Interface *int        `json:"interface,omitempty"`
+	Address   types.IPNet `json:"address"`
+	Gateway   net.IP      `json:"gateway,omitempty"`
+}
+
+// route100 is a route of the result of cniVersion 1.0.0, with the table of
+// the policy routing it goes to as the routes of the later versions tell
+type route100 struct {
+	Dst   types.IPNet `json:"dst"`
+	GW    net.IP      `json:"gw,omitempty"`
+	Table int         `json:"table,omitempty"`
+}
+
+// result100 is the result of cniVersion 1.0.0
+type result100 struct {
+	CNIVersion string               `json:"cniVersion,omitempty"`
+	Interfaces []*current.Interface `json:"interfaces,omitempty"`
+	IPs        []*ipConfig100       `json:"ips,omitempty"`
+	Routes     []*route100          `json:"routes,omitempty"`
+	DNS        types.DNS            `json:"dns,omitempty"`
+}
+
+// newResult100 converts result to cniVersion 1.0.0, which holds all it holds,
+// tables are those of the routes of result, if any
+func newResult100(result *current.Result, tables []int) *result100 {
+	r := &result100{
+		CNIVersion: cniVersion100,
+		Interfaces: result.Interfaces,
+		DNS:        result.DNS,
+	}
+	for _, ipc := range result.IPs {
+		r.IPs = append(r.IPs, &ipConfig100{Interface: ipc.Interface, Address: ipc.Address, Gateway: ipc.Gateway})
+	}
+	for i, rt := range result.Routes {
+		r.Routes = append(r.Routes, &route100{Dst: rt.Dst, GW: rt.GW})
+		if i < len(tables) {
+			r.Routes[i].Table = tables[i]
+		}
+	}
+	return r
+}
+
+func (r *result100) Version() string {
+	return cniVersion100
+}
+
+// GetAsVersion returns r in version, the versions before 1.0.0 through the
+// current result of the library
+func (r *result100) GetAsVersion(version string) (types.Result, error) {
+	if version == cniVersion100 {
+		return r, nil
+	}
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: r.Interfaces,
+		DNS:        r.DNS,
+	}
+	for _, rt := range r.Routes {
+		result.Routes = append(result.Routes, &types.Route{Dst: rt.Dst, GW: rt.GW})
+	}
+	for _, ipc := range r.IPs {
+		v := "6"
+		if ipc.Address.IP.To4() != nil {
+			v = "4"
+		}
+		result.IPs = append(result.IPs, &current.IPConfig{Version: v, Interface: ipc.Interface, Address: ipc.Address, Gateway: ipc.Gateway})
+	}
+	return result.GetAsVersion(version)
+}
+
+func (r *result100) Print() error {
+	return writeResult(r)
+}
+
+func (r *result100) String() string {
+	return fmt.Sprintf("IP:%+v, Routes:%+v, DNS:%+v", r.IPs, r.Routes, r.DNS)
+}
+
+// convertResult returns result in confVersion, the tables of the routes are
+// dropped by the versions before 1.0.0, which can not tell them
+func convertResult(result *current.Result, confVersion string, tables []int) (types.Result, error) {
+	if confVersion == cniVersion100 {
+		return newResult100(result, tables), nil
+	}
+	for i := range tables {
+		if tables[i] > 0 && i < len(result.Routes) {
+			logging.Verbosef("table %d of route %v is dropped by cniVersion %v", tables[i], result.Routes[i].Dst.String(), confVersion)
+		}
+	}
+	return result.GetAsVersion(confVersion)
+}
+
+// printResult prints result in confVersion to the runtime
+func printResult(result *current.Result, confVersion string, tables []int) error {
+	r, err := convertResult(result, confVersion, tables)
+	if err != nil {
+		return err
+	}
+	return writeResult(r)
+}
+
+// writeResult prints r to resultOut as the results of the library print
+func writeResult(r types.Result) error {
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = resultOut.Write(data)
+	return err
+}
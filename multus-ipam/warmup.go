@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+)
+
+// warmup applies and caches apply units of each range set of netConf until the
+// node holds minReserveUnits of them, so that the first adds after the node
+// starts find the ranges cached. The ranges cached already count, a range set
+// exhausted stops short of the target without failing. It returns the units
+// applied for each range set.
+func warmup(ctx context.Context, netConf *allocator.Net) ([]int, error) {
+	ipamConf := netConf.IPAM
+	applied := make([]int, len(ipamConf.Ranges))
+	if ipamConf.ReserveUnits == 0 {
+		return applied, nil
+	}
+	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	if err != nil {
+		return nil, logging.Errorf("disk.New(%v, %v) failed, %v", ipamConf.Name, ipamConf.DataDir, err)
+	}
+	defer store.Close()
+	if err := saveNetConf(ipamConf, store); err != nil {
+		return nil, err
+	}
+
+	applyUnit := ipamConf.NodeApplyUnit(etcdv3.NodeId())
+	rss, err := formRangeSets(ipamConf.Ranges, ipamConf.Name, applyUnit, store, ipamConf.RangeOverlap)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range ipamConf.Ranges {
+		for n := len(rss[idx]); n < ipamConf.ReserveUnits; n++ {
+			_, sr, err := applyRangeSetIPRange(ctx, ipamConf, store, idx, applyUnit)
+			if err == etcdv3cli.ErrRangeExhausted {
+				logging.Verbosef("range set %d of %v is exhausted with %d units reserved", idx, ipamConf.Name, n)
+				break
+			}
+			if err != nil {
+				logging.Errorf("warm up range set %d of %v failed, %v", idx, ipamConf.Name, err)
+				return applied, fmt.Errorf("warm up range set %d failed, %w", idx, err)
+			}
+			if err := cacheRange(ctx, ipamConf, store, sr); err != nil {
+				return applied, err
+			}
+			applied[idx]++
+		}
+	}
+	return applied, nil
+}
@@ -1,6 +1,7 @@
 package etcdv3cli
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -24,11 +25,12 @@ func RecVxlan(network string, vxlan *netlink.Vxlan) error {
 	}
 	defer em.Close() // make sure to close the client
 
-	key := filepath.Join(em.RootKeyDir, vxlanKeyDir, vxlan.Attrs().Name, vxlan.SrcAddr.String())
+	keyDir := filepath.Join(em.RootKeyDir, vxlanKeyDir, vxlan.Attrs().Name)
+	key := filepath.Join(keyDir, vxlan.SrcAddr.String())
 
-	err = etcdv3.TransPutKey(em.Cli, key, em.Id, true)
+	err = etcdv3.TransPutKey(context.Background(), em.Cli, keyDir, 1, key, em.Id, true)
 	if err != nil {
-		if !strings.Contains(err.Error(), "exists") {
+		if err != etcdv3.ErrKeyExists {
 			e := cacheRec(vxlan.Attrs().Name, vxlan.SrcAddr.String())
 			if e != nil {
 				return logging.Errorf("etcd failed %v, cache failed %v (%v:%v)", err, e, key, em.Id)
@@ -105,8 +107,8 @@ func CacheToEtcd() error {
 			}
 			value := strings.Trim(string(v), "\r\n\t ")
 
-			key := filepath.Join(em.RootKeyDir, vxlanKeyDir, file.Name(), value)
-			err = etcdv3.TransPutKey(em.Cli, key, em.Id, true)
+			keyDir := filepath.Join(em.RootKeyDir, vxlanKeyDir, file.Name())
+			err = etcdv3.TransPutKey(context.Background(), em.Cli, keyDir, 1, filepath.Join(keyDir, value), em.Id, true)
 			if err == nil {
 				err = os.Remove(cacheFile)
 				if err != nil {
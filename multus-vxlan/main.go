@@ -16,6 +16,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"runtime"
 
@@ -37,6 +38,10 @@ type NetConf struct {
 	LogLevel string       `json:"logLevel"`
 }
 
+// errCodeInvalidConfig is the code of the CNI spec for an invalid network
+// configuration, telling the runtime not to retry before it is fixed
+const errCodeInvalidConfig uint = 7
+
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
@@ -49,7 +54,8 @@ func init() {
 func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, "", logging.Errorf("Unmarshal failed, %v", err)
+		logging.Errorf("Unmarshal failed, %v", err)
+		return nil, "", &types.Error{Code: errCodeInvalidConfig, Msg: fmt.Sprintf("Unmarshal failed, %v", err)}
 	}
 	// Logging
 	if n.LogFile != "" {
@@ -66,6 +72,8 @@ func loadNetConf(bytes []byte) (*NetConf, string, error) {
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
 
 	logging.Debugf(os.Getenv("CNI_ARGS"))
 	n, cniVersion, err := loadNetConf(args.StdinData)
@@ -105,6 +113,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 }
 
 func cmdDel(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
 	n, _, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
@@ -114,6 +124,8 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
+	logging.SetRequestID(logging.RequestID(args.ContainerID, args.IfName))
+	defer logging.SetRequestID("")
 	n, _, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err